@@ -19,24 +19,77 @@ func (inst Instructions) String() string {
 	offset := 0
 	output := ""
 	for offset < len(inst) {
-		def, err := Lookup(inst[offset])
+		def, operands, width, err := inst.ReadInstruction(offset)
 		if err != nil {
-			fmt.Printf("definition not found: %q\n", err)
-			continue
+			output += fmt.Sprintf("%04d ERROR: %s\n", offset, err)
+			break
+		}
+		name := def.Name
+		if Opcode(inst[offset]) == OpWide {
+			name = "OpWide " + name
 		}
-		operands, bytesRead := ReadOperands(def, inst[offset+1:])
 		if len(operands) > 0 {
-			output += fmt.Sprintf("%04d %s %s\n", offset, def.Name, strings.Trim(fmt.Sprint(operands), "[]"))
+			output += fmt.Sprintf("%04d %s %s\n", offset, name, strings.Trim(fmt.Sprint(operands), "[]"))
 		} else {
-			output += fmt.Sprintf("%04d %s\n", offset, def.Name)
+			output += fmt.Sprintf("%04d %s\n", offset, name)
 		}
 
-		offset += bytesRead + 1
+		offset += width
 	}
 
 	return output
 }
 
+// ReadInstruction decodes the instruction at offset and returns its
+// definition, its operands and its total width in bytes. For an
+// instruction prefixed with OpWide it returns the definition of the
+// prefixed opcode; the width includes the prefix. Unlike ReadOperands it
+// reports an undefined opcode or truncated operands as an error.
+func (inst Instructions) ReadInstruction(offset int) (*Definition, []int, int, error) {
+	def, err := Lookup(inst[offset])
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	width := 1
+	widths := def.OperandWidths
+	if Opcode(inst[offset]) == OpWide {
+		if offset+1 >= len(inst) {
+			return nil, nil, 0, fmt.Errorf("OpWide at %d truncated: no opcode follows", offset)
+		}
+		def, err = Lookup(inst[offset+1])
+		if err != nil {
+			return nil, nil, 0, err
+		}
+		if len(def.OperandWidths) == 0 {
+			return nil, nil, 0, fmt.Errorf("OpWide at %d: %s has no operands", offset, def.Name)
+		}
+		width++
+		widths = wideWidths(def)
+	}
+
+	for _, w := range widths {
+		width += w
+	}
+	if offset+width > len(inst) {
+		return nil, nil, 0, fmt.Errorf("%s at %d truncated: want %d bytes, have %d",
+			def.Name, offset, width, len(inst)-offset)
+	}
+
+	operands, _ := readOperands(widths, inst[offset+width-sum(widths):])
+	return def, operands, width, nil
+}
+
+// OpcodeAt returns the opcode of the instruction at offset, looking
+// through an OpWide prefix.
+func (inst Instructions) OpcodeAt(offset int) Opcode {
+	op := Opcode(inst[offset])
+	if op == OpWide && offset+1 < len(inst) {
+		return Opcode(inst[offset+1])
+	}
+	return op
+}
+
 func ReadUint16(inst []byte) uint16 {
 	return binary.BigEndian.Uint16(inst)
 }
@@ -45,15 +98,42 @@ func PutUint16(inst []byte, val uint16) {
 	binary.BigEndian.PutUint16(inst, val)
 }
 
+func ReadUint32(inst []byte) uint32 {
+	return binary.BigEndian.Uint32(inst)
+}
+
+func PutUint32(inst []byte, val uint32) {
+	binary.BigEndian.PutUint32(inst, val)
+}
+
+// ReadOperands decodes the operands of an instruction with definition def
+// from inst, which starts right after the opcode. For OpWide, inst starts
+// with the prefixed opcode and the operands returned are the prefixed
+// instruction's; the bytes read include its opcode.
 func ReadOperands(def *Definition, inst []byte) ([]int, int) {
-	operands := make([]int, len(def.OperandWidths))
+	if def == definitions[OpWide] {
+		wrapped, err := Lookup(inst[0])
+		if err != nil {
+			return nil, 0
+		}
+		operands, n := readOperands(wideWidths(wrapped), inst[1:])
+		return operands, n + 1
+	}
+
+	return readOperands(def.OperandWidths, inst)
+}
+
+func readOperands(widths []int, inst []byte) ([]int, int) {
+	operands := make([]int, len(widths))
 	offset := 0
-	for i, width := range def.OperandWidths {
+	for i, width := range widths {
 		switch width {
 		case 1:
 			operands[i] = int(inst[offset])
 		case 2:
 			operands[i] = int(ReadUint16(inst[offset:]))
+		case 4:
+			operands[i] = int(ReadUint32(inst[offset:]))
 		}
 
 		offset += width
@@ -61,28 +141,44 @@ func ReadOperands(def *Definition, inst []byte) ([]int, int) {
 	return operands, offset
 }
 
+// Make encodes an instruction. When an operand does not fit its width the
+// instruction is prefixed with OpWide and all its operands are encoded
+// twice as wide. Make panics if an operand does not even fit then.
 func Make(op Opcode, operands ...int) []byte {
 	def, ok := definitions[op]
 	if !ok {
 		return []byte{}
 	}
 
-	instLen := 1
-	for _, el := range def.OperandWidths {
-		instLen += el
+	widths := def.OperandWidths
+	prefix := []byte{}
+	for i, el := range operands {
+		if !fits(el, widths[i]) {
+			widths = wideWidths(def)
+			prefix = []byte{byte(OpWide)}
+			break
+		}
 	}
 
+	instLen := len(prefix) + 1 + sum(widths)
+
 	inst := make([]byte, instLen)
-	inst[0] = byte(op)
+	copy(inst, prefix)
+	inst[len(prefix)] = byte(op)
 
-	offset := 1
+	offset := len(prefix) + 1
 	for i, el := range operands {
-		width := def.OperandWidths[i]
+		width := widths[i]
+		if !fits(el, width) {
+			panic(fmt.Sprintf("operand %d of %s does not fit in %d bytes", el, def.Name, width))
+		}
 		switch width {
 		case 1:
 			inst[offset] = byte(el)
 		case 2:
 			PutUint16(inst[offset:], uint16(el))
+		case 4:
+			PutUint32(inst[offset:], uint32(el))
 		}
 		offset += width
 	}
@@ -90,6 +186,35 @@ func Make(op Opcode, operands ...int) []byte {
 	return inst
 }
 
+func wideWidths(def *Definition) []int {
+	widths := make([]int, len(def.OperandWidths))
+	for i, w := range def.OperandWidths {
+		widths[i] = 2 * w
+	}
+	return widths
+}
+
+func fits(operand, width int) bool {
+	return operand >= 0 && operand < 1<<(8*width)
+}
+
+func sum(widths []int) int {
+	total := 0
+	for _, w := range widths {
+		total += w
+	}
+	return total
+}
+
+// IsJump reports whether the first operand of op is an instruction offset.
+func IsJump(op Opcode) bool {
+	switch op {
+	case OpJump, OpJumpNotTruthy, OpIterNext:
+		return true
+	}
+	return false
+}
+
 func Lookup(op byte) (*Definition, error) {
 	def, ok := definitions[Opcode(op)]
 	if !ok {
@@ -100,32 +225,48 @@ func Lookup(op byte) (*Definition, error) {
 }
 
 var definitions = map[Opcode]*Definition{
-	OpConstant:      {"OpConstant", []int{2}},
-	OpJumpNotTruthy: {"OpJumpNotTruthy", []int{2}},
-	OpJump:          {"OpJump", []int{2}},
-	OpGetGlobal:     {"OpGetGlobal", []int{2}},
-	OpSetGlobal:     {"OpSetGlobal", []int{2}},
-	OpGetLocal:      {"OpGetLocal", []int{1}},
-	OpSetLocal:      {"OpSetLocal", []int{1}},
-	OpArray:         {"OpArray", []int{2}},
-	OpHash:          {"OpHash", []int{2}},
-	OpAdd:           {"OpAdd", []int{}},
-	OpSub:           {"OpSub", []int{}},
-	OpMul:           {"OpMul", []int{}},
-	OpDiv:           {"OpDiv", []int{}},
-	OpPop:           {"OpPop", []int{}},
-	OpTrue:          {"OpTrue", []int{}},
-	OpFalse:         {"OpFalse", []int{}},
-	OpEqual:         {"OpEqual", []int{}},
-	OpNotEqual:      {"OpNotEqual", []int{}},
-	OpGreaterThan:   {"OpGreaterThan", []int{}},
-	OpMinus:         {"OpMinus", []int{}},
-	OpBang:          {"OpBang", []int{}},
-	OpNull:          {"OpNull", []int{}},
-	OpIndex:         {"OpIndex", []int{}},
-	OpCall:          {"OpCall", []int{}},
-	OpReturnValue:   {"OpReturnValue", []int{}},
-	OpReturn:        {"OpReturn", []int{}},
+	OpConstant:       {"OpConstant", []int{2}},
+	OpJumpNotTruthy:  {"OpJumpNotTruthy", []int{2}},
+	OpJump:           {"OpJump", []int{2}},
+	OpGetGlobal:      {"OpGetGlobal", []int{2}},
+	OpSetGlobal:      {"OpSetGlobal", []int{2}},
+	OpGetLocal:       {"OpGetLocal", []int{1}},
+	OpSetLocal:       {"OpSetLocal", []int{1}},
+	OpGetBuiltin:     {"OpGetBuiltin", []int{1}},
+	OpClosure:        {"OpClosure", []int{2, 1}},
+	OpGetFree:        {"OpGetFree", []int{1}},
+	OpCurrentClosure: {"OpCurrentClosure", []int{}},
+	OpTailCall:       {"OpTailCall", []int{1}},
+	OpDup:            {"OpDup", []int{}},
+	OpWide:           {"OpWide", []int{}},
+	OpArray:          {"OpArray", []int{2}},
+	OpHash:           {"OpHash", []int{2}},
+	OpAdd:            {"OpAdd", []int{}},
+	OpSub:            {"OpSub", []int{}},
+	OpMul:            {"OpMul", []int{}},
+	OpDiv:            {"OpDiv", []int{}},
+	OpPop:            {"OpPop", []int{}},
+	OpTrue:           {"OpTrue", []int{}},
+	OpFalse:          {"OpFalse", []int{}},
+	OpEqual:          {"OpEqual", []int{}},
+	OpNotEqual:       {"OpNotEqual", []int{}},
+	OpGreaterThan:    {"OpGreaterThan", []int{}},
+	OpMinus:          {"OpMinus", []int{}},
+	OpBang:           {"OpBang", []int{}},
+	OpNull:           {"OpNull", []int{}},
+	OpIndex:          {"OpIndex", []int{}},
+	OpCall:           {"OpCall", []int{1}},
+	OpReturnValue:    {"OpReturnValue", []int{}},
+	OpReturn:         {"OpReturn", []int{}},
+	OpIter:           {"OpIter", []int{}},
+	OpIterNext:       {"OpIterNext", []int{2, 1}},
+	OpSetIndex:       {"OpSetIndex", []int{}},
+	OpMod:            {"OpMod", []int{}},
+	OpDup2:           {"OpDup2", []int{}},
+	OpGetCell:        {"OpGetCell", []int{1}},
+	OpSetCell:        {"OpSetCell", []int{1}},
+	OpGetFreeCell:    {"OpGetFreeCell", []int{1}},
+	OpSetFreeCell:    {"OpSetFreeCell", []int{1}},
 }
 
 const (
@@ -155,4 +296,35 @@ const (
 	OpReturn
 	OpGetLocal
 	OpSetLocal
+	OpGetBuiltin
+	OpClosure
+	OpGetFree
+	OpCurrentClosure
+	OpTailCall
+	OpDup
+	// OpWide prefixes an instruction whose operands are encoded twice as
+	// wide as its definition says.
+	OpWide
+	// OpIter replaces the collection on top of the stack with an iterator
+	// over it.
+	OpIter
+	// OpIterNext pushes the next key and value, or only the value if its
+	// second operand is 1, of the iterator on top of the stack. Once the
+	// iterator is exhausted it pops it and jumps to its first operand.
+	OpIterNext
+	// OpSetIndex pops a value, an index and an array or a hash, stores the
+	// value at the index and pushes the value again.
+	OpSetIndex
+	OpMod
+	// OpDup2 pushes copies of the top two values of the stack.
+	OpDup2
+	// OpGetCell pushes the value of the cell in a local and OpSetCell pops
+	// a value into it. OpGetLocal pushes the cell itself, for a closure to
+	// capture.
+	OpGetCell
+	OpSetCell
+	// OpGetFreeCell and OpSetFreeCell are OpGetCell and OpSetCell for a
+	// cell that the closure captured. OpGetFree pushes the cell itself.
+	OpGetFreeCell
+	OpSetFreeCell
 )
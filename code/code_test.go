@@ -15,6 +15,9 @@ func TestReadOperands(t *testing.T) {
 		{OpPop, []int{}, 0},
 		{OpAdd, []int{}, 0},
 		{OpSetLocal, []int{43}, 1},
+		{OpCall, []int{3}, 1},
+		{OpClosure, []int{65535, 255}, 3},
+		{OpIterNext, []int{65535, 2}, 3},
 	}
 
 	for _, tt := range tests {
@@ -37,6 +40,72 @@ func TestReadOperands(t *testing.T) {
 	}
 }
 
+func TestReadWideOperands(t *testing.T) {
+	tests := []struct {
+		op        Opcode
+		operands  []int
+		bytesRead int
+	}{
+		{OpConstant, []int{65536}, 5},
+		{OpJump, []int{1 << 20}, 5},
+		{OpSetLocal, []int{300}, 3},
+		{OpClosure, []int{70000, 2}, 7},
+		{OpIterNext, []int{70000, 1}, 7},
+	}
+
+	for _, tt := range tests {
+		instruction := Make(tt.op, tt.operands...)
+		if Opcode(instruction[0]) != OpWide {
+			t.Fatalf("%d is not prefixed with OpWide", tt.operands)
+		}
+
+		def, err := Lookup(instruction[0])
+		if err != nil {
+			t.Fatalf("definition not found: %q\n", err)
+		}
+
+		operandsRead, n := ReadOperands(def, instruction[1:])
+		if n != tt.bytesRead {
+			t.Fatalf("n wrong. want=%d, got=%d", tt.bytesRead, n)
+		}
+
+		for i, want := range tt.operands {
+			if operandsRead[i] != want {
+				t.Errorf("operand wrong. want=%d, got=%d", want, operandsRead[i])
+			}
+		}
+
+		wrapped, operandsRead, width, err := Instructions(instruction).ReadInstruction(0)
+		if err != nil {
+			t.Fatalf("ReadInstruction failed: %s", err)
+		}
+		if width != len(instruction) {
+			t.Errorf("width wrong. want=%d, got=%d", len(instruction), width)
+		}
+		if wrapped != definitions[tt.op] {
+			t.Errorf("definition wrong. want=%s, got=%s", definitions[tt.op].Name, wrapped.Name)
+		}
+		if Instructions(instruction).OpcodeAt(0) != tt.op {
+			t.Errorf("OpcodeAt wrong. want=%d, got=%d", tt.op, Instructions(instruction).OpcodeAt(0))
+		}
+		for i, want := range tt.operands {
+			if operandsRead[i] != want {
+				t.Errorf("operand wrong. want=%d, got=%d", want, operandsRead[i])
+			}
+		}
+	}
+}
+
+func TestMakePanicsOnOverflow(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Errorf("Make did not panic on an operand that does not fit")
+		}
+	}()
+
+	Make(OpGetLocal, 65536)
+}
+
 func TestInstructionsString(t *testing.T) {
 	instructions := []Instructions{
 		Make(OpAdd),
@@ -48,6 +117,8 @@ func TestInstructionsString(t *testing.T) {
 		Make(OpNotEqual),
 		Make(OpGetLocal, 23),
 		Make(OpSetLocal, 35),
+		Make(OpClosure, 65535, 255),
+		Make(OpConstant, 65536),
 	}
 
 	expected := `0000 OpAdd
@@ -59,6 +130,8 @@ func TestInstructionsString(t *testing.T) {
 0010 OpNotEqual
 0011 OpGetLocal 23
 0013 OpSetLocal 35
+0015 OpClosure 65535 255
+0019 OpWide OpConstant 65536
 `
 
 	concatted := Instructions{}
@@ -82,6 +155,10 @@ func TestMake(t *testing.T) {
 		{OpAdd, []int{}, []byte{byte(OpAdd)}},
 		{OpEqual, []int{}, []byte{byte(OpEqual)}},
 		{OpGetLocal, []int{137}, []byte{byte(OpGetLocal), 137}},
+		{OpClosure, []int{65534, 255}, []byte{byte(OpClosure), 255, 254, 255}},
+		{OpConstant, []int{65536}, []byte{byte(OpWide), byte(OpConstant), 0, 1, 0, 0}},
+		{OpGetLocal, []int{256}, []byte{byte(OpWide), byte(OpGetLocal), 1, 0}},
+		{OpClosure, []int{1, 256}, []byte{byte(OpWide), byte(OpClosure), 0, 0, 0, 1, 1, 0}},
 	}
 
 	for _, tt := range tests {
@@ -100,3 +177,38 @@ func TestMake(t *testing.T) {
 		}
 	}
 }
+
+func TestInstructionsStringMalformed(t *testing.T) {
+	tests := []struct {
+		input    Instructions
+		expected string
+	}{
+		{
+			append(Make(OpTrue), 255, byte(OpPop)),
+			"0000 OpTrue\n0001 ERROR: opcode 255 undefined\n",
+		},
+		{
+			append(Make(OpPop), Make(OpConstant, 1)[:2]...),
+			"0000 OpPop\n0001 ERROR: OpConstant at 1 truncated: want 3 bytes, have 2\n",
+		},
+		{
+			Instructions{byte(OpWide), byte(OpPop)},
+			"0000 ERROR: OpWide at 0: OpPop has no operands\n",
+		},
+		{
+			Instructions{byte(OpWide)},
+			"0000 ERROR: OpWide at 0 truncated: no opcode follows\n",
+		},
+		{
+			Make(OpConstant, 65536)[:4],
+			"0000 ERROR: OpConstant at 0 truncated: want 6 bytes, have 4\n",
+		},
+	}
+
+	for _, tt := range tests {
+		if tt.input.String() != tt.expected {
+			t.Errorf("instructions wrongly formatted. \nwant=%q\ngot =%q",
+				tt.expected, tt.input.String())
+		}
+	}
+}
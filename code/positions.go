@@ -0,0 +1,52 @@
+package code
+
+import (
+	"karaoke/token"
+	"sort"
+)
+
+// A Span is the part of the source code an instruction was compiled from.
+type Span struct {
+	Start token.Position
+	End   token.Position
+}
+
+// A PositionEntry says that the instructions from Offset up to the next
+// entry's offset were compiled from Span.
+type PositionEntry struct {
+	Offset int
+	Span   Span
+}
+
+// A PositionTable maps instruction offsets to source spans. Its entries
+// are sorted by offset.
+type PositionTable []PositionEntry
+
+// Add records that the instruction at offset, which lies at or past every
+// offset in t, was compiled from span. An entry already at offset had no
+// instruction and is replaced, and consecutive instructions from the same
+// span share one entry.
+func (t PositionTable) Add(offset int, span Span) PositionTable {
+	if len(t) > 0 && t[len(t)-1].Offset == offset {
+		t = t[:len(t)-1]
+	}
+	if len(t) > 0 && t[len(t)-1].Span == span {
+		return t
+	}
+	return append(t, PositionEntry{offset, span})
+}
+
+// Truncate drops the entries of instructions at or after offset.
+func (t PositionTable) Truncate(offset int) PositionTable {
+	i := sort.Search(len(t), func(i int) bool { return t[i].Offset >= offset })
+	return t[:i]
+}
+
+// Lookup returns the span of the instruction covering offset.
+func (t PositionTable) Lookup(offset int) (Span, bool) {
+	i := sort.Search(len(t), func(i int) bool { return t[i].Offset > offset })
+	if i == 0 {
+		return Span{}, false
+	}
+	return t[i-1].Span, true
+}
@@ -0,0 +1,51 @@
+package code
+
+import (
+	"karaoke/token"
+	"testing"
+)
+
+func TestPositionTable(t *testing.T) {
+	span := func(line int) Span {
+		return Span{
+			Start: token.Position{Line: line, Column: 1},
+			End:   token.Position{Line: line, Column: 5},
+		}
+	}
+
+	var table PositionTable
+	table = table.Add(0, span(1))
+	table = table.Add(3, span(1))
+	table = table.Add(4, span(2))
+	table = table.Add(4, span(3))
+	table = table.Add(7, span(3))
+	table = table.Add(9, span(4))
+
+	expected := PositionTable{{0, span(1)}, {4, span(3)}, {9, span(4)}}
+	if len(table) != len(expected) {
+		t.Fatalf("wrong table. want=%v, got=%v", expected, table)
+	}
+	for i, entry := range expected {
+		if table[i] != entry {
+			t.Errorf("entry %d wrong. want=%v, got=%v", i, entry, table[i])
+		}
+	}
+
+	lookups := []struct {
+		offset int
+		line   int
+	}{
+		{-1, 0}, {0, 1}, {3, 1}, {4, 3}, {8, 3}, {9, 4}, {100, 4},
+	}
+	for _, tt := range lookups {
+		got, ok := table.Lookup(tt.offset)
+		if ok != (tt.line != 0) || got.Start.Line != tt.line {
+			t.Errorf("Lookup(%d) wrong. want line %d, got=%v (%t)", tt.offset, tt.line, got, ok)
+		}
+	}
+
+	table = table.Truncate(4)
+	if len(table) != 1 || table[0].Offset != 0 {
+		t.Errorf("Truncate(4) wrong. got=%v", table)
+	}
+}
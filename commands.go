@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"karaoke/ast"
+	"karaoke/compiler"
+	"karaoke/dap"
+	"karaoke/debugger"
+	"karaoke/disasm"
+	"karaoke/lexer"
+	"karaoke/parser"
+	"karaoke/vm"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const bytecodeExt = ".mkc"
+
+func compileCmd(args []string) error {
+	fs := flag.NewFlagSet("compile", flag.ContinueOnError)
+	out := fs.String("o", "", "output file (default: input with "+bytecodeExt+" extension)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("expected exactly one source file")
+	}
+
+	src := fs.Arg(0)
+	bc, err := compileSource(src)
+	if err != nil {
+		return err
+	}
+
+	dst := *out
+	if dst == "" {
+		dst = strings.TrimSuffix(src, filepath.Ext(src)) + bytecodeExt
+	}
+
+	f, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+
+	_, err = bc.WriteTo(f)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func runCmd(args []string) error {
+	fs := flag.NewFlagSet("run", flag.ContinueOnError)
+	backend := fs.String("vm", "stack", "VM backend: stack or register")
+	timeout := fs.Duration("timeout", 0, "stop the program after this long, 0 for no limit")
+	budget := fs.Int64("budget", 0, "stop the program after this many instructions, 0 for no limit")
+	memory := fs.Int64("memory", 0, "stop the program once it allocated this many bytes, 0 for no limit")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("expected exactly one file to run")
+	}
+
+	newVM, ok := vm.Backends[*backend]
+	if !ok {
+		return fmt.Errorf("unknown VM backend %q", *backend)
+	}
+
+	bc, err := loadBytecode(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	if *timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *timeout)
+		defer cancel()
+	}
+
+	machine := newVM(bc, vm.InstructionBudget(*budget), vm.MemoryLimit(*memory))
+	return machine.RunContext(ctx)
+}
+
+func disasmCmd(args []string) error {
+	if len(args) != 1 {
+		return errors.New("expected exactly one file to disassemble")
+	}
+
+	bc, err := loadBytecode(args[0])
+	if err != nil {
+		return err
+	}
+
+	return disasm.Disassemble(os.Stdout, bc)
+}
+
+func debugCmd(args []string) error {
+	if len(args) != 1 {
+		return errors.New("expected exactly one file to debug")
+	}
+
+	// The peephole optimiser moves instructions across source lines, so
+	// scripts are debugged without it.
+	bc, err := loadBytecode(args[0], compiler.Peephole(false))
+	if err != nil {
+		return err
+	}
+
+	debugger.Start(os.Stdin, os.Stdout, vm.New(bc))
+	return nil
+}
+
+func dapCmd(args []string) error {
+	fs := flag.NewFlagSet("dap", flag.ContinueOnError)
+	port := fs.Int("port", 0, "serve on this local TCP port instead of stdio")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 0 {
+		return errors.New("unexpected arguments")
+	}
+
+	load := dap.Loader{
+		Compile: func(path string) (*compiler.Bytecode, error) {
+			return loadBytecode(path, compiler.Peephole(false))
+		},
+		Parse: func(path string) (*ast.Program, error) {
+			if filepath.Ext(path) == bytecodeExt {
+				return nil, errors.New("the evaluator cannot run bytecode")
+			}
+			return parseSource(path)
+		},
+	}
+
+	if *port == 0 {
+		// Standard output carries the protocol, so what programs print
+		// with puts goes to standard error.
+		stdout := os.Stdout
+		os.Stdout = os.Stderr
+		return dap.Serve(os.Stdin, stdout, load)
+	}
+
+	l, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", *port))
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "listening on %s\n", l.Addr())
+	return dap.Listen(l, load)
+}
+
+// loadBytecode reads a bytecode file, or compiles a script with opts when
+// the file does not have the bytecode extension.
+func loadBytecode(path string, opts ...compiler.Option) (*compiler.Bytecode, error) {
+	if filepath.Ext(path) != bytecodeExt {
+		return compileSource(path, opts...)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return compiler.ReadBytecode(f)
+}
+
+func compileSource(path string, opts ...compiler.Option) (*compiler.Bytecode, error) {
+	program, err := parseSource(path)
+	if err != nil {
+		return nil, err
+	}
+
+	comp := compiler.New(opts...)
+	err = comp.Compile(program)
+	if err != nil {
+		return nil, fmt.Errorf("compilation failed: %w", err)
+	}
+
+	return comp.Bytecode(), nil
+}
+
+func parseSource(path string) (*ast.Program, error) {
+	input, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	p := parser.New(lexer.NewWithFile(path, string(input)))
+	program := p.ParseProgram()
+	if len(p.Errors()) != 0 {
+		return nil, fmt.Errorf("parser errors:\n\t%s", strings.Join(p.Errors(), "\n\t"))
+	}
+	return program, nil
+}
@@ -0,0 +1,85 @@
+package compiler
+
+import "karaoke/ast"
+
+// capturedNames returns the names the function literals nested in body
+// refer to. Only a local of the function with that body whose name is
+// among them can be captured by a closure, so those locals are kept in
+// cells. The names include those of locals the nested functions define
+// themselves, which only costs a cell nobody shares.
+func capturedNames(body *ast.BlockStatement) map[string]bool {
+	names := map[string]bool{}
+	collectNames(body, false, names)
+	return names
+}
+
+// collectNames adds the identifiers node refers to to names, once inside
+// a nested function literal.
+func collectNames(node ast.Node, nested bool, names map[string]bool) {
+	switch n := node.(type) {
+	case *ast.Identifier:
+		if nested {
+			names[n.Value] = true
+		}
+
+	case *ast.BlockStatement:
+		for _, st := range n.Statements {
+			collectNames(st, nested, names)
+		}
+	case *ast.LetStatement:
+		collectNames(n.Value, nested, names)
+	case *ast.ReturnStatement:
+		collectNames(n.ReturnValue, nested, names)
+	case *ast.ExpressionStatement:
+		collectNames(n.Expression, nested, names)
+	case *ast.WhileStatement:
+		collectNames(n.Condition, nested, names)
+		collectNames(n.Body, nested, names)
+	case *ast.ForStatement:
+		collectNames(n.Iterable, nested, names)
+		collectNames(n.Body, nested, names)
+
+	case *ast.FunctionLiteral:
+		// The parameters are bound in the function. Its own name is not:
+		// the function refers to itself through the let that binds it.
+		inner := map[string]bool{}
+		collectNames(n.Body, true, inner)
+		for _, param := range n.Parameters {
+			delete(inner, param.Value)
+		}
+		for name := range inner {
+			names[name] = true
+		}
+	case *ast.PrefixExpression:
+		collectNames(n.Right, nested, names)
+	case *ast.InfixExpression:
+		collectNames(n.Left, nested, names)
+		collectNames(n.Right, nested, names)
+	case *ast.AssignExpression:
+		collectNames(n.Target, nested, names)
+		collectNames(n.Value, nested, names)
+	case *ast.IfExpression:
+		collectNames(n.Condition, nested, names)
+		collectNames(n.Consequence, nested, names)
+		if n.Alternative != nil {
+			collectNames(n.Alternative, nested, names)
+		}
+	case *ast.CallExpression:
+		collectNames(n.Function, nested, names)
+		for _, arg := range n.Arguments {
+			collectNames(arg, nested, names)
+		}
+	case *ast.IndexExpression:
+		collectNames(n.Left, nested, names)
+		collectNames(n.Index, nested, names)
+	case *ast.ArrayLiteral:
+		for _, elem := range n.Elements {
+			collectNames(elem, nested, names)
+		}
+	case *ast.HashLiteral:
+		for key, value := range n.Pairs {
+			collectNames(key, nested, names)
+			collectNames(value, nested, names)
+		}
+	}
+}
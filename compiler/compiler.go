@@ -6,21 +6,44 @@ import (
 	"karaoke/code"
 	"karaoke/object"
 	"karaoke/token"
+	"math"
 	"slices"
+	"strconv"
 	"strings"
 )
 
 type Compiler struct {
 	constants   []object.Object
 	symbolTable *SymbolTable
+	tailCalls   map[*ast.CallExpression]bool
+
+	foldConstants  bool
+	dedupConstants bool
+	peephole       bool
+	constantIdx    map[constantKey]int
 
 	scopes   []CompilationScope
 	scopeIdx int
+
+	// span is the source of the node being compiled, which every emitted
+	// instruction is recorded to come from.
+	span code.Span
+
+	// operands counts the expressions being compiled whose earlier
+	// operands are on the stack while later ones are compiled. A break or
+	// continue cannot jump out of them without leaving those behind.
+	operands int
 }
 
 type Bytecode struct {
 	Instructions code.Instructions
 	Constants    []object.Object
+	Positions    code.PositionTable
+	GlobalNames  []string // the names of the globals, by slot
+
+	// Variants are the functions of the closures the main program makes
+	// of shared constants; see object.CompiledFunction.Variants.
+	Variants map[int]*object.CompiledFunction
 }
 
 type EmittedInstruction struct {
@@ -30,41 +53,241 @@ type EmittedInstruction struct {
 
 type CompilationScope struct {
 	instructions code.Instructions
+	positions    code.PositionTable
 	lastInst     EmittedInstruction
 	prevInst     EmittedInstruction
+
+	// wideJumps maps the position of a jump to its target when the
+	// target did not fit the jump's operand; see patchJump.
+	wideJumps map[int]int
+
+	// loops are the loops being compiled, innermost last.
+	loops []*loop
+
+	// closures holds for every OpClosure emitted, in order, the variant
+	// of the constant it makes a closure of, or nil for the constant
+	// itself.
+	closures []*object.CompiledFunction
+}
+
+// A loop is where the break and continue statements in its body jump to.
+type loop struct {
+	start    int   // the instruction continue jumps back to
+	breaks   []int // the jumps of break statements, patched to the end
+	iterator bool  // whether a for loop's iterator is on the stack
+	operands int   // the compiler's operands when the loop started
+}
+
+// An Option configures a Compiler created by New or NewWithState.
+type Option func(*Compiler)
+
+// FoldConstants switches the evaluation of constant prefix and infix
+// expressions at compile time on or off. It is on by default.
+func FoldConstants(enabled bool) Option {
+	return func(c *Compiler) {
+		c.foldConstants = enabled
+	}
+}
+
+// DeduplicateConstants switches sharing of equal integer, string and
+// compiled function constants on or off. It is on by default.
+func DeduplicateConstants(enabled bool) Option {
+	return func(c *Compiler) {
+		c.dedupConstants = enabled
+	}
+}
+
+// Peephole switches the peephole optimisation of emitted instructions on
+// or off. It is on by default.
+func Peephole(enabled bool) Option {
+	return func(c *Compiler) {
+		c.peephole = enabled
+	}
 }
 
-func NewWithState(s *SymbolTable, consts []object.Object) *Compiler {
-	compiler := New()
+func NewWithState(s *SymbolTable, consts []object.Object, opts ...Option) *Compiler {
+	compiler := New(opts...)
 	compiler.symbolTable = s
 	compiler.constants = consts
+
+	for i, con := range consts {
+		key, ok := keyOf(con)
+		if _, seen := compiler.constantIdx[key]; ok && !seen {
+			compiler.constantIdx[key] = i
+		}
+	}
+
 	return compiler
 }
 
-func New() *Compiler {
+func New(opts ...Option) *Compiler {
 	mainScope := CompilationScope{
 		instructions: code.Instructions{},
 		lastInst:     EmittedInstruction{},
 		prevInst:     EmittedInstruction{},
 	}
-	return &Compiler{
-		constants:   []object.Object{},
-		symbolTable: NewSymbolTable(),
-		scopes:      []CompilationScope{mainScope},
-		scopeIdx:    0,
+	symbolTable := NewSymbolTable()
+	for i, def := range object.Builtins {
+		symbolTable.DefineBuiltin(i, def.Name)
+	}
+
+	compiler := &Compiler{
+		constants:      []object.Object{},
+		symbolTable:    symbolTable,
+		tailCalls:      make(map[*ast.CallExpression]bool),
+		foldConstants:  true,
+		dedupConstants: true,
+		peephole:       true,
+		constantIdx:    make(map[constantKey]int),
+		scopes:         []CompilationScope{mainScope},
+		scopeIdx:       0,
 	}
+
+	for _, opt := range opts {
+		opt(compiler)
+	}
+
+	return compiler
 }
 
 func (c *Compiler) Bytecode() *Bytecode {
+	insts, positions, variants := c.finish(c.scopes[c.scopeIdx])
 	return &Bytecode{
-		Instructions: c.scopes[c.scopeIdx].instructions,
+		Instructions: insts,
 		Constants:    c.constants,
+		Positions:    positions,
+		GlobalNames:  c.symbolTable.Names(),
+		Variants:     variants,
+	}
+}
+
+// finish returns the final instructions of a scope, their positions and
+// the variants of the closures they make: jumps set aside by patchJump
+// get their targets, widening them, and the peephole optimiser runs if
+// it is enabled.
+func (c *Compiler) finish(scope CompilationScope) (code.Instructions, code.PositionTable, map[int]*object.CompiledFunction) {
+	insts, positions := scope.instructions, scope.positions
+
+	if len(scope.wideJumps) > 0 {
+		decoded, _ := decodeInstructions(insts, positions)
+		for i, in := range decoded {
+			if target, ok := scope.wideJumps[in.offset]; ok {
+				decoded[i].operands[0] = target
+			}
+		}
+		insts, positions = relocate(decoded, len(insts))
+	}
+
+	if c.peephole {
+		insts, positions = optimiseInstructions(insts, positions)
 	}
+
+	return insts, positions, closureVariants(insts, scope.closures)
+}
+
+// closureVariants maps the offset of every OpClosure in insts that has a
+// variant to that variant. Neither relocation nor the peephole optimiser
+// drops or reorders an OpClosure, so the nth one in insts is the nth one
+// emitted.
+func closureVariants(insts code.Instructions, closures []*object.CompiledFunction) map[int]*object.CompiledFunction {
+	var variants map[int]*object.CompiledFunction
+
+	n := 0
+	for offset := 0; offset < len(insts); {
+		_, _, width, err := insts.ReadInstruction(offset)
+		if err != nil {
+			break
+		}
+		if insts.OpcodeAt(offset) == code.OpClosure {
+			if variant := closures[n]; variant != nil {
+				if variants == nil {
+					variants = map[int]*object.CompiledFunction{}
+				}
+				variants[offset] = variant
+			}
+			n++
+		}
+		offset += width
+	}
+
+	return variants
 }
 
 func (c *Compiler) addConstant(con object.Object) int {
+	if !c.dedupConstants {
+		c.constants = append(c.constants, con)
+		return len(c.constants) - 1
+	}
+
+	key, ok := keyOf(con)
+	if idx, seen := c.constantIdx[key]; ok && seen {
+		return idx
+	}
+
 	c.constants = append(c.constants, con)
-	return len(c.constants) - 1
+	idx := len(c.constants) - 1
+	if ok {
+		c.constantIdx[key] = idx
+	}
+	return idx
+}
+
+// constantKey identifies a constant by value, so equal constants can share
+// one slot in the pool. Functions that differ only in where they are in
+// the source or in the names of their locals are equal; the closures made
+// of a later one get it as a variant of the first.
+type constantKey struct {
+	Type  object.ObjectType
+	Value string
+}
+
+func keyOf(con object.Object) (constantKey, bool) {
+	switch con := con.(type) {
+	case *object.Integer:
+		return constantKey{con.Type(), strconv.FormatInt(con.Value, 10)}, true
+	case *object.String:
+		return constantKey{con.Type(), con.Value}, true
+	case *object.CompiledFunction:
+		value := fmt.Sprintf("%s/%d/%d/", con.Name, con.NumLocals, con.NumParameters) +
+			string(con.Instructions)
+		return constantKey{con.Type(), value}, true
+	}
+	return constantKey{}, false
+}
+
+// emitClosure emits the OpClosure that makes a closure of fn. When fn
+// shares its slot in the constant pool with an equal function from
+// elsewhere in the source, the closure is made of fn as a variant of that
+// constant, so it keeps its own positions and local names.
+func (c *Compiler) emitClosure(fn *object.CompiledFunction, numFree int) {
+	idx := c.addConstant(fn)
+
+	var variant *object.CompiledFunction
+	if shared := c.constants[idx].(*object.CompiledFunction); shared != fn && !sameSource(shared, fn) {
+		fn.Instructions = shared.Instructions
+		variant = fn
+	}
+
+	scope := &c.scopes[c.scopeIdx]
+	scope.closures = append(scope.closures, variant)
+	c.emit(code.OpClosure, idx, numFree)
+}
+
+// sameSource reports whether two functions with the same instructions
+// also come from the same source, down to the variants of the closures
+// they make.
+func sameSource(a, b *object.CompiledFunction) bool {
+	if !slices.Equal(a.Positions, b.Positions) || !slices.Equal(a.LocalNames, b.LocalNames) ||
+		len(a.Variants) != len(b.Variants) {
+		return false
+	}
+	for offset, variant := range a.Variants {
+		other, ok := b.Variants[offset]
+		if !ok || !sameSource(variant, other) {
+			return false
+		}
+	}
+	return true
 }
 
 func (c *Compiler) addInstruction(in code.Instructions) int {
@@ -82,6 +305,8 @@ func (c *Compiler) deleteLastOpPop() {
 	if c.scopes[c.scopeIdx].lastInst.Opcode == code.OpPop {
 		c.scopes[c.scopeIdx].instructions =
 			c.scopes[c.scopeIdx].instructions[:c.scopes[c.scopeIdx].lastInst.Pos]
+		c.scopes[c.scopeIdx].positions =
+			c.scopes[c.scopeIdx].positions.Truncate(c.scopes[c.scopeIdx].lastInst.Pos)
 		c.scopes[c.scopeIdx].lastInst = c.scopes[c.scopeIdx].prevInst
 	}
 }
@@ -97,26 +322,372 @@ func (c *Compiler) enterScope() {
 	c.scopeIdx++
 }
 
-func (c *Compiler) leaveScope() code.Instructions {
-	insts := c.scopes[c.scopeIdx].instructions
+func (c *Compiler) leaveScope() (code.Instructions, code.PositionTable, map[int]*object.CompiledFunction) {
+	insts, positions, variants := c.finish(c.scopes[c.scopeIdx])
 	c.scopes = c.scopes[:len(c.scopes)-1]
 	c.symbolTable = c.symbolTable.Outer
 
 	c.scopeIdx--
-	return insts
+	return insts, positions, variants
 }
 
 func (c *Compiler) emit(op code.Opcode, operands ...int) int {
 	inst := code.Make(op, operands...)
 	pos := c.addInstruction(inst)
+	c.scopes[c.scopeIdx].positions = c.scopes[c.scopeIdx].positions.Add(pos, c.span)
 
 	c.setLastInstruction(op, pos)
 	return pos
 }
 
+// emitAt emits an instruction compiled from span rather than from the
+// node being compiled.
+func (c *Compiler) emitAt(span code.Span, op code.Opcode, operands ...int) int {
+	outer := c.span
+	c.span = span
+	defer func() { c.span = outer }()
+
+	return c.emit(op, operands...)
+}
+
+// patchJump points the jump emitted at pos to the current end of the
+// instructions. Jumps are emitted with a placeholder that fits a narrow
+// operand, so a target that does not is set aside and filled in by finish,
+// which can move the instructions to make room for a wide operand.
+func (c *Compiler) patchJump(pos int) {
+	scope := &c.scopes[c.scopeIdx]
+	target := len(scope.instructions)
+
+	if target > math.MaxUint16 {
+		if scope.wideJumps == nil {
+			scope.wideJumps = map[int]int{}
+		}
+		scope.wideJumps[pos] = target
+		return
+	}
+
+	code.PutUint16(scope.instructions[pos+1:], uint16(target))
+}
+
+// enterLoop starts a loop whose body continue statements jump back to
+// start. iterator says that a for loop's iterator is on the stack, which
+// break statements pop.
+func (c *Compiler) enterLoop(start int, iterator bool) {
+	scope := &c.scopes[c.scopeIdx]
+	scope.loops = append(scope.loops, &loop{
+		start:    start,
+		iterator: iterator,
+		operands: c.operands,
+	})
+}
+
+// leaveLoop ends the innermost loop and points its break statements to
+// the current end of the instructions, where the loop exits. The exit
+// leaves null as the loop's value, like the evaluator's loops.
+func (c *Compiler) leaveLoop() {
+	scope := &c.scopes[c.scopeIdx]
+	l := scope.loops[len(scope.loops)-1]
+	scope.loops = scope.loops[:len(scope.loops)-1]
+
+	for _, pos := range l.breaks {
+		c.patchJump(pos)
+	}
+
+	c.emit(code.OpNull)
+	c.emit(code.OpPop)
+}
+
+// innermostLoop returns the loop a break or continue statement jumps out
+// of. Loops outside the function being compiled do not count.
+func (c *Compiler) innermostLoop(tok token.Token) (*loop, error) {
+	loops := c.scopes[c.scopeIdx].loops
+	if len(loops) == 0 {
+		return nil, fmt.Errorf("%s: %s outside of a loop", tok.Pos, tok.Literal)
+	}
+
+	l := loops[len(loops)-1]
+	if l.operands != c.operands {
+		return nil, fmt.Errorf("%s: %s inside an operand of an expression", tok.Pos, tok.Literal)
+	}
+	return l, nil
+}
+
+// compoundOps are the instructions of the operators of compound
+// assignments.
+var compoundOps = map[string]code.Opcode{
+	"+": code.OpAdd,
+	"-": code.OpSub,
+	"*": code.OpMul,
+	"/": code.OpDiv,
+	"%": code.OpMod,
+}
+
+// compileAssignment stores the value of an assignment in its target and
+// leaves it on the stack. A closure shares the cells of the variables it
+// captured with the function that defines them, so it can assign to them
+// too. The name of the function being defined cannot be assigned to.
+//
+// A compound assignment applies its operator to the target's old value
+// and the value first. The array or hash and the index of an index target
+// are evaluated once, and kept on the stack for the store.
+func (c *Compiler) compileAssignment(n *ast.AssignExpression) error {
+	op, compound := compoundOps[n.Operator]
+	if n.Operator != "" && !compound {
+		return fmt.Errorf("%s: unknown operator %s=", n.Token.Pos, n.Operator)
+	}
+
+	switch target := n.Target.(type) {
+	case *ast.Identifier:
+		sym, ok := c.symbolTable.Resolve(target.Value)
+		if !ok {
+			return fmt.Errorf("%s: variable %s is undefined", target.Pos(), target.Value)
+		}
+
+		switch {
+		case sym.Scope == GlobalScope, sym.Scope == LocalScope:
+		case sym.Scope == FreeScope && sym.Cell:
+		case sym.Scope == BuiltinScope:
+			return fmt.Errorf("%s: cannot assign to builtin %s", target.Pos(), target.Value)
+		default:
+			return fmt.Errorf("%s: cannot assign to %s, which is bound outside this function",
+				target.Pos(), target.Value)
+		}
+
+		if compound {
+			c.loadSymbol(sym)
+			c.operands++
+			defer func() { c.operands-- }()
+		}
+
+		err := c.Compile(n.Value)
+		if err != nil {
+			return err
+		}
+
+		if compound {
+			c.emit(op)
+		}
+		c.storeSymbol(sym)
+		c.loadSymbol(sym)
+
+	case *ast.IndexExpression:
+		// The array or hash and the index, and for a compound assignment
+		// the old value, are on the stack while the value is compiled.
+		c.operands++
+		defer func() { c.operands-- }()
+
+		err := c.Compile(target.Left)
+		if err != nil {
+			return err
+		}
+
+		err = c.Compile(target.Index)
+		if err != nil {
+			return err
+		}
+
+		if compound {
+			c.emit(code.OpDup2)
+			c.emit(code.OpIndex)
+		}
+
+		err = c.Compile(n.Value)
+		if err != nil {
+			return err
+		}
+
+		if compound {
+			c.emit(op)
+		}
+		c.emit(code.OpSetIndex)
+
+	default:
+		return fmt.Errorf("%s: cannot assign to %s", n.Pos(), n.Target)
+	}
+
+	return nil
+}
+
+// compileLogical compiles && and ||. The right operand is compiled only to
+// run when the left one does not decide the result, and the value left on
+// the stack is that of the operand evaluated last.
+func (c *Compiler) compileLogical(n *ast.InfixExpression) error {
+	err := c.Compile(n.Left)
+	if err != nil {
+		return err
+	}
+
+	c.emit(code.OpDup)
+	jmpNotTruthyIdx := c.emit(code.OpJumpNotTruthy, 9999)
+
+	jmpIdx := -1
+	if n.Token.Type == token.OR {
+		jmpIdx = c.emit(code.OpJump, 9999)
+		c.patchJump(jmpNotTruthyIdx)
+	}
+
+	c.emit(code.OpPop)
+	err = c.Compile(n.Right)
+	if err != nil {
+		return err
+	}
+
+	if n.Token.Type == token.OR {
+		c.patchJump(jmpIdx)
+	} else {
+		c.patchJump(jmpNotTruthyIdx)
+	}
+	return nil
+}
+
+// compileBranch compiles a branch of an if expression so that it leaves
+// its value on the stack: the value of its last expression or loop, or
+// null if it is empty or ends in a let statement.
+func (c *Compiler) compileBranch(block *ast.BlockStatement) error {
+	err := c.Compile(block)
+	if err != nil {
+		return err
+	}
+
+	if len(block.Statements) > 0 {
+		switch block.Statements[len(block.Statements)-1].(type) {
+		case *ast.ExpressionStatement, *ast.WhileStatement, *ast.ForStatement:
+			c.deleteLastOpPop()
+			return nil
+		case *ast.ReturnStatement, *ast.BreakStatement, *ast.ContinueStatement:
+			return nil
+		}
+	}
+
+	c.emit(code.OpNull)
+	return nil
+}
+
+// declareGlobals defines every top-level let binding of the program up
+// front, so function bodies can refer to globals bound further down.
+func (c *Compiler) declareGlobals(program *ast.Program) {
+	for _, st := range program.Statements {
+		if let, ok := st.(*ast.LetStatement); ok {
+			c.symbolTable.Define(let.Name.Value)
+		}
+	}
+}
+
+// markTailCalls records the calls in block whose result the enclosing
+// function returns unchanged: the operand of every return statement and,
+// if tail is set, the value of the block's last expression. Those calls
+// are compiled to OpTailCall and reuse the caller's frame.
+func (c *Compiler) markTailCalls(block *ast.BlockStatement, tail bool) {
+	for i, st := range block.Statements {
+		last := tail && i == len(block.Statements)-1
+
+		switch st := st.(type) {
+		case *ast.ReturnStatement:
+			c.markTailExpression(st.ReturnValue, true)
+		case *ast.ExpressionStatement:
+			c.markTailExpression(st.Expression, last)
+		}
+	}
+}
+
+func (c *Compiler) markTailExpression(exp ast.Expression, tail bool) {
+	switch exp := exp.(type) {
+	case *ast.CallExpression:
+		if tail {
+			c.tailCalls[exp] = true
+		}
+	case *ast.IfExpression:
+		c.markTailCalls(exp.Consequence, tail)
+		if exp.Alternative != nil {
+			c.markTailCalls(exp.Alternative, tail)
+		}
+	}
+}
+
+// emitConstant pushes the value of a folded constant expression.
+func (c *Compiler) emitConstant(obj object.Object) {
+	switch obj := obj.(type) {
+	case *object.Boolean:
+		if obj.Value {
+			c.emit(code.OpTrue)
+		} else {
+			c.emit(code.OpFalse)
+		}
+	default:
+		c.emit(code.OpConstant, c.addConstant(obj))
+	}
+}
+
+func (c *Compiler) loadSymbol(s Symbol) {
+	switch {
+	case s.Scope == GlobalScope:
+		c.emit(code.OpGetGlobal, s.Idx)
+	case s.Scope == LocalScope && s.Cell:
+		c.emit(code.OpGetCell, s.Idx)
+	case s.Scope == LocalScope:
+		c.emit(code.OpGetLocal, s.Idx)
+	case s.Scope == BuiltinScope:
+		c.emit(code.OpGetBuiltin, s.Idx)
+	case s.Scope == FreeScope && s.Cell:
+		c.emit(code.OpGetFreeCell, s.Idx)
+	case s.Scope == FreeScope:
+		c.emit(code.OpGetFree, s.Idx)
+	case s.Scope == FunctionScope:
+		c.emit(code.OpCurrentClosure)
+	}
+}
+
+// loadCapture pushes what a closure captures of a variable: its cell if it
+// is held in one, and its value otherwise.
+func (c *Compiler) loadCapture(s Symbol) {
+	switch {
+	case s.Scope == LocalScope && s.Cell:
+		c.emit(code.OpGetLocal, s.Idx)
+	case s.Scope == FreeScope && s.Cell:
+		c.emit(code.OpGetFree, s.Idx)
+	default:
+		c.loadSymbol(s)
+	}
+}
+
+// storeSymbol pops the top of the stack into a global or local defined
+// with Define, or into a captured variable's cell.
+func (c *Compiler) storeSymbol(s Symbol) {
+	switch {
+	case s.Scope == GlobalScope:
+		c.emit(code.OpSetGlobal, s.Idx)
+	case s.Scope == FreeScope:
+		c.emit(code.OpSetFreeCell, s.Idx)
+	case s.Cell:
+		c.emit(code.OpSetCell, s.Idx)
+	default:
+		c.emit(code.OpSetLocal, s.Idx)
+	}
+}
+
 func (c *Compiler) Compile(node ast.Node) error {
+	outer := c.span
+	c.span = code.Span{Start: node.Pos(), End: node.End()}
+	defer func() { c.span = outer }()
+
+	switch n := node.(type) {
+	case *ast.InfixExpression:
+		// The left operand of && and || is popped before the right one
+		// runs.
+		if n.Token.Type != token.AND && n.Token.Type != token.OR {
+			c.operands++
+			defer func() { c.operands-- }()
+		}
+	case *ast.CallExpression, *ast.IndexExpression, *ast.ArrayLiteral,
+		*ast.HashLiteral:
+		c.operands++
+		defer func() { c.operands-- }()
+	}
+
 	switch n := node.(type) {
 	case *ast.Program:
+		c.declareGlobals(n)
+
 		for _, st := range n.Statements {
 			err := c.Compile(st)
 			if err != nil {
@@ -125,17 +696,24 @@ func (c *Compiler) Compile(node ast.Node) error {
 		}
 
 	case *ast.LetStatement:
+		// A function bound by a let refers to itself through the binding,
+		// so the binding exists before its body is compiled.
+		fn, ok := n.Value.(*ast.FunctionLiteral)
+		recursive := ok && fn.Name == n.Name.Value
+		var sym Symbol
+		if recursive {
+			sym = c.symbolTable.Define(n.Name.Value)
+		}
+
 		err := c.Compile(n.Value)
 		if err != nil {
 			return err
 		}
 
-		symbol := c.symbolTable.Define(n.Name.Value)
-		if symbol.Scope == GlobalScope {
-			c.emit(code.OpSetGlobal, symbol.Idx)
-		} else {
-			c.emit(code.OpSetLocal, symbol.Idx)
+		if !recursive {
+			sym = c.symbolTable.Define(n.Name.Value)
 		}
+		c.storeSymbol(sym)
 
 	case *ast.BlockStatement:
 		for _, elm := range n.Statements {
@@ -153,11 +731,107 @@ func (c *Compiler) Compile(node ast.Node) error {
 
 		c.emit(code.OpReturnValue)
 
+	case *ast.WhileStatement:
+		// The body's statements leave the stack as they found it, so the
+		// jump back to the condition needs no cleanup.
+		loopStart := len(c.scopes[c.scopeIdx].instructions)
+
+		err := c.Compile(n.Condition)
+		if err != nil {
+			return err
+		}
+
+		jmpNotTruthyIdx := c.emit(code.OpJumpNotTruthy, 9999)
+
+		c.enterLoop(loopStart, false)
+
+		err = c.Compile(n.Body)
+		if err != nil {
+			return err
+		}
+
+		c.emit(code.OpJump, loopStart)
+
+		c.patchJump(jmpNotTruthyIdx)
+		c.leaveLoop()
+
+	case *ast.ForStatement:
+		// The iterator stays on the stack while the loop runs, below the
+		// values OpIterNext pushes for the loop's variables.
+		err := c.Compile(n.Iterable)
+		if err != nil {
+			return err
+		}
+
+		c.emit(code.OpIter)
+
+		loopStart := len(c.scopes[c.scopeIdx].instructions)
+
+		numVars := 1
+		if n.Key != nil {
+			numVars = 2
+		}
+		iterNextIdx := c.emit(code.OpIterNext, 9999, numVars)
+
+		// As in the evaluator, every step stores into the same variables,
+		// so closures made in the body share them.
+		c.storeSymbol(c.symbolTable.Define(n.Value.Value))
+		if n.Key != nil {
+			c.storeSymbol(c.symbolTable.Define(n.Key.Value))
+		}
+
+		c.enterLoop(loopStart, true)
+
+		err = c.Compile(n.Body)
+		if err != nil {
+			return err
+		}
+
+		c.emit(code.OpJump, loopStart)
+
+		c.patchJump(iterNextIdx)
+		c.leaveLoop()
+
+	case *ast.BreakStatement:
+		l, err := c.innermostLoop(n.Token)
+		if err != nil {
+			return err
+		}
+
+		// An exhausted iterator is popped by OpIterNext; one left behind
+		// by a break is popped here.
+		if l.iterator {
+			c.emit(code.OpPop)
+		}
+		l.breaks = append(l.breaks, c.emit(code.OpJump, 9999))
+
+	case *ast.ContinueStatement:
+		l, err := c.innermostLoop(n.Token)
+		if err != nil {
+			return err
+		}
+
+		c.emit(code.OpJump, l.start)
+
 	case *ast.FunctionLiteral:
 		c.enterScope()
+		c.symbolTable.cells = capturedNames(n.Body)
+
+		if n.Name != "" && !c.symbolTable.Outer.assignable(n.Name) {
+			c.symbolTable.DefineFunctionName(n.Name)
+		}
+
+		c.markTailCalls(n.Body, true)
+
+		for _, param := range n.Parameters {
+			c.symbolTable.Define(param.Value)
+		}
+
+		// An implicit return comes from the closing brace of the body.
+		rbrace := code.Span{Start: n.Body.Rbrace.Pos, End: n.Body.Rbrace.End}
 
 		if len(n.Body.Statements) == 0 {
-			c.emit(code.OpReturn)
+			c.emitAt(rbrace, code.OpReturn)
 		} else {
 			err := c.Compile(n.Body)
 			if err != nil {
@@ -165,16 +839,39 @@ func (c *Compiler) Compile(node ast.Node) error {
 			}
 
 			c.deleteLastOpPop()
-			if n.Body.Statements[len(n.Body.Statements)-1].TokenLiteral() != "return" {
-				c.emit(code.OpReturnValue)
+
+			// A body that ends in a let statement returns null, one
+			// that ends in a loop the null the loop leaves.
+			switch n.Body.Statements[len(n.Body.Statements)-1].(type) {
+			case *ast.ReturnStatement:
+			case *ast.ExpressionStatement, *ast.WhileStatement, *ast.ForStatement:
+				c.emitAt(rbrace, code.OpReturnValue)
+			default:
+				c.emitAt(rbrace, code.OpReturn)
 			}
 		}
 
+		freeSymbols := c.symbolTable.FreeSymbols
 		numLocals := c.symbolTable.numDefs
-		insts := c.leaveScope()
+		localNames := c.symbolTable.Names()
+		cells := c.symbolTable.Cells()
+		insts, positions, variants := c.leaveScope()
 
-		funcObj := &object.CompiledFunction{Instructions: insts, NumLocals: numLocals}
-		c.emit(code.OpConstant, c.addConstant(funcObj))
+		for _, sym := range freeSymbols {
+			c.loadCapture(sym)
+		}
+
+		funcObj := &object.CompiledFunction{
+			Instructions:  insts,
+			NumLocals:     numLocals,
+			NumParameters: len(n.Parameters),
+			Name:          n.Name,
+			Positions:     positions,
+			LocalNames:    localNames,
+			Cells:         cells,
+			Variants:      variants,
+		}
+		c.emitClosure(funcObj, len(freeSymbols))
 
 	case *ast.CallExpression:
 		err := c.Compile(n.Function)
@@ -182,7 +879,18 @@ func (c *Compiler) Compile(node ast.Node) error {
 			return err
 		}
 
-		c.emit(code.OpCall)
+		for _, arg := range n.Arguments {
+			err := c.Compile(arg)
+			if err != nil {
+				return err
+			}
+		}
+
+		if c.tailCalls[n] {
+			c.emit(code.OpTailCall, len(n.Arguments))
+		} else {
+			c.emit(code.OpCall, len(n.Arguments))
+		}
 
 	case *ast.ExpressionStatement:
 		err := c.Compile(n.Expression)
@@ -204,6 +912,9 @@ func (c *Compiler) Compile(node ast.Node) error {
 
 		c.emit(code.OpIndex)
 
+	case *ast.AssignExpression:
+		return c.compileAssignment(n)
+
 	case *ast.IfExpression:
 		err := c.Compile(n.Condition)
 		if err != nil {
@@ -212,33 +923,34 @@ func (c *Compiler) Compile(node ast.Node) error {
 
 		jmpNotTruthyIdx := c.emit(code.OpJumpNotTruthy, 9999)
 
-		err = c.Compile(n.Consequence)
+		err = c.compileBranch(n.Consequence)
 		if err != nil {
 			return err
 		}
 
-		c.deleteLastOpPop()
-
 		jmpIdx := c.emit(code.OpJump, 9999)
 
-		code.PutUint16(c.scopes[c.scopeIdx].instructions[jmpNotTruthyIdx+1:],
-			uint16(len(c.scopes[c.scopeIdx].instructions)))
+		c.patchJump(jmpNotTruthyIdx)
 
 		if n.Alternative != nil {
-			err = c.Compile(n.Alternative)
+			err = c.compileBranch(n.Alternative)
 			if err != nil {
 				return err
 			}
-
-			c.deleteLastOpPop()
 		} else {
 			c.emit(code.OpNull)
 		}
 
-		code.PutUint16(c.scopes[c.scopeIdx].instructions[jmpIdx+1:],
-			uint16(len(c.scopes[c.scopeIdx].instructions)))
+		c.patchJump(jmpIdx)
 
 	case *ast.PrefixExpression:
+		if c.foldConstants {
+			if obj, ok := evalConstant(n); ok {
+				c.emitConstant(obj)
+				return nil
+			}
+		}
+
 		err := c.Compile(n.Right)
 		if err != nil {
 			return err
@@ -250,10 +962,21 @@ func (c *Compiler) Compile(node ast.Node) error {
 		case token.MINUS:
 			c.emit(code.OpMinus)
 		default:
-			return fmt.Errorf("unknown operator %s", n.Operator)
+			return fmt.Errorf("%s: unknown operator %s", n.Token.Pos, n.Operator)
 		}
 
 	case *ast.InfixExpression:
+		if c.foldConstants {
+			if obj, ok := evalConstant(n); ok {
+				c.emitConstant(obj)
+				return nil
+			}
+		}
+
+		if n.Token.Type == token.AND || n.Token.Type == token.OR {
+			return c.compileLogical(n)
+		}
+
 		if n.Token.Type == token.LT {
 			err := c.Compile(n.Right)
 			if err != nil {
@@ -283,6 +1006,8 @@ func (c *Compiler) Compile(node ast.Node) error {
 			c.emit(code.OpMul)
 		case token.SLASH:
 			c.emit(code.OpDiv)
+		case token.PERCENT:
+			c.emit(code.OpMod)
 		case token.EQ:
 			c.emit(code.OpEqual)
 		case token.NOT_EQ:
@@ -290,20 +1015,16 @@ func (c *Compiler) Compile(node ast.Node) error {
 		case token.GT:
 			c.emit(code.OpGreaterThan)
 		default:
-			return fmt.Errorf("unknown operator %s", n.Operator)
+			return fmt.Errorf("%s: unknown operator %s", n.Token.Pos, n.Operator)
 		}
 
 	case *ast.Identifier:
 		sym, ok := c.symbolTable.Resolve(n.Value)
 		if !ok {
-			return fmt.Errorf("variable %s is undefined", n.Value)
+			return fmt.Errorf("%s: variable %s is undefined", n.Pos(), n.Value)
 		}
 
-		if sym.Scope == GlobalScope {
-			c.emit(code.OpGetGlobal, sym.Idx)
-		} else {
-			c.emit(code.OpGetLocal, sym.Idx)
-		}
+		c.loadSymbol(sym)
 
 	case *ast.IntegerLiteral:
 		intObj := &object.Integer{Value: n.Value}
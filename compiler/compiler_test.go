@@ -7,6 +7,8 @@ import (
 	"karaoke/lexer"
 	"karaoke/object"
 	"karaoke/parser"
+	"slices"
+	"strings"
 	"testing"
 )
 
@@ -32,7 +34,7 @@ func TestLocalBindings(t *testing.T) {
 			expectedInsts: []code.Instructions{
 				code.Make(code.OpConstant, 0),
 				code.Make(code.OpSetGlobal, 0),
-				code.Make(code.OpConstant, 1),
+				code.Make(code.OpClosure, 1, 0),
 				code.Make(code.OpPop),
 			},
 		},
@@ -51,7 +53,7 @@ func TestLocalBindings(t *testing.T) {
 				},
 			},
 			expectedInsts: []code.Instructions{
-				code.Make(code.OpConstant, 1),
+				code.Make(code.OpClosure, 1, 0),
 				code.Make(code.OpPop),
 			},
 		},
@@ -76,7 +78,7 @@ func TestLocalBindings(t *testing.T) {
 				},
 			},
 			expectedInsts: []code.Instructions{
-				code.Make(code.OpConstant, 2),
+				code.Make(code.OpClosure, 2, 0),
 				code.Make(code.OpPop),
 			},
 		},
@@ -97,8 +99,8 @@ func TestFunctionCalls(t *testing.T) {
 				},
 			},
 			expectedInsts: []code.Instructions{
-				code.Make(code.OpConstant, 1), // The compiled function
-				code.Make(code.OpCall),
+				code.Make(code.OpClosure, 1, 0), // The compiled function
+				code.Make(code.OpCall, 0),
 				code.Make(code.OpPop),
 			},
 		},
@@ -117,8 +119,8 @@ func TestFunctionCalls(t *testing.T) {
 				},
 			},
 			expectedInsts: []code.Instructions{
-				code.Make(code.OpConstant, 2),
-				code.Make(code.OpCall),
+				code.Make(code.OpClosure, 2, 0),
+				code.Make(code.OpCall, 0),
 				code.Make(code.OpPop),
 			},
 		},
@@ -135,10 +137,10 @@ func TestFunctionCalls(t *testing.T) {
 				},
 			},
 			expectedInsts: []code.Instructions{
-				code.Make(code.OpConstant, 1), // The compiled function
+				code.Make(code.OpClosure, 1, 0), // The compiled function
 				code.Make(code.OpSetGlobal, 0),
 				code.Make(code.OpGetGlobal, 0),
-				code.Make(code.OpCall),
+				code.Make(code.OpCall, 0),
 				code.Make(code.OpPop),
 			},
 		},
@@ -147,91 +149,222 @@ func TestFunctionCalls(t *testing.T) {
 	runCompilerTests(t, tests)
 }
 
-func TestFunctionsWithoutReturnValue(t *testing.T) {
+func TestFunctionCallsWithArguments(t *testing.T) {
 	tests := []CompilerTestCase{
 		{
-			input: `fn() { }`,
+			input: `
+			let oneArg = fn(a) { a };
+			oneArg(24);
+			`,
 			expectedConst: []interface{}{
 				[]code.Instructions{
-					code.Make(code.OpReturn),
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpReturnValue),
 				},
+				24,
 			},
 			expectedInsts: []code.Instructions{
-				code.Make(code.OpConstant, 0),
+				code.Make(code.OpClosure, 0, 0),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpCall, 1),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input: `
+			let manyArg = fn(a, b, c) { a; b; c };
+			manyArg(24, 25, 26);
+			`,
+			expectedConst: []interface{}{
+				[]code.Instructions{
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpPop),
+					code.Make(code.OpGetLocal, 1),
+					code.Make(code.OpPop),
+					code.Make(code.OpGetLocal, 2),
+					code.Make(code.OpReturnValue),
+				},
+				24,
+				25,
+				26,
+			},
+			expectedInsts: []code.Instructions{
+				code.Make(code.OpClosure, 0, 0),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpConstant, 2),
+				code.Make(code.OpConstant, 3),
+				code.Make(code.OpCall, 3),
 				code.Make(code.OpPop),
 			},
 		},
 	}
+
 	runCompilerTests(t, tests)
 }
 
-func TestFunctions(t *testing.T) {
+func TestBuiltins(t *testing.T) {
 	tests := []CompilerTestCase{
 		{
-			input: `fn() { 1; 2 }`,
+			input: `
+			len([]);
+			push([], 1);
+			`,
+			expectedConst: []interface{}{1},
+			expectedInsts: []code.Instructions{
+				code.Make(code.OpGetBuiltin, 0),
+				code.Make(code.OpArray, 0),
+				code.Make(code.OpCall, 1),
+				code.Make(code.OpPop),
+				code.Make(code.OpGetBuiltin, 5),
+				code.Make(code.OpArray, 0),
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpCall, 2),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input: `fn() { len([]) }`,
 			expectedConst: []interface{}{
-				1,
-				2,
 				[]code.Instructions{
-					code.Make(code.OpConstant, 0),
-					code.Make(code.OpPop),
-					code.Make(code.OpConstant, 1),
+					code.Make(code.OpGetBuiltin, 0),
+					code.Make(code.OpArray, 0),
+					code.Make(code.OpTailCall, 1),
 					code.Make(code.OpReturnValue),
 				},
 			},
 			expectedInsts: []code.Instructions{
-				code.Make(code.OpConstant, 2),
+				code.Make(code.OpClosure, 0, 0),
 				code.Make(code.OpPop),
 			},
 		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestClosures(t *testing.T) {
+	tests := []CompilerTestCase{
 		{
-			input: "fn () { 5 + 10 }",
+			input: `
+			fn(a) {
+				fn(b) {
+					a + b
+				}
+			}
+			`,
 			expectedConst: []interface{}{
-				5,
-				10,
 				[]code.Instructions{
-					code.Make(code.OpConstant, 0),
-					code.Make(code.OpConstant, 1),
+					code.Make(code.OpGetFreeCell, 0),
+					code.Make(code.OpGetLocal, 0),
 					code.Make(code.OpAdd),
 					code.Make(code.OpReturnValue),
 				},
+				[]code.Instructions{
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpClosure, 0, 1),
+					code.Make(code.OpReturnValue),
+				},
 			},
 			expectedInsts: []code.Instructions{
-				code.Make(code.OpConstant, 2),
+				code.Make(code.OpClosure, 1, 0),
 				code.Make(code.OpPop),
 			},
 		},
 		{
-			input: "fn () { return 5 + 10 }",
+			input: `
+			fn(a) {
+				fn(b) {
+					fn(c) {
+						a + b + c
+					}
+				}
+			};
+			`,
 			expectedConst: []interface{}{
-				5,
-				10,
 				[]code.Instructions{
-					code.Make(code.OpConstant, 0),
-					code.Make(code.OpConstant, 1),
+					code.Make(code.OpGetFreeCell, 0),
+					code.Make(code.OpGetFreeCell, 1),
+					code.Make(code.OpAdd),
+					code.Make(code.OpGetLocal, 0),
 					code.Make(code.OpAdd),
 					code.Make(code.OpReturnValue),
 				},
+				[]code.Instructions{
+					code.Make(code.OpGetFree, 0),
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpClosure, 0, 2),
+					code.Make(code.OpReturnValue),
+				},
+				[]code.Instructions{
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpClosure, 1, 1),
+					code.Make(code.OpReturnValue),
+				},
 			},
 			expectedInsts: []code.Instructions{
-				code.Make(code.OpConstant, 2),
+				code.Make(code.OpClosure, 2, 0),
 				code.Make(code.OpPop),
 			},
 		},
 		{
-			input: "fn () { return 15 - 5 }",
+			input: `
+			let global = 55;
+
+			fn() {
+				let a = 66;
+
+				fn() {
+					let b = 77;
+
+					fn() {
+						let c = 88;
+
+						global + a + b + c;
+					}
+				}
+			}
+			`,
 			expectedConst: []interface{}{
-				15,
-				5,
+				55,
+				66,
+				77,
+				88,
+				[]code.Instructions{
+					code.Make(code.OpConstant, 3),
+					code.Make(code.OpSetLocal, 0),
+					code.Make(code.OpGetGlobal, 0),
+					code.Make(code.OpGetFreeCell, 0),
+					code.Make(code.OpAdd),
+					code.Make(code.OpGetFreeCell, 1),
+					code.Make(code.OpAdd),
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpAdd),
+					code.Make(code.OpReturnValue),
+				},
+				[]code.Instructions{
+					code.Make(code.OpConstant, 2),
+					code.Make(code.OpSetCell, 0),
+					code.Make(code.OpGetFree, 0),
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpClosure, 4, 2),
+					code.Make(code.OpReturnValue),
+				},
 				[]code.Instructions{
-					code.Make(code.OpConstant, 0),
 					code.Make(code.OpConstant, 1),
-					code.Make(code.OpSub),
+					code.Make(code.OpSetCell, 0),
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpClosure, 5, 1),
 					code.Make(code.OpReturnValue),
 				},
 			},
 			expectedInsts: []code.Instructions{
-				code.Make(code.OpConstant, 2),
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpClosure, 6, 0),
 				code.Make(code.OpPop),
 			},
 		},
@@ -240,34 +373,68 @@ func TestFunctions(t *testing.T) {
 	runCompilerTests(t, tests)
 }
 
-func TestIndexExpressions(t *testing.T) {
+func TestRecursiveFunctions(t *testing.T) {
 	tests := []CompilerTestCase{
 		{
-			input:         "[1, 2, 3][1 + 1]",
-			expectedConst: []interface{}{1, 2, 3, 1, 1},
+			input: `
+			let countDown = fn(x) { countDown(x - 1); };
+			countDown(1);
+			`,
+			expectedConst: []interface{}{
+				1,
+				[]code.Instructions{
+					code.Make(code.OpGetGlobal, 0),
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpSub),
+					code.Make(code.OpTailCall, 1),
+					code.Make(code.OpReturnValue),
+				},
+				1,
+			},
 			expectedInsts: []code.Instructions{
-				code.Make(code.OpConstant, 0),
-				code.Make(code.OpConstant, 1),
+				code.Make(code.OpClosure, 1, 0),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpGetGlobal, 0),
 				code.Make(code.OpConstant, 2),
-				code.Make(code.OpArray, 3),
-				code.Make(code.OpConstant, 3),
-				code.Make(code.OpConstant, 4),
-				code.Make(code.OpAdd),
-				code.Make(code.OpIndex),
+				code.Make(code.OpCall, 1),
 				code.Make(code.OpPop),
 			},
 		},
 		{
-			input:         "{1: 2}[2 - 1]",
-			expectedConst: []interface{}{1, 2, 2, 1},
+			input: `
+			let wrapper = fn() {
+				let countDown = fn(x) { countDown(x - 1); };
+				countDown(1);
+			};
+			wrapper();
+			`,
+			expectedConst: []interface{}{
+				1,
+				[]code.Instructions{
+					code.Make(code.OpGetFreeCell, 0),
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpSub),
+					code.Make(code.OpTailCall, 1),
+					code.Make(code.OpReturnValue),
+				},
+				1,
+				[]code.Instructions{
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpClosure, 1, 1),
+					code.Make(code.OpSetCell, 0),
+					code.Make(code.OpGetCell, 0),
+					code.Make(code.OpConstant, 2),
+					code.Make(code.OpTailCall, 1),
+					code.Make(code.OpReturnValue),
+				},
+			},
 			expectedInsts: []code.Instructions{
-				code.Make(code.OpConstant, 0),
-				code.Make(code.OpConstant, 1),
-				code.Make(code.OpHash, 1),
-				code.Make(code.OpConstant, 2),
-				code.Make(code.OpConstant, 3),
-				code.Make(code.OpSub),
-				code.Make(code.OpIndex),
+				code.Make(code.OpClosure, 3, 0),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpCall, 0),
 				code.Make(code.OpPop),
 			},
 		},
@@ -276,41 +443,92 @@ func TestIndexExpressions(t *testing.T) {
 	runCompilerTests(t, tests)
 }
 
-func TestHashLiterals(t *testing.T) {
+func TestTailCalls(t *testing.T) {
 	tests := []CompilerTestCase{
 		{
-			input:         `{1 + 1: 2 * 2, 3 + 3: 4 * 4}`,
-			expectedConst: []interface{}{1, 1, 2, 2, 3, 3, 4, 4},
+			input: `fn(f) { if (true) { f() } else { 1 } }`,
+			expectedConst: []interface{}{
+				1,
+				[]code.Instructions{
+					// 0000
+					code.Make(code.OpTrue),
+					// 0001
+					code.Make(code.OpJumpNotTruthy, 11),
+					// 0004
+					code.Make(code.OpGetLocal, 0),
+					// 0006
+					code.Make(code.OpTailCall, 0),
+					// 0008
+					code.Make(code.OpJump, 14),
+					// 0011
+					code.Make(code.OpConstant, 0),
+					// 0014
+					code.Make(code.OpReturnValue),
+				},
+			},
 			expectedInsts: []code.Instructions{
-				code.Make(code.OpConstant, 0),
-				code.Make(code.OpConstant, 1),
-				code.Make(code.OpAdd),
-				code.Make(code.OpConstant, 2),
-				code.Make(code.OpConstant, 3),
-				code.Make(code.OpMul),
-				code.Make(code.OpConstant, 4),
-				code.Make(code.OpConstant, 5),
-				code.Make(code.OpAdd),
-				code.Make(code.OpConstant, 6),
-				code.Make(code.OpConstant, 7),
-				code.Make(code.OpMul),
-				code.Make(code.OpHash, 2),
+				code.Make(code.OpClosure, 1, 0),
 				code.Make(code.OpPop),
 			},
 		},
 		{
-			input:         "{1: 2 + 3, 4: 5 * 6}",
-			expectedConst: []interface{}{1, 2, 3, 4, 5, 6},
+			input: `fn(f) { if (true) { return f(); }; f(); 2 }`,
+			expectedConst: []interface{}{
+				2,
+				[]code.Instructions{
+					// 0000
+					code.Make(code.OpTrue),
+					// 0001
+					code.Make(code.OpJumpNotTruthy, 12),
+					// 0004
+					code.Make(code.OpGetLocal, 0),
+					// 0006
+					code.Make(code.OpTailCall, 0),
+					// 0008
+					code.Make(code.OpReturnValue),
+					// 0009
+					code.Make(code.OpJump, 13),
+					// 0012
+					code.Make(code.OpNull),
+					// 0013
+					code.Make(code.OpPop),
+					// 0014
+					code.Make(code.OpGetLocal, 0),
+					// 0016
+					code.Make(code.OpCall, 0),
+					// 0018
+					code.Make(code.OpPop),
+					// 0019
+					code.Make(code.OpConstant, 0),
+					// 0022
+					code.Make(code.OpReturnValue),
+				},
+			},
 			expectedInsts: []code.Instructions{
-				code.Make(code.OpConstant, 0),
-				code.Make(code.OpConstant, 1),
+				code.Make(code.OpClosure, 1, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input: `let f = fn() { 1 }; f() + 1; f();`,
+			expectedConst: []interface{}{
+				1,
+				[]code.Instructions{
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpReturnValue),
+				},
+				1,
+			},
+			expectedInsts: []code.Instructions{
+				code.Make(code.OpClosure, 1, 0),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpCall, 0),
 				code.Make(code.OpConstant, 2),
 				code.Make(code.OpAdd),
-				code.Make(code.OpConstant, 3),
-				code.Make(code.OpConstant, 4),
-				code.Make(code.OpConstant, 5),
-				code.Make(code.OpMul),
-				code.Make(code.OpHash, 2),
+				code.Make(code.OpPop),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpCall, 0),
 				code.Make(code.OpPop),
 			},
 		},
@@ -319,21 +537,271 @@ func TestHashLiterals(t *testing.T) {
 	runCompilerTests(t, tests)
 }
 
-func TestArrayLiterls(t *testing.T) {
+func TestForwardReferences(t *testing.T) {
 	tests := []CompilerTestCase{
 		{
-			input:         `[]`,
-			expectedConst: []interface{}{},
-			expectedInsts: []code.Instructions{
-				code.Make(code.OpArray, 0),
-				code.Make(code.OpPop),
-			},
-		},
-		{
-			input:         `[1, 2, 3, 4]`,
-			expectedConst: []interface{}{1, 2, 3, 4},
-			expectedInsts: []code.Instructions{
-				code.Make(code.OpConstant, 0),
+			input: `
+			let isEven = fn(n) { isOdd(n) };
+			let isOdd = fn(n) { isEven(n) };
+			`,
+			expectedConst: []interface{}{
+				[]code.Instructions{
+					code.Make(code.OpGetGlobal, 1),
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpTailCall, 1),
+					code.Make(code.OpReturnValue),
+				},
+				[]code.Instructions{
+					code.Make(code.OpGetGlobal, 0),
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpTailCall, 1),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInsts: []code.Instructions{
+				code.Make(code.OpClosure, 0, 0),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpClosure, 1, 0),
+				code.Make(code.OpSetGlobal, 1),
+			},
+		},
+		{
+			input: `
+			let a = 1;
+			let a = a + 1;
+			`,
+			expectedConst: []interface{}{1, 1},
+			expectedInsts: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpAdd),
+				code.Make(code.OpSetGlobal, 0),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestUndefinedVariable(t *testing.T) {
+	program := parse(`fn() { let a = 1; }; a;`)
+
+	compiler := New()
+	err := compiler.Compile(program)
+	if err == nil {
+		t.Fatalf("expected compiler error but resulted in none.")
+	}
+
+	expected := "1:22: variable a is undefined"
+	if err.Error() != expected {
+		t.Fatalf("wrong compiler error: want=%q, got=%q", expected, err)
+	}
+}
+
+func TestFunctionsWithoutReturnValue(t *testing.T) {
+	tests := []CompilerTestCase{
+		{
+			input: `fn() { }`,
+			expectedConst: []interface{}{
+				[]code.Instructions{
+					code.Make(code.OpReturn),
+				},
+			},
+			expectedInsts: []code.Instructions{
+				code.Make(code.OpClosure, 0, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input: `fn() { let a = 1; }`,
+			expectedConst: []interface{}{
+				1,
+				[]code.Instructions{
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpSetLocal, 0),
+					code.Make(code.OpReturn),
+				},
+			},
+			expectedInsts: []code.Instructions{
+				code.Make(code.OpClosure, 1, 0),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+	runCompilerTests(t, tests)
+}
+
+func TestFunctions(t *testing.T) {
+	tests := []CompilerTestCase{
+		{
+			input: `fn() { 1; 2 }`,
+			expectedConst: []interface{}{
+				1,
+				2,
+				[]code.Instructions{
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpPop),
+					code.Make(code.OpConstant, 1),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInsts: []code.Instructions{
+				code.Make(code.OpClosure, 2, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input: "fn () { 5 + 10 }",
+			expectedConst: []interface{}{
+				5,
+				10,
+				[]code.Instructions{
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpConstant, 1),
+					code.Make(code.OpAdd),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInsts: []code.Instructions{
+				code.Make(code.OpClosure, 2, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input: "fn () { return 5 + 10 }",
+			expectedConst: []interface{}{
+				5,
+				10,
+				[]code.Instructions{
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpConstant, 1),
+					code.Make(code.OpAdd),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInsts: []code.Instructions{
+				code.Make(code.OpClosure, 2, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input: "fn () { return 15 - 5 }",
+			expectedConst: []interface{}{
+				15,
+				5,
+				[]code.Instructions{
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpConstant, 1),
+					code.Make(code.OpSub),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInsts: []code.Instructions{
+				code.Make(code.OpClosure, 2, 0),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestIndexExpressions(t *testing.T) {
+	tests := []CompilerTestCase{
+		{
+			input:         "[1, 2, 3][1 + 1]",
+			expectedConst: []interface{}{1, 2, 3, 1, 1},
+			expectedInsts: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpConstant, 2),
+				code.Make(code.OpArray, 3),
+				code.Make(code.OpConstant, 3),
+				code.Make(code.OpConstant, 4),
+				code.Make(code.OpAdd),
+				code.Make(code.OpIndex),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:         "{1: 2}[2 - 1]",
+			expectedConst: []interface{}{1, 2, 2, 1},
+			expectedInsts: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpHash, 1),
+				code.Make(code.OpConstant, 2),
+				code.Make(code.OpConstant, 3),
+				code.Make(code.OpSub),
+				code.Make(code.OpIndex),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestHashLiterals(t *testing.T) {
+	tests := []CompilerTestCase{
+		{
+			input:         `{1 + 1: 2 * 2, 3 + 3: 4 * 4}`,
+			expectedConst: []interface{}{1, 1, 2, 2, 3, 3, 4, 4},
+			expectedInsts: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpAdd),
+				code.Make(code.OpConstant, 2),
+				code.Make(code.OpConstant, 3),
+				code.Make(code.OpMul),
+				code.Make(code.OpConstant, 4),
+				code.Make(code.OpConstant, 5),
+				code.Make(code.OpAdd),
+				code.Make(code.OpConstant, 6),
+				code.Make(code.OpConstant, 7),
+				code.Make(code.OpMul),
+				code.Make(code.OpHash, 2),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:         "{1: 2 + 3, 4: 5 * 6}",
+			expectedConst: []interface{}{1, 2, 3, 4, 5, 6},
+			expectedInsts: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpConstant, 2),
+				code.Make(code.OpAdd),
+				code.Make(code.OpConstant, 3),
+				code.Make(code.OpConstant, 4),
+				code.Make(code.OpConstant, 5),
+				code.Make(code.OpMul),
+				code.Make(code.OpHash, 2),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestArrayLiterls(t *testing.T) {
+	tests := []CompilerTestCase{
+		{
+			input:         `[]`,
+			expectedConst: []interface{}{},
+			expectedInsts: []code.Instructions{
+				code.Make(code.OpArray, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:         `[1, 2, 3, 4]`,
+			expectedConst: []interface{}{1, 2, 3, 4},
+			expectedInsts: []code.Instructions{
+				code.Make(code.OpConstant, 0),
 				code.Make(code.OpConstant, 1),
 				code.Make(code.OpConstant, 2),
 				code.Make(code.OpConstant, 3),
@@ -498,6 +966,28 @@ func TestConditionals(t *testing.T) {
 				code.Make(code.OpPop),
 			},
 		},
+		{
+			input:         "if (true) { let a = 1; }",
+			expectedConst: []interface{}{1},
+			expectedInsts: []code.Instructions{
+				// 0000
+				code.Make(code.OpTrue),
+				// 0001
+				code.Make(code.OpJumpNotTruthy, 14),
+				// 0004
+				code.Make(code.OpConstant, 0),
+				// 0007
+				code.Make(code.OpSetGlobal, 0),
+				// 0010
+				code.Make(code.OpNull),
+				// 0011
+				code.Make(code.OpJump, 15),
+				// 0014
+				code.Make(code.OpNull),
+				// 0015
+				code.Make(code.OpPop),
+			},
+		},
 		{
 			input:         "if (true) { 10 };",
 			expectedConst: []interface{}{10},
@@ -518,7 +1008,467 @@ func TestConditionals(t *testing.T) {
 		},
 	}
 
-	runCompilerTests(t, tests)
+	runCompilerTests(t, tests)
+}
+
+func TestWhileStatements(t *testing.T) {
+	tests := []CompilerTestCase{
+		{
+			input:         "while (true) { 10 }; 3333;",
+			expectedConst: []interface{}{10, 3333},
+			expectedInsts: []code.Instructions{
+				// 0000
+				code.Make(code.OpTrue),
+				// 0001
+				code.Make(code.OpJumpNotTruthy, 11),
+				// 0004
+				code.Make(code.OpConstant, 0),
+				// 0007
+				code.Make(code.OpPop),
+				// 0008
+				code.Make(code.OpJump, 0),
+				// 0011
+				code.Make(code.OpNull),
+				// 0012
+				code.Make(code.OpPop),
+				// 0013
+				code.Make(code.OpConstant, 1),
+				// 0016
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:         "if (true) { while (false) { } }",
+			expectedConst: []interface{}{},
+			expectedInsts: []code.Instructions{
+				// 0000
+				code.Make(code.OpTrue),
+				// 0001
+				code.Make(code.OpJumpNotTruthy, 15),
+				// 0004
+				code.Make(code.OpFalse),
+				// 0005
+				code.Make(code.OpJumpNotTruthy, 11),
+				// 0008
+				code.Make(code.OpJump, 4),
+				// 0011
+				code.Make(code.OpNull),
+				// 0012
+				code.Make(code.OpJump, 16),
+				// 0015
+				code.Make(code.OpNull),
+				// 0016
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input: "fn() { while (false) { } }",
+			expectedConst: []interface{}{
+				[]code.Instructions{
+					code.Make(code.OpFalse),
+					code.Make(code.OpJumpNotTruthy, 7),
+					code.Make(code.OpJump, 0),
+					code.Make(code.OpNull),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInsts: []code.Instructions{
+				code.Make(code.OpClosure, 0, 0),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+
+	// The peephole drops the test of a constant true condition, and the
+	// jump back lands on the body.
+	runCompilerTestsWithOptions(t, []CompilerTestCase{
+		{
+			input:         "while (true) { 10 }",
+			expectedConst: []interface{}{10},
+			expectedInsts: []code.Instructions{
+				// 0000
+				code.Make(code.OpConstant, 0),
+				// 0003
+				code.Make(code.OpPop),
+				// 0004
+				code.Make(code.OpJump, 0),
+			},
+		},
+	})
+}
+
+func TestForStatements(t *testing.T) {
+	tests := []CompilerTestCase{
+		{
+			input:         "for (x in [1, 2]) { x }",
+			expectedConst: []interface{}{1, 2},
+			expectedInsts: []code.Instructions{
+				// 0000
+				code.Make(code.OpConstant, 0),
+				// 0003
+				code.Make(code.OpConstant, 1),
+				// 0006
+				code.Make(code.OpArray, 2),
+				// 0009
+				code.Make(code.OpIter),
+				// 0010
+				code.Make(code.OpIterNext, 24, 1),
+				// 0014
+				code.Make(code.OpSetGlobal, 0),
+				// 0017
+				code.Make(code.OpGetGlobal, 0),
+				// 0020
+				code.Make(code.OpPop),
+				// 0021
+				code.Make(code.OpJump, 10),
+				// 0024
+				code.Make(code.OpNull),
+				// 0025
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input: "fn(xs) { for (i, x in xs) { x } }",
+			expectedConst: []interface{}{
+				[]code.Instructions{
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpIter),
+					code.Make(code.OpIterNext, 17, 2),
+					code.Make(code.OpSetLocal, 1),
+					code.Make(code.OpSetLocal, 2),
+					code.Make(code.OpGetLocal, 1),
+					code.Make(code.OpPop),
+					code.Make(code.OpJump, 3),
+					code.Make(code.OpNull),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInsts: []code.Instructions{
+				code.Make(code.OpClosure, 0, 0),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestBreakAndContinue(t *testing.T) {
+	tests := []CompilerTestCase{
+		{
+			input:         "while (true) { break; }",
+			expectedConst: []interface{}{},
+			expectedInsts: []code.Instructions{
+				// 0000
+				code.Make(code.OpTrue),
+				// 0001
+				code.Make(code.OpJumpNotTruthy, 10),
+				// 0004
+				code.Make(code.OpJump, 10),
+				// 0007
+				code.Make(code.OpJump, 0),
+				// 0010
+				code.Make(code.OpNull),
+				// 0011
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:         "while (true) { continue; }",
+			expectedConst: []interface{}{},
+			expectedInsts: []code.Instructions{
+				// 0000
+				code.Make(code.OpTrue),
+				// 0001
+				code.Make(code.OpJumpNotTruthy, 10),
+				// 0004
+				code.Make(code.OpJump, 0),
+				// 0007
+				code.Make(code.OpJump, 0),
+				// 0010
+				code.Make(code.OpNull),
+				// 0011
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:         "for (x in []) { if (x) { continue } else { break } }",
+			expectedConst: []interface{}{},
+			expectedInsts: []code.Instructions{
+				// 0000
+				code.Make(code.OpArray, 0),
+				// 0003
+				code.Make(code.OpIter),
+				// 0004
+				code.Make(code.OpIterNext, 31, 1),
+				// 0008
+				code.Make(code.OpSetGlobal, 0),
+				// 0011
+				code.Make(code.OpGetGlobal, 0),
+				// 0014
+				code.Make(code.OpJumpNotTruthy, 23),
+				// 0017
+				code.Make(code.OpJump, 4),
+				// 0020
+				code.Make(code.OpJump, 27),
+				// 0023
+				code.Make(code.OpPop),
+				// 0024
+				code.Make(code.OpJump, 31),
+				// 0027
+				code.Make(code.OpPop),
+				// 0028
+				code.Make(code.OpJump, 4),
+				// 0031
+				code.Make(code.OpNull),
+				// 0032
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestBreakAndContinueErrors(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"break;", "1:1: break outside of a loop"},
+		{"if (true) { continue }", "1:13: continue outside of a loop"},
+		{"while (true) { fn() { break } }", "1:23: break outside of a loop"},
+		{"while (true) { 1 + if (true) { break } }", "1:32: break inside an operand of an expression"},
+		{"for (x in []) { [x, if (x) { continue }] }", "1:30: continue inside an operand of an expression"},
+	}
+
+	for _, tt := range tests {
+		compiler := New()
+		err := compiler.Compile(parse(tt.input))
+		if err == nil {
+			t.Fatalf("expected compiler error for %q but resulted in none.", tt.input)
+		}
+
+		if err.Error() != tt.expected {
+			t.Errorf("wrong compiler error: want=%q, got=%q", tt.expected, err)
+		}
+	}
+}
+
+func TestAssignments(t *testing.T) {
+	tests := []CompilerTestCase{
+		{
+			input:         "let a = 1; a = 2;",
+			expectedConst: []interface{}{1, 2},
+			expectedInsts: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input: "fn() { let a = 1; a = 2 }",
+			expectedConst: []interface{}{
+				1,
+				2,
+				[]code.Instructions{
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpSetLocal, 0),
+					code.Make(code.OpConstant, 1),
+					code.Make(code.OpSetLocal, 0),
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInsts: []code.Instructions{
+				code.Make(code.OpClosure, 2, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:         "let a = [1]; a[0] = 2;",
+			expectedConst: []interface{}{1, 0, 2},
+			expectedInsts: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpArray, 1),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpConstant, 2),
+				code.Make(code.OpSetIndex),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:         "let a = 1; a += 2;",
+			expectedConst: []interface{}{1, 2},
+			expectedInsts: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpAdd),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input: "fn() { let a = 1; a %= 2 }",
+			expectedConst: []interface{}{
+				1,
+				2,
+				[]code.Instructions{
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpSetLocal, 0),
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpConstant, 1),
+					code.Make(code.OpMod),
+					code.Make(code.OpSetLocal, 0),
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInsts: []code.Instructions{
+				code.Make(code.OpClosure, 2, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			// The collection and index are evaluated once and duplicated
+			// for the read.
+			input:         "let a = [1]; a[0] -= 2;",
+			expectedConst: []interface{}{1, 0, 2},
+			expectedInsts: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpArray, 1),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpDup2),
+				code.Make(code.OpIndex),
+				code.Make(code.OpConstant, 2),
+				code.Make(code.OpSub),
+				code.Make(code.OpSetIndex),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+
+	// The peephole keeps an assigned value on the stack only when it is
+	// used.
+	runCompilerTestsWithOptions(t, []CompilerTestCase{
+		{
+			input:         "let a = 1; a = 2; let b = a = 3;",
+			expectedConst: []interface{}{1, 2, 3},
+			expectedInsts: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpConstant, 2),
+				code.Make(code.OpDup),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpSetGlobal, 1),
+			},
+		},
+	})
+}
+
+func TestCells(t *testing.T) {
+	tests := []CompilerTestCase{
+		{
+			// A captured local lives in a cell, which the closure
+			// captures and assigns through.
+			input: "fn() { let n = 0; fn() { n += 1 } }",
+			expectedConst: []interface{}{
+				0,
+				1,
+				[]code.Instructions{
+					code.Make(code.OpGetFreeCell, 0),
+					code.Make(code.OpConstant, 1),
+					code.Make(code.OpAdd),
+					code.Make(code.OpSetFreeCell, 0),
+					code.Make(code.OpGetFreeCell, 0),
+					code.Make(code.OpReturnValue),
+				},
+				[]code.Instructions{
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpSetCell, 0),
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpClosure, 2, 1),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInsts: []code.Instructions{
+				code.Make(code.OpClosure, 3, 0),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+
+	cellTests := []struct {
+		input    string
+		expected []int
+	}{
+		{"fn(a, b) { let c = 1; let d = 2; fn() { b + d } }", []int{1, 3}},
+		{"fn(a) { fn(a) { a } }", []int{}},
+		{"fn() { let f = fn() { f }; f }", []int{0}},
+		{"fn(x) { for (y in x) { fn() { y } } }", []int{1}},
+	}
+
+	for _, tt := range cellTests {
+		compiler := New()
+		err := compiler.Compile(parse(tt.input))
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		var fn *object.CompiledFunction
+		for _, con := range compiler.Bytecode().Constants {
+			if f, ok := con.(*object.CompiledFunction); ok {
+				fn = f
+			}
+		}
+		if !slices.Equal(fn.Cells, tt.expected) {
+			t.Errorf("%q: wrong cells. want=%v, got=%v", tt.input, tt.expected, fn.Cells)
+		}
+	}
+}
+
+func TestAssignmentErrors(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"a = 1;", "1:1: variable a is undefined"},
+		{"len = 1;", "1:1: cannot assign to builtin len"},
+		{"a *= 2;", "1:1: variable a is undefined"},
+		{"while (true) { let a = 1; a += if (true) { continue } }", "1:44: continue inside an operand of an expression"},
+		{"while (true) { 1 + (true && if (true) { break }) }", "1:41: break inside an operand of an expression"},
+		{"while (true) { let a = [0]; a[0] = if (true) { break } }", "1:48: break inside an operand of an expression"},
+	}
+
+	for _, tt := range tests {
+		compiler := New()
+		err := compiler.Compile(parse(tt.input))
+		if err == nil {
+			t.Fatalf("expected compiler error for %q but resulted in none.", tt.input)
+		}
+
+		if err.Error() != tt.expected {
+			t.Errorf("wrong compiler error: want=%q, got=%q", tt.expected, err)
+		}
+	}
 }
 
 func TestIntegerArithemtic(t *testing.T) {
@@ -563,6 +1513,16 @@ func TestIntegerArithemtic(t *testing.T) {
 				code.Make(code.OpPop),
 			},
 		},
+		{
+			input:         "7 % 3",
+			expectedConst: []interface{}{7, 3},
+			expectedInsts: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpMod),
+				code.Make(code.OpPop),
+			},
+		},
 		{
 			input:         "5; 3",
 			expectedConst: []interface{}{5, 3},
@@ -609,6 +1569,72 @@ func TestIntegerArithemtic(t *testing.T) {
 	runCompilerTests(t, tests)
 }
 
+func TestLogicalExpressions(t *testing.T) {
+	tests := []CompilerTestCase{
+		{
+			input:         "1 && 2; 3",
+			expectedConst: []interface{}{1, 2, 3},
+			expectedInsts: []code.Instructions{
+				// 0000
+				code.Make(code.OpConstant, 0),
+				// 0003
+				code.Make(code.OpDup),
+				// 0004
+				code.Make(code.OpJumpNotTruthy, 11),
+				// 0007
+				code.Make(code.OpPop),
+				// 0008
+				code.Make(code.OpConstant, 1),
+				// 0011
+				code.Make(code.OpPop),
+				// 0012
+				code.Make(code.OpConstant, 2),
+				// 0015
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:         "1 || 2; 3",
+			expectedConst: []interface{}{1, 2, 3},
+			expectedInsts: []code.Instructions{
+				// 0000
+				code.Make(code.OpConstant, 0),
+				// 0003
+				code.Make(code.OpDup),
+				// 0004
+				code.Make(code.OpJumpNotTruthy, 10),
+				// 0007
+				code.Make(code.OpJump, 14),
+				// 0010
+				code.Make(code.OpPop),
+				// 0011
+				code.Make(code.OpConstant, 1),
+				// 0014
+				code.Make(code.OpPop),
+				// 0015
+				code.Make(code.OpConstant, 2),
+				// 0018
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+
+	runCompilerTestsWithOptions(t, []CompilerTestCase{
+		{
+			input:         "1 && false || 2; 0 || 3 && 4",
+			expectedConst: []interface{}{2, 0},
+			expectedInsts: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpPop),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpPop),
+			},
+		},
+	})
+}
+
 func TestBooleanExpressions(t *testing.T) {
 	tests := []CompilerTestCase{
 		{
@@ -709,6 +1735,306 @@ func TestBooleanExpressions(t *testing.T) {
 	runCompilerTests(t, tests)
 }
 
+func TestConstantFolding(t *testing.T) {
+	tests := []CompilerTestCase{
+		{
+			input:         "1 + 2",
+			expectedConst: []interface{}{3},
+			expectedInsts: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:         "(5 + 10 * 2 + 15 / 3) * 2 + -10",
+			expectedConst: []interface{}{50},
+			expectedInsts: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:         "17 % 5 * 3",
+			expectedConst: []interface{}{6},
+			expectedInsts: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:         "-5",
+			expectedConst: []interface{}{-5},
+			expectedInsts: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:         `"mon" + "key" + "banana"`,
+			expectedConst: []interface{}{"monkeybanana"},
+			expectedInsts: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:         "!true; !!5; 1 < 2; 2 > 3; true != false; (1 < 2) == true",
+			expectedConst: []interface{}{},
+			expectedInsts: []code.Instructions{
+				code.Make(code.OpFalse),
+				code.Make(code.OpPop),
+				code.Make(code.OpTrue),
+				code.Make(code.OpPop),
+				code.Make(code.OpTrue),
+				code.Make(code.OpPop),
+				code.Make(code.OpFalse),
+				code.Make(code.OpPop),
+				code.Make(code.OpTrue),
+				code.Make(code.OpPop),
+				code.Make(code.OpTrue),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:         "let x = 2; x * (3 + 4)",
+			expectedConst: []interface{}{2, 7},
+			expectedInsts: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpMul),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			// Left for the VM to report at run time.
+			input:         `1 / 0; 1 % 0; 1 + true; -"a"; "a" == "a"`,
+			expectedConst: []interface{}{1, 0, 1, 0, 1, "a", "a", "a"},
+			expectedInsts: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpDiv),
+				code.Make(code.OpPop),
+				code.Make(code.OpConstant, 2),
+				code.Make(code.OpConstant, 3),
+				code.Make(code.OpMod),
+				code.Make(code.OpPop),
+				code.Make(code.OpConstant, 4),
+				code.Make(code.OpTrue),
+				code.Make(code.OpAdd),
+				code.Make(code.OpPop),
+				code.Make(code.OpConstant, 5),
+				code.Make(code.OpMinus),
+				code.Make(code.OpPop),
+				code.Make(code.OpConstant, 6),
+				code.Make(code.OpConstant, 7),
+				code.Make(code.OpEqual),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTestsWithOptions(t, tests, FoldConstants(true), DeduplicateConstants(false), Peephole(false))
+}
+
+func TestConstantDeduplication(t *testing.T) {
+	tests := []CompilerTestCase{
+		{
+			input:         `1; 2; 1; "a"; "b"; "a"; 2`,
+			expectedConst: []interface{}{1, 2, "a", "b"},
+			expectedInsts: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpPop),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpPop),
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpPop),
+				code.Make(code.OpConstant, 2),
+				code.Make(code.OpPop),
+				code.Make(code.OpConstant, 3),
+				code.Make(code.OpPop),
+				code.Make(code.OpConstant, 2),
+				code.Make(code.OpPop),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input: `fn(a) { a + 1 }; fn(b) { b + 1 }; fn(c) { c + 2 }`,
+			expectedConst: []interface{}{
+				1,
+				[]code.Instructions{
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpAdd),
+					code.Make(code.OpReturnValue),
+				},
+				2,
+				[]code.Instructions{
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpConstant, 2),
+					code.Make(code.OpAdd),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInsts: []code.Instructions{
+				code.Make(code.OpClosure, 1, 0),
+				code.Make(code.OpPop),
+				code.Make(code.OpClosure, 1, 0),
+				code.Make(code.OpPop),
+				code.Make(code.OpClosure, 3, 0),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTestsWithOptions(t, tests, FoldConstants(false), DeduplicateConstants(true), Peephole(false))
+}
+
+func TestConstantDeduplicationAcrossState(t *testing.T) {
+	symbolTable := NewSymbolTable()
+	constants := []object.Object{}
+
+	for _, input := range []string{`1 + "a"`, `"a" + 1`, `1; 1; 1`, `fn(x) { x }`, `fn(x) { x }`} {
+		compiler := NewWithState(symbolTable, constants)
+		err := compiler.Compile(parse(input))
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+		constants = compiler.Bytecode().Constants
+	}
+
+	err := testConstants([]interface{}{
+		1,
+		"a",
+		[]code.Instructions{
+			code.Make(code.OpGetLocal, 0),
+			code.Make(code.OpReturnValue),
+		},
+	}, constants)
+	if err != nil {
+		t.Fatalf("testConstants failed: %s", err)
+	}
+}
+
+func TestPositions(t *testing.T) {
+	input := `let x = 1;
+let f = fn(a) {
+  a + x
+};
+f(2);`
+
+	compiler := New()
+	err := compiler.Compile(parse(input))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+	bytecode := compiler.Bytecode()
+
+	err = testPositions([]string{
+		"OpConstant 1:9-1:10",
+		"OpSetGlobal 1:1-1:10",
+		"OpClosure 2:9-4:2",
+		// The peephole optimiser turned OpSetGlobal; OpGetGlobal for
+		// the f in f(2) into OpDup; OpSetGlobal.
+		"OpDup 2:1-4:2",
+		"OpSetGlobal 2:1-4:2",
+		"OpConstant 5:3-5:4",
+		"OpCall 5:1-5:5",
+		"OpPop 5:1-5:5",
+	}, bytecode.Instructions, bytecode.Positions)
+	if err != nil {
+		t.Errorf("main: %s", err)
+	}
+
+	fn := bytecode.Constants[1].(*object.CompiledFunction)
+	if fn.Name != "f" {
+		t.Errorf("wrong function name. want=%q, got=%q", "f", fn.Name)
+	}
+	err = testPositions([]string{
+		"OpGetLocal 3:3-3:4",
+		"OpGetGlobal 3:7-3:8",
+		"OpAdd 3:3-3:8",
+		"OpReturnValue 4:1-4:2",
+	}, fn.Instructions, fn.Positions)
+	if err != nil {
+		t.Errorf("function: %s", err)
+	}
+}
+
+func TestClosureVariants(t *testing.T) {
+	input := `[fn() { fn(a) { a } },
+ fn() { fn(b) { b } },
+ fn() { fn(a) { a } }]`
+
+	compiler := New()
+	err := compiler.Compile(parse(input))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+	bytecode := compiler.Bytecode()
+
+	// The inner and the outer functions are shared; the closures made on
+	// lines 2 and 3 are made of variants of them.
+	if len(bytecode.Constants) != 2 {
+		t.Fatalf("wrong number of constants. want=2, got=%d", len(bytecode.Constants))
+	}
+	outer := bytecode.Constants[1].(*object.CompiledFunction)
+
+	if len(bytecode.Variants) != 2 {
+		t.Fatalf("wrong variants of main: %v", bytecode.Variants)
+	}
+	variant, ok := bytecode.Variants[4]
+	if !ok {
+		t.Fatalf("no variant for the OpClosure at 4: %v", bytecode.Variants)
+	}
+	if &variant.Instructions[0] != &outer.Instructions[0] {
+		t.Errorf("variant does not share the instructions of its constant")
+	}
+	err = testPositions([]string{
+		"OpClosure 2:9-2:20",
+		"OpReturnValue 2:21-2:22",
+	}, variant.Instructions, variant.Positions)
+	if err != nil {
+		t.Errorf("outer variant: %s", err)
+	}
+
+	inner, ok := variant.Variants[0]
+	if !ok || len(variant.Variants) != 1 {
+		t.Fatalf("wrong variants of the outer variant: %v", variant.Variants)
+	}
+	if !slices.Equal(inner.LocalNames, []string{"b"}) {
+		t.Errorf("wrong local names. want=[b], got=%q", inner.LocalNames)
+	}
+	err = testPositions([]string{
+		"OpGetLocal 2:17-2:18",
+		"OpReturnValue 2:19-2:20",
+	}, inner.Instructions, inner.Positions)
+	if err != nil {
+		t.Errorf("inner variant: %s", err)
+	}
+}
+
+// testPositions checks the opcode and span of every instruction.
+func testPositions(expected []string, ins code.Instructions, positions code.PositionTable) error {
+	actual := []string{}
+	for offset := 0; offset < len(ins); {
+		def, _, width, err := ins.ReadInstruction(offset)
+		if err != nil {
+			return err
+		}
+		span, _ := positions.Lookup(offset)
+		actual = append(actual, fmt.Sprintf("%s %s-%s", def.Name, span.Start, span.End))
+		offset += width
+	}
+
+	if strings.Join(actual, "\n") != strings.Join(expected, "\n") {
+		return fmt.Errorf("wrong positions.\nwant=%q\ngot =%q", expected, actual)
+	}
+	return nil
+}
+
 func TestCompilerScopes(t *testing.T) {
 	compiler := New()
 	if compiler.scopeIdx != 0 {
@@ -775,10 +2101,16 @@ func TestCompilerScopes(t *testing.T) {
 func runCompilerTests(t *testing.T, tests []CompilerTestCase) {
 	t.Helper()
 
+	runCompilerTestsWithOptions(t, tests, FoldConstants(false), DeduplicateConstants(false), Peephole(false))
+}
+
+func runCompilerTestsWithOptions(t *testing.T, tests []CompilerTestCase, opts ...Option) {
+	t.Helper()
+
 	for _, tt := range tests {
 		program := parse(tt.input)
 
-		compiler := New()
+		compiler := New(opts...)
 		err := compiler.Compile(program)
 		if err != nil {
 			t.Fatalf("compiler error: %s", err)
@@ -0,0 +1,409 @@
+package compiler
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"karaoke/code"
+	"karaoke/object"
+	"karaoke/token"
+	"maps"
+	"slices"
+)
+
+// A serialised Bytecode starts with a fixed header:
+//
+//	magic    [4]byte  "MKC\x00"
+//	version  uint16
+//	length   uint32   size of the payload in bytes
+//	checksum uint32   CRC-32 (IEEE) of the payload
+//
+// The payload holds the main instructions, their position table, the
+// names of the globals and the variants of the closures the main program
+// makes, followed by the constant pool. Each constant is written as a one byte
+// tag and its tag specific data. All integers are big endian, like the
+// operands in code.Instructions.
+//
+// Version 2 added function names and position tables, version 3 the
+// names of globals and locals, version 4 the locals of functions held in
+// cells, version 5 variants. A variant is written as the offset of its
+// OpClosure, its positions, its local names and its own variants; the
+// rest it takes from the constant the OpClosure names.
+
+const BytecodeVersion uint16 = 5
+
+var bytecodeMagic = [4]byte{'M', 'K', 'C', 0}
+
+const headerSize = 4 + 2 + 4 + 4
+
+// MaxPayloadSize is the largest payload ReadBytecode accepts. The length
+// in the header is checked against it before the payload is read, and the
+// payload grows only as far as there are bytes to read.
+const MaxPayloadSize = 64 << 20
+
+// Constant tags. New constant types get a new tag; existing tags must
+// never change meaning.
+const (
+	tagInteger byte = iota + 1
+	tagString
+	tagCompiledFunction
+)
+
+var ErrBadMagic = errors.New("not a bytecode file")
+
+// WriteTo serialises the bytecode to w.
+func (b *Bytecode) WriteTo(w io.Writer) (int64, error) {
+	var payload bytes.Buffer
+
+	writeInstructions(&payload, b.Instructions)
+	writePositions(&payload, b.Positions)
+	writeStrings(&payload, b.GlobalNames)
+	writeVariants(&payload, b.Variants)
+
+	binary.Write(&payload, binary.BigEndian, uint32(len(b.Constants)))
+	for i, con := range b.Constants {
+		err := writeConstant(&payload, con)
+		if err != nil {
+			return 0, fmt.Errorf("constant %d: %w", i, err)
+		}
+	}
+
+	header := make([]byte, headerSize)
+	copy(header, bytecodeMagic[:])
+	binary.BigEndian.PutUint16(header[4:], BytecodeVersion)
+	binary.BigEndian.PutUint32(header[6:], uint32(payload.Len()))
+	binary.BigEndian.PutUint32(header[10:], crc32.ChecksumIEEE(payload.Bytes()))
+
+	n, err := w.Write(header)
+	if err != nil {
+		return int64(n), err
+	}
+
+	m, err := w.Write(payload.Bytes())
+	return int64(n + m), err
+}
+
+// ReadBytecode deserialises bytecode written by Bytecode.WriteTo. It
+// rejects files with a wrong magic, an unknown version, a payload larger
+// than MaxPayloadSize or a checksum mismatch.
+func ReadBytecode(r io.Reader) (*Bytecode, error) {
+	header := make([]byte, headerSize)
+	_, err := io.ReadFull(r, header)
+	if err != nil {
+		return nil, fmt.Errorf("reading header: %w", err)
+	}
+
+	if !bytes.Equal(header[:4], bytecodeMagic[:]) {
+		return nil, ErrBadMagic
+	}
+
+	version := binary.BigEndian.Uint16(header[4:])
+	if version != BytecodeVersion {
+		return nil, fmt.Errorf("unsupported bytecode version %d, want %d",
+			version, BytecodeVersion)
+	}
+
+	length := binary.BigEndian.Uint32(header[6:])
+	checksum := binary.BigEndian.Uint32(header[10:])
+
+	if length > MaxPayloadSize {
+		return nil, fmt.Errorf("payload of %d bytes exceeds the maximum of %d", length, MaxPayloadSize)
+	}
+
+	payload, err := io.ReadAll(io.LimitReader(r, int64(length)))
+	if err == nil && len(payload) < int(length) {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading payload: %w", err)
+	}
+
+	if crc32.ChecksumIEEE(payload) != checksum {
+		return nil, errors.New("bytecode checksum mismatch")
+	}
+
+	d := &decoder{buf: payload}
+
+	bc := &Bytecode{}
+	bc.Instructions = d.instructions()
+	bc.Positions = d.positions()
+	bc.GlobalNames = d.strings()
+	bc.Variants = d.variants()
+
+	numConsts := d.uint32()
+	for i := uint32(0); i < numConsts && d.err == nil; i++ {
+		bc.Constants = append(bc.Constants, d.constant())
+	}
+
+	d.completeVariants(bc.Instructions, bc.Variants, bc.Constants)
+	for _, con := range bc.Constants {
+		if fn, ok := con.(*object.CompiledFunction); ok {
+			d.completeVariants(fn.Instructions, fn.Variants, bc.Constants)
+		}
+	}
+
+	if d.err != nil {
+		return nil, d.err
+	}
+	if len(d.buf) != 0 {
+		return nil, fmt.Errorf("%d trailing bytes after constant pool", len(d.buf))
+	}
+
+	return bc, nil
+}
+
+func writeInstructions(buf *bytes.Buffer, ins code.Instructions) {
+	binary.Write(buf, binary.BigEndian, uint32(len(ins)))
+	buf.Write(ins)
+}
+
+func writeString(buf *bytes.Buffer, s string) {
+	binary.Write(buf, binary.BigEndian, uint32(len(s)))
+	buf.WriteString(s)
+}
+
+func writeStrings(buf *bytes.Buffer, ss []string) {
+	binary.Write(buf, binary.BigEndian, uint32(len(ss)))
+	for _, s := range ss {
+		writeString(buf, s)
+	}
+}
+
+func writePositions(buf *bytes.Buffer, positions code.PositionTable) {
+	binary.Write(buf, binary.BigEndian, uint32(len(positions)))
+	for _, entry := range positions {
+		binary.Write(buf, binary.BigEndian, uint32(entry.Offset))
+		writePosition(buf, entry.Span.Start)
+		writePosition(buf, entry.Span.End)
+	}
+}
+
+func writePosition(buf *bytes.Buffer, pos token.Position) {
+	writeString(buf, pos.File)
+	binary.Write(buf, binary.BigEndian, uint32(pos.Line))
+	binary.Write(buf, binary.BigEndian, uint32(pos.Column))
+}
+
+func writeConstant(buf *bytes.Buffer, con object.Object) error {
+	switch con := con.(type) {
+	case *object.Integer:
+		buf.WriteByte(tagInteger)
+		binary.Write(buf, binary.BigEndian, con.Value)
+
+	case *object.String:
+		buf.WriteByte(tagString)
+		writeString(buf, con.Value)
+
+	case *object.CompiledFunction:
+		buf.WriteByte(tagCompiledFunction)
+		binary.Write(buf, binary.BigEndian, uint32(con.NumLocals))
+		binary.Write(buf, binary.BigEndian, uint32(con.NumParameters))
+		writeString(buf, con.Name)
+		writeInstructions(buf, con.Instructions)
+		writePositions(buf, con.Positions)
+		writeStrings(buf, con.LocalNames)
+		binary.Write(buf, binary.BigEndian, uint32(len(con.Cells)))
+		for _, idx := range con.Cells {
+			binary.Write(buf, binary.BigEndian, uint32(idx))
+		}
+		writeVariants(buf, con.Variants)
+
+	default:
+		return fmt.Errorf("cannot serialise constant of type %s", con.Type())
+	}
+
+	return nil
+}
+
+func writeVariants(buf *bytes.Buffer, variants map[int]*object.CompiledFunction) {
+	binary.Write(buf, binary.BigEndian, uint32(len(variants)))
+	for _, offset := range slices.Sorted(maps.Keys(variants)) {
+		variant := variants[offset]
+		binary.Write(buf, binary.BigEndian, uint32(offset))
+		writePositions(buf, variant.Positions)
+		writeStrings(buf, variant.LocalNames)
+		writeVariants(buf, variant.Variants)
+	}
+}
+
+// decoder reads from buf until the first error, after which every read
+// returns a zero value and err holds the cause.
+type decoder struct {
+	buf []byte
+	err error
+}
+
+func (d *decoder) next(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if len(d.buf) < n {
+		d.err = io.ErrUnexpectedEOF
+		return nil
+	}
+
+	b := d.buf[:n]
+	d.buf = d.buf[n:]
+	return b
+}
+
+func (d *decoder) byte() byte {
+	b := d.next(1)
+	if b == nil {
+		return 0
+	}
+	return b[0]
+}
+
+func (d *decoder) uint32() uint32 {
+	b := d.next(4)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint32(b)
+}
+
+func (d *decoder) int64() int64 {
+	b := d.next(8)
+	if b == nil {
+		return 0
+	}
+	return int64(binary.BigEndian.Uint64(b))
+}
+
+func (d *decoder) instructions() code.Instructions {
+	n := d.uint32()
+	return append(code.Instructions{}, d.next(int(n))...)
+}
+
+func (d *decoder) string() string {
+	n := d.uint32()
+	return string(d.next(int(n)))
+}
+
+func (d *decoder) strings() []string {
+	n := d.uint32()
+
+	ss := []string{}
+	for i := uint32(0); i < n && d.err == nil; i++ {
+		ss = append(ss, d.string())
+	}
+	return ss
+}
+
+// cells reads the slots of the locals held in cells of a function with
+// numLocals locals.
+func (d *decoder) cells(numLocals int) []int {
+	n := d.uint32()
+
+	cells := []int{}
+	for i := uint32(0); i < n && d.err == nil; i++ {
+		idx := int(d.uint32())
+		if idx >= numLocals && d.err == nil {
+			d.err = fmt.Errorf("cell slot %d out of range", idx)
+		}
+		cells = append(cells, idx)
+	}
+	return cells
+}
+
+func (d *decoder) positions() code.PositionTable {
+	n := d.uint32()
+
+	var positions code.PositionTable
+	for i := uint32(0); i < n && d.err == nil; i++ {
+		entry := code.PositionEntry{Offset: int(d.uint32())}
+		entry.Span.Start = d.position()
+		entry.Span.End = d.position()
+		positions = append(positions, entry)
+	}
+	return positions
+}
+
+// variants reads the variants of the closures a function makes. They
+// are completed by completeVariants once the constants are read.
+func (d *decoder) variants() map[int]*object.CompiledFunction {
+	n := d.uint32()
+
+	var variants map[int]*object.CompiledFunction
+	for i := uint32(0); i < n && d.err == nil; i++ {
+		if variants == nil {
+			variants = map[int]*object.CompiledFunction{}
+		}
+		offset := int(d.uint32())
+		variants[offset] = &object.CompiledFunction{
+			Positions:  d.positions(),
+			LocalNames: d.strings(),
+			Variants:   d.variants(),
+		}
+	}
+	return variants
+}
+
+// completeVariants fills in the variants of the closures made by ins with
+// what they share with the constants their OpClosure names.
+func (d *decoder) completeVariants(ins code.Instructions, variants map[int]*object.CompiledFunction, constants []object.Object) {
+	for offset, variant := range variants {
+		if d.err != nil {
+			return
+		}
+
+		var fn *object.CompiledFunction
+		if offset < len(ins) && ins.OpcodeAt(offset) == code.OpClosure {
+			_, operands, _, err := ins.ReadInstruction(offset)
+			if err == nil && operands[0] < len(constants) {
+				fn, _ = constants[operands[0]].(*object.CompiledFunction)
+			}
+		}
+		if fn == nil {
+			d.err = fmt.Errorf("variant at %d is not made by an OpClosure of a function", offset)
+			return
+		}
+
+		variant.Instructions = fn.Instructions
+		variant.NumLocals = fn.NumLocals
+		variant.NumParameters = fn.NumParameters
+		variant.Name = fn.Name
+		variant.Cells = fn.Cells
+		d.completeVariants(variant.Instructions, variant.Variants, constants)
+	}
+}
+
+func (d *decoder) position() token.Position {
+	return token.Position{
+		File:   d.string(),
+		Line:   int(d.uint32()),
+		Column: int(d.uint32()),
+	}
+}
+
+func (d *decoder) constant() object.Object {
+	switch tag := d.byte(); tag {
+	case tagInteger:
+		return &object.Integer{Value: d.int64()}
+
+	case tagString:
+		return &object.String{Value: d.string()}
+
+	case tagCompiledFunction:
+		fn := &object.CompiledFunction{}
+		fn.NumLocals = int(d.uint32())
+		fn.NumParameters = int(d.uint32())
+		fn.Name = d.string()
+		fn.Instructions = d.instructions()
+		fn.Positions = d.positions()
+		fn.LocalNames = d.strings()
+		fn.Cells = d.cells(fn.NumLocals)
+		fn.Variants = d.variants()
+		return fn
+
+	default:
+		if d.err == nil {
+			d.err = fmt.Errorf("unknown constant tag %d", tag)
+		}
+		return nil
+	}
+}
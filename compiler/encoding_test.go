@@ -0,0 +1,170 @@
+package compiler
+
+import (
+	"bytes"
+	"encoding/binary"
+	"karaoke/object"
+	"reflect"
+	"testing"
+)
+
+func TestBytecodeRoundTrip(t *testing.T) {
+	input := `
+	let greet = fn(name) { "hello " + name };
+	let adder = fn(a) { fn(b) { a + b } };
+	greet("monkey");
+	adder(-40)(2);
+	let fs = [fn() { fn(x) { x + 1 } },
+	  fn() { fn(y) { y + 1 } }];
+	let pair = fn() { [fn(z) { z }, fn(w) { w }] };
+	`
+
+	comp := New()
+	err := comp.Compile(parse(input))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+	original := comp.Bytecode()
+
+	var buf bytes.Buffer
+	_, err = original.WriteTo(&buf)
+	if err != nil {
+		t.Fatalf("WriteTo failed: %s", err)
+	}
+
+	decoded, err := ReadBytecode(&buf)
+	if err != nil {
+		t.Fatalf("ReadBytecode failed: %s", err)
+	}
+
+	if !bytes.Equal(decoded.Instructions, original.Instructions) {
+		t.Errorf("instructions differ.\nwant=%q\ngot =%q",
+			original.Instructions, decoded.Instructions)
+	}
+
+	if !reflect.DeepEqual(decoded.GlobalNames, original.GlobalNames) {
+		t.Errorf("global names differ. want=%q, got=%q",
+			original.GlobalNames, decoded.GlobalNames)
+	}
+
+	if !reflect.DeepEqual(decoded.Positions, original.Positions) {
+		t.Errorf("positions differ.\nwant=%v\ngot =%v",
+			original.Positions, decoded.Positions)
+	}
+
+	if !reflect.DeepEqual(decoded.Variants, original.Variants) {
+		t.Errorf("variants differ.\nwant=%+v\ngot =%+v",
+			original.Variants, decoded.Variants)
+	}
+
+	if len(decoded.Constants) != len(original.Constants) {
+		t.Fatalf("wrong number of constants. want=%d, got=%d",
+			len(original.Constants), len(decoded.Constants))
+	}
+
+	for i, want := range original.Constants {
+		got := decoded.Constants[i]
+		switch want := want.(type) {
+		case *object.Integer:
+			err := testIntegerObject(want.Value, got)
+			if err != nil {
+				t.Errorf("constant %d: %s", i, err)
+			}
+		case *object.String:
+			err := testStringObject(want.Value, got)
+			if err != nil {
+				t.Errorf("constant %d: %s", i, err)
+			}
+		case *object.CompiledFunction:
+			fn, ok := got.(*object.CompiledFunction)
+			if !ok {
+				t.Errorf("constant %d - not a function: %T", i, got)
+				continue
+			}
+			if fn.NumLocals != want.NumLocals || fn.NumParameters != want.NumParameters {
+				t.Errorf("constant %d - wrong counts. want=%d/%d, got=%d/%d", i,
+					want.NumLocals, want.NumParameters, fn.NumLocals, fn.NumParameters)
+			}
+			if !bytes.Equal(fn.Instructions, want.Instructions) {
+				t.Errorf("constant %d - instructions differ.\nwant=%q\ngot =%q",
+					i, want.Instructions, fn.Instructions)
+			}
+			if fn.Name != want.Name {
+				t.Errorf("constant %d - wrong name. want=%q, got=%q", i, want.Name, fn.Name)
+			}
+			if !reflect.DeepEqual(fn.LocalNames, want.LocalNames) {
+				t.Errorf("constant %d - local names differ. want=%q, got=%q",
+					i, want.LocalNames, fn.LocalNames)
+			}
+			if !reflect.DeepEqual(fn.Variants, want.Variants) {
+				t.Errorf("constant %d - variants differ.\nwant=%+v\ngot =%+v",
+					i, want.Variants, fn.Variants)
+			}
+			if !reflect.DeepEqual(fn.Positions, want.Positions) {
+				t.Errorf("constant %d - positions differ.\nwant=%v\ngot =%v",
+					i, want.Positions, fn.Positions)
+			}
+		}
+	}
+}
+
+func TestReadBytecodeErrors(t *testing.T) {
+	var buf bytes.Buffer
+	bc := &Bytecode{Constants: []object.Object{&object.Integer{Value: 1}}}
+	_, err := bc.WriteTo(&buf)
+	if err != nil {
+		t.Fatalf("WriteTo failed: %s", err)
+	}
+	valid := buf.Bytes()
+
+	corrupt := func(f func(b []byte)) []byte {
+		b := append([]byte{}, valid...)
+		f(b)
+		return b
+	}
+
+	tests := []struct {
+		name     string
+		input    []byte
+		expected string
+	}{
+		{"magic", corrupt(func(b []byte) { b[0] = 'X' }), ErrBadMagic.Error()},
+		{"version", corrupt(func(b []byte) { b[5] = 99 }), "unsupported bytecode version 99, want 5"},
+		{"checksum", corrupt(func(b []byte) { b[len(b)-1] ^= 0xff }), "bytecode checksum mismatch"},
+		{"truncated", valid[:len(valid)-2], "reading payload: unexpected EOF"},
+		{"short", corrupt(func(b []byte) { binary.BigEndian.PutUint32(b[6:], 1<<20) }),
+			"reading payload: unexpected EOF"},
+		{"too large", corrupt(func(b []byte) { binary.BigEndian.PutUint32(b[6:], 0xffffffff) }),
+			"payload of 4294967295 bytes exceeds the maximum of 67108864"},
+	}
+
+	for _, tt := range tests {
+		_, err := ReadBytecode(bytes.NewReader(tt.input))
+		if err == nil {
+			t.Errorf("%s: expected error but got none", tt.name)
+			continue
+		}
+		if err.Error() != tt.expected {
+			t.Errorf("%s: wrong error. want=%q, got=%q", tt.name, tt.expected, err)
+		}
+	}
+
+	_, err = ReadBytecode(bytes.NewReader(valid))
+	if err != nil {
+		t.Errorf("valid input rejected: %s", err)
+	}
+}
+
+func TestWriteUnsupportedConstant(t *testing.T) {
+	bc := &Bytecode{Constants: []object.Object{&object.Boolean{Value: true}}}
+
+	_, err := bc.WriteTo(&bytes.Buffer{})
+	if err == nil {
+		t.Fatalf("expected error but got none")
+	}
+
+	expected := "constant 0: cannot serialise constant of type BOOLEAN"
+	if err.Error() != expected {
+		t.Errorf("wrong error. want=%q, got=%q", expected, err)
+	}
+}
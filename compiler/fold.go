@@ -0,0 +1,143 @@
+package compiler
+
+import (
+	"karaoke/ast"
+	"karaoke/object"
+)
+
+// evalConstant computes the value of exp when it is built only from
+// literals and prefix or infix operators on them, and reports whether it
+// could. Operations whose outcome is decided at run time, such as a
+// division by zero or an operator applied to the wrong types, are left
+// alone so the VM still reports them.
+func evalConstant(exp ast.Expression) (object.Object, bool) {
+	switch exp := exp.(type) {
+	case *ast.IntegerLiteral:
+		return &object.Integer{Value: exp.Value}, true
+
+	case *ast.StringLiteral:
+		return &object.String{Value: exp.Value}, true
+
+	case *ast.Boolean:
+		return &object.Boolean{Value: exp.Value}, true
+
+	case *ast.PrefixExpression:
+		right, ok := evalConstant(exp.Right)
+		if !ok {
+			return nil, false
+		}
+		return foldPrefix(exp.Operator, right)
+
+	case *ast.InfixExpression:
+		left, ok := evalConstant(exp.Left)
+		if !ok {
+			return nil, false
+		}
+		right, ok := evalConstant(exp.Right)
+		if !ok {
+			return nil, false
+		}
+		return foldInfix(exp.Operator, left, right)
+	}
+
+	return nil, false
+}
+
+// isTruthy reports whether a folded constant is truthy. Only false and
+// null are falsy and null has no literal.
+func isTruthy(obj object.Object) bool {
+	if b, ok := obj.(*object.Boolean); ok {
+		return b.Value
+	}
+	return true
+}
+
+func foldPrefix(operator string, right object.Object) (object.Object, bool) {
+	switch operator {
+	case "!":
+		return &object.Boolean{Value: !isTruthy(right)}, true
+
+	case "-":
+		if i, ok := right.(*object.Integer); ok {
+			return &object.Integer{Value: -i.Value}, true
+		}
+	}
+
+	return nil, false
+}
+
+func foldInfix(operator string, left, right object.Object) (object.Object, bool) {
+	switch operator {
+	case "&&":
+		if isTruthy(left) {
+			return right, true
+		}
+		return left, true
+	case "||":
+		if isTruthy(left) {
+			return left, true
+		}
+		return right, true
+	}
+
+	switch left := left.(type) {
+	case *object.Integer:
+		right, ok := right.(*object.Integer)
+		if !ok {
+			return nil, false
+		}
+		return foldIntegerInfix(operator, left.Value, right.Value)
+
+	case *object.String:
+		right, ok := right.(*object.String)
+		if !ok || operator != "+" {
+			return nil, false
+		}
+		return &object.String{Value: left.Value + right.Value}, true
+
+	case *object.Boolean:
+		right, ok := right.(*object.Boolean)
+		if !ok {
+			return nil, false
+		}
+		switch operator {
+		case "==":
+			return &object.Boolean{Value: left.Value == right.Value}, true
+		case "!=":
+			return &object.Boolean{Value: left.Value != right.Value}, true
+		}
+	}
+
+	return nil, false
+}
+
+func foldIntegerInfix(operator string, left, right int64) (object.Object, bool) {
+	switch operator {
+	case "+":
+		return &object.Integer{Value: left + right}, true
+	case "-":
+		return &object.Integer{Value: left - right}, true
+	case "*":
+		return &object.Integer{Value: left * right}, true
+	case "/":
+		if right == 0 {
+			return nil, false
+		}
+		return &object.Integer{Value: left / right}, true
+	case "%":
+		if right == 0 {
+			return nil, false
+		}
+		return &object.Integer{Value: left % right}, true
+	case "<":
+		return &object.Boolean{Value: left < right}, true
+	case ">":
+		return &object.Boolean{Value: left > right}, true
+	case "==":
+		return &object.Boolean{Value: left == right}, true
+	case "!=":
+		return &object.Boolean{Value: left != right}, true
+	}
+
+	return nil, false
+}
@@ -0,0 +1,97 @@
+package compiler
+
+import (
+	"karaoke/code"
+	"sort"
+)
+
+// A decodedInst is an instruction taken apart for rewriting. offset is
+// where it started in the instructions it was decoded from, and a jump's
+// operand is such an offset until relocate lays the instructions out
+// again. span is the source it was compiled from. target says whether a
+// jump lands on it, which only the peephole optimiser looks at.
+type decodedInst struct {
+	op       code.Opcode
+	operands []int
+	offset   int
+	span     code.Span
+	target   bool
+}
+
+func decodeInstructions(ins code.Instructions, positions code.PositionTable) ([]decodedInst, bool) {
+	insts := []decodedInst{}
+
+	for offset := 0; offset < len(ins); {
+		_, operands, width, err := ins.ReadInstruction(offset)
+		if err != nil {
+			return nil, false
+		}
+		span, _ := positions.Lookup(offset)
+		insts = append(insts, decodedInst{
+			op:       ins.OpcodeAt(offset),
+			operands: operands,
+			offset:   offset,
+			span:     span,
+		})
+		offset += width
+	}
+
+	return insts, true
+}
+
+// relocate encodes insts, which are ordered by their old offsets, and
+// points every jump at the new offset of its target. A target that is no
+// longer there maps to the next instruction that is; end is the old
+// length. Jumps whose target moves past the reach of a narrow operand are
+// widened, which moves later targets again, so the layout is repeated
+// until no jump grows any more. The positions of the instructions move
+// along with them.
+func relocate(insts []decodedInst, end int) (code.Instructions, code.PositionTable) {
+	targets := make([]int, len(insts))
+	for i, in := range insts {
+		if code.IsJump(in.op) {
+			targets[i] = in.operands[0]
+			insts[i].operands = append([]int{0}, in.operands[1:]...)
+		}
+	}
+
+	for {
+		oldOffsets := []int{}
+		newOffsets := []int{}
+		pos := 0
+		for _, in := range insts {
+			if len(oldOffsets) == 0 || oldOffsets[len(oldOffsets)-1] != in.offset {
+				oldOffsets = append(oldOffsets, in.offset)
+				newOffsets = append(newOffsets, pos)
+			}
+			pos += len(code.Make(in.op, in.operands...))
+		}
+		oldOffsets = append(oldOffsets, end)
+		newOffsets = append(newOffsets, pos)
+
+		grown := false
+		for i, in := range insts {
+			if !code.IsJump(in.op) {
+				continue
+			}
+
+			target := newOffsets[sort.SearchInts(oldOffsets, targets[i])]
+			if len(code.Make(in.op, target)) != len(code.Make(in.op, in.operands[0])) {
+				grown = true
+			}
+			in.operands[0] = target
+		}
+
+		if !grown {
+			break
+		}
+	}
+
+	out := code.Instructions{}
+	var positions code.PositionTable
+	for _, in := range insts {
+		positions = positions.Add(len(out), in.span)
+		out = append(out, code.Make(in.op, in.operands...)...)
+	}
+	return out, positions
+}
@@ -0,0 +1,82 @@
+package compiler
+
+import (
+	"fmt"
+	"karaoke/code"
+	"karaoke/token"
+	"strings"
+	"testing"
+)
+
+func TestRelocateWidensJumps(t *testing.T) {
+	// A jump over more than 65535 bytes of OpConstant 0; OpPop.
+	body := []code.Instructions{code.Make(code.OpJump, 0)}
+	for i := 0; i < 16400; i++ {
+		body = append(body, code.Make(code.OpConstant, 0), code.Make(code.OpPop))
+	}
+	ins := concatInstructions(body)
+	end := len(ins)
+	ins = append(ins, code.Make(code.OpNull)...)
+	code.PutUint16(ins[1:], 0)
+
+	nullSpan := code.Span{Start: token.Position{Line: 2, Column: 1}, End: token.Position{Line: 2, Column: 5}}
+	positions := code.PositionTable{}.Add(end, nullSpan)
+
+	insts, ok := decodeInstructions(ins, positions)
+	if !ok {
+		t.Fatalf("decodeInstructions failed")
+	}
+	insts[0].operands[0] = end
+
+	out, outPositions := relocate(insts, len(ins))
+
+	// OpWide OpJump is three bytes longer than OpJump.
+	target := end + 3
+	if len(out) != len(ins)+3 {
+		t.Fatalf("wrong length. want=%d, got=%d", len(ins)+3, len(out))
+	}
+	if !strings.HasPrefix(out[:16].String(), fmt.Sprintf("0000 OpWide OpJump %d\n", target)) {
+		t.Errorf("jump not widened:\n%s", out[:16])
+	}
+	if out.OpcodeAt(target) != code.OpNull {
+		t.Errorf("jump target is not the OpNull, got %d", out.OpcodeAt(target))
+	}
+	if span, _ := outPositions.Lookup(target); span != nullSpan {
+		t.Errorf("OpNull lost its position, got %v", span)
+	}
+}
+
+func TestWideJumps(t *testing.T) {
+	consequence := strings.Repeat("1; ", 20000)
+	input := fmt.Sprintf("if (x) { %s 2 } else { 3 }", consequence)
+	program := parse("let x = true; " + input)
+
+	compiler := New()
+	err := compiler.Compile(program)
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+	ins := compiler.Bytecode().Instructions
+
+	wide := 0
+	for offset := 0; offset < len(ins); {
+		def, operands, width, err := ins.ReadInstruction(offset)
+		if err != nil {
+			t.Fatalf("ReadInstruction failed: %s", err)
+		}
+		if code.IsJump(ins.OpcodeAt(offset)) {
+			if code.Opcode(ins[offset]) == code.OpWide {
+				wide++
+			}
+			if _, _, _, err := ins.ReadInstruction(operands[0]); err != nil && operands[0] != len(ins) {
+				t.Errorf("%s at %d jumps to %d, not an instruction: %s",
+					def.Name, offset, operands[0], err)
+			}
+		}
+		offset += width
+	}
+
+	if wide != 2 {
+		t.Errorf("wrong number of wide jumps. want=2, got=%d", wide)
+	}
+}
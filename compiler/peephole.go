@@ -0,0 +1,143 @@
+package compiler
+
+import "karaoke/code"
+
+// A peephole rule looks at the instructions starting at insts[0]. If it
+// matches it returns how many of them it consumes and what to emit in
+// their place.
+type peepholeRule func(insts []decodedInst, next int) (int, []decodedInst, bool)
+
+var peepholeRules = []peepholeRule{
+	// OpSetGlobal x; OpGetGlobal x; OpPop leaves x as the last popped
+	// value on its own.
+	func(insts []decodedInst, next int) (int, []decodedInst, bool) {
+		if len(insts) < 3 || !isStoreAndLoad(insts[0], insts[1]) || insts[2].op != code.OpPop {
+			return 0, nil, false
+		}
+		return 3, insts[:1], true
+	},
+	// OpSetGlobal x; OpGetGlobal x keeps the stored value on the stack.
+	func(insts []decodedInst, next int) (int, []decodedInst, bool) {
+		if len(insts) < 2 || !isStoreAndLoad(insts[0], insts[1]) {
+			return 0, nil, false
+		}
+		return 2, []decodedInst{{op: code.OpDup}, insts[0]}, true
+	},
+	// A jump to the instruction right after it.
+	func(insts []decodedInst, next int) (int, []decodedInst, bool) {
+		if insts[0].op != code.OpJump || insts[0].operands[0] != next {
+			return 0, nil, false
+		}
+		return 1, nil, true
+	},
+	// A null pushed only to be popped again. One a jump lands on is the
+	// value a loop leaves when it exits, and stays.
+	func(insts []decodedInst, next int) (int, []decodedInst, bool) {
+		if len(insts) < 2 || insts[0].op != code.OpNull || insts[1].op != code.OpPop ||
+			insts[0].target {
+			return 0, nil, false
+		}
+		return 2, nil, true
+	},
+	// Conditional jumps on a constant condition.
+	func(insts []decodedInst, next int) (int, []decodedInst, bool) {
+		if len(insts) < 2 || insts[1].op != code.OpJumpNotTruthy {
+			return 0, nil, false
+		}
+		switch insts[0].op {
+		case code.OpTrue:
+			return 2, nil, true
+		case code.OpFalse:
+			return 2, []decodedInst{{op: code.OpJump, operands: insts[1].operands}}, true
+		}
+		return 0, nil, false
+	},
+}
+
+func isStoreAndLoad(store, load decodedInst) bool {
+	switch {
+	case store.op == code.OpSetGlobal && load.op == code.OpGetGlobal,
+		store.op == code.OpSetLocal && load.op == code.OpGetLocal,
+		store.op == code.OpSetCell && load.op == code.OpGetCell,
+		store.op == code.OpSetFreeCell && load.op == code.OpGetFreeCell:
+		return store.operands[0] == load.operands[0]
+	}
+	return false
+}
+
+// optimiseInstructions applies the peephole rules until none matches any
+// more and re-patches every jump to the new offset of its target. A
+// sequence is only rewritten when no jump lands inside it.
+func optimiseInstructions(ins code.Instructions, positions code.PositionTable) (code.Instructions, code.PositionTable) {
+	insts, ok := decodeInstructions(ins, positions)
+	if !ok {
+		return ins, positions
+	}
+
+	for {
+		rewritten, changed := applyPeepholeRules(insts, len(ins))
+		if !changed {
+			return ins, positions
+		}
+		ins, positions = relocate(rewritten, len(ins))
+		insts, _ = decodeInstructions(ins, positions)
+	}
+}
+
+func applyPeepholeRules(insts []decodedInst, end int) ([]decodedInst, bool) {
+	targets := map[int]bool{}
+	for _, in := range insts {
+		if code.IsJump(in.op) {
+			targets[in.operands[0]] = true
+		}
+	}
+	for i := range insts {
+		insts[i].target = targets[insts[i].offset]
+	}
+
+	out := []decodedInst{}
+	changed := false
+
+	for i := 0; i < len(insts); {
+		next := end
+		if i+1 < len(insts) {
+			next = insts[i+1].offset
+		}
+
+		matched := false
+		for _, rule := range peepholeRules {
+			n, replacement, ok := rule(insts[i:], next)
+			if !ok || jumpsInto(insts[i:i+n], targets) {
+				continue
+			}
+
+			// The replacement starts where the matched sequence did, so
+			// jumps to its first instruction still land on it, and comes
+			// from the same source.
+			for j := range replacement {
+				replacement[j].offset = insts[i].offset
+				replacement[j].span = insts[i].span
+			}
+			out = append(out, replacement...)
+			i += n
+			matched, changed = true, true
+			break
+		}
+
+		if !matched {
+			out = append(out, insts[i])
+			i++
+		}
+	}
+
+	return out, changed
+}
+
+func jumpsInto(seq []decodedInst, targets map[int]bool) bool {
+	for _, in := range seq[1:] {
+		if targets[in.offset] {
+			return true
+		}
+	}
+	return false
+}
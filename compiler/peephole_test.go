@@ -0,0 +1,224 @@
+package compiler
+
+import (
+	"karaoke/code"
+	"testing"
+)
+
+func TestOptimiseInstructions(t *testing.T) {
+	tests := []struct {
+		input    []code.Instructions
+		expected []code.Instructions
+	}{
+		{
+			// A jump to the next instruction.
+			input: []code.Instructions{
+				code.Make(code.OpJump, 3),
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpPop),
+			},
+			expected: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input: []code.Instructions{
+				code.Make(code.OpNull),
+				code.Make(code.OpPop),
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpPop),
+			},
+			expected: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			// The OpNull is a jump target: a loop leaves it as its value.
+			input: []code.Instructions{
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpJumpNotTruthy, 6),
+				code.Make(code.OpNull),
+				code.Make(code.OpPop),
+			},
+			expected: []code.Instructions{
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpJumpNotTruthy, 6),
+				code.Make(code.OpNull),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			// The OpPop is a jump target and has to stay.
+			input: []code.Instructions{
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpJumpNotTruthy, 7),
+				code.Make(code.OpNull),
+				code.Make(code.OpPop),
+			},
+			expected: []code.Instructions{
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpJumpNotTruthy, 7),
+				code.Make(code.OpNull),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input: []code.Instructions{
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpJumpNotTruthy, 10),
+				code.Make(code.OpTrue),
+				code.Make(code.OpJumpNotTruthy, 10),
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpPop),
+			},
+			expected: []code.Instructions{
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpJumpNotTruthy, 6),
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input: []code.Instructions{
+				code.Make(code.OpFalse),
+				code.Make(code.OpJumpNotTruthy, 10),
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpJump, 11),
+				code.Make(code.OpNull),
+				code.Make(code.OpPop),
+			},
+			expected: []code.Instructions{
+				code.Make(code.OpJump, 9),
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpJump, 10),
+				code.Make(code.OpNull),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpPop),
+			},
+			expected: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpSetGlobal, 0),
+			},
+		},
+		{
+			input: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpSetLocal, 0),
+				code.Make(code.OpGetLocal, 0),
+				code.Make(code.OpReturnValue),
+			},
+			expected: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpDup),
+				code.Make(code.OpSetLocal, 0),
+				code.Make(code.OpReturnValue),
+			},
+		},
+		{
+			// Different slots.
+			input: []code.Instructions{
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpGetGlobal, 1),
+				code.Make(code.OpPop),
+			},
+			expected: []code.Instructions{
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpGetGlobal, 1),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			// A jump lands on the load.
+			input: []code.Instructions{
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpJump, 3),
+			},
+			expected: []code.Instructions{
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpJump, 3),
+			},
+		},
+		{
+			// A jump to the end of the stream past a removed instruction.
+			input: []code.Instructions{
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpJumpNotTruthy, 8),
+				code.Make(code.OpNull),
+				code.Make(code.OpPop),
+			},
+			expected: []code.Instructions{
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpJumpNotTruthy, 6),
+			},
+		},
+	}
+
+	for i, tt := range tests {
+		actual, _ := optimiseInstructions(concatInstructions(tt.input), nil)
+
+		err := testInstructions(tt.expected, actual)
+		if err != nil {
+			t.Errorf("test[%d]: %s", i, err)
+		}
+	}
+}
+
+func TestPeephole(t *testing.T) {
+	tests := []CompilerTestCase{
+		{
+			input:         "let x = 1; x;",
+			expectedConst: []interface{}{1},
+			expectedInsts: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpSetGlobal, 0),
+			},
+		},
+		{
+			input: "fn() { let a = 1; a }",
+			expectedConst: []interface{}{
+				1,
+				[]code.Instructions{
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpDup),
+					code.Make(code.OpSetLocal, 0),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInsts: []code.Instructions{
+				code.Make(code.OpClosure, 1, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:         "if (true) { 10 }; 3333;",
+			expectedConst: []interface{}{10, 3333},
+			expectedInsts: []code.Instructions{
+				// 0000
+				code.Make(code.OpConstant, 0),
+				// 0003
+				code.Make(code.OpJump, 7),
+				// 0006
+				code.Make(code.OpNull),
+				// 0007
+				code.Make(code.OpPop),
+				// 0008
+				code.Make(code.OpConstant, 1),
+				// 0011
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTestsWithOptions(t, tests, FoldConstants(false), DeduplicateConstants(false), Peephole(true))
+}
@@ -3,20 +3,30 @@ package compiler
 type SymbolScope string
 
 const (
-	GlobalScope SymbolScope = "GLOBAL"
-	LocalScope  SymbolScope = "LOCAL"
+	GlobalScope   SymbolScope = "GLOBAL"
+	LocalScope    SymbolScope = "LOCAL"
+	BuiltinScope  SymbolScope = "BUILTIN"
+	FreeScope     SymbolScope = "FREE"
+	FunctionScope SymbolScope = "FUNCTION"
 )
 
 type Symbol struct {
 	Name  string
 	Scope SymbolScope
 	Idx   int
+	Cell  bool // whether the local or free variable is held in a cell
 }
 
 type SymbolTable struct {
 	store   map[string]Symbol
 	numDefs int
 	Outer   *SymbolTable
+
+	FreeSymbols []Symbol
+
+	// cells are the names of the locals to keep in cells, because a
+	// closure may capture them.
+	cells map[string]bool
 }
 
 func NewEnclosedSymbolTable(table *SymbolTable) *SymbolTable {
@@ -27,15 +37,24 @@ func NewEnclosedSymbolTable(table *SymbolTable) *SymbolTable {
 
 func NewSymbolTable() *SymbolTable {
 	s := make(map[string]Symbol)
-	return &SymbolTable{store: s}
+	free := []Symbol{}
+	return &SymbolTable{store: s, FreeSymbols: free}
 }
 
+// Define binds name in this table. Redefining a name that already has a
+// slot in the same scope reuses that slot, so a binding declared ahead of
+// time keeps its index once its let statement is compiled.
 func (st *SymbolTable) Define(name string) Symbol {
+	if sym, ok := st.store[name]; ok && (sym.Scope == GlobalScope || sym.Scope == LocalScope) {
+		return sym
+	}
+
 	sym := Symbol{Name: name, Idx: st.numDefs}
 	if st.Outer == nil {
 		sym.Scope = GlobalScope
 	} else {
 		sym.Scope = LocalScope
+		sym.Cell = st.cells[name]
 	}
 
 	st.store[name] = sym
@@ -43,10 +62,89 @@ func (st *SymbolTable) Define(name string) Symbol {
 	return sym
 }
 
+// Names returns the names of the globals or locals defined in this table,
+// indexed by slot.
+func (st *SymbolTable) Names() []string {
+	names := make([]string, st.numDefs)
+	for _, sym := range st.store {
+		if sym.Scope == GlobalScope || sym.Scope == LocalScope {
+			names[sym.Idx] = sym.Name
+		}
+	}
+	return names
+}
+
+// Cells returns the slots of the locals defined in this table that are
+// held in cells, in order.
+func (st *SymbolTable) Cells() []int {
+	cells := []int{}
+	for _, name := range st.Names() {
+		if sym := st.store[name]; sym.Cell && sym.Scope == LocalScope {
+			cells = append(cells, sym.Idx)
+		}
+	}
+	return cells
+}
+
+func (st *SymbolTable) DefineBuiltin(idx int, name string) Symbol {
+	sym := Symbol{Name: name, Scope: BuiltinScope, Idx: idx}
+	st.store[name] = sym
+	return sym
+}
+
+// DefineFunctionName binds the name of the function being compiled in
+// this table, so its body can refer to itself when the name is bound
+// nowhere else. Parameters and locals of the same name are defined later
+// and shadow it.
+func (st *SymbolTable) DefineFunctionName(name string) Symbol {
+	sym := Symbol{Name: name, Scope: FunctionScope, Idx: 0}
+	st.store[name] = sym
+	return sym
+}
+
+// assignable reports whether name is bound to a global or to a local of
+// this or an enclosing table that assignments can change. Unlike
+// Resolve it captures nothing.
+func (st *SymbolTable) assignable(name string) bool {
+	for t := st; t != nil; t = t.Outer {
+		if sym, ok := t.store[name]; ok {
+			switch {
+			case sym.Scope == GlobalScope, sym.Scope == LocalScope:
+				return true
+			case sym.Scope == FreeScope:
+				return sym.Cell
+			}
+			return false
+		}
+	}
+	return false
+}
+
+func (st *SymbolTable) defineFree(original Symbol) Symbol {
+	st.FreeSymbols = append(st.FreeSymbols, original)
+
+	sym := Symbol{Name: original.Name, Scope: FreeScope, Idx: len(st.FreeSymbols) - 1, Cell: original.Cell}
+	st.store[original.Name] = sym
+	return sym
+}
+
+// Resolve looks name up through the enclosing tables. A local of an
+// enclosing function is captured: it is recorded in FreeSymbols and
+// resolved as a free variable of this table from then on.
 func (st *SymbolTable) Resolve(name string) (Symbol, bool) {
 	result, ok := st.store[name]
-	if !ok && st.Outer != nil {
-		return st.Outer.Resolve(name)
+	if ok || st.Outer == nil {
+		return result, ok
+	}
+
+	result, ok = st.Outer.Resolve(name)
+	if !ok {
+		return result, ok
 	}
-	return result, ok
+
+	if result.Scope == GlobalScope || result.Scope == BuiltinScope {
+		return result, ok
+	}
+
+	return st.defineFree(result), true
 }
@@ -0,0 +1,148 @@
+package dap
+
+import (
+	"karaoke/evaluator"
+	"karaoke/object"
+	"karaoke/token"
+	"karaoke/vm"
+)
+
+// An engine runs the launched program: the VM or the evaluator. The
+// session sees both through it the same way.
+type engine interface {
+	SetBreakpoint(file string, line int) ([]int, error)
+	ClearBreakpoint(id int)
+	CallStack() []frame
+	Globals() []binding
+	Continue() (stop, error)
+	StepOver() (stop, error)
+	StepInto() (stop, error)
+	StepOut() (stop, error)
+	Close()
+}
+
+// A stop is where the program stopped. Breakpoint is the id of the
+// breakpoint that was hit, if any.
+type stop struct {
+	exited     bool
+	breakpoint int
+}
+
+// A frame is one call on the call stack, innermost first.
+type frame struct {
+	function string
+	pos      token.Position
+	locals   []binding
+}
+
+// A binding is a named global or local with a value.
+type binding struct {
+	name  string
+	value object.Object
+}
+
+// vmEngine runs compiled programs on the VM.
+type vmEngine struct {
+	machine *vm.VM
+}
+
+func (e vmEngine) SetBreakpoint(file string, line int) ([]int, error) {
+	bps, err := e.machine.SetBreakpoint(file, line)
+	var ids []int
+	for _, bp := range bps {
+		ids = append(ids, bp.ID)
+	}
+	return ids, err
+}
+
+func (e vmEngine) ClearBreakpoint(id int) { e.machine.ClearBreakpoint(id) }
+
+func (e vmEngine) CallStack() []frame {
+	var frames []frame
+	for _, f := range e.machine.CallStack() {
+		frames = append(frames, frame{function: f.Function, pos: f.Span.Start, locals: vmBindings(f.Locals)})
+	}
+	return frames
+}
+
+func (e vmEngine) Globals() []binding { return vmBindings(e.machine.Globals()) }
+
+func (e vmEngine) Continue() (stop, error) { return vmStop(e.machine.Continue()) }
+func (e vmEngine) StepOver() (stop, error) { return vmStop(e.machine.StepOver()) }
+func (e vmEngine) StepInto() (stop, error) { return vmStop(e.machine.StepInto()) }
+func (e vmEngine) StepOut() (stop, error)  { return vmStop(e.machine.StepOut()) }
+
+func (e vmEngine) Close() {}
+
+func vmStop(s *vm.Stop, err error) (stop, error) {
+	if err != nil {
+		return stop{}, err
+	}
+
+	st := stop{exited: s.Reason == vm.StopExited}
+	if s.Breakpoint != nil {
+		st.breakpoint = s.Breakpoint.ID
+	}
+	return st, nil
+}
+
+func vmBindings(vars []vm.Variable) []binding {
+	var bindings []binding
+	for _, v := range vars {
+		bindings = append(bindings, binding{v.Name, v.Value})
+	}
+	return bindings
+}
+
+// evalEngine runs parsed programs in the evaluator.
+type evalEngine struct {
+	debugger *evaluator.Debugger
+}
+
+func (e evalEngine) SetBreakpoint(file string, line int) ([]int, error) {
+	bps, err := e.debugger.SetBreakpoint(file, line)
+	var ids []int
+	for _, bp := range bps {
+		ids = append(ids, bp.ID)
+	}
+	return ids, err
+}
+
+func (e evalEngine) ClearBreakpoint(id int) { e.debugger.ClearBreakpoint(id) }
+
+func (e evalEngine) CallStack() []frame {
+	var frames []frame
+	for _, f := range e.debugger.CallStack() {
+		frames = append(frames, frame{function: f.Function, pos: f.Pos, locals: evalBindings(f.Locals)})
+	}
+	return frames
+}
+
+func (e evalEngine) Globals() []binding { return evalBindings(e.debugger.Globals()) }
+
+func (e evalEngine) Continue() (stop, error) { return evalStop(e.debugger.Continue()) }
+func (e evalEngine) StepOver() (stop, error) { return evalStop(e.debugger.StepOver()) }
+func (e evalEngine) StepInto() (stop, error) { return evalStop(e.debugger.StepInto()) }
+func (e evalEngine) StepOut() (stop, error)  { return evalStop(e.debugger.StepOut()) }
+
+func (e evalEngine) Close() { e.debugger.Close() }
+
+func evalStop(s *evaluator.Stop, err error) (stop, error) {
+	if err != nil {
+		return stop{}, err
+	}
+
+	st := stop{exited: s.Reason == evaluator.StopExited}
+	if s.Breakpoint != nil {
+		st.breakpoint = s.Breakpoint.ID
+	}
+	return st, nil
+}
+
+func evalBindings(vars []evaluator.Variable) []binding {
+	var bindings []binding
+	for _, v := range vars {
+		bindings = append(bindings, binding{v.Name, v.Value})
+	}
+	return bindings
+}
@@ -0,0 +1,481 @@
+package dap
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"karaoke/ast"
+	"karaoke/compiler"
+	"karaoke/evaluator"
+	"karaoke/object"
+	"karaoke/vm"
+	"net"
+	"path/filepath"
+	"sort"
+)
+
+// threadID is the id of the only thread, the program.
+const threadID = 1
+
+// A Loader reads the program at path for the engine a launch asks for:
+// Compile compiles or reads it for the VM, Parse parses it for the
+// evaluator.
+type Loader struct {
+	Compile func(path string) (*compiler.Bytecode, error)
+	Parse   func(path string) (*ast.Program, error)
+}
+
+var errNotLaunched = errors.New("no program launched")
+
+type session struct {
+	in   *bufio.Reader
+	out  io.Writer
+	seq  int
+	load Loader
+	ctx  context.Context // done once the session ends
+
+	engine      engine
+	stopOnEntry bool
+
+	// The breakpoints set by setBreakpoints, by source path, so the next
+	// request for the same source can replace them.
+	sourceBreakpoints map[string][]int
+
+	// What the variablesReferences handed out since the program last
+	// stopped refer to: a []binding, an *object.Array or an
+	// *object.Hash. Reference n is handles[n-1].
+	handles []interface{}
+}
+
+// Serve runs one debug session, reading requests from in and writing
+// responses and events to out until the client disconnects or closes in.
+// A program that is still running then stops.
+func Serve(in io.Reader, out io.Writer, load Loader) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s := &session{
+		in:                bufio.NewReader(in),
+		out:               out,
+		load:              load,
+		ctx:               ctx,
+		sourceBreakpoints: map[string][]int{},
+	}
+	defer func() {
+		if s.engine != nil {
+			s.engine.Close()
+		}
+	}()
+
+	requests := make(chan request)
+	errs := make(chan error, 1)
+	go s.read(requests, errs, cancel)
+
+	for {
+		select {
+		case req := <-requests:
+			if !s.dispatch(req) {
+				return nil
+			}
+		case err := <-errs:
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+// read hands the requests read from in to Serve until the client
+// disconnects or in fails. The program runs while Serve handles a
+// request, so read cancels the session's context first, which stops it.
+func (s *session) read(requests chan<- request, errs chan<- error, cancel context.CancelFunc) {
+	for {
+		var req request
+		err := readMessage(s.in, &req)
+		if err != nil {
+			cancel()
+			errs <- err
+			return
+		}
+		if req.Type != "request" {
+			continue
+		}
+
+		if req.Command == "disconnect" {
+			cancel()
+		}
+		requests <- req
+		if req.Command == "disconnect" {
+			return
+		}
+	}
+}
+
+// Listen serves a debug session for every connection accepted from l.
+func Listen(l net.Listener, load Loader) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+
+		go func() {
+			defer conn.Close()
+			Serve(conn, conn, load)
+		}()
+	}
+}
+
+// dispatch handles req and reports whether the session goes on.
+func (s *session) dispatch(req request) bool {
+	switch req.Command {
+	case "initialize":
+		s.respond(req, capabilities{SupportsConfigurationDoneRequest: true})
+
+	case "launch":
+		err := s.launch(req.Arguments)
+		s.reply(req, nil, err)
+		if err == nil {
+			s.sendEvent("initialized", nil)
+		}
+
+	case "setBreakpoints":
+		body, err := s.setBreakpoints(req.Arguments)
+		s.reply(req, body, err)
+
+	case "configurationDone":
+		if s.engine == nil {
+			s.fail(req, errNotLaunched)
+			break
+		}
+		s.respond(req, nil)
+
+		if s.stopOnEntry {
+			s.sendEvent("stopped", stoppedEvent{Reason: "entry", ThreadID: threadID, AllThreadsStopped: true})
+		} else {
+			s.resume(engine.Continue)
+		}
+
+	case "threads":
+		s.respond(req, struct {
+			Threads []thread `json:"threads"`
+		}{[]thread{{ID: threadID, Name: "main"}}})
+
+	case "stackTrace":
+		body, err := s.stackTrace()
+		s.reply(req, body, err)
+
+	case "scopes":
+		body, err := s.scopes(req.Arguments)
+		s.reply(req, body, err)
+
+	case "variables":
+		body, err := s.variables(req.Arguments)
+		s.reply(req, body, err)
+
+	case "continue":
+		s.run(req, engine.Continue)
+	case "next":
+		s.run(req, engine.StepOver)
+	case "stepIn":
+		s.run(req, engine.StepInto)
+	case "stepOut":
+		s.run(req, engine.StepOut)
+
+	case "disconnect":
+		s.respond(req, nil)
+		return false
+
+	default:
+		s.fail(req, fmt.Errorf("unsupported request %q", req.Command))
+	}
+
+	return true
+}
+
+func (s *session) launch(arguments json.RawMessage) error {
+	var args launchArguments
+	err := json.Unmarshal(arguments, &args)
+	if err != nil {
+		return err
+	}
+	if args.Program == "" {
+		return errors.New("no program given")
+	}
+
+	// Sources are named by absolute path in setBreakpoints, so the
+	// program is compiled under its absolute path too.
+	program, err := filepath.Abs(args.Program)
+	if err != nil {
+		return err
+	}
+
+	switch args.Engine {
+	case "", "vm":
+		bc, err := s.load.Compile(program)
+		if err != nil {
+			return err
+		}
+		machine := vm.New(bc)
+		machine.DebugContext(s.ctx)
+		s.engine = vmEngine{machine}
+
+	case "evaluator":
+		node, err := s.load.Parse(program)
+		if err != nil {
+			return err
+		}
+		s.engine = evalEngine{evaluator.New().Debug(s.ctx, node, object.NewEnvironment())}
+
+	default:
+		return fmt.Errorf("unknown engine %q", args.Engine)
+	}
+
+	s.stopOnEntry = args.StopOnEntry
+	return nil
+}
+
+func (s *session) setBreakpoints(arguments json.RawMessage) (interface{}, error) {
+	if s.engine == nil {
+		return nil, errNotLaunched
+	}
+
+	var args setBreakpointsArguments
+	err := json.Unmarshal(arguments, &args)
+	if err != nil {
+		return nil, err
+	}
+
+	path, err := filepath.Abs(args.Source.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, id := range s.sourceBreakpoints[path] {
+		s.engine.ClearBreakpoint(id)
+	}
+	s.sourceBreakpoints[path] = nil
+
+	set := []breakpoint{}
+	for _, sbp := range args.Breakpoints {
+		ids, err := s.engine.SetBreakpoint(path, sbp.Line)
+		if err != nil {
+			set = append(set, breakpoint{Verified: false, Line: sbp.Line, Message: err.Error()})
+			continue
+		}
+
+		s.sourceBreakpoints[path] = append(s.sourceBreakpoints[path], ids...)
+		set = append(set, breakpoint{ID: ids[0], Verified: true, Line: sbp.Line})
+	}
+
+	return struct {
+		Breakpoints []breakpoint `json:"breakpoints"`
+	}{set}, nil
+}
+
+func (s *session) stackTrace() (interface{}, error) {
+	if s.engine == nil {
+		return nil, errNotLaunched
+	}
+
+	frames := []stackFrame{}
+	for i, frame := range s.engine.CallStack() {
+		sf := stackFrame{
+			ID:     i + 1,
+			Name:   frame.function,
+			Line:   frame.pos.Line,
+			Column: frame.pos.Column,
+		}
+		if file := frame.pos.File; file != "" {
+			sf.Source = &source{Name: filepath.Base(file), Path: file}
+		}
+		frames = append(frames, sf)
+	}
+
+	return struct {
+		StackFrames []stackFrame `json:"stackFrames"`
+		TotalFrames int          `json:"totalFrames"`
+	}{frames, len(frames)}, nil
+}
+
+func (s *session) scopes(arguments json.RawMessage) (interface{}, error) {
+	if s.engine == nil {
+		return nil, errNotLaunched
+	}
+
+	var args scopesArguments
+	err := json.Unmarshal(arguments, &args)
+	if err != nil {
+		return nil, err
+	}
+
+	frames := s.engine.CallStack()
+	if args.FrameID < 1 || args.FrameID > len(frames) {
+		return nil, fmt.Errorf("no frame %d", args.FrameID)
+	}
+
+	return struct {
+		Scopes []scope `json:"scopes"`
+	}{[]scope{
+		{Name: "Locals", VariablesReference: s.newHandle(frames[args.FrameID-1].locals)},
+		{Name: "Globals", VariablesReference: s.newHandle(s.engine.Globals())},
+	}}, nil
+}
+
+func (s *session) variables(arguments json.RawMessage) (interface{}, error) {
+	var args variablesArguments
+	err := json.Unmarshal(arguments, &args)
+	if err != nil {
+		return nil, err
+	}
+
+	ref := args.VariablesReference
+	if ref < 1 || ref > len(s.handles) {
+		return nil, fmt.Errorf("no variables with reference %d", ref)
+	}
+
+	vars := []variable{}
+	switch h := s.handles[ref-1].(type) {
+	case []binding:
+		for _, b := range h {
+			vars = append(vars, s.variable(b.name, b.value))
+		}
+
+	case *object.Array:
+		for i, elem := range h.Elements {
+			vars = append(vars, s.variable(fmt.Sprint(i), elem))
+		}
+
+	case *object.Hash:
+		for _, pair := range h.Pairs {
+			vars = append(vars, s.variable(pair.Key.Inspect(), pair.Value))
+		}
+		sort.Slice(vars, func(i, j int) bool { return vars[i].Name < vars[j].Name })
+	}
+
+	return struct {
+		Variables []variable `json:"variables"`
+	}{vars}, nil
+}
+
+// variable renders obj with Inspect. Arrays and hashes that are not empty
+// get a reference to their elements.
+func (s *session) variable(name string, obj object.Object) variable {
+	v := variable{Name: name, Value: obj.Inspect(), Type: string(obj.Type())}
+
+	switch obj := obj.(type) {
+	case *object.Array:
+		if len(obj.Elements) > 0 {
+			v.VariablesReference = s.newHandle(obj)
+		}
+	case *object.Hash:
+		if len(obj.Pairs) > 0 {
+			v.VariablesReference = s.newHandle(obj)
+		}
+	}
+	return v
+}
+
+func (s *session) newHandle(h interface{}) int {
+	s.handles = append(s.handles, h)
+	return len(s.handles)
+}
+
+// run answers a continue or step request and resumes the program.
+func (s *session) run(req request, step func(engine) (stop, error)) {
+	if s.engine == nil {
+		s.fail(req, errNotLaunched)
+		return
+	}
+
+	if req.Command == "continue" {
+		s.respond(req, struct {
+			AllThreadsContinued bool `json:"allThreadsContinued"`
+		}{true})
+	} else {
+		s.respond(req, nil)
+	}
+
+	s.resume(step)
+}
+
+// resume runs the program and reports where it stopped. References to
+// variables are only valid while it stays stopped.
+func (s *session) resume(step func(engine) (stop, error)) {
+	s.handles = nil
+
+	stop, err := step(s.engine)
+	if err != nil && s.ctx.Err() != nil {
+		// The client is gone or leaving; nobody waits for the events.
+		return
+	}
+	if err != nil {
+		// Runtime errors of both engines come with a stack trace.
+		output := err.Error() + "\n"
+		if rerr, ok := err.(interface{ StackTrace() string }); ok {
+			output += rerr.StackTrace()
+		}
+		s.sendEvent("output", outputEvent{Category: "stderr", Output: output})
+		s.sendEvent("exited", exitedEvent{ExitCode: 1})
+		s.sendEvent("terminated", nil)
+		return
+	}
+
+	switch {
+	case stop.exited:
+		s.sendEvent("exited", exitedEvent{ExitCode: 0})
+		s.sendEvent("terminated", nil)
+
+	case stop.breakpoint != 0:
+		s.sendEvent("stopped", stoppedEvent{
+			Reason:            "breakpoint",
+			ThreadID:          threadID,
+			AllThreadsStopped: true,
+			HitBreakpointIDs:  []int{stop.breakpoint},
+		})
+
+	default:
+		s.sendEvent("stopped", stoppedEvent{Reason: "step", ThreadID: threadID, AllThreadsStopped: true})
+	}
+}
+
+func (s *session) reply(req request, body interface{}, err error) {
+	if err != nil {
+		s.fail(req, err)
+		return
+	}
+	s.respond(req, body)
+}
+
+func (s *session) respond(req request, body interface{}) {
+	s.seq++
+	writeMessage(s.out, response{
+		Seq:        s.seq,
+		Type:       "response",
+		RequestSeq: req.Seq,
+		Success:    true,
+		Command:    req.Command,
+		Body:       body,
+	})
+}
+
+func (s *session) fail(req request, err error) {
+	s.seq++
+	writeMessage(s.out, response{
+		Seq:        s.seq,
+		Type:       "response",
+		RequestSeq: req.Seq,
+		Success:    false,
+		Command:    req.Command,
+		Message:    err.Error(),
+	})
+}
+
+func (s *session) sendEvent(name string, body interface{}) {
+	s.seq++
+	writeMessage(s.out, event{Seq: s.seq, Type: "event", Event: name, Body: body})
+}
@@ -0,0 +1,496 @@
+package dap
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"karaoke/ast"
+	"karaoke/compiler"
+	"karaoke/lexer"
+	"karaoke/parser"
+	"net"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// message is any message a client reads.
+type message struct {
+	Seq        int             `json:"seq"`
+	Type       string          `json:"type"`
+	Command    string          `json:"command"`
+	Event      string          `json:"event"`
+	RequestSeq int             `json:"request_seq"`
+	Success    bool            `json:"success"`
+	Message    string          `json:"message"`
+	Body       json.RawMessage `json:"body"`
+}
+
+// client is a scripted DAP client. Every message it expects must be the
+// next one the server sends.
+type client struct {
+	t   *testing.T
+	in  *bufio.Reader
+	out io.Writer
+	seq int
+}
+
+func (c *client) send(command string, arguments interface{}) int {
+	c.t.Helper()
+
+	args, err := json.Marshal(arguments)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+
+	c.seq++
+	err = writeMessage(c.out, request{Seq: c.seq, Type: "request", Command: command, Arguments: args})
+	if err != nil {
+		c.t.Fatalf("sending %s: %s", command, err)
+	}
+	return c.seq
+}
+
+func (c *client) next() message {
+	c.t.Helper()
+
+	var msg message
+	err := readMessage(c.in, &msg)
+	if err != nil {
+		c.t.Fatalf("reading message: %s", err)
+	}
+	return msg
+}
+
+// request sends a request, expects a successful response to it and
+// decodes its body into body, if not nil.
+func (c *client) request(command string, arguments interface{}, body interface{}) {
+	c.t.Helper()
+
+	seq := c.send(command, arguments)
+	msg := c.next()
+	if msg.Type != "response" || msg.Command != command || msg.RequestSeq != seq {
+		c.t.Fatalf("expected the response to %s #%d, got %+v", command, seq, msg)
+	}
+	if !msg.Success {
+		c.t.Fatalf("%s failed: %s", command, msg.Message)
+	}
+	c.decode(msg, body)
+}
+
+// expectEvent expects an event and decodes its body into body, if not nil.
+func (c *client) expectEvent(name string, body interface{}) {
+	c.t.Helper()
+
+	msg := c.next()
+	if msg.Type != "event" || msg.Event != name {
+		c.t.Fatalf("expected a %s event, got %+v", name, msg)
+	}
+	c.decode(msg, body)
+}
+
+func (c *client) decode(msg message, body interface{}) {
+	c.t.Helper()
+
+	if body == nil {
+		return
+	}
+	err := json.Unmarshal(msg.Body, body)
+	if err != nil {
+		c.t.Fatalf("decoding %s: %s", msg.Body, err)
+	}
+}
+
+// startSession serves a session in the background for a program made of
+// input and returns a client connected to it.
+func startSession(t *testing.T, input string) (*client, string) {
+	program := filepath.Join(t.TempDir(), "prog.mk")
+	load := Loader{
+		Compile: func(path string) (*compiler.Bytecode, error) {
+			p := parser.New(lexer.NewWithFile(path, input))
+			comp := compiler.New(compiler.Peephole(false))
+			err := comp.Compile(p.ParseProgram())
+			return comp.Bytecode(), err
+		},
+		Parse: func(path string) (*ast.Program, error) {
+			return parser.New(lexer.NewWithFile(path, input)).ParseProgram(), nil
+		},
+	}
+
+	clientIn, serverOut := io.Pipe()
+	serverIn, clientOut := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		done <- Serve(serverIn, serverOut, load)
+		serverOut.Close()
+	}()
+	t.Cleanup(func() {
+		clientOut.Close()
+		if err := <-done; err != nil {
+			t.Errorf("Serve: %s", err)
+		}
+	})
+
+	return &client{t: t, in: bufio.NewReader(clientIn), out: clientOut}, program
+}
+
+func TestSession(t *testing.T) {
+	input := `let sum = fn(xs, h) {
+  let total = xs[0] + xs[1];
+  total + h["k"][0]
+};
+let r = sum([1, 2], {"k": [3]});
+r`
+	c, program := startSession(t, input)
+
+	var caps capabilities
+	c.request("initialize", map[string]string{"adapterID": "monkey"}, &caps)
+	if !caps.SupportsConfigurationDoneRequest {
+		t.Errorf("configurationDone is not supported")
+	}
+
+	c.request("launch", launchArguments{Program: program}, nil)
+	c.expectEvent("initialized", nil)
+
+	var bps struct{ Breakpoints []breakpoint }
+	c.request("setBreakpoints", setBreakpointsArguments{
+		Source:      source{Path: program},
+		Breakpoints: []sourceBreakpoint{{Line: 2}, {Line: 9}},
+	}, &bps)
+	wantBps := []breakpoint{
+		{ID: 1, Verified: true, Line: 2},
+		{Verified: false, Line: 9, Message: "no code at line 9"},
+	}
+	if !reflect.DeepEqual(bps.Breakpoints, wantBps) {
+		t.Errorf("wrong breakpoints. want=%+v, got=%+v", wantBps, bps.Breakpoints)
+	}
+
+	var stopped stoppedEvent
+	c.request("configurationDone", nil, nil)
+	c.expectEvent("stopped", &stopped)
+	if stopped.Reason != "breakpoint" || !reflect.DeepEqual(stopped.HitBreakpointIDs, []int{1}) {
+		t.Errorf("wrong stop: %+v", stopped)
+	}
+
+	var threads struct{ Threads []thread }
+	c.request("threads", nil, &threads)
+	if len(threads.Threads) != 1 || threads.Threads[0].ID != threadID {
+		t.Errorf("wrong threads: %+v", threads.Threads)
+	}
+
+	var trace struct{ StackFrames []stackFrame }
+	c.request("stackTrace", map[string]int{"threadId": threadID}, &trace)
+	wantFrames := []stackFrame{
+		{ID: 1, Name: "sum", Source: &source{Name: "prog.mk", Path: program}, Line: 2, Column: 15},
+		{ID: 2, Name: "<main>", Source: &source{Name: "prog.mk", Path: program}, Line: 5, Column: 9},
+	}
+	if !reflect.DeepEqual(trace.StackFrames, wantFrames) {
+		t.Errorf("wrong stack frames. want=%+v, got=%+v", wantFrames, trace.StackFrames)
+	}
+
+	var scopes struct{ Scopes []scope }
+	c.request("scopes", scopesArguments{FrameID: 1}, &scopes)
+	if len(scopes.Scopes) != 2 || scopes.Scopes[0].Name != "Locals" || scopes.Scopes[1].Name != "Globals" {
+		t.Fatalf("wrong scopes: %+v", scopes.Scopes)
+	}
+
+	locals := c.variables(scopes.Scopes[0].VariablesReference)
+	if got := describe(locals); got != `xs=[1, 2] (ARRAY) h={k: [3]} (HASH)` {
+		t.Errorf("wrong locals: %s", got)
+	}
+
+	if got := describe(c.variables(locals[0].VariablesReference)); got != "0=1 (INTEGER) 1=2 (INTEGER)" {
+		t.Errorf("wrong elements of xs: %s", got)
+	}
+	pairs := c.variables(locals[1].VariablesReference)
+	if got := describe(pairs); got != "k=[3] (ARRAY)" {
+		t.Errorf("wrong pairs of h: %s", got)
+	}
+	if got := describe(c.variables(pairs[0].VariablesReference)); got != "0=3 (INTEGER)" {
+		t.Errorf("wrong elements of h[k]: %s", got)
+	}
+
+	globals := c.variables(scopes.Scopes[1].VariablesReference)
+	if len(globals) != 1 || globals[0].Name != "sum" || globals[0].VariablesReference != 0 {
+		t.Errorf("wrong globals: %+v", globals)
+	}
+
+	steps := []struct {
+		command string
+		line    int
+	}{
+		{"next", 3},
+		{"stepIn", 4},
+		{"stepIn", 5},
+	}
+	for _, step := range steps {
+		c.request(step.command, map[string]int{"threadId": threadID}, nil)
+		c.expectEvent("stopped", &stopped)
+		if stopped.Reason != "step" {
+			t.Errorf("%s: wrong reason %q", step.command, stopped.Reason)
+		}
+
+		c.request("stackTrace", map[string]int{"threadId": threadID}, &trace)
+		if line := trace.StackFrames[0].Line; line != step.line {
+			t.Errorf("%s: wrong line. want=%d, got=%d", step.command, step.line, line)
+		}
+	}
+
+	var exited exitedEvent
+	c.request("continue", map[string]int{"threadId": threadID}, nil)
+	c.expectEvent("exited", &exited)
+	c.expectEvent("terminated", nil)
+	if exited.ExitCode != 0 {
+		t.Errorf("wrong exit code: %d", exited.ExitCode)
+	}
+
+	c.request("disconnect", nil, nil)
+}
+
+func TestEvaluatorSession(t *testing.T) {
+	input := `let sum = fn(xs, h) {
+  let total = xs[0] + xs[1];
+  total + h["k"][0]
+};
+let r = sum([1, 2], {"k": [3]});
+r`
+	c, program := startSession(t, input)
+
+	c.request("initialize", nil, nil)
+	c.request("launch", launchArguments{Program: program, Engine: "evaluator"}, nil)
+	c.expectEvent("initialized", nil)
+
+	var bps struct{ Breakpoints []breakpoint }
+	c.request("setBreakpoints", setBreakpointsArguments{
+		Source:      source{Path: program},
+		Breakpoints: []sourceBreakpoint{{Line: 2}, {Line: 4}},
+	}, &bps)
+	wantBps := []breakpoint{
+		{ID: 1, Verified: true, Line: 2},
+		{Verified: false, Line: 4, Message: "no code at line 4"},
+	}
+	if !reflect.DeepEqual(bps.Breakpoints, wantBps) {
+		t.Errorf("wrong breakpoints. want=%+v, got=%+v", wantBps, bps.Breakpoints)
+	}
+
+	var stopped stoppedEvent
+	c.request("configurationDone", nil, nil)
+	c.expectEvent("stopped", &stopped)
+	if stopped.Reason != "breakpoint" || !reflect.DeepEqual(stopped.HitBreakpointIDs, []int{1}) {
+		t.Errorf("wrong stop: %+v", stopped)
+	}
+
+	var trace struct{ StackFrames []stackFrame }
+	c.request("stackTrace", map[string]int{"threadId": threadID}, &trace)
+	wantFrames := []stackFrame{
+		{ID: 1, Name: "sum", Source: &source{Name: "prog.mk", Path: program}, Line: 2, Column: 3},
+		{ID: 2, Name: "<main>", Source: &source{Name: "prog.mk", Path: program}, Line: 5, Column: 9},
+	}
+	if !reflect.DeepEqual(trace.StackFrames, wantFrames) {
+		t.Errorf("wrong stack frames. want=%+v, got=%+v", wantFrames, trace.StackFrames)
+	}
+
+	var scopes struct{ Scopes []scope }
+	c.request("scopes", scopesArguments{FrameID: 1}, &scopes)
+	if len(scopes.Scopes) != 2 {
+		t.Fatalf("wrong scopes: %+v", scopes.Scopes)
+	}
+
+	locals := c.variables(scopes.Scopes[0].VariablesReference)
+	if got := describe(locals); got != `xs=[1, 2] (ARRAY) h={k: [3]} (HASH)` {
+		t.Errorf("wrong locals: %s", got)
+	}
+	if got := describe(c.variables(locals[1].VariablesReference)); got != "k=[3] (ARRAY)" {
+		t.Errorf("wrong pairs of h: %s", got)
+	}
+
+	globals := c.variables(scopes.Scopes[1].VariablesReference)
+	if len(globals) != 1 || globals[0].Name != "sum" {
+		t.Errorf("wrong globals: %+v", globals)
+	}
+
+	// The evaluator steps from statement to statement, so a step out of
+	// sum ends on the statement after the call.
+	steps := []struct {
+		command string
+		line    int
+		depth   int
+	}{
+		{"next", 3, 2},
+		{"stepIn", 6, 1},
+	}
+	for _, step := range steps {
+		c.request(step.command, map[string]int{"threadId": threadID}, nil)
+		c.expectEvent("stopped", &stopped)
+		if stopped.Reason != "step" {
+			t.Errorf("%s: wrong reason %q", step.command, stopped.Reason)
+		}
+
+		c.request("stackTrace", map[string]int{"threadId": threadID}, &trace)
+		if line := trace.StackFrames[0].Line; line != step.line || len(trace.StackFrames) != step.depth {
+			t.Errorf("%s: wrong frames %+v", step.command, trace.StackFrames)
+		}
+	}
+
+	c.request("scopes", scopesArguments{FrameID: 1}, &scopes)
+	globals = c.variables(scopes.Scopes[1].VariablesReference)
+	if got := describe(globals); !strings.HasSuffix(got, " r=6 (INTEGER)") {
+		t.Errorf("wrong globals: %s", got)
+	}
+
+	var exited exitedEvent
+	c.request("continue", map[string]int{"threadId": threadID}, nil)
+	c.expectEvent("exited", &exited)
+	c.expectEvent("terminated", nil)
+	if exited.ExitCode != 0 {
+		t.Errorf("wrong exit code: %d", exited.ExitCode)
+	}
+
+	c.request("disconnect", nil, nil)
+}
+
+func TestEvaluatorRuntimeErrors(t *testing.T) {
+	c, program := startSession(t, "let f = fn() { 1 + true };\nf();")
+
+	c.request("initialize", nil, nil)
+	c.request("launch", launchArguments{Program: program, Engine: "evaluator"}, nil)
+	c.expectEvent("initialized", nil)
+
+	var output outputEvent
+	var exited exitedEvent
+	c.request("configurationDone", nil, nil)
+	c.expectEvent("output", &output)
+	c.expectEvent("exited", &exited)
+	c.expectEvent("terminated", nil)
+
+	want := "type mismatch: INTEGER + BOOLEAN\n" +
+		"\tat f (" + program + ":1:16)\n" +
+		"\tat <main> (" + program + ":2:1)\n"
+	if output.Category != "stderr" || output.Output != want {
+		t.Errorf("wrong output. want=%q, got=%+v", want, output)
+	}
+	if exited.ExitCode != 1 {
+		t.Errorf("wrong exit code: %d", exited.ExitCode)
+	}
+}
+
+func TestRuntimeErrors(t *testing.T) {
+	c, program := startSession(t, "let f = fn() { 1 + true };\nf();")
+
+	c.request("initialize", nil, nil)
+	c.request("launch", launchArguments{Program: program, StopOnEntry: true}, nil)
+	c.expectEvent("initialized", nil)
+
+	var stopped stoppedEvent
+	c.request("configurationDone", nil, nil)
+	c.expectEvent("stopped", &stopped)
+	if stopped.Reason != "entry" {
+		t.Errorf("wrong reason. want=entry, got=%q", stopped.Reason)
+	}
+
+	var output outputEvent
+	var exited exitedEvent
+	c.request("continue", nil, nil)
+	c.expectEvent("output", &output)
+	c.expectEvent("exited", &exited)
+	c.expectEvent("terminated", nil)
+
+	want := "unsupported types for binary operation: INTEGER BOOLEAN\n" +
+		"\tat f (" + program + ":1:16)\n" +
+		"\tat <main> (" + program + ":2:1)\n"
+	if output.Category != "stderr" || output.Output != want {
+		t.Errorf("wrong output. want=%q, got=%+v", want, output)
+	}
+	if exited.ExitCode != 1 {
+		t.Errorf("wrong exit code: %d", exited.ExitCode)
+	}
+}
+
+func TestErrorResponses(t *testing.T) {
+	c, _ := startSession(t, "1")
+
+	tests := []struct {
+		command string
+		message string
+	}{
+		{"stackTrace", "no program launched"},
+		{"launch", "no program given"},
+		{"variables", "no variables with reference 0"},
+		{"evaluate", `unsupported request "evaluate"`},
+	}
+
+	for _, tt := range tests {
+		seq := c.send(tt.command, map[string]string{})
+		msg := c.next()
+		if msg.Success || msg.RequestSeq != seq || msg.Message != tt.message {
+			t.Errorf("%s: wrong response %+v", tt.command, msg)
+		}
+	}
+
+	seq := c.send("launch", launchArguments{Program: "prog.mk", Engine: "jit"})
+	if msg := c.next(); msg.Success || msg.RequestSeq != seq || msg.Message != `unknown engine "jit"` {
+		t.Errorf("launch: wrong response %+v", msg)
+	}
+}
+
+func TestListen(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("cannot listen: %s", err)
+	}
+	defer l.Close()
+	go Listen(l, Loader{})
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	c := &client{t: t, in: bufio.NewReader(conn), out: conn}
+	c.request("initialize", nil, nil)
+	c.request("disconnect", nil, nil)
+}
+
+func (c *client) variables(ref int) []variable {
+	c.t.Helper()
+
+	var body struct{ Variables []variable }
+	c.request("variables", variablesArguments{VariablesReference: ref}, &body)
+	return body.Variables
+}
+
+// describe formats variables as "name=value (type)".
+func describe(vars []variable) string {
+	var out []string
+	for _, v := range vars {
+		out = append(out, v.Name+"="+v.Value+" ("+v.Type+")")
+	}
+	return strings.Join(out, " ")
+}
+
+func TestDisconnectWhileRunning(t *testing.T) {
+	for _, engine := range []string{"vm", "evaluator"} {
+		c, program := startSession(t, "while (true) {}")
+
+		c.request("initialize", nil, nil)
+		c.request("launch", launchArguments{Program: program, Engine: engine}, nil)
+		c.expectEvent("initialized", nil)
+		c.request("configurationDone", nil, nil)
+		c.request("disconnect", nil, nil)
+	}
+}
+
+func TestCloseWhileRunning(t *testing.T) {
+	for _, engine := range []string{"vm", "evaluator"} {
+		c, program := startSession(t, "while (true) {}")
+
+		c.request("initialize", nil, nil)
+		c.request("launch", launchArguments{Program: program, Engine: engine}, nil)
+		c.expectEvent("initialized", nil)
+		c.request("configurationDone", nil, nil)
+
+		// The cleanup closes the connection and waits for Serve to end.
+	}
+}
@@ -0,0 +1,274 @@
+package debugger
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"karaoke/object"
+	"karaoke/vm"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const PROMPT = "(debug) "
+
+const help = `commands:
+  break LINE          set a breakpoint on a source line
+  break [FN]@OFFSET   set a breakpoint on an instruction of FN, or of main
+  delete [ID]         delete a breakpoint, or all of them
+  breakpoints         list the breakpoints
+  continue, c         run to the next breakpoint
+  step, s             run to the next line, stepping into calls
+  next, n             run to the next line, stepping over calls
+  out, o              run until the current call returns
+  stepi, si           run one instruction
+  backtrace, bt       show the call stack
+  locals              show the locals of the current call
+  globals             show the globals
+  stack               show the values on the stack
+  list, l             show the source around the current line
+  help, h             show this help
+  quit, q             stop debugging
+`
+
+type session struct {
+	out     io.Writer
+	machine *vm.VM
+	sources map[string][]string
+}
+
+// Start debugs the program loaded in machine, reading commands from in
+// until it ends or the user quits. The program stops before its first
+// instruction.
+func Start(in io.Reader, out io.Writer, machine *vm.VM) {
+	scanner := bufio.NewScanner(in)
+	s := &session{out: out, machine: machine, sources: map[string][]string{}}
+
+	fmt.Fprint(out, "stopped at entry, ")
+	s.printLocation()
+
+	for {
+		fmt.Fprint(out, PROMPT)
+		scanned := scanner.Scan()
+		if !scanned {
+			return
+		}
+
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if fields[0] == "quit" || fields[0] == "q" {
+			return
+		}
+		s.execute(fields[0], fields[1:])
+	}
+}
+
+func (s *session) execute(cmd string, args []string) {
+	switch cmd {
+	case "break", "b":
+		s.setBreakpoint(args)
+	case "delete", "d":
+		s.deleteBreakpoints(args)
+	case "breakpoints":
+		for _, bp := range s.machine.Breakpoints() {
+			fmt.Fprintf(s.out, "%d  %s\n", bp.ID, describeBreakpoint(bp))
+		}
+	case "continue", "c":
+		s.resume(s.machine.Continue)
+	case "step", "s":
+		s.resume(s.machine.StepInto)
+	case "next", "n":
+		s.resume(s.machine.StepOver)
+	case "out", "o":
+		s.resume(s.machine.StepOut)
+	case "stepi", "si":
+		s.resume(s.machine.StepInstruction)
+	case "backtrace", "bt":
+		for i, frame := range s.machine.CallStack() {
+			fmt.Fprintf(s.out, "#%d %s at %s\n", i, frame.Function, frame.Span.Start)
+		}
+	case "locals":
+		s.printVariables(s.machine.Locals(), "no locals")
+	case "globals":
+		s.printVariables(s.machine.Globals(), "no globals")
+	case "stack":
+		for i, obj := range s.machine.Stack() {
+			fmt.Fprintf(s.out, "%d: %s\n", i, inspect(obj))
+		}
+	case "list", "l":
+		s.list()
+	case "help", "h":
+		io.WriteString(s.out, help)
+	default:
+		fmt.Fprintf(s.out, "unknown command %q, try help\n", cmd)
+	}
+}
+
+// setBreakpoint handles "break LINE" and "break [FN]@OFFSET".
+func (s *session) setBreakpoint(args []string) {
+	if len(args) != 1 {
+		fmt.Fprintln(s.out, "usage: break LINE or break [FN]@OFFSET")
+		return
+	}
+
+	name, offsetArg, isOffset := strings.Cut(args[0], "@")
+	if !isOffset {
+		line, err := strconv.Atoi(args[0])
+		if err != nil {
+			fmt.Fprintf(s.out, "invalid line %q\n", args[0])
+			return
+		}
+
+		bps, err := s.machine.SetBreakpoint("", line)
+		if err != nil {
+			fmt.Fprintln(s.out, err)
+			return
+		}
+		for _, bp := range bps {
+			fmt.Fprintf(s.out, "breakpoint %d at %s\n", bp.ID, describeBreakpoint(bp))
+		}
+		return
+	}
+
+	offset, err := strconv.Atoi(offsetArg)
+	if err != nil {
+		fmt.Fprintf(s.out, "invalid offset %q\n", offsetArg)
+		return
+	}
+
+	fn := s.function(name)
+	if fn == nil {
+		fmt.Fprintf(s.out, "no function named %q\n", name)
+		return
+	}
+
+	bp, err := s.machine.SetInstructionBreakpoint(fn, offset)
+	if err != nil {
+		fmt.Fprintln(s.out, err)
+		return
+	}
+	fmt.Fprintf(s.out, "breakpoint %d at %s\n", bp.ID, describeBreakpoint(bp))
+}
+
+// function finds a function by name. An empty name is the main program.
+func (s *session) function(name string) *object.CompiledFunction {
+	fns := s.machine.Functions()
+	if name == "" {
+		return fns[0]
+	}
+	for _, fn := range fns {
+		if fn.Name == name {
+			return fn
+		}
+	}
+	return nil
+}
+
+func (s *session) deleteBreakpoints(args []string) {
+	if len(args) == 0 {
+		s.machine.ClearBreakpoints()
+		return
+	}
+
+	for _, arg := range args {
+		id, err := strconv.Atoi(arg)
+		if err != nil || !s.machine.ClearBreakpoint(id) {
+			fmt.Fprintf(s.out, "no breakpoint %s\n", arg)
+		}
+	}
+}
+
+func (s *session) resume(run func() (*vm.Stop, error)) {
+	stop, err := run()
+	if err != nil {
+		fmt.Fprintf(s.out, "execution failed: %s\n", err)
+		if rerr, ok := err.(*vm.RuntimeError); ok {
+			io.WriteString(s.out, rerr.StackTrace())
+		}
+		return
+	}
+
+	switch stop.Reason {
+	case vm.StopExited:
+		fmt.Fprintf(s.out, "program exited: %s\n", inspect(s.machine.LastPoppedStackElem()))
+	case vm.StopBreakpoint:
+		fmt.Fprintf(s.out, "breakpoint %d, ", stop.Breakpoint.ID)
+		s.printLocation()
+	default:
+		s.printLocation()
+	}
+}
+
+// printLocation shows the function and the source line the program is
+// stopped at.
+func (s *session) printLocation() {
+	frame := s.machine.CallStack()[0]
+	fmt.Fprintf(s.out, "%s at %s\n", frame.Function, frame.Span.Start)
+
+	line := frame.Span.Start.Line
+	if text, ok := s.sourceLine(frame.Span.Start.File, line); ok {
+		fmt.Fprintf(s.out, "%4d  %s\n", line, text)
+	}
+}
+
+func (s *session) list() {
+	start := s.machine.CallStack()[0].Span.Start
+	for line := start.Line - 2; line <= start.Line+2; line++ {
+		text, ok := s.sourceLine(start.File, line)
+		if !ok {
+			continue
+		}
+
+		marker := "  "
+		if line == start.Line {
+			marker = "=>"
+		}
+		fmt.Fprintf(s.out, "%s%4d  %s\n", marker, line, text)
+	}
+}
+
+// sourceLine returns a line of a source file, reading the file the first
+// time it is needed.
+func (s *session) sourceLine(file string, line int) (string, bool) {
+	lines, ok := s.sources[file]
+	if !ok && file != "" {
+		input, err := os.ReadFile(file)
+		if err == nil {
+			lines = strings.Split(string(input), "\n")
+		}
+		s.sources[file] = lines
+	}
+
+	if line < 1 || line > len(lines) {
+		return "", false
+	}
+	return lines[line-1], true
+}
+
+func (s *session) printVariables(vars []vm.Variable, none string) {
+	if len(vars) == 0 {
+		fmt.Fprintln(s.out, none)
+	}
+	for _, v := range vars {
+		fmt.Fprintf(s.out, "%s = %s\n", v.Name, v.Value.Inspect())
+	}
+}
+
+func describeBreakpoint(bp *vm.Breakpoint) string {
+	name := bp.Fn.Name
+	if name == "" {
+		name = "<anonymous>"
+	}
+	return fmt.Sprintf("%s@%d (%s)", name, bp.Offset, bp.Span.Start)
+}
+
+// inspect is Inspect for a stack slot, which can be empty.
+func inspect(obj object.Object) string {
+	if obj == nil {
+		return "-"
+	}
+	return obj.Inspect()
+}
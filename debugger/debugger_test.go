@@ -0,0 +1,88 @@
+package debugger
+
+import (
+	"karaoke/compiler"
+	"karaoke/lexer"
+	"karaoke/parser"
+	"karaoke/vm"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const input = `let add = fn(a, b) {
+  let sum = a + b;
+  sum * 2
+};
+let x = add(1, 2);
+add(x, 3)`
+
+func TestSession(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "add.mk")
+	err := os.WriteFile(file, []byte(input), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := parser.New(lexer.NewWithFile(file, input))
+	comp := compiler.New(compiler.Peephole(false))
+	err = comp.Compile(p.ParseProgram())
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	commands := []string{
+		"break 2",
+		"break 9",
+		"break add@1",
+		"continue",
+		"bt",
+		"locals",
+		"next",
+		"out",
+		"delete 1",
+		"step",
+		"step",
+		"globals",
+		"list",
+		"continue",
+		"quit",
+	}
+
+	var out strings.Builder
+	Start(strings.NewReader(strings.Join(commands, "\n")), &out, vm.New(comp.Bytecode()))
+
+	want := []string{
+		"stopped at entry, <main> at " + file + ":1:11",
+		"   1  let add = fn(a, b) {",
+		"breakpoint 1 at add@0 (" + file + ":2:13)",
+		"no code at line 9",
+		"no instruction at offset 1 in add",
+		"breakpoint 1, add at " + file + ":2:13",
+		"   2    let sum = a + b;",
+		"#0 add at " + file + ":2:13",
+		"#1 <main> at " + file + ":5:9",
+		"a = 1",
+		"b = 2",
+		"add at " + file + ":3:3",
+		"<main> at " + file + ":5:1",
+		"<main> at " + file + ":6:1",
+		"add at " + file + ":2:13",
+		"x = 6",
+		"     1  let add = fn(a, b) {",
+		"=>   2    let sum = a + b;",
+		"     3    sum * 2",
+		"     4  };",
+		"program exited: 18",
+	}
+
+	got := out.String()
+	for _, w := range want {
+		i := strings.Index(got, w+"\n")
+		if i < 0 {
+			t.Fatalf("output is missing %q after the previous line. output:\n%s", w, out.String())
+		}
+		got = got[i+len(w):]
+	}
+}
@@ -0,0 +1,182 @@
+package disasm
+
+import (
+	"fmt"
+	"io"
+	"karaoke/code"
+	"karaoke/compiler"
+	"karaoke/object"
+	"sort"
+	"strings"
+)
+
+// constOps are the opcodes whose first operand indexes the constant pool.
+var constOps = map[code.Opcode]bool{
+	code.OpConstant: true,
+	code.OpClosure:  true,
+}
+
+type instruction struct {
+	offset   int
+	op       code.Opcode
+	def      *code.Definition
+	operands []int
+}
+
+// Disassemble writes a listing of bc to w: the main program, the constant
+// pool and every compiled function in the pool under its own header.
+// Jump targets are shown as labels. Malformed bytecode, such as an
+// unknown opcode, a truncated operand or a jump into the middle of an
+// instruction, is reported as an error.
+func Disassemble(w io.Writer, bc *compiler.Bytecode) error {
+	fmt.Fprintln(w, "== main ==")
+	err := Instructions(w, bc.Instructions, bc.Constants)
+	if err != nil {
+		return fmt.Errorf("main: %w", err)
+	}
+
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "== constants ==")
+	for i, con := range bc.Constants {
+		fmt.Fprintf(w, "%04d %s\n", i, describeConstant(i, con))
+	}
+
+	for i, con := range bc.Constants {
+		fn, ok := con.(*object.CompiledFunction)
+		if !ok {
+			continue
+		}
+
+		fmt.Fprintln(w)
+		fmt.Fprintf(w, "== %s ==\n", describeConstant(i, fn))
+		err := Instructions(w, fn.Instructions, bc.Constants)
+		if err != nil {
+			return fmt.Errorf("function %d: %w", i, err)
+		}
+	}
+
+	return nil
+}
+
+// Instructions writes the listing of a single instruction stream to w.
+// Constant operands are checked against and annotated from constants.
+func Instructions(w io.Writer, ins code.Instructions, constants []object.Object) error {
+	decoded, err := decode(ins)
+	if err != nil {
+		return err
+	}
+
+	labels, err := jumpLabels(decoded, len(ins))
+	if err != nil {
+		return err
+	}
+
+	for _, in := range decoded {
+		if label, ok := labels[in.offset]; ok {
+			fmt.Fprintf(w, "%s:\n", label)
+		}
+
+		name := in.def.Name
+		if code.Opcode(ins[in.offset]) == code.OpWide {
+			name = "OpWide " + name
+		}
+
+		line := fmt.Sprintf("%04d %s", in.offset, name)
+		if len(in.operands) > 0 {
+			operands := make([]string, len(in.operands))
+			for i, o := range in.operands {
+				operands[i] = fmt.Sprint(o)
+			}
+			if code.IsJump(in.op) {
+				operands[0] = labels[in.operands[0]]
+			}
+			line += " " + strings.Join(operands, " ")
+		}
+
+		if constOps[in.op] {
+			idx := in.operands[0]
+			if idx >= len(constants) {
+				return fmt.Errorf("%s at %d: constant %d out of range (pool has %d)",
+					in.def.Name, in.offset, idx, len(constants))
+			}
+			line += " ; " + describeConstant(idx, constants[idx])
+		}
+
+		fmt.Fprintln(w, line)
+	}
+
+	if label, ok := labels[len(ins)]; ok {
+		fmt.Fprintf(w, "%s:\n", label)
+	}
+
+	return nil
+}
+
+func decode(ins code.Instructions) ([]instruction, error) {
+	decoded := []instruction{}
+
+	for offset := 0; offset < len(ins); {
+		def, operands, width, err := ins.ReadInstruction(offset)
+		if err != nil {
+			return nil, fmt.Errorf("offset %d: %w", offset, err)
+		}
+
+		decoded = append(decoded, instruction{
+			offset:   offset,
+			op:       ins.OpcodeAt(offset),
+			def:      def,
+			operands: operands,
+		})
+		offset += width
+	}
+
+	return decoded, nil
+}
+
+// jumpLabels names every jump target L1, L2, ... in offset order. A target
+// must be the start of an instruction or the end of the stream.
+func jumpLabels(decoded []instruction, end int) (map[int]string, error) {
+	starts := map[int]bool{end: true}
+	for _, in := range decoded {
+		starts[in.offset] = true
+	}
+
+	targets := []int{}
+	seen := map[int]bool{}
+	for _, in := range decoded {
+		if !code.IsJump(in.op) {
+			continue
+		}
+
+		target := in.operands[0]
+		if !starts[target] {
+			return nil, fmt.Errorf("%s at %d: target %d is not an instruction boundary",
+				in.def.Name, in.offset, target)
+		}
+		if !seen[target] {
+			seen[target] = true
+			targets = append(targets, target)
+		}
+	}
+
+	sort.Ints(targets)
+
+	labels := make(map[int]string, len(targets))
+	for i, target := range targets {
+		labels[target] = fmt.Sprintf("L%d", i+1)
+	}
+
+	return labels, nil
+}
+
+func describeConstant(idx int, con object.Object) string {
+	switch con := con.(type) {
+	case *object.CompiledFunction:
+		return fmt.Sprintf("fn#%d (params=%d, locals=%d)",
+			idx, con.NumParameters, con.NumLocals)
+	case *object.String:
+		return fmt.Sprintf("%s %q", con.Type(), con.Value)
+	default:
+		return fmt.Sprintf("%s %s", con.Type(), con.Inspect())
+	}
+}
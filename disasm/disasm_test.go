@@ -0,0 +1,114 @@
+package disasm
+
+import (
+	"bytes"
+	"karaoke/code"
+	"karaoke/compiler"
+	"karaoke/lexer"
+	"karaoke/object"
+	"karaoke/parser"
+	"testing"
+)
+
+func TestDisassemble(t *testing.T) {
+	input := `let f = fn(x) { if (x) { "yes" } else { 2 } }; f(true);`
+
+	expected := `== main ==
+0000 OpClosure 2 0 ; fn#2 (params=1, locals=1)
+0004 OpDup
+0005 OpSetGlobal 0
+0008 OpTrue
+0009 OpCall 1
+0011 OpPop
+
+== constants ==
+0000 STRING "yes"
+0001 INTEGER 2
+0002 fn#2 (params=1, locals=1)
+
+== fn#2 (params=1, locals=1) ==
+0000 OpGetLocal 0
+0002 OpJumpNotTruthy L1
+0005 OpConstant 0 ; STRING "yes"
+0008 OpJump L2
+L1:
+0011 OpConstant 1 ; INTEGER 2
+L2:
+0014 OpReturnValue
+`
+
+	l := lexer.New(input)
+	p := parser.New(l)
+	program := p.ParseProgram()
+
+	comp := compiler.New()
+	err := comp.Compile(program)
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	var out bytes.Buffer
+	err = Disassemble(&out, comp.Bytecode())
+	if err != nil {
+		t.Fatalf("Disassemble failed: %s", err)
+	}
+
+	if out.String() != expected {
+		t.Errorf("wrong listing.\nwant=%q\ngot =%q", expected, out.String())
+	}
+}
+
+func TestDisassembleMalformed(t *testing.T) {
+	tests := []struct {
+		bytecode *compiler.Bytecode
+		expected string
+	}{
+		{
+			&compiler.Bytecode{Instructions: code.Instructions{byte(code.OpPop), 250}},
+			"main: offset 1: opcode 250 undefined",
+		},
+		{
+			&compiler.Bytecode{Instructions: code.Make(code.OpConstant, 1)[:2]},
+			"main: offset 0: OpConstant at 0 truncated: want 3 bytes, have 2",
+		},
+		{
+			&compiler.Bytecode{Instructions: concat(
+				code.Make(code.OpJump, 2),
+				code.Make(code.OpNull),
+			)},
+			"main: OpJump at 0: target 2 is not an instruction boundary",
+		},
+		{
+			&compiler.Bytecode{Instructions: code.Make(code.OpConstant, 3)},
+			"main: OpConstant at 0: constant 3 out of range (pool has 0)",
+		},
+		{
+			&compiler.Bytecode{
+				Instructions: code.Make(code.OpClosure, 0, 0),
+				Constants: []object.Object{
+					&object.CompiledFunction{Instructions: code.Instructions{255}},
+				},
+			},
+			"function 0: offset 0: opcode 255 undefined",
+		},
+	}
+
+	for _, tt := range tests {
+		err := Disassemble(&bytes.Buffer{}, tt.bytecode)
+		if err == nil {
+			t.Errorf("expected error %q but got none", tt.expected)
+			continue
+		}
+		if err.Error() != tt.expected {
+			t.Errorf("wrong error. want=%q, got=%q", tt.expected, err)
+		}
+	}
+}
+
+func concat(insts ...code.Instructions) code.Instructions {
+	out := code.Instructions{}
+	for _, ins := range insts {
+		out = append(out, ins...)
+	}
+	return out
+}
@@ -0,0 +1,426 @@
+package evaluator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"karaoke/ast"
+	"karaoke/object"
+	"karaoke/token"
+	"strings"
+)
+
+// The debugger runs the program in a goroutine of its own. Before every
+// statement the evaluator asks it whether to pause there; if so the
+// goroutine hands the stop to the resume that is waiting for it and waits
+// in turn for the next resume, so only one of them runs at a time.
+
+var errDetached = errors.New("debugger closed")
+
+const mainName = "<main>"
+
+// A StopReason says why the program stopped.
+type StopReason string
+
+const (
+	StopBreakpoint StopReason = "breakpoint"
+	StopStep       StopReason = "step"
+	StopExited     StopReason = "exited"
+)
+
+// A Stop is where a Continue or a step ended. Breakpoint is the breakpoint
+// that was hit, for StopBreakpoint.
+type Stop struct {
+	Reason     StopReason
+	Breakpoint *Breakpoint
+}
+
+// A Breakpoint pauses the program before the statement at Pos runs.
+type Breakpoint struct {
+	ID  int
+	Pos token.Position
+}
+
+// A Variable is a named global or local with a value.
+type Variable struct {
+	Name  string
+	Value object.Object
+}
+
+// A DebugFrame is one call on the call stack. Pos is the statement the
+// frame runs next, or for a caller the call it is in.
+type DebugFrame struct {
+	Function string
+	Pos      token.Position
+	Locals   []Variable
+}
+
+// A RuntimeError is an error the debugged program failed with. Trace
+// holds the calls that were running, innermost first. Calls replaced by
+// tail calls are not in it.
+type RuntimeError struct {
+	Message string
+	Trace   []DebugFrame
+}
+
+func (e *RuntimeError) Error() string { return e.Message }
+
+// StackTrace formats the trace with one call per line.
+func (e *RuntimeError) StackTrace() string {
+	var out strings.Builder
+	for _, f := range e.Trace {
+		fmt.Fprintf(&out, "\tat %s (%s)\n", f.Function, f.Pos)
+	}
+	return out.String()
+}
+
+// A frame is a call the debugged program is running.
+type frame struct {
+	name string
+	env  *object.Environment
+	pos  token.Position
+}
+
+// A location is where the program is about to run a statement.
+type location struct {
+	depth int
+	pos   token.Position
+}
+
+func (l location) sameLine(other location) bool {
+	return l.pos.File == other.pos.File && l.pos.Line == other.pos.Line
+}
+
+// A stepFunc reports whether a step from where it was made ends at loc.
+type stepFunc func(loc location) bool
+
+// A result is what a resume comes back with: a stop, or the end of the
+// program with the error it failed with, if any.
+type result struct {
+	stop *Stop
+	err  error
+}
+
+// A Debugger runs a program in an Evaluator under the control of its
+// caller, who sets breakpoints and continues or steps through it.
+type Debugger struct {
+	e       *Evaluator
+	ctx     context.Context
+	program *ast.Program
+	env     *object.Environment
+
+	breakpoints map[ast.Statement]*Breakpoint
+	nextID      int
+
+	frames  []*frame
+	current location // where the program paused last
+	first   bool     // the next statement is the first one of the run
+	step    stepFunc // nil when continuing
+	trace   []DebugFrame
+
+	started bool
+	end     *result // how the program ended, once it did
+	resumes chan struct{}
+	results chan result
+	quit    chan struct{}
+}
+
+// Debug returns a Debugger for program in env. The program stops before
+// its first statement; it runs within the evaluator's limits and until
+// ctx is done once it is continued or stepped.
+func (e *Evaluator) Debug(ctx context.Context, program *ast.Program, env *object.Environment) *Debugger {
+	d := &Debugger{
+		e:           e,
+		ctx:         ctx,
+		program:     program,
+		env:         env,
+		breakpoints: map[ast.Statement]*Breakpoint{},
+		current:     location{depth: 1},
+		resumes:     make(chan struct{}),
+		results:     make(chan result, 1),
+		quit:        make(chan struct{}),
+	}
+	if len(program.Statements) > 0 {
+		d.current.pos = program.Statements[0].Pos()
+	}
+	return d
+}
+
+// run evaluates the program in the debugger's goroutine.
+func (d *Debugger) run() {
+	d.e.debugger = d
+	defer func() { d.e.debugger = nil }()
+
+	d.frames = []*frame{{name: mainName, env: d.env}}
+	obj, err := d.e.EvalContext(d.ctx, d.program, d.env)
+	d.frames = nil
+
+	if rerr, ok := obj.(*object.Error); ok && err == nil {
+		err = &RuntimeError{Message: rerr.Message, Trace: d.trace}
+	}
+	d.results <- result{stop: &Stop{Reason: StopExited}, err: err}
+}
+
+// pause is called before every statement and waits there for the next
+// resume if the program stops at it. A breakpoint is hit even by the
+// first statement of a run; a step always runs at least one.
+func (d *Debugger) pause(st ast.Statement) {
+	select {
+	case <-d.quit:
+		return
+	default:
+	}
+
+	loc := location{depth: len(d.frames), pos: st.Pos()}
+	d.frames[len(d.frames)-1].pos = loc.pos
+
+	first := d.first
+	d.first = false
+
+	var stop *Stop
+	if bp, ok := d.breakpoints[st]; ok {
+		stop = &Stop{Reason: StopBreakpoint, Breakpoint: bp}
+	} else if !first && d.step != nil && d.step(loc) {
+		stop = &Stop{Reason: StopStep}
+	}
+	if stop == nil {
+		return
+	}
+
+	d.current = loc
+	d.results <- result{stop: stop}
+	select {
+	case <-d.resumes:
+	case <-d.quit:
+		d.e.stop(errDetached)
+	}
+}
+
+// enter records a call of fn with its locals in env at depth. A tail call
+// replaces the frame at that depth.
+func (d *Debugger) enter(depth int, fn *object.Function, env *object.Environment) {
+	name := fn.Name
+	if name == "" {
+		name = "<anonymous>"
+	}
+	d.frames = append(d.frames[:depth], &frame{name: name, env: env})
+}
+
+// leave drops the frames from depth on.
+func (d *Debugger) leave(depth int) {
+	d.frames = d.frames[:depth]
+}
+
+// fail records the calls running where err came out first.
+func (d *Debugger) fail(err *object.Error) {
+	if d.trace == nil {
+		d.frames[len(d.frames)-1].pos = err.Pos
+		d.trace = d.CallStack()
+	}
+}
+
+// resume runs the program until a breakpoint, the end of step or the end
+// of the program. Once the program ended every resume reports it again.
+func (d *Debugger) resume(step stepFunc) (*Stop, error) {
+	if d.end != nil {
+		return d.end.stop, d.end.err
+	}
+
+	d.step = step
+	if !d.started {
+		d.started, d.first = true, true
+		go d.run()
+	} else {
+		d.resumes <- struct{}{}
+	}
+
+	r := <-d.results
+	if r.err != nil || r.stop.Reason == StopExited {
+		d.end = &r
+		if r.err != nil {
+			r.stop = nil
+		}
+	}
+	return r.stop, r.err
+}
+
+// Continue runs the program until it hits a breakpoint or ends. An error
+// the program fails with is a *RuntimeError.
+func (d *Debugger) Continue() (*Stop, error) {
+	return d.resume(nil)
+}
+
+// StepInto runs the program to the next source line, entering calls.
+func (d *Debugger) StepInto() (*Stop, error) {
+	start := d.current
+	return d.resume(func(loc location) bool {
+		return loc.depth != start.depth || !loc.sameLine(start)
+	})
+}
+
+// StepOver runs the program to the next source line of the current call,
+// or of its caller once it returns. Calls it makes run to their end
+// unless they hit a breakpoint.
+func (d *Debugger) StepOver() (*Stop, error) {
+	start := d.current
+	return d.resume(func(loc location) bool {
+		return loc.depth < start.depth || loc.depth == start.depth && !loc.sameLine(start)
+	})
+}
+
+// StepOut runs the program until the current call returns to its caller.
+func (d *Debugger) StepOut() (*Stop, error) {
+	start := d.current
+	return d.resume(func(loc location) bool {
+		return loc.depth < start.depth
+	})
+}
+
+// Close stops a program that is paused, ending its goroutine. The
+// Debugger cannot be resumed afterwards.
+func (d *Debugger) Close() {
+	if d.started && d.end == nil {
+		close(d.quit)
+		d.end = &result{err: errDetached}
+	}
+}
+
+// SetBreakpoint sets a breakpoint on the first statement on line in the
+// program and in every function that has one there. An empty file
+// matches any file.
+func (d *Debugger) SetBreakpoint(file string, line int) ([]*Breakpoint, error) {
+	var stmts []ast.Statement
+	statementsOnLine(d.program, file, line, new(bool), &stmts)
+
+	var bps []*Breakpoint
+	for _, st := range stmts {
+		bp, ok := d.breakpoints[st]
+		if !ok {
+			d.nextID++
+			bp = &Breakpoint{ID: d.nextID, Pos: st.Pos()}
+			d.breakpoints[st] = bp
+		}
+		bps = append(bps, bp)
+	}
+
+	if len(bps) == 0 {
+		return nil, fmt.Errorf("no code at line %d", line)
+	}
+	return bps, nil
+}
+
+// statementsOnLine appends to stmts the first statement on line of every
+// function in node. found says whether the function node is in has one.
+func statementsOnLine(node ast.Node, file string, line int, found *bool, stmts *[]ast.Statement) {
+	if st, ok := node.(ast.Statement); ok && !*found {
+		pos := st.Pos()
+		_, block := st.(*ast.BlockStatement)
+		if !block && pos.Line == line && (file == "" || pos.File == file) {
+			*stmts = append(*stmts, st)
+			*found = true
+		}
+	}
+
+	walk := func(n ast.Node) {
+		statementsOnLine(n, file, line, found, stmts)
+	}
+
+	switch n := node.(type) {
+	case *ast.Program:
+		for _, st := range n.Statements {
+			walk(st)
+		}
+	case *ast.BlockStatement:
+		for _, st := range n.Statements {
+			walk(st)
+		}
+	case *ast.LetStatement:
+		walk(n.Value)
+	case *ast.ReturnStatement:
+		walk(n.ReturnValue)
+	case *ast.ExpressionStatement:
+		walk(n.Expression)
+	case *ast.WhileStatement:
+		walk(n.Condition)
+		walk(n.Body)
+	case *ast.ForStatement:
+		walk(n.Iterable)
+		walk(n.Body)
+
+	case *ast.FunctionLiteral:
+		statementsOnLine(n.Body, file, line, new(bool), stmts)
+	case *ast.PrefixExpression:
+		walk(n.Right)
+	case *ast.InfixExpression:
+		walk(n.Left)
+		walk(n.Right)
+	case *ast.AssignExpression:
+		walk(n.Target)
+		walk(n.Value)
+	case *ast.IfExpression:
+		walk(n.Condition)
+		walk(n.Consequence)
+		if n.Alternative != nil {
+			walk(n.Alternative)
+		}
+	case *ast.CallExpression:
+		walk(n.Function)
+		for _, arg := range n.Arguments {
+			walk(arg)
+		}
+	case *ast.IndexExpression:
+		walk(n.Left)
+		walk(n.Index)
+	case *ast.ArrayLiteral:
+		for _, elem := range n.Elements {
+			walk(elem)
+		}
+	case *ast.HashLiteral:
+		for key, value := range n.Pairs {
+			walk(key)
+			walk(value)
+		}
+	}
+}
+
+// ClearBreakpoint removes the breakpoint with the given id and reports
+// whether there was one.
+func (d *Debugger) ClearBreakpoint(id int) bool {
+	for st, bp := range d.breakpoints {
+		if bp.ID == id {
+			delete(d.breakpoints, st)
+			return true
+		}
+	}
+	return false
+}
+
+// CallStack returns the calls that are running, innermost first. Calls
+// replaced by tail calls are not in it.
+func (d *Debugger) CallStack() []DebugFrame {
+	frames := make([]DebugFrame, 0, len(d.frames))
+	for i := len(d.frames) - 1; i >= 0; i-- {
+		f := d.frames[i]
+
+		var locals []Variable
+		if i > 0 {
+			locals = variables(f.env)
+		}
+		frames = append(frames, DebugFrame{Function: f.name, Pos: f.pos, Locals: locals})
+	}
+	return frames
+}
+
+// Globals returns the variables of the program's environment.
+func (d *Debugger) Globals() []Variable {
+	return variables(d.env)
+}
+
+func variables(env *object.Environment) []Variable {
+	var vars []Variable
+	for _, name := range env.Names() {
+		value, _ := env.Get(name)
+		vars = append(vars, Variable{Name: name, Value: value})
+	}
+	return vars
+}
@@ -0,0 +1,227 @@
+package evaluator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"karaoke/lexer"
+	"karaoke/object"
+	"karaoke/parser"
+	"strings"
+	"testing"
+)
+
+const debugInput = `let add = fn(a, b) {
+  let sum = a + b;
+  sum * 2
+};
+let x = add(1, 2);
+let y = add(x, 3);
+y + 0`
+
+func newDebugger(input string, opts ...Option) *Debugger {
+	program := parser.New(lexer.NewWithFile("debug.mk", input)).ParseProgram()
+	return New(opts...).Debug(context.Background(), program, object.NewEnvironment())
+}
+
+// describeStop formats where the program stopped as "reason function
+// line".
+func describeStop(t *testing.T, d *Debugger, stop *Stop, err error) string {
+	t.Helper()
+
+	if err != nil {
+		t.Fatalf("debugger error: %s", err)
+	}
+	if stop.Reason == StopExited {
+		return string(stop.Reason)
+	}
+	frame := d.CallStack()[0]
+	return fmt.Sprintf("%s %s %d", stop.Reason, frame.Function, frame.Pos.Line)
+}
+
+func describeVariables(vars []Variable) string {
+	var out []string
+	for _, v := range vars {
+		out = append(out, v.Name+"="+v.Value.Inspect())
+	}
+	return strings.Join(out, " ")
+}
+
+func TestDebugLineBreakpoints(t *testing.T) {
+	d := newDebugger(debugInput)
+	defer d.Close()
+
+	bps, err := d.SetBreakpoint("debug.mk", 2)
+	if err != nil {
+		t.Fatalf("SetBreakpoint: %s", err)
+	}
+	if len(bps) != 1 || bps[0].Pos.Line != 2 || bps[0].Pos.Column != 3 {
+		t.Fatalf("wrong breakpoints: %+v", bps)
+	}
+
+	_, err = d.SetBreakpoint("", 4)
+	if err == nil || err.Error() != "no code at line 4" {
+		t.Errorf("wrong error for a line without code: %v", err)
+	}
+	_, err = d.SetBreakpoint("other.mk", 2)
+	if err == nil {
+		t.Errorf("expected an error for another file")
+	}
+
+	tests := []struct {
+		locals  string
+		globals string
+		callers string
+	}{
+		{"a=1 b=2", "add", "<main> 5"},
+		{"a=6 b=3", "add x", "<main> 6"},
+	}
+
+	for _, tt := range tests {
+		stop, err := d.Continue()
+		if got := describeStop(t, d, stop, err); got != "breakpoint add 2" {
+			t.Fatalf("wrong stop: %s", got)
+		}
+		if stop.Breakpoint != bps[0] {
+			t.Errorf("wrong breakpoint: %+v", stop.Breakpoint)
+		}
+
+		frames := d.CallStack()
+		if got := describeVariables(frames[0].Locals); got != tt.locals {
+			t.Errorf("wrong locals. want=%q, got=%q", tt.locals, got)
+		}
+		var globals []string
+		for _, v := range d.Globals() {
+			globals = append(globals, v.Name)
+		}
+		if got := strings.Join(globals, " "); got != tt.globals {
+			t.Errorf("wrong globals. want=%q, got=%q", tt.globals, got)
+		}
+		caller := fmt.Sprintf("%s %d", frames[1].Function, frames[1].Pos.Line)
+		if len(frames) != 2 || caller != tt.callers {
+			t.Errorf("wrong callers. want=%q, got=%q", tt.callers, caller)
+		}
+	}
+
+	if !d.ClearBreakpoint(bps[0].ID) || d.ClearBreakpoint(bps[0].ID) {
+		t.Errorf("ClearBreakpoint does not report whether there was one")
+	}
+	stop, err := d.Continue()
+	if got := describeStop(t, d, stop, err); got != "exited" {
+		t.Errorf("wrong stop after clearing: %s", got)
+	}
+}
+
+func TestDebugStepping(t *testing.T) {
+	tests := []struct {
+		name  string
+		step  func(*Debugger) (*Stop, error)
+		stops []string
+	}{
+		{"StepOver", (*Debugger).StepOver, []string{
+			"step <main> 5", "step <main> 6", "step <main> 7", "exited",
+		}},
+		{"StepInto", (*Debugger).StepInto, []string{
+			"step <main> 5", "step add 2", "step add 3", "step <main> 6",
+			"step add 2", "step add 3", "step <main> 7", "exited",
+		}},
+	}
+
+	for _, tt := range tests {
+		d := newDebugger(debugInput)
+		for _, want := range tt.stops {
+			stop, err := tt.step(d)
+			if got := describeStop(t, d, stop, err); got != want {
+				t.Fatalf("%s: wrong stop. want=%q, got=%q", tt.name, want, got)
+			}
+		}
+	}
+}
+
+func TestDebugStepOut(t *testing.T) {
+	d := newDebugger(debugInput)
+	defer d.Close()
+
+	d.SetBreakpoint("", 2)
+	d.Continue()
+	d.ClearBreakpoint(1)
+
+	stop, err := d.StepOut()
+	if got := describeStop(t, d, stop, err); got != "step <main> 6" {
+		t.Errorf("wrong stop: %s", got)
+	}
+	if globals := d.Globals(); len(globals) != 2 || describeVariables(globals[1:]) != "x=6" {
+		t.Errorf("wrong globals: %s", describeVariables(globals))
+	}
+}
+
+func TestDebugTailCalls(t *testing.T) {
+	d := newDebugger(`let f = fn(n) {
+  if (n == 0) { return 0; }
+  f(n - 1)
+};
+f(3)`)
+
+	d.SetBreakpoint("", 2)
+	for n := 3; n >= 0; n-- {
+		stop, err := d.Continue()
+		if got := describeStop(t, d, stop, err); got != "breakpoint f 2" {
+			t.Fatalf("wrong stop: %s", got)
+		}
+
+		// Every call replaces the one it is made in.
+		frames := d.CallStack()
+		want := fmt.Sprintf("n=%d", n)
+		if len(frames) != 2 || describeVariables(frames[0].Locals) != want {
+			t.Errorf("wrong frames for %s: %+v", want, frames)
+		}
+	}
+
+	stop, err := d.Continue()
+	if got := describeStop(t, d, stop, err); got != "exited" {
+		t.Errorf("wrong stop: %s", got)
+	}
+}
+
+func TestDebugRuntimeError(t *testing.T) {
+	d := newDebugger("let f = fn() { 1 + true };\nf();")
+
+	for i := 0; i < 2; i++ {
+		_, err := d.Continue()
+
+		var rerr *RuntimeError
+		if !errors.As(err, &rerr) {
+			t.Fatalf("expected a *RuntimeError, got %T (%v)", err, err)
+		}
+		want := "\tat f (debug.mk:1:16)\n\tat <main> (debug.mk:2:1)\n"
+		if rerr.Message != "type mismatch: INTEGER + BOOLEAN" || rerr.StackTrace() != want {
+			t.Errorf("wrong error: %s\n%s", rerr, rerr.StackTrace())
+		}
+	}
+}
+
+func TestDebugLimits(t *testing.T) {
+	d := newDebugger("while (true) { 1 }", StepBudget(100))
+
+	_, err := d.Continue()
+	var budgetErr *object.BudgetExceededError
+	if !errors.As(err, &budgetErr) {
+		t.Errorf("expected a *object.BudgetExceededError, got %T (%v)", err, err)
+	}
+}
+
+func TestDebugClose(t *testing.T) {
+	d := newDebugger(debugInput)
+
+	d.SetBreakpoint("", 2)
+	stop, err := d.Continue()
+	if got := describeStop(t, d, stop, err); got != "breakpoint add 2" {
+		t.Fatalf("wrong stop: %s", got)
+	}
+
+	d.Close()
+	_, err = d.Continue()
+	if err == nil || err.Error() != "debugger closed" {
+		t.Errorf("wrong error after Close: %v", err)
+	}
+}
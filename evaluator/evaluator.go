@@ -1,6 +1,7 @@
 package evaluator
 
 import (
+	"context"
 	"fmt"
 	"karaoke/ast"
 	"karaoke/object"
@@ -12,65 +13,220 @@ var (
 	FALSE = &object.Boolean{Value: false}
 )
 
+// MaxDepth is how deeply calls may nest unless DepthLimit says otherwise.
+// Every nested call takes Go stack, so without a limit deep recursion
+// would crash the host rather than fail the run.
+const MaxDepth = 1024
+
+// checkInterval is how many steps run between two looks at the context.
+const checkInterval = 1024
+
+// An Evaluator evaluates programs within the limits it was created with.
+type Evaluator struct {
+	budget   int64 // the steps a run may take, 0 for no limit
+	memory   int64 // the bytes a run may allocate, 0 for no limit
+	maxDepth int   // how deeply calls may nest, 0 for no limit
+
+	ctx       context.Context
+	steps     int64
+	allocated int64
+	depth     int
+	err       error         // why the run was stopped
+	stopped   *object.Error // what every evaluation returns once it was
+	debugger  *Debugger     // the debugger running the program, if any
+}
+
+// An Option configures an Evaluator created by New.
+type Option func(*Evaluator)
+
+// StepBudget limits every run to n steps, one per node evaluated.
+func StepBudget(n int64) Option {
+	return func(e *Evaluator) {
+		e.budget = n
+	}
+}
+
+// MemoryLimit limits the bytes every run may allocate for strings, arrays
+// and hashes, as estimated by object.SizeOf.
+func MemoryLimit(n int64) Option {
+	return func(e *Evaluator) {
+		e.memory = n
+	}
+}
+
+// DepthLimit limits how deeply calls may nest in every run to n instead
+// of MaxDepth, or not at all for 0. Tail calls do not nest.
+func DepthLimit(n int) Option {
+	return func(e *Evaluator) {
+		e.maxDepth = n
+	}
+}
+
+func New(opts ...Option) *Evaluator {
+	e := &Evaluator{maxDepth: MaxDepth}
+	for _, opt := range opts {
+		opt(e)
+	}
+	return e
+}
+
+// Eval evaluates node in env without limits.
 func Eval(node ast.Node, env *object.Environment) object.Object {
+	return New().eval(node, env)
+}
+
+// EvalContext evaluates node in env until ctx is done, the step budget is
+// spent or the memory or depth limit exceeded, which it reports as an
+// *object.CanceledError, an *object.BudgetExceededError, an
+// *object.MemoryLimitError or an *object.DepthLimitError. Errors of the
+// program itself are returned as *object.Error values, like with Eval.
+func (e *Evaluator) EvalContext(ctx context.Context, node ast.Node, env *object.Environment) (object.Object, error) {
+	e.ctx, e.steps, e.allocated, e.err, e.stopped = ctx, 0, 0, nil, nil
+	defer func() { e.ctx = nil }()
+
+	result := e.eval(node, env)
+	if e.err != nil {
+		return nil, e.err
+	}
+	return result, nil
+}
+
+// eval evaluates node in env. An error gets the position of the innermost
+// node it came out of. Once the run was stopped every evaluation returns
+// the same error, which unwinds it like any other.
+func (e *Evaluator) eval(node ast.Node, env *object.Environment) object.Object {
+	e.stop(e.step())
+	if e.stopped != nil {
+		return e.stopped
+	}
+
+	result := e.evalNode(node, env)
+	if err, ok := result.(*object.Error); ok {
+		if !err.Pos.IsValid() {
+			err.Pos = node.Pos()
+		}
+		if e.debugger != nil {
+			e.debugger.fail(err)
+		}
+	}
+	return result
+}
+
+// stop stops the run with err, unless err is nil or the run was stopped
+// already.
+func (e *Evaluator) stop(err error) {
+	if err != nil && e.err == nil {
+		e.err = err
+		e.stopped = newError("%s", err)
+	}
+}
+
+// alloc counts size bytes of obj against the memory limit. It returns
+// obj, or the error that stops the run if the limit is exceeded.
+func (e *Evaluator) alloc(obj object.Object, size int64) object.Object {
+	e.allocated += size
+	if e.memory > 0 && e.allocated > e.memory {
+		e.stop(&object.MemoryLimitError{Limit: e.memory})
+		return e.stopped
+	}
+	return obj
+}
+
+// step counts one step against the budget and now and then checks the
+// context.
+func (e *Evaluator) step() error {
+	e.steps++
+	if e.budget > 0 && e.steps > e.budget {
+		return &object.BudgetExceededError{Budget: e.budget}
+	}
+	if e.ctx != nil && e.steps%checkInterval == 0 {
+		if err := e.ctx.Err(); err != nil {
+			return &object.CanceledError{Err: err}
+		}
+	}
+	return nil
+}
+
+func (e *Evaluator) evalNode(node ast.Node, env *object.Environment) object.Object {
 	switch node := node.(type) {
 
 	// Statements
 	case *ast.Program:
-		return evalProgram(node, env)
+		return e.evalProgram(node, env)
 
 	case *ast.BlockStatement:
-		return evalBlockStatement(node, env)
+		return e.evalBlockStatement(node, env)
 
 	case *ast.ExpressionStatement:
-		return Eval(node.Expression, env)
+		return e.eval(node.Expression, env)
 
 	case *ast.ReturnStatement:
-		val := Eval(node.ReturnValue, env)
-		if isError(val) {
+		val := e.eval(node.ReturnValue, env)
+		if unwinds(val) {
 			return val
 		}
 		return &object.ReturnValue{Value: val}
 
 	case *ast.LetStatement:
-		val := Eval(node.Value, env)
-		if isError(val) {
+		val := e.eval(node.Value, env)
+		if unwinds(val) {
 			return val
 		}
 		env.Set(node.Name.Value, val)
 
+	case *ast.WhileStatement:
+		return e.evalWhileStatement(node, env)
+
+	case *ast.ForStatement:
+		return e.evalForStatement(node, env)
+
+	case *ast.BreakStatement:
+		return &object.Break{Pos: node.Pos()}
+
+	case *ast.ContinueStatement:
+		return &object.Continue{Pos: node.Pos()}
+
 	// Expressions
 	case *ast.IntegerLiteral:
 		return &object.Integer{Value: node.Value}
 
 	case *ast.StringLiteral:
-		return &object.String{Value: node.Value}
+		str := &object.String{Value: node.Value}
+		return e.alloc(str, object.SizeOf(str))
 
 	case *ast.Boolean:
 		return nativeBoolToBooleanObject(node.Value)
 
 	case *ast.PrefixExpression:
-		right := Eval(node.Right, env)
-		if isError(right) {
+		right := e.eval(node.Right, env)
+		if unwinds(right) {
 			return right
 		}
 		return evalPrefixExpression(node.Operator, right)
 
 	case *ast.InfixExpression:
-		left := Eval(node.Left, env)
-		if isError(left) {
+		if node.Operator == "&&" || node.Operator == "||" {
+			return e.evalLogicalExpression(node, env)
+		}
+
+		left := e.evalOperand(node.Left, env)
+		if unwinds(left) {
 			return left
 		}
 
-		right := Eval(node.Right, env)
-		if isError(right) {
+		right := e.evalOperand(node.Right, env)
+		if unwinds(right) {
 			return right
 		}
 
-		return evalInfixExpression(node.Operator, left, right)
+		result := evalInfixExpression(node.Operator, left, right)
+		return e.alloc(result, object.SizeOf(result))
 
 	case *ast.IfExpression:
-		return evalIfExpression(node, env)
+		return e.evalIfExpression(node, env)
+
+	case *ast.AssignExpression:
+		return e.evalAssignExpression(node, env)
 
 	case *ast.Identifier:
 		return evalIdentifier(node, env)
@@ -78,84 +234,159 @@ func Eval(node ast.Node, env *object.Environment) object.Object {
 	case *ast.FunctionLiteral:
 		params := node.Parameters
 		body := node.Body
-		return &object.Function{Parameters: params, Env: env, Body: body}
+		return &object.Function{Parameters: params, Env: env, Body: body, Name: node.Name}
 
 	case *ast.CallExpression:
-		function := Eval(node.Function, env)
-		if isError(function) {
+		function := e.evalOperand(node.Function, env)
+		if unwinds(function) {
 			return function
 		}
 
-		args := evalExpressions(node.Arguments, env)
-		if len(args) == 1 && isError(args[0]) {
+		args := e.evalExpressions(node.Arguments, env)
+		if len(args) == 1 && unwinds(args[0]) {
 			return args[0]
 		}
 
-		return applyFunction(function, args)
+		if e.debugger != nil {
+			e.debugger.frames[len(e.debugger.frames)-1].pos = node.Pos()
+		}
+		return e.applyFunction(function, args)
 
 	case *ast.ArrayLiteral:
-		elements := evalExpressions(node.Elements, env)
-		if len(elements) == 1 && isError(elements[0]) {
+		elements := e.evalExpressions(node.Elements, env)
+		if len(elements) == 1 && unwinds(elements[0]) {
 			return elements[0]
 		}
-		return &object.Array{Elements: elements}
+		arr := &object.Array{Elements: elements}
+		return e.alloc(arr, object.SizeOf(arr))
 
 	case *ast.IndexExpression:
-		left := Eval(node.Left, env)
-		if isError(left) {
+		left := e.evalOperand(node.Left, env)
+		if unwinds(left) {
 			return left
 		}
-		index := Eval(node.Index, env)
-		if isError(index) {
+		index := e.evalOperand(node.Index, env)
+		if unwinds(index) {
 			return index
 		}
 		return evalIndexExpression(left, index)
 
 	case *ast.HashLiteral:
-		return evalHashLiteral(node, env)
+		hash := e.evalHashLiteral(node, env)
+		if unwinds(hash) {
+			return hash
+		}
+		return e.alloc(hash, object.SizeOf(hash))
 
 	}
 
 	return nil
 }
 
-func evalProgram(program *ast.Program, env *object.Environment) object.Object {
+func (e *Evaluator) evalProgram(program *ast.Program, env *object.Environment) object.Object {
 	var result object.Object
 
 	for _, statement := range program.Statements {
-		result = Eval(statement, env)
+		if e.debugger != nil {
+			e.debugger.pause(statement)
+		}
+		result = e.eval(statement, env)
 
 		switch result := result.(type) {
 		case *object.ReturnValue:
 			return result.Value
 		case *object.Error:
 			return result
+		case *object.Break, *object.Continue:
+			return outsideLoop(result)
 		}
 	}
 
 	return result
 }
 
-func evalBlockStatement(
+func (e *Evaluator) evalBlockStatement(
 	block *ast.BlockStatement,
 	env *object.Environment,
 ) object.Object {
 	var result object.Object
 
 	for _, statement := range block.Statements {
-		result = Eval(statement, env)
+		if e.debugger != nil {
+			e.debugger.pause(statement)
+		}
+		result = e.eval(statement, env)
 
-		if result != nil {
-			rt := result.Type()
-			if rt == object.RETURN_VALUE_OBJ || rt == object.ERROR_OBJ {
-				return result
-			}
+		if unwinds(result) {
+			return result
 		}
 	}
 
 	return result
 }
 
+// evalLogicalExpression evaluates && and ||, which evaluate their right
+// operand only when the left one does not decide the result. The left
+// operand is gone by the time the right one runs, so either can break out
+// of a loop.
+func (e *Evaluator) evalLogicalExpression(
+	node *ast.InfixExpression,
+	env *object.Environment,
+) object.Object {
+	left := e.eval(node.Left, env)
+	if unwinds(left) {
+		return left
+	}
+
+	switch node.Operator {
+	case "&&":
+		if !isTruthy(left) {
+			return left
+		}
+	case "||":
+		if isTruthy(left) {
+			return left
+		}
+	}
+	return e.eval(node.Right, env)
+}
+
+// evalOperand evaluates an operand of an expression that has more than
+// one. As in the compiler, a break or continue cannot leave such an
+// expression: one coming out of the operand is an error.
+func (e *Evaluator) evalOperand(exp ast.Expression, env *object.Environment) object.Object {
+	switch obj := e.eval(exp, env).(type) {
+	case *object.Break:
+		return &object.Error{Message: "break inside an operand of an expression", Pos: obj.Pos}
+	case *object.Continue:
+		return &object.Error{Message: "continue inside an operand of an expression", Pos: obj.Pos}
+	default:
+		return obj
+	}
+}
+
+// unwinds reports whether obj ends the evaluation of the blocks it comes
+// out of: it is a returned value, an error, a break or a continue.
+func unwinds(obj object.Object) bool {
+	switch obj.(type) {
+	case *object.ReturnValue, *object.Error, *object.Break, *object.Continue:
+		return true
+	}
+	return false
+}
+
+// outsideLoop is the error for a break or continue that unwound to a
+// function body or the program without meeting a loop.
+func outsideLoop(signal object.Object) *object.Error {
+	switch signal := signal.(type) {
+	case *object.Break:
+		return &object.Error{Message: "break outside of a loop", Pos: signal.Pos}
+	case *object.Continue:
+		return &object.Error{Message: "continue outside of a loop", Pos: signal.Pos}
+	}
+	return nil
+}
+
 func nativeBoolToBooleanObject(input bool) *object.Boolean {
 	if input {
 		return TRUE
@@ -233,7 +464,15 @@ func evalIntegerInfixExpression(
 	case "*":
 		return &object.Integer{Value: leftVal * rightVal}
 	case "/":
+		if rightVal == 0 {
+			return newError("division by zero")
+		}
 		return &object.Integer{Value: leftVal / rightVal}
+	case "%":
+		if rightVal == 0 {
+			return newError("division by zero")
+		}
+		return &object.Integer{Value: leftVal % rightVal}
 	case "<":
 		return nativeBoolToBooleanObject(leftVal < rightVal)
 	case ">":
@@ -262,24 +501,207 @@ func evalStringInfixExpression(
 	return &object.String{Value: leftVal + rightVal}
 }
 
-func evalIfExpression(
+func (e *Evaluator) evalIfExpression(
 	ie *ast.IfExpression,
 	env *object.Environment,
 ) object.Object {
-	condition := Eval(ie.Condition, env)
-	if isError(condition) {
+	condition := e.eval(ie.Condition, env)
+	if unwinds(condition) {
 		return condition
 	}
 
 	if isTruthy(condition) {
-		return Eval(ie.Consequence, env)
+		return e.eval(ie.Consequence, env)
 	} else if ie.Alternative != nil {
-		return Eval(ie.Alternative, env)
+		return e.eval(ie.Alternative, env)
 	} else {
 		return NULL
 	}
 }
 
+// evalWhileStatement runs the body for as long as the condition is
+// truthy. A break in the body ends the loop and a continue goes on with
+// the next test of the condition. A return statement or an error in the
+// body ends the loop and is passed on; otherwise the loop evaluates to
+// null.
+func (e *Evaluator) evalWhileStatement(
+	ws *ast.WhileStatement,
+	env *object.Environment,
+) object.Object {
+	for {
+		condition := e.eval(ws.Condition, env)
+		if unwinds(condition) {
+			return condition
+		}
+		if !isTruthy(condition) {
+			return NULL
+		}
+
+		result := e.eval(ws.Body, env)
+		switch result.(type) {
+		case *object.Break:
+			return NULL
+		case *object.ReturnValue, *object.Error:
+			return result
+		}
+	}
+}
+
+// evalForStatement binds the loop's variables to every step through the
+// iterable in turn and runs the body. Like a while loop it stops at a
+// break, passes on a return statement or an error in the body and
+// otherwise evaluates to null. The loop has no scope of its own, so all
+// steps share one binding of each variable: a closure made in the body
+// sees the value of the last step.
+func (e *Evaluator) evalForStatement(
+	fs *ast.ForStatement,
+	env *object.Environment,
+) object.Object {
+	iterable := e.eval(fs.Iterable, env)
+	if unwinds(iterable) {
+		return iterable
+	}
+
+	it, ok := object.NewIterator(iterable)
+	if !ok {
+		return newError("cannot iterate over %s", iterable.Type())
+	}
+
+	for {
+		key, value, ok := it.Next(fs.Key != nil)
+		if !ok {
+			return NULL
+		}
+
+		if fs.Key != nil {
+			env.Set(fs.Key.Value, key)
+		}
+		env.Set(fs.Value.Value, value)
+
+		result := e.eval(fs.Body, env)
+		switch result.(type) {
+		case *object.Break:
+			return NULL
+		case *object.ReturnValue, *object.Error:
+			return result
+		}
+	}
+}
+
+// evalAssignExpression stores the value in the variable or at the index
+// the target names and evaluates to the value. A variable is updated in
+// the environment that defines it, so a function assigning to a variable
+// of an enclosing scope changes it there.
+//
+// A compound assignment stores the result of its operator applied to the
+// target's old value and the value. The array or hash and the index of an
+// index target are evaluated once, before the value.
+func (e *Evaluator) evalAssignExpression(
+	ae *ast.AssignExpression,
+	env *object.Environment,
+) object.Object {
+	switch target := ae.Target.(type) {
+	case *ast.Identifier:
+		var old object.Object
+		if ae.Operator != "" {
+			old = evalIdentifier(target, env)
+			if isError(old) {
+				return old
+			}
+		}
+
+		val := e.evalAssignedValue(ae, old, env)
+		if unwinds(val) {
+			return val
+		}
+
+		if !env.Assign(target.Value, val) {
+			if _, ok := builtins[target.Value]; ok {
+				return newError("cannot assign to builtin %s", target.Value)
+			}
+			return newError("identifier not found: " + target.Value)
+		}
+		return val
+
+	case *ast.IndexExpression:
+		left := e.evalOperand(target.Left, env)
+		if unwinds(left) {
+			return left
+		}
+		index := e.evalOperand(target.Index, env)
+		if unwinds(index) {
+			return index
+		}
+
+		var old object.Object
+		if ae.Operator != "" {
+			old = evalIndexExpression(left, index)
+			if isError(old) {
+				return old
+			}
+		}
+
+		val := e.evalAssignedValue(ae, old, env)
+		if unwinds(val) {
+			return val
+		}
+		return e.evalSetIndex(left, index, val)
+	}
+
+	return newError("cannot assign to %s", ae.Target)
+}
+
+// evalAssignedValue evaluates the value of an assignment and, for a
+// compound one, applies its operator to old and the value. Only the value
+// of a plain assignment to a variable is not an operand.
+func (e *Evaluator) evalAssignedValue(
+	ae *ast.AssignExpression,
+	old object.Object,
+	env *object.Environment,
+) object.Object {
+	var val object.Object
+	if _, ok := ae.Target.(*ast.Identifier); ok && ae.Operator == "" {
+		val = e.eval(ae.Value, env)
+	} else {
+		val = e.evalOperand(ae.Value, env)
+	}
+	if unwinds(val) || ae.Operator == "" {
+		return val
+	}
+
+	result := evalInfixExpression(ae.Operator, old, val)
+	return e.alloc(result, object.SizeOf(result))
+}
+
+// evalSetIndex stores val at index of an array or a hash. Only indices
+// inside an array can be set; a hash grows by a pair for a new key.
+func (e *Evaluator) evalSetIndex(left, index, val object.Object) object.Object {
+	switch left := left.(type) {
+	case *object.Array:
+		idx, ok := index.(*object.Integer)
+		if !ok {
+			return newError("unknown index type for array: %s", index.Type())
+		}
+		if idx.Value < 0 || idx.Value >= int64(len(left.Elements)) {
+			return newError("index out of bounds (idx: %d, length: %d)", idx.Value, len(left.Elements))
+		}
+		left.Elements[idx.Value] = val
+		return val
+
+	case *object.Hash:
+		key, ok := index.(object.Hashable)
+		if !ok {
+			return newError("unusable as hash key: %s", index.Type())
+		}
+		size := object.SizeOf(left)
+		left.Pairs[key.HashKey()] = object.HashPair{Key: index, Value: val}
+		return e.alloc(val, object.SizeOf(left)-size)
+
+	default:
+		return newError("index assignment not supported: %s", left.Type())
+	}
+}
+
 func evalIdentifier(
 	node *ast.Identifier,
 	env *object.Environment,
@@ -319,15 +741,15 @@ func isError(obj object.Object) bool {
 	return false
 }
 
-func evalExpressions(
+func (e *Evaluator) evalExpressions(
 	exps []ast.Expression,
 	env *object.Environment,
 ) []object.Object {
 	var result []object.Object
 
-	for _, e := range exps {
-		evaluated := Eval(e, env)
-		if isError(evaluated) {
+	for _, exp := range exps {
+		evaluated := e.evalOperand(exp, env)
+		if unwinds(evaluated) {
 			return []object.Object{evaluated}
 		}
 		result = append(result, evaluated)
@@ -336,19 +758,152 @@ func evalExpressions(
 	return result
 }
 
-func applyFunction(fn object.Object, args []object.Object) object.Object {
-	switch fn := fn.(type) {
+// applyFunction is a trampoline: a call in tail position of the body comes
+// back as an *object.TailCall and is made by the next loop iteration
+// instead of a nested applyFunction, so tail recursion runs in constant
+// Go stack.
+func (e *Evaluator) applyFunction(fn object.Object, args []object.Object) object.Object {
+	if e.maxDepth > 0 && e.depth >= e.maxDepth {
+		e.stop(&object.DepthLimitError{Limit: e.maxDepth})
+		return e.stopped
+	}
+	e.depth++
+	defer func() { e.depth-- }()
+
+	// A call made under the debugger gets a frame, which a tail call
+	// replaces.
+	d := e.debugger
+	var depth int
+	if d != nil {
+		depth = len(d.frames)
+		defer d.leave(depth)
+	}
+
+	for {
+		switch f := fn.(type) {
 
-	case *object.Function:
-		extendedEnv := extendFunctionEnv(fn, args)
-		evaluated := Eval(fn.Body, extendedEnv)
-		return unwrapReturnValue(evaluated)
+		case *object.Function:
+			if len(args) != len(f.Parameters) {
+				return newError("wrong number of arguments: want=%d, got=%d",
+					len(f.Parameters), len(args))
+			}
+
+			extendedEnv := extendFunctionEnv(f, args)
+			if d != nil {
+				d.enter(depth, f, extendedEnv)
+			}
+			evaluated := e.evalTailBlock(f.Body, extendedEnv, true)
 
-	case *object.Builtin:
-		return fn.Fn(args...)
+			switch evaluated.(type) {
+			case *object.Break, *object.Continue:
+				return outsideLoop(evaluated)
+			}
+
+			tc, ok := evaluated.(*object.TailCall)
+			if !ok {
+				return unwrapReturnValue(evaluated)
+			}
+			fn, args = tc.Fn, tc.Args
+
+		case *object.Builtin:
+			if result := f.Fn(args...); result != nil {
+				return e.alloc(result, object.BuiltinResultSize(result, args))
+			}
+			return NULL
+
+		default:
+			return newError("not a function: %s", fn.Type())
+		}
+	}
+}
+
+// evalTailBlock evaluates a function body, or a block nested in it, where
+// a return statement leaves the function. Calls whose value is returned
+// unchanged are not made but handed back as an *object.TailCall: the
+// operand of a return statement and, if tail is set, the value of the
+// block's last statement.
+func (e *Evaluator) evalTailBlock(
+	block *ast.BlockStatement,
+	env *object.Environment,
+	tail bool,
+) object.Object {
+	var result object.Object
+
+	for i, statement := range block.Statements {
+		last := tail && i == len(block.Statements)-1
+		if e.debugger != nil {
+			e.debugger.pause(statement)
+		}
+		result = e.evalTailStatement(statement, env, last)
+
+		if _, ok := result.(*object.TailCall); ok || unwinds(result) {
+			return result
+		}
+	}
+
+	return result
+}
+
+func (e *Evaluator) evalTailStatement(
+	statement ast.Statement,
+	env *object.Environment,
+	tail bool,
+) object.Object {
+	switch statement := statement.(type) {
+	case *ast.ReturnStatement:
+		val := e.evalTailExpression(statement.ReturnValue, env, true)
+		if unwinds(val) || val.Type() == object.TAIL_CALL_OBJ {
+			return val
+		}
+		return &object.ReturnValue{Value: val}
+
+	case *ast.ExpressionStatement:
+		return e.evalTailExpression(statement.Expression, env, tail)
+
+	default:
+		return e.eval(statement, env)
+	}
+}
+
+func (e *Evaluator) evalTailExpression(
+	exp ast.Expression,
+	env *object.Environment,
+	tail bool,
+) object.Object {
+	switch exp := exp.(type) {
+	case *ast.CallExpression:
+		if !tail {
+			return e.eval(exp, env)
+		}
+
+		function := e.evalOperand(exp.Function, env)
+		if unwinds(function) {
+			return function
+		}
+
+		args := e.evalExpressions(exp.Arguments, env)
+		if len(args) == 1 && unwinds(args[0]) {
+			return args[0]
+		}
+
+		return &object.TailCall{Fn: function, Args: args}
+
+	case *ast.IfExpression:
+		condition := e.eval(exp.Condition, env)
+		if unwinds(condition) {
+			return condition
+		}
+
+		if isTruthy(condition) {
+			return e.evalTailBlock(exp.Consequence, env, tail)
+		} else if exp.Alternative != nil {
+			return e.evalTailBlock(exp.Alternative, env, tail)
+		} else {
+			return NULL
+		}
 
 	default:
-		return newError("not a function: %s", fn.Type())
+		return e.eval(exp, env)
 	}
 }
 
@@ -396,15 +951,15 @@ func evalArrayIndexExpression(array, index object.Object) object.Object {
 	return arrayObject.Elements[idx]
 }
 
-func evalHashLiteral(
+func (e *Evaluator) evalHashLiteral(
 	node *ast.HashLiteral,
 	env *object.Environment,
 ) object.Object {
 	pairs := make(map[object.HashKey]object.HashPair)
 
 	for keyNode, valueNode := range node.Pairs {
-		key := Eval(keyNode, env)
-		if isError(key) {
+		key := e.evalOperand(keyNode, env)
+		if unwinds(key) {
 			return key
 		}
 
@@ -413,8 +968,8 @@ func evalHashLiteral(
 			return newError("unusable as hash key: %s", key.Type())
 		}
 
-		value := Eval(valueNode, env)
-		if isError(value) {
+		value := e.evalOperand(valueNode, env)
+		if unwinds(value) {
 			return value
 		}
 
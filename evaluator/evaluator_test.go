@@ -1,10 +1,13 @@
 package evaluator
 
 import (
+	"context"
+	"errors"
 	"karaoke/lexer"
 	"karaoke/object"
 	"karaoke/parser"
 	"testing"
+	"time"
 )
 
 func TestEvalIntegerExpression(t *testing.T) {
@@ -27,6 +30,9 @@ func TestEvalIntegerExpression(t *testing.T) {
 		{"3 * 3 * 3 + 10", 37},
 		{"3 * (3 * 3) + 10", 37},
 		{"(5 + 10 * 2 + 15 / 3) * 2 + -10", 50},
+		{"17 % 5", 2},
+		{"-7 % 3", -1},
+		{"2 + 10 % 4 * 3", 8},
 	}
 
 	for _, tt := range tests {
@@ -111,6 +117,168 @@ func TestIfElseExpressions(t *testing.T) {
 	}
 }
 
+func TestLogicalExpressions(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected interface{}
+	}{
+		{"true && true", true},
+		{"true && false", false},
+		{"false || true", true},
+		{"false || false", false},
+		{"1 && 2", 2},
+		{"false && 2", false},
+		{"1 || 2", 1},
+		{"if (false) { 1 } || 3", 3},
+		{"if (false) { 1 } && 3", nil},
+		{"1 < 2 && 3 > 4 || 5", 5},
+		{"true || false && false", true},
+		{"false && 1 / 0", false},
+		{"let n = 0; let f = fn() { n = n + 1; true }; f() || f(); true && f(); n", 2},
+		{"let i = 0; while (i < 10 && i * i < 20) { i = i + 1 }; i", 5},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(tt.input)
+		switch expected := tt.expected.(type) {
+		case int:
+			testIntegerObject(t, evaluated, int64(expected))
+		case bool:
+			testBooleanObject(t, evaluated, expected)
+		default:
+			testNullObject(t, evaluated)
+		}
+	}
+}
+
+func TestWhileStatements(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected interface{}
+	}{
+		{"let i = 0; let s = 0; while (i < 5) { let s = s + i; let i = i + 1; }; s", 10},
+		{"let i = 0; while (i < 5000) { let i = i + 1 }; i", 5000},
+		{"while (false) { 10 }", nil},
+		{"let f = fn() { while (false) { 10 } }; f()", nil},
+		{`
+let f = fn(n) {
+  let i = 0;
+  while (true) {
+    if (i == n) { return i * 2; }
+    let i = i + 1;
+  }
+};
+f(5)`, 10},
+		{"let i = 0; let r = if (true) { while (i < 3) { let i = i + 1 } }; r", nil},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(tt.input)
+		integer, ok := tt.expected.(int)
+		if ok {
+			testIntegerObject(t, evaluated, int64(integer))
+		} else {
+			testNullObject(t, evaluated)
+		}
+	}
+}
+
+func TestForStatements(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected interface{}
+	}{
+		{"let s = 0; for (x in [1, 2, 3]) { let s = s + x }; s", 6},
+		{"let s = 0; for (i, x in [5, 6, 7]) { let s = s + i * x }; s", 20},
+		{`let s = 0; for (k, v in {"a": 1, "b": 2}) { let s = s + v }; s`, 3},
+		{`let n = 0; for (k in {"a": 1, 2: 2, true: 3}) { let n = n + 1 }; n`, 3},
+		{`let n = 0; for (c in "héllo") { let n = n + 1 }; n`, 5},
+		{"let xs = [1, 2]; for (x in xs) { let xs = push(xs, x) }; len(xs)", 4},
+		{"for (x in []) { 10 }", nil},
+		{"for (x in [1]) { 10 }", nil},
+		{`
+let find = fn(xs, y) {
+  for (i, x in xs) {
+    if (x == y) { return i; }
+  }
+  -1
+};
+find([4, 5, 6], 6)`, 2},
+		{`
+let s = 0;
+for (x in [1, 2]) {
+  for (y in [10, 20]) { let s = s + x * y }
+};
+s`, 90},
+		{"let fs = []; for (x in [1, 2, 3]) { let fs = push(fs, fn() { x }) }; fs[0]()", 3},
+		{`
+let f = fn() {
+  let fs = [];
+  for (x in [1, 2, 3]) { let fs = push(fs, fn() { x }) };
+  fs[0]() + fs[1]()
+};
+f()`, 6},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(tt.input)
+		integer, ok := tt.expected.(int)
+		if ok {
+			testIntegerObject(t, evaluated, int64(integer))
+		} else {
+			testNullObject(t, evaluated)
+		}
+	}
+}
+
+func TestBreakAndContinue(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected interface{}
+	}{
+		{"let i = 0; while (true) { let i = i + 1; if (i == 3) { break; } }; i", 3},
+		{"let i = 0; let s = 0; while (i < 5) { let i = i + 1; if (i == 2) { continue } let s = s + i }; s", 13},
+		{"let s = 0; for (x in [1, 2, 3, 4]) { if (x == 3) { break } let s = s + x }; s", 3},
+		{"let s = 0; for (x in [1, 2, 3, 4]) { if (x == 3) { continue } let s = s + x }; s", 7},
+		{"while (true) { break }", nil},
+		{"for (x in [1]) { break }", nil},
+		{"let s = 0; while (s < 3) { s += 1; let y = if (true) { break } }; s", 1},
+		{"let s = 0; while (s < 3) { s += 1; s = if (s == 1) { continue } else { s } }; s", 3},
+		{"let s = 0; while (s < 3) { s += 1; -if (true) { break } }; s", 1},
+		{"let s = 0; while (s < 3) { s += 1; true && if (true) { break } }; s", 1},
+		{"let s = 0; for (x in [1]) { while (if (s == 2) { break } else { true }) { s += 1 } }; s", 2},
+		{"let f = fn() { while (true) { return if (true) { break } }; 4 }; f()", 4},
+		{`
+let n = 0;
+for (x in [1, 2, 3]) {
+  for (y in [1, 2, 3]) {
+    if (y > x) { break }
+    let n = n + 1;
+  }
+};
+n`, 6},
+		{`
+let f = fn() {
+  while (true) {
+    let g = fn() { 5 };
+    break;
+  }
+  7
+};
+f()`, 7},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(tt.input)
+		integer, ok := tt.expected.(int)
+		if ok {
+			testIntegerObject(t, evaluated, int64(integer))
+		} else {
+			testNullObject(t, evaluated)
+		}
+	}
+}
+
 func TestReturnStatements(t *testing.T) {
 	tests := []struct {
 		input    string
@@ -173,6 +341,22 @@ func TestErrorHandling(t *testing.T) {
 			"5 + true; 5;",
 			"type mismatch: INTEGER + BOOLEAN",
 		},
+		{
+			"while (true) { 5 + true; }",
+			"type mismatch: INTEGER + BOOLEAN",
+		},
+		{
+			"while (1 + true) { 5 }",
+			"type mismatch: INTEGER + BOOLEAN",
+		},
+		{
+			"for (x in 5) { x }",
+			"cannot iterate over INTEGER",
+		},
+		{
+			"for (x in [1]) { x + true }",
+			"type mismatch: INTEGER + BOOLEAN",
+		},
 		{
 			"-true",
 			"unknown operator: -BOOLEAN",
@@ -256,6 +440,39 @@ func TestLetStatements(t *testing.T) {
 	}
 }
 
+func TestAssignExpressions(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected int64
+	}{
+		{"let a = 5; a = a + 1; a;", 6},
+		{"let a = 5; a = 7", 7},
+		{"let a = 1; let b = 2; a = b = 3; a + b", 6},
+		{"let a = 0; let i = 0; while (i < 4) { i = i + 1; a = a + i; }; a", 10},
+		{"let c = 0; let inc = fn() { c = c + 1 }; inc(); inc(); c", 2},
+		{"let c = 0; let f = fn() { let c = 10; c = c + 1; c }; f() + c", 11},
+		{"let a = [1, 2, 3]; a[1] = 5; a[0] + a[1] + a[2]", 9},
+		{"let a = [1, 2]; let b = a; b[0] = 10; a[0]", 10},
+		{`let h = {"a": 1}; h["a"] = h["a"] + 1; h["b"] = 5; h["a"] + h["b"]`, 7},
+		{"let a = [[0]]; a[0][0] = 4; a[0][0]", 4},
+		{"let a = [0]; (a[0] = 3) + 1", 4},
+		{"let a = 5; a += 2; a -= 1; a *= 10; a /= 4; a %= 4; a", 3},
+		{"let a = 1; let b = 2; a += b += 3; a * 10 + b", 65},
+		{"let c = 0; let inc = fn() { c += 1 }; inc(); inc(); c", 2},
+		{"let a = [1, 2]; a[1] *= 5; a[0] + a[1]", 11},
+		{`let h = {"n": 1}; h["n"] += 4; h["n"]`, 5},
+		{"let n = 0; let a = [10, 20]; let k = fn() { n += 1; 1 }; a[k()] += 5; a[1] * 10 + n", 251},
+		{"let a = 5; a++; a++; a--; a", 6},
+		{"let a = 1; a++ * 10", 20},
+		{"let a = [1, 2]; a[1]++; a[0]--; a[0] + a[1]", 3},
+		{"let n = 0; let a = [10, 20]; let k = fn() { n += 1; 1 }; a[k()]++; a[1] * 10 + n", 211},
+	}
+
+	for _, tt := range tests {
+		testIntegerObject(t, testEval(tt.input), tt.expected)
+	}
+}
+
 func TestFunctionObject(t *testing.T) {
 	input := "fn(x) { x + 2; };"
 
@@ -328,6 +545,66 @@ addTwo(2);`
 	testIntegerObject(t, testEval(input), 4)
 }
 
+func TestTailCalls(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected interface{}
+	}{
+		{
+			`let count = fn(n, acc) {
+				if (n == 0) { acc } else { count(n - 1, acc + 1) }
+			};
+			count(100000, 0);`,
+			100000,
+		},
+		{
+			`let count = fn(n) {
+				if (n == 0) { return 7; }
+				return count(n - 1);
+			};
+			count(5000);`,
+			7,
+		},
+		{
+			`let build = fn(n, acc) {
+				if (n == 0) { acc } else { build(n - 1, push(acc, n)) }
+			};
+			let sum = fn(arr, acc) {
+				if (len(arr) == 0) { acc } else { sum(rest(arr), acc + first(arr)) }
+			};
+			sum(build(2000, []), 0);`,
+			2001000,
+		},
+		{
+			`let f = fn(n) { if (n == 0) { len("abc") } else { f(n - 1) } }; f(10);`,
+			3,
+		},
+		{
+			`let f = fn(a, b) { a }; let g = fn() { f(1) }; g();`,
+			"wrong number of arguments: want=2, got=1",
+		},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(tt.input)
+
+		switch expected := tt.expected.(type) {
+		case int:
+			testIntegerObject(t, evaluated, int64(expected))
+		case string:
+			errObj, ok := evaluated.(*object.Error)
+			if !ok {
+				t.Errorf("object is not Error. got=%T (%+v)", evaluated, evaluated)
+				continue
+			}
+			if errObj.Message != expected {
+				t.Errorf("wrong error message. expected=%q, got=%q",
+					expected, errObj.Message)
+			}
+		}
+	}
+}
+
 func TestStringLiteral(t *testing.T) {
 	input := `"Hello World!"`
 
@@ -582,6 +859,175 @@ func TestHashIndexExpressions(t *testing.T) {
 		}
 	}
 }
+func TestErrorPositions(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"5 + true;", "ERROR: 1:1: type mismatch: INTEGER + BOOLEAN"},
+		{"let a = 1;\nlet b = -true;", "ERROR: 2:9: unknown operator: -BOOLEAN"},
+		{"let f = fn() {\n  foobar\n};\nf();", "ERROR: 2:3: identifier not found: foobar"},
+		{"len(1, 2)", "ERROR: 1:1: wrong number of arguments. got=2, want=1"},
+		{"let h = {\"é\": 1};\n h[fn(x) { x }]", "ERROR: 2:2: unusable as hash key: FUNCTION"},
+		{"if (true) { break }", "ERROR: 1:13: break outside of a loop"},
+		{"let a = 1;\nb = a", "ERROR: 2:1: identifier not found: b"},
+		{"len = 1", "ERROR: 1:1: cannot assign to builtin len"},
+		{"let a = 1;\nb += a", "ERROR: 2:1: identifier not found: b"},
+		{"let a = 1;\na += true", "ERROR: 2:1: type mismatch: INTEGER + BOOLEAN"},
+		{"let h = {};\nh[[]] -= 2", "ERROR: 2:1: unusable as hash key: ARRAY"},
+		{"let a = true;\na++", "ERROR: 2:1: type mismatch: BOOLEAN + INTEGER"},
+		{"let a = 1;\na / 0", "ERROR: 2:1: division by zero"},
+		{"let a = 1;\na %= 0", "ERROR: 2:1: division by zero"},
+		{"true && -true || 1", "ERROR: 1:9: unknown operator: -BOOLEAN"},
+		{"let a = [1];\na[1] = 2", "ERROR: 2:1: index out of bounds (idx: 1, length: 1)"},
+		{"let a = [1];\na[\"x\"] = 2", "ERROR: 2:1: unknown index type for array: STRING"},
+		{"let h = {};\nh[[]] = 2", "ERROR: 2:1: unusable as hash key: ARRAY"},
+		{"let s = \"ab\";\ns[0] = 2", "ERROR: 2:1: index assignment not supported: STRING"},
+		{"while (true) {\n  let f = fn() { continue };\n  f();\n}", "ERROR: 2:18: continue outside of a loop"},
+		{"while (true) { [if (true) { break }] }", "ERROR: 1:29: break inside an operand of an expression"},
+		{"while (true) { puts(if (true) { break }) }", "ERROR: 1:33: break inside an operand of an expression"},
+		{"while (true) { 1 + if (true) { continue } }", "ERROR: 1:32: continue inside an operand of an expression"},
+		{"while (true) { {1: if (true) { break }} }", "ERROR: 1:32: break inside an operand of an expression"},
+		{"let a = 1;\nwhile (true) { a += if (true) { break } }", "ERROR: 2:33: break inside an operand of an expression"},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(tt.input)
+
+		errObj, ok := evaluated.(*object.Error)
+		if !ok {
+			t.Errorf("no error object returned. got=%T(%+v)", evaluated, evaluated)
+			continue
+		}
+
+		if errObj.Inspect() != tt.expected {
+			t.Errorf("wrong error. expected=%q, got=%q", tt.expected, errObj.Inspect())
+		}
+	}
+}
+
+func TestStepBudget(t *testing.T) {
+	program := parser.New(lexer.New("let loop = fn() { loop() }; loop();")).ParseProgram()
+
+	e := New(StepBudget(10000))
+	_, err := e.EvalContext(context.Background(), program, object.NewEnvironment())
+
+	var budgetErr *object.BudgetExceededError
+	if !errors.As(err, &budgetErr) || budgetErr.Budget != 10000 {
+		t.Fatalf("expected a budget error, got %v", err)
+	}
+
+	// The program, the statement, the infix expression and its operands
+	// take five steps, and every run gets the whole budget.
+	program = parser.New(lexer.New("1 + 2")).ParseProgram()
+	e = New(StepBudget(5))
+	for i := 0; i < 2; i++ {
+		result, err := e.EvalContext(context.Background(), program, object.NewEnvironment())
+		if err != nil {
+			t.Fatalf("run %d: unexpected error %v", i, err)
+		}
+		testIntegerObject(t, result, 3)
+	}
+
+	_, err = New(StepBudget(4)).EvalContext(context.Background(), program, object.NewEnvironment())
+	if !errors.As(err, &budgetErr) {
+		t.Errorf("expected a budget error for 4 steps, got %v", err)
+	}
+}
+
+func TestMemoryLimit(t *testing.T) {
+	program := parser.New(lexer.New(`
+let grow = fn(s, n) { if (n == 0) { s } else { grow(s + s, n - 1) } };
+grow("ab", 40);`)).ParseProgram()
+
+	_, err := New(MemoryLimit(1<<20)).EvalContext(context.Background(), program, object.NewEnvironment())
+
+	var memErr *object.MemoryLimitError
+	if !errors.As(err, &memErr) || memErr.Limit != 1<<20 {
+		t.Fatalf("expected a memory limit error, got %v", err)
+	}
+
+	// Both literals and their concatenation allocate, an array counts its
+	// elements and first returns one of them.
+	tests := []struct {
+		input string
+		limit int64
+		fails bool
+	}{
+		{`"ab" + "cd"`, 8, false},
+		{`"ab" + "cd"`, 7, true},
+		{`let a = [1, 2]; first(a); first(a)`, 32, false},
+		{`let a = [1, 2]; rest(a)`, 48, false},
+		{`let a = [1, 2]; rest(a)`, 47, true},
+		{`{"a": 1}`, 57, false},
+		{`{"a": 1}`, 56, true},
+		// A new key grows a hash; setting an existing one does not.
+		{`let h = {}; h["a"] = 1; h["a"] = 2`, 58, false},
+		{`let h = {}; h["a"] = 1; h["a"] = 2`, 57, true},
+	}
+
+	for _, tt := range tests {
+		program := parser.New(lexer.New(tt.input)).ParseProgram()
+		_, err := New(MemoryLimit(tt.limit)).EvalContext(context.Background(), program, object.NewEnvironment())
+		if errors.As(err, &memErr) != tt.fails {
+			t.Errorf("%q with limit %d: wrong error %v", tt.input, tt.limit, err)
+		}
+	}
+}
+
+func TestEvalContext(t *testing.T) {
+	program := parser.New(lexer.New("let loop = fn() { loop() }; loop();")).ParseProgram()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	_, err := New().EvalContext(ctx, program, object.NewEnvironment())
+
+	var cancelErr *object.CanceledError
+	if !errors.As(err, &cancelErr) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected to be stopped by the deadline, got %v", err)
+	}
+
+	// Errors of the program are values, not Go errors.
+	program = parser.New(lexer.New("-true")).ParseProgram()
+	result, err := New().EvalContext(context.Background(), program, object.NewEnvironment())
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if _, ok := result.(*object.Error); !ok {
+		t.Errorf("expected an error value, got %T", result)
+	}
+}
+
+func TestDepthLimit(t *testing.T) {
+	program := parser.New(lexer.New("let deep = fn(n) { deep(n + 1) + 1 }; deep(0);")).ParseProgram()
+
+	// Without options the default limit keeps deep recursion from
+	// overflowing the Go stack.
+	_, err := New().EvalContext(context.Background(), program, object.NewEnvironment())
+
+	var depthErr *object.DepthLimitError
+	if !errors.As(err, &depthErr) || depthErr.Limit != MaxDepth {
+		t.Fatalf("expected a depth limit error, got %v", err)
+	}
+
+	_, err = New(DepthLimit(100)).EvalContext(context.Background(), program, object.NewEnvironment())
+	if !errors.As(err, &depthErr) || depthErr.Limit != 100 {
+		t.Fatalf("expected a depth limit error, got %v", err)
+	}
+
+	// Tail calls do not nest.
+	program = parser.New(lexer.New(`
+let count = fn(n) { if (n == 0) { 0 } else { count(n - 1) } };
+count(1000);`)).ParseProgram()
+
+	result, err := New(DepthLimit(2)).EvalContext(context.Background(), program, object.NewEnvironment())
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	testIntegerObject(t, result, 0)
+}
+
 func testEval(input string) object.Object {
 	l := lexer.New(input)
 	p := parser.New(l)
@@ -30,6 +30,12 @@ if (5 < 10) {
 "foo bar"
 [1, 2];
 {"foo": "bar"}
+while (x) {}
+for (k in xs)
+break; continue;
+x += 1 -= 2 *= 3 /= 4 %= 5 % 6;
+x++ + --;
+a && b || c & d
 `
 
 	tests := []struct {
@@ -122,6 +128,48 @@ if (5 < 10) {
 		{token.COLON, ":"},
 		{token.STRING, "bar"},
 		{token.RBRACE, "}"},
+		{token.WHILE, "while"},
+		{token.LPAREN, "("},
+		{token.IDENT, "x"},
+		{token.RPAREN, ")"},
+		{token.LBRACE, "{"},
+		{token.RBRACE, "}"},
+		{token.FOR, "for"},
+		{token.LPAREN, "("},
+		{token.IDENT, "k"},
+		{token.IN, "in"},
+		{token.IDENT, "xs"},
+		{token.RPAREN, ")"},
+		{token.BREAK, "break"},
+		{token.SEMICOLON, ";"},
+		{token.CONTINUE, "continue"},
+		{token.SEMICOLON, ";"},
+		{token.IDENT, "x"},
+		{token.PLUS_ASSIGN, "+="},
+		{token.INT, "1"},
+		{token.MINUS_ASSIGN, "-="},
+		{token.INT, "2"},
+		{token.ASTERISK_ASSIGN, "*="},
+		{token.INT, "3"},
+		{token.SLASH_ASSIGN, "/="},
+		{token.INT, "4"},
+		{token.PERCENT_ASSIGN, "%="},
+		{token.INT, "5"},
+		{token.PERCENT, "%"},
+		{token.INT, "6"},
+		{token.SEMICOLON, ";"},
+		{token.IDENT, "x"},
+		{token.INCREMENT, "++"},
+		{token.PLUS, "+"},
+		{token.DECREMENT, "--"},
+		{token.SEMICOLON, ";"},
+		{token.IDENT, "a"},
+		{token.AND, "&&"},
+		{token.IDENT, "b"},
+		{token.OR, "||"},
+		{token.IDENT, "c"},
+		{token.ILLEGAL, "&"},
+		{token.IDENT, "d"},
 		{token.EOF, ""},
 	}
 
@@ -141,3 +189,47 @@ if (5 < 10) {
 		}
 	}
 }
+
+func TestTokenPositions(t *testing.T) {
+	input := "let s = \"héllo\";\n\tlen(s) €"
+
+	tests := []struct {
+		expectedType    token.TokenType
+		expectedLiteral string
+		expectedPos     string
+		expectedEnd     string
+	}{
+		{token.LET, "let", "a.mk:1:1", "a.mk:1:4"},
+		{token.IDENT, "s", "a.mk:1:5", "a.mk:1:6"},
+		{token.ASSIGN, "=", "a.mk:1:7", "a.mk:1:8"},
+		{token.STRING, "héllo", "a.mk:1:9", "a.mk:1:16"},
+		{token.SEMICOLON, ";", "a.mk:1:16", "a.mk:1:17"},
+		{token.IDENT, "len", "a.mk:2:2", "a.mk:2:5"},
+		{token.LPAREN, "(", "a.mk:2:5", "a.mk:2:6"},
+		{token.IDENT, "s", "a.mk:2:6", "a.mk:2:7"},
+		{token.RPAREN, ")", "a.mk:2:7", "a.mk:2:8"},
+		{token.ILLEGAL, "€", "a.mk:2:9", "a.mk:2:10"},
+		{token.EOF, "", "a.mk:2:10", "a.mk:2:10"},
+	}
+
+	l := NewWithFile("a.mk", input)
+
+	for i, tt := range tests {
+		tok := l.NextToken()
+
+		if tok.Type != tt.expectedType || tok.Literal != tt.expectedLiteral {
+			t.Fatalf("tests[%d] - token wrong. expected=%s %q, got=%s %q",
+				i, tt.expectedType, tt.expectedLiteral, tok.Type, tok.Literal)
+		}
+
+		if tok.Pos.String() != tt.expectedPos {
+			t.Errorf("tests[%d] - pos wrong. expected=%s, got=%s",
+				i, tt.expectedPos, tok.Pos)
+		}
+
+		if tok.End.String() != tt.expectedEnd {
+			t.Errorf("tests[%d] - end wrong. expected=%s, got=%s",
+				i, tt.expectedEnd, tok.End)
+		}
+	}
+}
@@ -1,13 +1,64 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"karaoke/repl"
+	"karaoke/vm"
 	"os"
 	"os/user"
 )
 
+const usage = `usage:
+  karaoke                             start the REPL
+  karaoke compile [-o out.mkc] <file.monkey>
+                                      compile a script to a bytecode file
+  karaoke run [-vm stack|register] [-timeout D] [-budget N] [-memory N] <file.mkc|file.monkey>
+                                      run a bytecode file or a script
+  karaoke disasm <file.mkc|file.monkey>
+                                      print a bytecode listing
+  karaoke debug <file.mkc|file.monkey>
+                                      step through a program
+  karaoke dap [-port N]               serve the Debug Adapter Protocol on
+                                      stdio or a local TCP port
+`
+
 func main() {
+	if len(os.Args) < 2 {
+		startRepl()
+		return
+	}
+
+	var err error
+	switch os.Args[1] {
+	case "compile":
+		err = compileCmd(os.Args[2:])
+	case "run":
+		err = runCmd(os.Args[2:])
+	case "disasm":
+		err = disasmCmd(os.Args[2:])
+	case "debug":
+		err = debugCmd(os.Args[2:])
+	case "dap":
+		err = dapCmd(os.Args[2:])
+	case "help", "-h", "-help", "--help":
+		fmt.Print(usage)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n%s", os.Args[1], usage)
+		os.Exit(2)
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", os.Args[1], err)
+		var rerr *vm.RuntimeError
+		if errors.As(err, &rerr) {
+			fmt.Fprint(os.Stderr, rerr.StackTrace())
+		}
+		os.Exit(1)
+	}
+}
+
+func startRepl() {
 	user, err := user.Current()
 	if err != nil {
 		panic(err)
@@ -13,6 +13,7 @@ func NewEnvironment() *Environment {
 
 type Environment struct {
 	store map[string]Object
+	names []string // the keys of store in the order they were set
 	outer *Environment
 }
 
@@ -25,6 +26,27 @@ func (e *Environment) Get(name string) (Object, bool) {
 }
 
 func (e *Environment) Set(name string, val Object) Object {
+	if _, ok := e.store[name]; !ok {
+		e.names = append(e.names, name)
+	}
 	e.store[name] = val
 	return val
 }
+
+// Names returns the names set in e itself, not in the environments
+// enclosing it, in the order they were first set.
+func (e *Environment) Names() []string {
+	return e.names
+}
+
+// Assign sets name in the environment that defines it, the innermost one
+// from e outwards. It reports false if none does.
+func (e *Environment) Assign(name string, val Object) bool {
+	for env := e; env != nil; env = env.outer {
+		if _, ok := env.store[name]; ok {
+			env.store[name] = val
+			return true
+		}
+	}
+	return false
+}
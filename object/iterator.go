@@ -0,0 +1,107 @@
+package object
+
+import (
+	"sort"
+	"unicode/utf8"
+)
+
+// An Iterator steps through an array, a string or a hash for a for-in
+// loop. Every step has a key and a value: the index and the element of an
+// array, the index and the character of a string, or a key of a hash and
+// its value, in the order of SortedPairs.
+type Iterator struct {
+	next func() (key, value Object, ok bool)
+	hash bool
+}
+
+func (it *Iterator) Type() ObjectType { return ITERATOR_OBJ }
+func (it *Iterator) Inspect() string  { return "iterator" }
+
+// NewIterator returns an iterator over obj, or false if obj is not an
+// array, a string or a hash. An array is iterated over the elements it
+// has when the iterator is made.
+func NewIterator(obj Object) (*Iterator, bool) {
+	switch obj := obj.(type) {
+	case *Array:
+		elements := obj.Elements
+		i := 0
+		return &Iterator{next: func() (Object, Object, bool) {
+			if i >= len(elements) {
+				return nil, nil, false
+			}
+			i++
+			return &Integer{Value: int64(i - 1)}, elements[i-1], true
+		}}, true
+
+	case *String:
+		str := obj.Value
+		i, offset := 0, 0
+		return &Iterator{next: func() (Object, Object, bool) {
+			if offset >= len(str) {
+				return nil, nil, false
+			}
+			_, width := utf8.DecodeRuneInString(str[offset:])
+			key := &Integer{Value: int64(i)}
+			value := &String{Value: str[offset : offset+width]}
+			i, offset = i+1, offset+width
+			return key, value, true
+		}}, true
+
+	case *Hash:
+		pairs := obj.SortedPairs()
+		i := 0
+		return &Iterator{hash: true, next: func() (Object, Object, bool) {
+			if i >= len(pairs) {
+				return nil, nil, false
+			}
+			i++
+			return pairs[i-1].Key, pairs[i-1].Value, true
+		}}, true
+	}
+
+	return nil, false
+}
+
+// Next returns the key and the value of the next step, or false once there
+// are none left. Without pairs only the value is returned, which for a
+// hash is the key: a loop with one variable walks the keys of a hash.
+func (it *Iterator) Next(pairs bool) (key, value Object, ok bool) {
+	key, value, ok = it.next()
+	if ok && !pairs {
+		if it.hash {
+			value = key
+		}
+		key = nil
+	}
+	return key, value, ok
+}
+
+// SortedPairs returns the pairs of h ordered by key: booleans before
+// integers before strings, and each of them in their natural order.
+func (h *Hash) SortedPairs() []HashPair {
+	pairs := make([]HashPair, 0, len(h.Pairs))
+	for _, pair := range h.Pairs {
+		pairs = append(pairs, pair)
+	}
+
+	sort.Slice(pairs, func(i, j int) bool {
+		return lessKey(pairs[i].Key, pairs[j].Key)
+	})
+	return pairs
+}
+
+func lessKey(a, b Object) bool {
+	if a.Type() != b.Type() {
+		return a.Type() < b.Type()
+	}
+
+	switch a := a.(type) {
+	case *Boolean:
+		return !a.Value && b.(*Boolean).Value
+	case *Integer:
+		return a.Value < b.(*Integer).Value
+	case *String:
+		return a.Value < b.(*String).Value
+	}
+	return false
+}
@@ -0,0 +1,86 @@
+package object
+
+import "fmt"
+
+// A BudgetExceededError stops a program that ran more steps than its host
+// allowed. A step is an instruction in the VMs and the evaluation of a
+// node in the evaluator.
+type BudgetExceededError struct {
+	Budget int64
+}
+
+func (e *BudgetExceededError) Error() string {
+	return fmt.Sprintf("execution budget of %d steps exceeded", e.Budget)
+}
+
+// A CanceledError stops a program whose context was canceled or ran past
+// its deadline. Err is the error of the context.
+type CanceledError struct {
+	Err error
+}
+
+func (e *CanceledError) Error() string { return "execution canceled: " + e.Err.Error() }
+func (e *CanceledError) Unwrap() error { return e.Err }
+
+// A MemoryLimitError stops a program that allocated more bytes for
+// strings, arrays and hashes than its host allowed.
+type MemoryLimitError struct {
+	Limit int64
+}
+
+func (e *MemoryLimitError) Error() string {
+	return fmt.Sprintf("memory limit of %d bytes exceeded", e.Limit)
+}
+
+// A DepthLimitError stops a program whose calls nested more deeply than
+// its host allowed.
+type DepthLimitError struct {
+	Limit int
+}
+
+func (e *DepthLimitError) Error() string {
+	return fmt.Sprintf("call depth limit of %d exceeded", e.Limit)
+}
+
+// The bytes an element of an array and a pair of a hash take, estimated
+// for a 64-bit machine: an interface value, and a HashKey with a
+// HashPair.
+const (
+	elementSize = 16
+	pairSize    = 56
+)
+
+// SizeOf estimates the bytes a String, an Array or a Hash allocated for
+// its contents, without the objects it refers to. Other objects count as
+// nothing.
+func SizeOf(obj Object) int64 {
+	switch obj := obj.(type) {
+	case *String:
+		return int64(len(obj.Value))
+	case *Array:
+		return int64(len(obj.Elements)) * elementSize
+	case *Hash:
+		return int64(len(obj.Pairs)) * pairSize
+	default:
+		return 0
+	}
+}
+
+// BuiltinResultSize is the SizeOf what a builtin called with args
+// returned, or nothing if the builtin returned one of args or an element
+// of one, like first and last do.
+func BuiltinResultSize(result Object, args []Object) int64 {
+	for _, arg := range args {
+		if result == arg {
+			return 0
+		}
+		if arr, ok := arg.(*Array); ok {
+			for _, elem := range arr.Elements {
+				if result == elem {
+					return 0
+				}
+			}
+		}
+	}
+	return SizeOf(result)
+}
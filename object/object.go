@@ -6,6 +6,7 @@ import (
 	"hash/fnv"
 	"karaoke/ast"
 	"karaoke/code"
+	"karaoke/token"
 	"strings"
 )
 
@@ -22,13 +23,19 @@ const (
 	STRING_OBJ  = "STRING"
 
 	RETURN_VALUE_OBJ = "RETURN_VALUE"
+	TAIL_CALL_OBJ    = "TAIL_CALL"
+	BREAK_OBJ        = "BREAK"
+	CONTINUE_OBJ     = "CONTINUE"
 
 	COMP_FUNCTION_OBJ = "COMP_FUNCTION_OBJ"
 	FUNCTION_OBJ      = "FUNCTION"
 	BUILTIN_OBJ       = "BUILTIN"
+	CLOSURE_OBJ       = "CLOSURE"
+	CELL_OBJ          = "CELL"
 
-	ARRAY_OBJ = "ARRAY"
-	HASH_OBJ  = "HASH"
+	ARRAY_OBJ    = "ARRAY"
+	HASH_OBJ     = "HASH"
+	ITERATOR_OBJ = "ITERATOR"
 )
 
 type HashKey struct {
@@ -85,16 +92,61 @@ type ReturnValue struct {
 func (rv *ReturnValue) Type() ObjectType { return RETURN_VALUE_OBJ }
 func (rv *ReturnValue) Inspect() string  { return rv.Value.Inspect() }
 
+// TailCall is a call in tail position that the evaluator has not made
+// yet. It unwinds to the caller's applyFunction, which performs it in
+// place of the returning call.
+type TailCall struct {
+	Fn   Object
+	Args []Object
+}
+
+func (tc *TailCall) Type() ObjectType { return TAIL_CALL_OBJ }
+func (tc *TailCall) Inspect() string  { return "tail call to " + tc.Fn.Inspect() }
+
+// Break and Continue unwind the evaluation of a loop's body to the loop,
+// which stops or goes on with its next step.
+type Break struct {
+	Pos token.Position // where the break statement is
+}
+
+func (b *Break) Type() ObjectType { return BREAK_OBJ }
+func (b *Break) Inspect() string  { return "break" }
+
+type Continue struct {
+	Pos token.Position // where the continue statement is
+}
+
+func (c *Continue) Type() ObjectType { return CONTINUE_OBJ }
+func (c *Continue) Inspect() string  { return "continue" }
+
 type Error struct {
 	Message string
+	Pos     token.Position // where in the source the error happened, if known
 }
 
 func (e *Error) Type() ObjectType { return ERROR_OBJ }
-func (e *Error) Inspect() string  { return "ERROR: " + e.Message }
+func (e *Error) Inspect() string {
+	if e.Pos.IsValid() {
+		return "ERROR: " + e.Pos.String() + ": " + e.Message
+	}
+	return "ERROR: " + e.Message
+}
 
 type CompiledFunction struct {
-	Instructions code.Instructions
-	NumLocals    int
+	Instructions  code.Instructions
+	NumLocals     int
+	NumParameters int
+	Name          string             // the binding name, empty if anonymous
+	Positions     code.PositionTable // the source of the instructions
+	LocalNames    []string           // the names of the locals, by slot
+	Cells         []int              // the slots of the locals held in cells
+
+	// Variants holds, by the offset of the OpClosure that makes it, the
+	// function of a closure whose function literal compiled to the same
+	// instructions as the constant the OpClosure names but sits elsewhere
+	// in the source. It shares the constant's instructions and has
+	// positions and local names of its own.
+	Variants map[int]*CompiledFunction
 }
 
 func (cf *CompiledFunction) Type() ObjectType { return COMP_FUNCTION_OBJ }
@@ -102,10 +154,31 @@ func (cf *CompiledFunction) Inspect() string {
 	return fmt.Sprintf("CompiledFunction[%p]", cf)
 }
 
+type Closure struct {
+	Fn   *CompiledFunction
+	Free []Object
+}
+
+func (c *Closure) Type() ObjectType { return CLOSURE_OBJ }
+func (c *Closure) Inspect() string {
+	return fmt.Sprintf("Closure[%p]", c)
+}
+
+// A Cell holds a local that closures capture. The function that defines
+// the local and the closures share the cell, so an assignment through any
+// of them is seen by all.
+type Cell struct {
+	Value Object
+}
+
+func (c *Cell) Type() ObjectType { return CELL_OBJ }
+func (c *Cell) Inspect() string  { return c.Value.Inspect() }
+
 type Function struct {
 	Parameters []*ast.Identifier
 	Body       *ast.BlockStatement
 	Env        *Environment
+	Name       string // the name it was bound to by a let, if any
 }
 
 func (f *Function) Type() ObjectType { return FUNCTION_OBJ }
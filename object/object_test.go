@@ -1,6 +1,9 @@
 package object
 
-import "testing"
+import (
+	"strings"
+	"testing"
+)
 
 func TestStringHashKey(t *testing.T) {
 	hello1 := &String{Value: "Hello World"}
@@ -58,3 +61,79 @@ func TestIntegerHashKey(t *testing.T) {
 		t.Errorf("integers with twoerent content have same hash keys")
 	}
 }
+
+func TestBuiltinResultSize(t *testing.T) {
+	elem := &String{Value: "elem"}
+	arr := &Array{Elements: []Object{elem, &Integer{Value: 1}}}
+	args := []Object{arr, &Integer{Value: 2}}
+
+	tests := []struct {
+		result Object
+		want   int64
+	}{
+		{arr, 0},
+		{elem, 0},
+		{&String{Value: "elem"}, 4},
+		{&Array{Elements: []Object{elem}}, 16},
+		{&Hash{Pairs: map[HashKey]HashPair{elem.HashKey(): {Key: elem, Value: elem}}}, 56},
+		{&Integer{Value: 3}, 0},
+	}
+
+	for _, tt := range tests {
+		if got := BuiltinResultSize(tt.result, args); got != tt.want {
+			t.Errorf("wrong size for %s. want=%d, got=%d", tt.result.Inspect(), tt.want, got)
+		}
+	}
+}
+
+func TestIterator(t *testing.T) {
+	hash := &Hash{Pairs: map[HashKey]HashPair{}}
+	for _, key := range []Object{
+		&String{Value: "b"}, &Integer{Value: 2}, &String{Value: "a"},
+		&Boolean{Value: true}, &Integer{Value: -1}, &Boolean{Value: false},
+	} {
+		hash.Pairs[key.(Hashable).HashKey()] = HashPair{Key: key, Value: &Integer{Value: 0}}
+	}
+
+	tests := []struct {
+		iterable Object
+		pairs    bool
+		expected []string
+	}{
+		{&Array{Elements: []Object{&Integer{Value: 7}, &String{Value: "x"}}}, true,
+			[]string{"0 7", "1 x"}},
+		{&Array{Elements: []Object{&Integer{Value: 7}}}, false, []string{"7"}},
+		{&String{Value: "hé!"}, true, []string{"0 h", "1 é", "2 !"}},
+		{&String{Value: ""}, false, []string{}},
+		{hash, false, []string{"false", "true", "-1", "2", "a", "b"}},
+		{hash, true, []string{"false 0", "true 0", "-1 0", "2 0", "a 0", "b 0"}},
+	}
+
+	for _, tt := range tests {
+		it, ok := NewIterator(tt.iterable)
+		if !ok {
+			t.Fatalf("no iterator for %s", tt.iterable.Inspect())
+		}
+
+		got := []string{}
+		for {
+			key, value, ok := it.Next(tt.pairs)
+			if !ok {
+				break
+			}
+			if tt.pairs {
+				got = append(got, key.Inspect()+" "+value.Inspect())
+			} else {
+				got = append(got, value.Inspect())
+			}
+		}
+
+		if strings.Join(got, ",") != strings.Join(tt.expected, ",") {
+			t.Errorf("wrong steps over %s. want=%q, got=%q", tt.iterable.Inspect(), tt.expected, got)
+		}
+	}
+
+	if _, ok := NewIterator(&Integer{Value: 1}); ok {
+		t.Errorf("expected no iterator for an integer")
+	}
+}
@@ -236,6 +236,47 @@ func TestParsingInfixExpressions(t *testing.T) {
 	}
 }
 
+func TestAssignExpressions(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"x = 5", "(x = 5)"},
+		{"x = x + 1 * 2;", "(x = (x + (1 * 2)))"},
+		{"x = y = z", "(x = (y = z))"},
+		{"a[i + 1] = b == c", "((a[(i + 1)]) = (b == c))"},
+		{"h[\"k\"][0] = f(x = 1)", "(((h[k])[0]) = f((x = 1)))"},
+		{"x += 1", "(x += 1)"},
+		{"x -= y * 2", "(x -= (y * 2))"},
+		{"a[0] *= b %= 3", "((a[0]) *= (b %= 3))"},
+		{"x /= y = 2", "(x /= (y = 2))"},
+		{"x++", "(x++)"},
+		{"a[i]--", "((a[i])--)"},
+		{"h[\"k\"][0]++", "(((h[k])[0])++)"},
+	}
+
+	for _, tt := range tests {
+		l := lexer.New(tt.input)
+		p := New(l)
+		program := p.ParseProgram()
+		checkParserErrors(t, p)
+
+		stmt, ok := program.Statements[0].(*ast.ExpressionStatement)
+		if !ok {
+			t.Fatalf("program.Statements[0] is not ast.ExpressionStatement. got=%T",
+				program.Statements[0])
+		}
+
+		if _, ok := stmt.Expression.(*ast.AssignExpression); !ok {
+			t.Fatalf("stmt.Expression is not ast.AssignExpression. got=%T", stmt.Expression)
+		}
+
+		if program.String() != tt.expected {
+			t.Errorf("expected=%q, got=%q", tt.expected, program.String())
+		}
+	}
+}
+
 func TestOperatorPrecedenceParsing(t *testing.T) {
 	tests := []struct {
 		input    string
@@ -249,6 +290,22 @@ func TestOperatorPrecedenceParsing(t *testing.T) {
 			"!-a",
 			"(!(-a))",
 		},
+		{
+			"a + b % c * d",
+			"(a + ((b % c) * d))",
+		},
+		{
+			"a || b && c || d",
+			"((a || (b && c)) || d)",
+		},
+		{
+			"a == b && !c || d < e + 1",
+			"(((a == b) && (!c)) || (d < (e + 1)))",
+		},
+		{
+			"x = a || b",
+			"(x = (a || b))",
+		},
 		{
 			"a + b + c",
 			"((a + b) + c)",
@@ -345,6 +402,14 @@ func TestOperatorPrecedenceParsing(t *testing.T) {
 			"a * [1, 2, 3, 4][b * c] * d",
 			"((a * ([1, 2, 3, 4][(b * c)])) * d)",
 		},
+		{
+			"-a++ * b-- - c",
+			"(((-(a++)) * (b--)) - c)",
+		},
+		{
+			"a[i]++ + 1",
+			"(((a[i])++) + 1)",
+		},
 		{
 			"add(a * b[2], b[1], 2 * [1, 2][1])",
 			"add((a * (b[2])), (b[1]), (2 * ([1, 2][1])))",
@@ -509,6 +574,139 @@ func TestIfElseExpression(t *testing.T) {
 	}
 }
 
+func TestWhileStatement(t *testing.T) {
+	input := `while (x < y) { x; y }`
+
+	l := lexer.New(input)
+	p := New(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	if len(program.Statements) != 1 {
+		t.Fatalf("program.Statements does not contain %d statements. got=%d\n",
+			1, len(program.Statements))
+	}
+
+	stmt, ok := program.Statements[0].(*ast.WhileStatement)
+	if !ok {
+		t.Fatalf("program.Statements[0] is not ast.WhileStatement. got=%T",
+			program.Statements[0])
+	}
+
+	if !testInfixExpression(t, stmt.Condition, "x", "<", "y") {
+		return
+	}
+
+	if len(stmt.Body.Statements) != 2 {
+		t.Fatalf("body is not 2 statements. got=%d\n", len(stmt.Body.Statements))
+	}
+
+	for i, name := range []string{"x", "y"} {
+		body, ok := stmt.Body.Statements[i].(*ast.ExpressionStatement)
+		if !ok {
+			t.Fatalf("Statements[%d] is not ast.ExpressionStatement. got=%T",
+				i, stmt.Body.Statements[i])
+		}
+
+		if !testIdentifier(t, body.Expression, name) {
+			return
+		}
+	}
+
+	if stmt.String() != "while(x < y) xy" {
+		t.Errorf("stmt.String() wrong. got=%q", stmt.String())
+	}
+}
+
+func TestForStatement(t *testing.T) {
+	tests := []struct {
+		input         string
+		expectedKey   string
+		expectedValue string
+		expectedStr   string
+	}{
+		{"for (x in xs) { x }", "", "x", "for (x in xs) x"},
+		{"for (i, x in xs) { x };", "i", "x", "for (i, x in xs) x"},
+	}
+
+	for _, tt := range tests {
+		l := lexer.New(tt.input)
+		p := New(l)
+		program := p.ParseProgram()
+		checkParserErrors(t, p)
+
+		if len(program.Statements) != 1 {
+			t.Fatalf("program.Statements does not contain %d statements. got=%d\n",
+				1, len(program.Statements))
+		}
+
+		stmt, ok := program.Statements[0].(*ast.ForStatement)
+		if !ok {
+			t.Fatalf("program.Statements[0] is not ast.ForStatement. got=%T",
+				program.Statements[0])
+		}
+
+		if tt.expectedKey == "" {
+			if stmt.Key != nil {
+				t.Errorf("stmt.Key was not nil. got=%+v", stmt.Key)
+			}
+		} else if !testIdentifier(t, stmt.Key, tt.expectedKey) {
+			return
+		}
+
+		if !testIdentifier(t, stmt.Value, tt.expectedValue) {
+			return
+		}
+
+		if !testIdentifier(t, stmt.Iterable, "xs") {
+			return
+		}
+
+		if len(stmt.Body.Statements) != 1 {
+			t.Fatalf("body is not 1 statement. got=%d\n", len(stmt.Body.Statements))
+		}
+
+		if stmt.String() != tt.expectedStr {
+			t.Errorf("stmt.String() wrong. want=%q, got=%q", tt.expectedStr, stmt.String())
+		}
+	}
+}
+
+func TestBreakAndContinueStatements(t *testing.T) {
+	input := `while (x) { break; continue }`
+
+	l := lexer.New(input)
+	p := New(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	if len(program.Statements) != 1 {
+		t.Fatalf("program.Statements does not contain %d statements. got=%d\n",
+			1, len(program.Statements))
+	}
+
+	stmt, ok := program.Statements[0].(*ast.WhileStatement)
+	if !ok {
+		t.Fatalf("program.Statements[0] is not ast.WhileStatement. got=%T",
+			program.Statements[0])
+	}
+
+	if len(stmt.Body.Statements) != 2 {
+		t.Fatalf("body is not 2 statements. got=%d\n", len(stmt.Body.Statements))
+	}
+
+	if _, ok := stmt.Body.Statements[0].(*ast.BreakStatement); !ok {
+		t.Fatalf("Statements[0] is not ast.BreakStatement. got=%T", stmt.Body.Statements[0])
+	}
+	if _, ok := stmt.Body.Statements[1].(*ast.ContinueStatement); !ok {
+		t.Fatalf("Statements[1] is not ast.ContinueStatement. got=%T", stmt.Body.Statements[1])
+	}
+
+	if stmt.String() != "whilex break;continue;" {
+		t.Errorf("stmt.String() wrong. got=%q", stmt.String())
+	}
+}
+
 func TestFunctionLiteralParsing(t *testing.T) {
 	input := `fn(x, y) { x + y; }`
 
@@ -556,6 +754,42 @@ func TestFunctionLiteralParsing(t *testing.T) {
 	testInfixExpression(t, bodyStmt.Expression, "x", "+", "y")
 }
 
+func TestFunctionLiteralWithName(t *testing.T) {
+	input := `let myFunction = fn() { };`
+
+	l := lexer.New(input)
+	p := New(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	if len(program.Statements) != 1 {
+		t.Fatalf("program.Statements does not contain %d statements. got=%d\n",
+			1, len(program.Statements))
+	}
+
+	stmt, ok := program.Statements[0].(*ast.LetStatement)
+	if !ok {
+		t.Fatalf("program.Statements[0] is not ast.LetStatement. got=%T",
+			program.Statements[0])
+	}
+
+	function, ok := stmt.Value.(*ast.FunctionLiteral)
+	if !ok {
+		t.Fatalf("stmt.Value is not ast.FunctionLiteral. got=%T",
+			stmt.Value)
+	}
+
+	if function.Name != "myFunction" {
+		t.Fatalf("function literal name wrong. want 'myFunction', got=%q\n",
+			function.Name)
+	}
+
+	// The name is the let's, so it is not part of the literal's source.
+	if program.String() != "let myFunction = fn() ;" {
+		t.Errorf("program.String() wrong. got=%q", program.String())
+	}
+}
+
 func TestFunctionParameterParsing(t *testing.T) {
 	tests := []struct {
 		input          string
@@ -1081,3 +1315,90 @@ func checkParserErrors(t *testing.T, p *Parser) {
 	}
 	t.FailNow()
 }
+
+func TestNodePositions(t *testing.T) {
+	input := `let add = fn(a, b) {
+  a + b
+};
+add(1, -2)[0];
+if (x) { [1] } else { {"k": true} }
+return "é";
+while (x) { x };`
+
+	l := lexer.New(input)
+	p := New(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	let := program.Statements[0].(*ast.LetStatement)
+	fn := let.Value.(*ast.FunctionLiteral)
+	sum := fn.Body.Statements[0].(*ast.ExpressionStatement).Expression
+	index := program.Statements[1].(*ast.ExpressionStatement).Expression.(*ast.IndexExpression)
+	call := index.Left.(*ast.CallExpression)
+	ifExp := program.Statements[2].(*ast.ExpressionStatement).Expression.(*ast.IfExpression)
+	ret := program.Statements[3].(*ast.ReturnStatement)
+	while := program.Statements[4].(*ast.WhileStatement)
+
+	tests := []struct {
+		node        ast.Node
+		expectedPos string
+		expectedEnd string
+	}{
+		{program, "1:1", "7:16"},
+		{let, "1:1", "3:2"},
+		{fn, "1:11", "3:2"},
+		{fn.Body, "1:20", "3:2"},
+		{sum, "2:3", "2:8"},
+		{index, "4:1", "4:14"},
+		{call, "4:1", "4:11"},
+		{call.Arguments[1], "4:8", "4:10"},
+		{ifExp, "5:1", "5:36"},
+		{ifExp.Consequence.Statements[0], "5:10", "5:13"},
+		{ifExp.Alternative.Statements[0], "5:23", "5:34"},
+		{ret, "6:1", "6:11"},
+		{while, "7:1", "7:16"},
+	}
+
+	for i, tt := range tests {
+		if tt.node.Pos().String() != tt.expectedPos {
+			t.Errorf("tests[%d] %q - pos wrong. expected=%s, got=%s",
+				i, tt.node.String(), tt.expectedPos, tt.node.Pos())
+		}
+		if tt.node.End().String() != tt.expectedEnd {
+			t.Errorf("tests[%d] %q - end wrong. expected=%s, got=%s",
+				i, tt.node.String(), tt.expectedEnd, tt.node.End())
+		}
+	}
+}
+
+func TestParserErrorPositions(t *testing.T) {
+	tests := []struct {
+		input         string
+		expectedError string
+	}{
+		{"let x 5;", "1:7: expected next token to be =, got INT instead"},
+		{"let x = 1;\n  let = 2;", "2:7: expected next token to be IDENT, got = instead"},
+		{"1 + ;", "1:5: no prefix parse function for ; found"},
+		{"while x { x }", "1:7: expected next token to be (, got IDENT instead"},
+		{"for (x xs) { x }", "1:8: expected next token to be IN, got IDENT instead"},
+		{"let a = 1;\na + 1 = 2", "2:1: cannot assign to (a + 1)"},
+		{"f() = 2", "1:1: cannot assign to f()"},
+		{"1 += 2", "1:1: cannot assign to 1"},
+		{"f()++", "1:1: cannot assign to f()"},
+		{"--x", "1:1: no prefix parse function for -- found"},
+		{"\"é\" + 99999999999999999999", "1:7: could not parse \"99999999999999999999\" as integer"},
+	}
+
+	for _, tt := range tests {
+		p := New(lexer.NewWithFile("", tt.input))
+		p.ParseProgram()
+
+		errors := p.Errors()
+		if len(errors) == 0 {
+			t.Fatalf("expected parser errors for %q", tt.input)
+		}
+		if errors[0] != tt.expectedError {
+			t.Errorf("wrong error. expected=%q, got=%q", tt.expectedError, errors[0])
+		}
+	}
+}
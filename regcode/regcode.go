@@ -0,0 +1,252 @@
+// Package regcode is the instruction set of the register VM. Operands
+// name registers of the current frame instead of implicit stack slots:
+// registers 0 to NumLocals-1 hold the locals, the registers above them
+// hold temporaries. The encoding follows package code: a one byte opcode
+// followed by big endian operands.
+package regcode
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+type Instructions []byte
+
+type Opcode byte
+
+type Definition struct {
+	Name          string
+	OperandWidths []int
+}
+
+func (inst Instructions) String() string {
+	offset := 0
+	output := ""
+	for offset < len(inst) {
+		def, operands, width, err := inst.ReadInstruction(offset)
+		if err != nil {
+			output += fmt.Sprintf("%04d ERROR: %s\n", offset, err)
+			break
+		}
+		if len(operands) > 0 {
+			output += fmt.Sprintf("%04d %s %s\n", offset, def.Name, strings.Trim(fmt.Sprint(operands), "[]"))
+		} else {
+			output += fmt.Sprintf("%04d %s\n", offset, def.Name)
+		}
+
+		offset += width
+	}
+
+	return output
+}
+
+// ReadInstruction decodes the instruction at offset and returns its
+// definition, its operands and its total width in bytes.
+func (inst Instructions) ReadInstruction(offset int) (*Definition, []int, int, error) {
+	def, err := Lookup(inst[offset])
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	width := 1
+	for _, w := range def.OperandWidths {
+		width += w
+	}
+	if offset+width > len(inst) {
+		return nil, nil, 0, fmt.Errorf("%s at %d truncated: want %d bytes, have %d",
+			def.Name, offset, width, len(inst)-offset)
+	}
+
+	operands, _ := ReadOperands(def, inst[offset+1:])
+	return def, operands, width, nil
+}
+
+func ReadUint16(inst []byte) uint16 {
+	return binary.BigEndian.Uint16(inst)
+}
+
+func PutUint16(inst []byte, val uint16) {
+	binary.BigEndian.PutUint16(inst, val)
+}
+
+func ReadUint32(inst []byte) uint32 {
+	return binary.BigEndian.Uint32(inst)
+}
+
+func PutUint32(inst []byte, val uint32) {
+	binary.BigEndian.PutUint32(inst, val)
+}
+
+func ReadOperands(def *Definition, inst []byte) ([]int, int) {
+	operands := make([]int, len(def.OperandWidths))
+	offset := 0
+	for i, width := range def.OperandWidths {
+		switch width {
+		case 1:
+			operands[i] = int(inst[offset])
+		case 2:
+			operands[i] = int(ReadUint16(inst[offset:]))
+		case 4:
+			operands[i] = int(ReadUint32(inst[offset:]))
+		}
+
+		offset += width
+	}
+	return operands, offset
+}
+
+// Make encodes an instruction. Unlike the stack code there is no wide
+// form: operands are as wide as they can get, so Make panics if one does
+// not fit.
+func Make(op Opcode, operands ...int) []byte {
+	def, ok := definitions[op]
+	if !ok {
+		return []byte{}
+	}
+
+	instLen := 1
+	for _, el := range def.OperandWidths {
+		instLen += el
+	}
+
+	inst := make([]byte, instLen)
+	inst[0] = byte(op)
+
+	offset := 1
+	for i, el := range operands {
+		width := def.OperandWidths[i]
+		if el < 0 || el >= 1<<(8*width) {
+			panic(fmt.Sprintf("operand %d of %s does not fit in %d bytes", el, def.Name, width))
+		}
+		switch width {
+		case 1:
+			inst[offset] = byte(el)
+		case 2:
+			PutUint16(inst[offset:], uint16(el))
+		case 4:
+			PutUint32(inst[offset:], uint32(el))
+		}
+		offset += width
+	}
+
+	return inst
+}
+
+func Lookup(op byte) (*Definition, error) {
+	def, ok := definitions[Opcode(op)]
+	if !ok {
+		return nil, fmt.Errorf("opcode %d undefined", op)
+	}
+
+	return def, nil
+}
+
+// In the comments below R[x] is register x of the current frame, K[x]
+// constant x and G[x] global x.
+var definitions = map[Opcode]*Definition{
+	// R[A] = K[B]
+	OpLoadConst: {"OpLoadConst", []int{2, 4}},
+	// R[A] = true, false or null
+	OpLoadTrue:  {"OpLoadTrue", []int{2}},
+	OpLoadFalse: {"OpLoadFalse", []int{2}},
+	OpLoadNull:  {"OpLoadNull", []int{2}},
+	// R[A] = R[B]
+	OpMove: {"OpMove", []int{2, 2}},
+	// R[A] = G[B]
+	OpGetGlobal: {"OpGetGlobal", []int{2, 4}},
+	// G[A] = R[B]
+	OpSetGlobal: {"OpSetGlobal", []int{4, 2}},
+	// R[A] = builtin B
+	OpGetBuiltin: {"OpGetBuiltin", []int{2, 1}},
+	// R[A] = free variable B of the running closure
+	OpGetFree: {"OpGetFree", []int{2, 2}},
+	// R[A] = the running closure
+	OpCurrentClosure: {"OpCurrentClosure", []int{2}},
+	// R[A] = R[B] op R[C]
+	OpAdd:         {"OpAdd", []int{2, 2, 2}},
+	OpSub:         {"OpSub", []int{2, 2, 2}},
+	OpMul:         {"OpMul", []int{2, 2, 2}},
+	OpDiv:         {"OpDiv", []int{2, 2, 2}},
+	OpEqual:       {"OpEqual", []int{2, 2, 2}},
+	OpNotEqual:    {"OpNotEqual", []int{2, 2, 2}},
+	OpGreaterThan: {"OpGreaterThan", []int{2, 2, 2}},
+	OpIndex:       {"OpIndex", []int{2, 2, 2}},
+	OpMod:         {"OpMod", []int{2, 2, 2}},
+	// R[A] = op R[B]
+	OpMinus: {"OpMinus", []int{2, 2}},
+	OpBang:  {"OpBang", []int{2, 2}},
+	// jump to offset A
+	OpJump: {"OpJump", []int{4}},
+	// jump to offset B unless R[A] is truthy
+	OpJumpNotTruthy: {"OpJumpNotTruthy", []int{2, 4}},
+	// R[A] = [R[B], ..., R[B+C-1]]
+	OpArray: {"OpArray", []int{2, 2, 2}},
+	// R[A] = {R[B]: R[B+1], ...} with C pairs
+	OpHash: {"OpHash", []int{2, 2, 2}},
+	// R[A] = R[A](R[A+1], ..., R[A+B])
+	OpCall: {"OpCall", []int{2, 2}},
+	// like OpCall, but a closure reuses the current frame
+	OpTailCall: {"OpTailCall", []int{2, 2}},
+	// return R[A]
+	OpReturnValue: {"OpReturnValue", []int{2}},
+	// return null
+	OpReturn: {"OpReturn", []int{}},
+	// R[A] = closure of K[B] over R[C], ..., R[C+D-1]
+	OpClosure: {"OpClosure", []int{2, 4, 2, 2}},
+	// R[A] = iterator over R[B]
+	OpIter: {"OpIter", []int{2, 2}},
+	// R[B], R[B+1] = next key and value of iterator R[A], or R[B] = next
+	// value if C is 1; once R[A] is exhausted, R[A] = null and jump to D
+	OpIterNext: {"OpIterNext", []int{2, 2, 1, 4}},
+	// R[A][R[B]] = R[C]
+	OpSetIndex: {"OpSetIndex", []int{2, 2, 2}},
+	// R[A] = the value of the cell in R[B]
+	OpGetCell: {"OpGetCell", []int{2, 2}},
+	// the value of the cell in R[A] = R[B]
+	OpSetCell: {"OpSetCell", []int{2, 2}},
+	// R[A] = the value of the cell that is free variable B
+	OpGetFreeCell: {"OpGetFreeCell", []int{2, 2}},
+	// the value of the cell that is free variable A = R[B]
+	OpSetFreeCell: {"OpSetFreeCell", []int{2, 2}},
+}
+
+const (
+	OpLoadConst Opcode = iota
+	OpLoadTrue
+	OpLoadFalse
+	OpLoadNull
+	OpMove
+	OpGetGlobal
+	OpSetGlobal
+	OpGetBuiltin
+	OpGetFree
+	OpCurrentClosure
+	OpAdd
+	OpSub
+	OpMul
+	OpDiv
+	OpEqual
+	OpNotEqual
+	OpGreaterThan
+	OpIndex
+	OpMinus
+	OpBang
+	OpJump
+	OpJumpNotTruthy
+	OpArray
+	OpHash
+	OpCall
+	OpTailCall
+	OpReturnValue
+	OpReturn
+	OpClosure
+	OpIter
+	OpIterNext
+	OpSetIndex
+	OpMod
+	OpGetCell
+	OpSetCell
+	OpGetFreeCell
+	OpSetFreeCell
+)
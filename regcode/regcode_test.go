@@ -0,0 +1,107 @@
+package regcode
+
+import (
+	"testing"
+)
+
+func TestMake(t *testing.T) {
+	tests := []struct {
+		op       Opcode
+		operands []int
+		expected []byte
+	}{
+		{OpLoadConst, []int{3, 65536}, []byte{byte(OpLoadConst), 0, 3, 0, 1, 0, 0}},
+		{OpReturn, []int{}, []byte{byte(OpReturn)}},
+		{OpAdd, []int{1, 2, 258}, []byte{byte(OpAdd), 0, 1, 0, 2, 1, 2}},
+		{OpCall, []int{4, 2}, []byte{byte(OpCall), 0, 4, 0, 2}},
+		{OpClosure, []int{1, 65534, 2, 256}, []byte{byte(OpClosure), 0, 1, 0, 0, 255, 254, 0, 2, 1, 0}},
+	}
+
+	for _, tt := range tests {
+		instruction := Make(tt.op, tt.operands...)
+
+		if len(instruction) != len(tt.expected) {
+			t.Errorf("instruction has wrong length. want=%d, got=%d",
+				len(tt.expected), len(instruction))
+		}
+
+		for i, el := range tt.expected {
+			if instruction[i] != el {
+				t.Errorf("wrong byte at pos %d. want=%d, got=%d",
+					i, el, instruction[i])
+			}
+		}
+	}
+}
+
+func TestMakePanicsOnOverflow(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Errorf("Make did not panic on an operand that does not fit")
+		}
+	}()
+
+	Make(OpMove, 65536, 0)
+}
+
+func TestReadOperands(t *testing.T) {
+	tests := []struct {
+		op        Opcode
+		operands  []int
+		bytesRead int
+	}{
+		{OpLoadConst, []int{65535, 70000}, 6},
+		{OpReturn, []int{}, 0},
+		{OpSub, []int{1, 2, 3}, 6},
+		{OpGetBuiltin, []int{300, 5}, 3},
+		{OpClosure, []int{1, 65535, 2, 300}, 10},
+		{OpIterNext, []int{3, 4, 2, 70000}, 9},
+	}
+
+	for _, tt := range tests {
+		instruction := Make(tt.op, tt.operands...)
+		def, err := Lookup(byte(tt.op))
+		if err != nil {
+			t.Fatalf("definition not found: %q\n", err)
+		}
+
+		operandsRead, n := ReadOperands(def, instruction[1:])
+		if n != tt.bytesRead {
+			t.Fatalf("n wrong. want=%d, got=%d", tt.bytesRead, n)
+		}
+
+		for i, want := range tt.operands {
+			if operandsRead[i] != want {
+				t.Errorf("operand wrong. want=%d, got=%d", want, operandsRead[i])
+			}
+		}
+	}
+}
+
+func TestInstructionsString(t *testing.T) {
+	instructions := []Instructions{
+		Make(OpLoadConst, 1, 2),
+		Make(OpAdd, 1, 0, 1),
+		Make(OpJumpNotTruthy, 1, 23),
+		Make(OpCall, 1, 0),
+		Make(OpReturnValue, 1),
+		Make(OpReturn),
+	}
+
+	expected := `0000 OpLoadConst 1 2
+0007 OpAdd 1 0 1
+0014 OpJumpNotTruthy 1 23
+0021 OpCall 1 0
+0026 OpReturnValue 1
+0029 OpReturn
+`
+
+	concatted := Instructions{}
+	for _, elm := range instructions {
+		concatted = append(concatted, elm...)
+	}
+	if concatted.String() != expected {
+		t.Errorf("instructions wrongly formatted. \nwant=%q\ngot =%q",
+			expected, concatted.String())
+	}
+}
@@ -19,6 +19,9 @@ func Start(in io.Reader, out io.Writer) {
 	constants := []object.Object{}
 	globals := make([]object.Object, vm.GlobalsSize)
 	symbolTable := compiler.NewSymbolTable()
+	for i, def := range object.Builtins {
+		symbolTable.DefineBuiltin(i, def.Name)
+	}
 
 	for {
 		fmt.Fprint(out, PROMPT)
@@ -51,6 +54,9 @@ func Start(in io.Reader, out io.Writer) {
 		err = machine.Run()
 		if err != nil {
 			fmt.Fprintf(out, "Woops, execution failed:\n %s\n", err)
+			if rerr, ok := err.(*vm.RuntimeError); ok {
+				io.WriteString(out, rerr.StackTrace())
+			}
 			continue
 		}
 
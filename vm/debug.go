@@ -0,0 +1,370 @@
+package vm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"karaoke/code"
+	"karaoke/object"
+	"sort"
+)
+
+// The debugger runs the program in the same loop as Run. Before every
+// instruction the loop asks it whether to pause there; if so run returns
+// errPaused with the frame's ip still on the instruction before, so the
+// next resume carries on with the instruction it paused at.
+
+var errPaused = errors.New("paused")
+
+// A StopReason says why the program stopped.
+type StopReason string
+
+const (
+	StopBreakpoint StopReason = "breakpoint"
+	StopStep       StopReason = "step"
+	StopExited     StopReason = "exited"
+)
+
+// A Stop is where a Continue or a step ended. Breakpoint is the breakpoint
+// that was hit, for StopBreakpoint.
+type Stop struct {
+	Reason     StopReason
+	Breakpoint *Breakpoint
+}
+
+// A Breakpoint pauses the program before the instruction at Offset in Fn
+// runs. Span is the source of that instruction.
+type Breakpoint struct {
+	ID     int
+	Fn     *object.CompiledFunction
+	Offset int
+	Span   code.Span
+}
+
+// A Variable is a named global or local with a value.
+type Variable struct {
+	Name  string
+	Value object.Object
+}
+
+// A DebugFrame is one call on the call stack. Offset is the instruction
+// the frame runs next, or for a caller the call it is in.
+type DebugFrame struct {
+	Function string
+	Fn       *object.CompiledFunction
+	Offset   int
+	Span     code.Span
+	Locals   []Variable
+}
+
+type breakpointKey struct {
+	fn     *object.CompiledFunction
+	offset int
+}
+
+// A location is where the program is about to run an instruction.
+type location struct {
+	depth  int
+	fn     *object.CompiledFunction
+	offset int
+	span   code.Span
+}
+
+func (l location) sameLine(other location) bool {
+	return l.fn == other.fn &&
+		l.span.Start.File == other.span.Start.File &&
+		l.span.Start.Line == other.span.Start.Line
+}
+
+// A stepFunc reports whether a step from where it was made ends at loc.
+type stepFunc func(loc location) bool
+
+type debugState struct {
+	breakpoints map[breakpointKey]*Breakpoint
+	nextID      int
+
+	started bool     // the limits were started for the debugged run
+	active  bool     // a resume is running
+	first   bool     // the loop is at the instruction the resume started at
+	resumed bool     // the program ran before, so it paused where it is
+	step    stepFunc // nil when continuing
+	stop    *Stop
+	err     *RuntimeError // the error the program failed with
+}
+
+func (vm *VM) debug() *debugState {
+	if vm.debugger == nil {
+		vm.debugger = &debugState{breakpoints: map[breakpointKey]*Breakpoint{}}
+	}
+	return vm.debugger
+}
+
+// pause reports whether the loop should stop before the next instruction.
+// A breakpoint where the program paused last does not stop it again, and
+// a step always runs at least one instruction.
+func (d *debugState) pause(vm *VM) bool {
+	first := d.first
+	d.first = false
+
+	loc := vm.location()
+	if !first || !d.resumed {
+		if bp, ok := d.breakpoints[breakpointKey{loc.fn, loc.offset}]; ok {
+			d.stop = &Stop{Reason: StopBreakpoint, Breakpoint: bp}
+			return true
+		}
+	}
+
+	if !first && d.step != nil && d.step(loc) {
+		d.stop = &Stop{Reason: StopStep}
+		return true
+	}
+	return false
+}
+
+func (vm *VM) location() location {
+	frame := vm.currenFrame()
+	fn := frame.cl.Fn
+	offset := frame.ip + 1
+	span, _ := fn.Positions.Lookup(offset)
+	return location{depth: vm.framesPtr, fn: fn, offset: offset, span: span}
+}
+
+// resume runs the program until a breakpoint, the end of step or the end
+// of the program. Once the program failed every resume returns its error.
+func (vm *VM) resume(step stepFunc) (*Stop, error) {
+	d := vm.debug()
+	if d.err != nil {
+		return nil, d.err
+	}
+
+	if !d.started {
+		vm.DebugContext(context.Background())
+	}
+
+	d.active, d.first, d.step = true, true, step
+	err := vm.run()
+	d.active, d.resumed, d.step = false, true, nil
+
+	switch {
+	case err == errPaused:
+		return d.stop, nil
+	case err != nil:
+		d.err = vm.runtimeError(err)
+		return nil, d.err
+	}
+	return &Stop{Reason: StopExited}, nil
+}
+
+// DebugContext begins the debugged run under ctx: the instruction budget
+// and the memory limit count for all of it and it stops once ctx is done,
+// across every Continue and step. Without a call the run begins at the
+// first of those, under no context.
+func (vm *VM) DebugContext(ctx context.Context) {
+	vm.limits.start(ctx)
+	vm.debug().started = true
+}
+
+// Continue runs the program until it hits a breakpoint or ends. An error
+// it returns is a *RuntimeError.
+func (vm *VM) Continue() (*Stop, error) {
+	return vm.resume(nil)
+}
+
+// StepInto runs the program to the next source line, entering calls.
+func (vm *VM) StepInto() (*Stop, error) {
+	start := vm.location()
+	return vm.resume(func(loc location) bool {
+		return loc.span.Start.IsValid() &&
+			(loc.depth != start.depth || !loc.sameLine(start))
+	})
+}
+
+// StepOver runs the program to the next source line of the current call,
+// or of its caller once it returns. Calls it makes run to their end
+// unless they hit a breakpoint.
+func (vm *VM) StepOver() (*Stop, error) {
+	start := vm.location()
+	return vm.resume(func(loc location) bool {
+		return loc.span.Start.IsValid() &&
+			(loc.depth < start.depth || loc.depth == start.depth && !loc.sameLine(start))
+	})
+}
+
+// StepOut runs the program until the current call returns to its caller.
+func (vm *VM) StepOut() (*Stop, error) {
+	start := vm.location()
+	return vm.resume(func(loc location) bool {
+		return loc.depth < start.depth
+	})
+}
+
+// StepInstruction runs a single instruction.
+func (vm *VM) StepInstruction() (*Stop, error) {
+	return vm.resume(func(loc location) bool { return true })
+}
+
+// Functions returns the main program followed by the functions in the
+// constant pool, each function followed by its variants: the code
+// breakpoints can be set in.
+func (vm *VM) Functions() []*object.CompiledFunction {
+	main := vm.frames[0].cl.Fn
+	fns := appendVariants([]*object.CompiledFunction{main}, main)
+	for _, con := range vm.constants {
+		if fn, ok := con.(*object.CompiledFunction); ok {
+			fns = appendVariants(append(fns, fn), fn)
+		}
+	}
+	return fns
+}
+
+// SetBreakpoint sets a breakpoint on the first instruction compiled from
+// line in every function that has code there. An empty file matches any
+// file.
+func (vm *VM) SetBreakpoint(file string, line int) ([]*Breakpoint, error) {
+	var bps []*Breakpoint
+	for _, fn := range vm.Functions() {
+		for _, entry := range fn.Positions {
+			start := entry.Span.Start
+			if start.Line != line || file != "" && start.File != file {
+				continue
+			}
+			if entry.Offset < len(fn.Instructions) {
+				bps = append(bps, vm.debug().addBreakpoint(fn, entry.Offset, entry.Span))
+			}
+			break
+		}
+	}
+
+	if len(bps) == 0 {
+		return nil, fmt.Errorf("no code at line %d", line)
+	}
+	return bps, nil
+}
+
+// SetInstructionBreakpoint sets a breakpoint on the instruction at offset
+// in fn.
+func (vm *VM) SetInstructionBreakpoint(fn *object.CompiledFunction, offset int) (*Breakpoint, error) {
+	if offset < 0 || offset >= len(fn.Instructions) || instructionAt(fn.Instructions, offset) != offset {
+		return nil, fmt.Errorf("no instruction at offset %d in %s", offset, functionName(fn))
+	}
+
+	span, _ := fn.Positions.Lookup(offset)
+	return vm.debug().addBreakpoint(fn, offset, span), nil
+}
+
+// addBreakpoint returns the breakpoint at offset in fn, setting it if
+// there is none yet.
+func (d *debugState) addBreakpoint(fn *object.CompiledFunction, offset int, span code.Span) *Breakpoint {
+	key := breakpointKey{fn, offset}
+	if bp, ok := d.breakpoints[key]; ok {
+		return bp
+	}
+
+	d.nextID++
+	bp := &Breakpoint{ID: d.nextID, Fn: fn, Offset: offset, Span: span}
+	d.breakpoints[key] = bp
+	return bp
+}
+
+// ClearBreakpoint removes the breakpoint with the given id and reports
+// whether there was one.
+func (vm *VM) ClearBreakpoint(id int) bool {
+	d := vm.debug()
+	for key, bp := range d.breakpoints {
+		if bp.ID == id {
+			delete(d.breakpoints, key)
+			return true
+		}
+	}
+	return false
+}
+
+// ClearBreakpoints removes every breakpoint.
+func (vm *VM) ClearBreakpoints() {
+	clear(vm.debug().breakpoints)
+}
+
+// Breakpoints returns the breakpoints ordered by id.
+func (vm *VM) Breakpoints() []*Breakpoint {
+	var bps []*Breakpoint
+	for _, bp := range vm.debug().breakpoints {
+		bps = append(bps, bp)
+	}
+	sort.Slice(bps, func(i, j int) bool { return bps[i].ID < bps[j].ID })
+	return bps
+}
+
+// CallStack returns the calls that are running, innermost first. Calls
+// replaced by tail calls are not in it.
+func (vm *VM) CallStack() []DebugFrame {
+	frames := make([]DebugFrame, 0, vm.framesPtr)
+	for i := vm.framesPtr - 1; i >= 0; i-- {
+		frame := vm.frames[i]
+		fn := frame.cl.Fn
+
+		// A caller's ip is on the last byte of its call.
+		offset := frame.ip + 1
+		if i < vm.framesPtr-1 {
+			offset = instructionAt(fn.Instructions, frame.ip)
+		}
+
+		span, _ := fn.Positions.Lookup(offset)
+		frames = append(frames, DebugFrame{
+			Function: functionName(fn),
+			Fn:       fn,
+			Offset:   offset,
+			Span:     span,
+			Locals:   vm.locals(frame),
+		})
+	}
+	return frames
+}
+
+// Locals returns the assigned locals of the current call.
+func (vm *VM) Locals() []Variable {
+	return vm.locals(vm.currenFrame())
+}
+
+func (vm *VM) locals(frame *Frame) []Variable {
+	var vars []Variable
+	for i, name := range frame.cl.Fn.LocalNames {
+		value := vm.stack[frame.basePtr+i]
+		if cell, ok := value.(*object.Cell); ok {
+			value = cell.Value
+		}
+		if name != "" && value != nil {
+			vars = append(vars, Variable{Name: name, Value: value})
+		}
+	}
+	return vars
+}
+
+// Globals returns the assigned globals.
+func (vm *VM) Globals() []Variable {
+	var vars []Variable
+	for i, name := range vm.globalNames {
+		if i < len(vm.globals) && name != "" && vm.globals[i] != nil {
+			vars = append(vars, Variable{Name: name, Value: vm.globals[i]})
+		}
+	}
+	return vars
+}
+
+// Stack returns the values on the stack, bottom first. It includes the
+// callees, arguments and locals of the running calls.
+func (vm *VM) Stack() []object.Object {
+	return append([]object.Object(nil), vm.stack[:vm.sp]...)
+}
+
+// instructionAt returns the offset of the instruction that covers offset.
+func instructionAt(ins code.Instructions, offset int) int {
+	start := 0
+	for start < len(ins) {
+		_, _, width, err := ins.ReadInstruction(start)
+		if err != nil || start+width > offset {
+			break
+		}
+		start += width
+	}
+	return start
+}
@@ -0,0 +1,345 @@
+package vm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"karaoke/compiler"
+	"karaoke/object"
+	"strings"
+	"testing"
+)
+
+const debugInput = `let add = fn(a, b) {
+  let sum = a + b;
+  sum * 2
+};
+let x = add(1, 2);
+let y = add(x, 3);
+y + 0`
+
+func newDebugVM(t *testing.T, input string) *VM {
+	t.Helper()
+
+	comp := compiler.New()
+	err := comp.Compile(parseFile("debug.mk", input))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+	return New(comp.Bytecode())
+}
+
+// describeStop formats where the VM stopped as "reason function line".
+func describeStop(t *testing.T, vm *VM, stop *Stop, err error) string {
+	t.Helper()
+
+	if err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+	if stop.Reason == StopExited {
+		return string(stop.Reason)
+	}
+	frame := vm.CallStack()[0]
+	return fmt.Sprintf("%s %s %d", stop.Reason, frame.Function, frame.Span.Start.Line)
+}
+
+func describeVariables(vars []Variable) string {
+	var out []string
+	for _, v := range vars {
+		out = append(out, v.Name+"="+v.Value.Inspect())
+	}
+	return strings.Join(out, " ")
+}
+
+func TestDebugLineBreakpoints(t *testing.T) {
+	vm := newDebugVM(t, debugInput)
+
+	bps, err := vm.SetBreakpoint("debug.mk", 2)
+	if err != nil {
+		t.Fatalf("SetBreakpoint: %s", err)
+	}
+	if len(bps) != 1 || bps[0].Fn.Name != "add" || bps[0].Offset != 0 {
+		t.Fatalf("wrong breakpoints: %+v", bps)
+	}
+
+	_, err = vm.SetBreakpoint("", 8)
+	if err == nil || err.Error() != "no code at line 8" {
+		t.Errorf("wrong error for a line without code: %v", err)
+	}
+	_, err = vm.SetBreakpoint("other.mk", 2)
+	if err == nil {
+		t.Errorf("expected an error for another file")
+	}
+
+	tests := []struct {
+		locals  string
+		globals string
+		callers string
+	}{
+		{"a=1 b=2", "add", "<main> 5"},
+		{"a=6 b=3", "add x", "<main> 6"},
+	}
+
+	for _, tt := range tests {
+		stop, err := vm.Continue()
+		if got := describeStop(t, vm, stop, err); got != "breakpoint add 2" {
+			t.Fatalf("wrong stop. want=%q, got=%q", "breakpoint add 2", got)
+		}
+		if stop.Breakpoint != bps[0] {
+			t.Errorf("wrong breakpoint hit: %+v", stop.Breakpoint)
+		}
+
+		if got := describeVariables(vm.Locals()); got != tt.locals {
+			t.Errorf("wrong locals. want=%q, got=%q", tt.locals, got)
+		}
+		var globals []string
+		for _, v := range vm.Globals() {
+			globals = append(globals, v.Name)
+		}
+		if got := strings.Join(globals, " "); got != tt.globals {
+			t.Errorf("wrong globals. want=%q, got=%q", tt.globals, got)
+		}
+
+		stack := vm.CallStack()
+		if len(stack) != 2 {
+			t.Fatalf("wrong call stack depth. want=2, got=%d", len(stack))
+		}
+		caller := fmt.Sprintf("%s %d", stack[1].Function, stack[1].Span.Start.Line)
+		if caller != tt.callers {
+			t.Errorf("wrong caller. want=%q, got=%q", tt.callers, caller)
+		}
+		if stack[1].Locals != nil {
+			t.Errorf("main has locals: %v", stack[1].Locals)
+		}
+	}
+
+	stop, err := vm.Continue()
+	if got := describeStop(t, vm, stop, err); got != "exited" {
+		t.Fatalf("wrong stop. want=%q, got=%q", "exited", got)
+	}
+	if err := testIntegerObject(18, vm.LastPoppedStackElem()); err != nil {
+		t.Errorf("wrong result: %s", err)
+	}
+}
+
+func TestDebugStepping(t *testing.T) {
+	vm := newDebugVM(t, debugInput)
+
+	steps := []struct {
+		name string
+		step func() (*Stop, error)
+		want string
+	}{
+		{"over", vm.StepOver, "step <main> 5"},
+		{"into", vm.StepInto, "step add 2"},
+		{"over", vm.StepOver, "step add 3"},
+		{"over", vm.StepOver, "step add 4"},
+		{"out", vm.StepOut, "step <main> 5"},
+		{"over", vm.StepOver, "step <main> 6"},
+		{"over", vm.StepOver, "step <main> 7"},
+		{"over", vm.StepOver, "exited"},
+	}
+
+	for i, s := range steps {
+		stop, err := s.step()
+		if got := describeStop(t, vm, stop, err); got != s.want {
+			t.Fatalf("step %d (%s): want=%q, got=%q", i, s.name, s.want, got)
+		}
+	}
+}
+
+func TestDebugStepIntoReturnsToCaller(t *testing.T) {
+	vm := newDebugVM(t, debugInput)
+	vm.SetBreakpoint("", 3)
+
+	want := []string{"breakpoint add 3", "step add 4", "step <main> 5", "step <main> 6", "step add 2"}
+	for i, w := range want {
+		var stop *Stop
+		var err error
+		if i == 0 {
+			stop, err = vm.Continue()
+		} else {
+			stop, err = vm.StepInto()
+		}
+		if got := describeStop(t, vm, stop, err); got != w {
+			t.Fatalf("stop %d: want=%q, got=%q", i, w, got)
+		}
+	}
+}
+
+func TestDebugStepOverSkipsBreakpointsOnce(t *testing.T) {
+	vm := newDebugVM(t, debugInput)
+	vm.SetBreakpoint("", 5)
+	vm.SetBreakpoint("", 2)
+
+	want := []string{"breakpoint <main> 5", "breakpoint add 2", "step add 3"}
+	for i, w := range want {
+		var stop *Stop
+		var err error
+		switch i {
+		case 2:
+			stop, err = vm.StepOver()
+		default:
+			// The second Continue starts at the breakpoint on line 5
+			// and must not stop there again.
+			stop, err = vm.Continue()
+		}
+		if got := describeStop(t, vm, stop, err); got != w {
+			t.Fatalf("stop %d: want=%q, got=%q", i, w, got)
+		}
+	}
+}
+
+func TestDebugInstructionBreakpoints(t *testing.T) {
+	vm := newDebugVM(t, debugInput)
+
+	fns := vm.Functions()
+	if len(fns) != 2 || fns[0].Name != mainName || fns[1].Name != "add" {
+		t.Fatalf("wrong functions: %v", fns)
+	}
+
+	_, err := vm.SetInstructionBreakpoint(fns[1], 1)
+	if err == nil || err.Error() != "no instruction at offset 1 in add" {
+		t.Errorf("wrong error for an operand offset: %v", err)
+	}
+
+	// The third instruction of add is OpAdd.
+	bp, err := vm.SetInstructionBreakpoint(fns[1], 4)
+	if err != nil {
+		t.Fatalf("SetInstructionBreakpoint: %s", err)
+	}
+	if again, _ := vm.SetInstructionBreakpoint(fns[1], 4); again != bp {
+		t.Errorf("setting a breakpoint twice made a new one")
+	}
+
+	stop, err := vm.Continue()
+	if got := describeStop(t, vm, stop, err); got != "breakpoint add 2" {
+		t.Fatalf("wrong stop: %q", got)
+	}
+	if offset := vm.CallStack()[0].Offset; offset != 4 {
+		t.Errorf("wrong offset. want=4, got=%d", offset)
+	}
+
+	stack := vm.Stack()
+	if len(stack) < 5 {
+		t.Fatalf("stack too short: %v", stack)
+	}
+	// The callee, a, b, the unassigned sum and the operands of OpAdd.
+	if err := testIntegerObject(2, stack[len(stack)-1]); err != nil {
+		t.Errorf("wrong top of stack: %s", err)
+	}
+	if stack[len(stack)-3] != nil {
+		t.Errorf("sum has a value before it is assigned: %v", stack[len(stack)-3])
+	}
+
+	stop, err = vm.StepInstruction()
+	if err != nil || stop.Reason != StopStep || vm.CallStack()[0].Offset != 5 {
+		t.Errorf("wrong stop after one instruction: %+v, %v", stop, err)
+	}
+
+	if !vm.ClearBreakpoint(bp.ID) || vm.ClearBreakpoint(bp.ID) {
+		t.Errorf("ClearBreakpoint did not remove the breakpoint once")
+	}
+	if len(vm.Breakpoints()) != 0 {
+		t.Errorf("breakpoints left: %v", vm.Breakpoints())
+	}
+
+	stop, err = vm.Continue()
+	if got := describeStop(t, vm, stop, err); got != "exited" {
+		t.Errorf("wrong stop: %q", got)
+	}
+}
+
+func TestDebugSharedFunctions(t *testing.T) {
+	vm := newDebugVM(t, `let fs = [fn(a) { a + 1 },
+  fn(b) { b + 1 }];
+fs[0](1);
+fs[1](2);`)
+
+	bps, err := vm.SetBreakpoint("", 2)
+	if err != nil || len(bps) != 2 {
+		t.Fatalf("SetBreakpoint: %v %v", bps, err)
+	}
+
+	stop, err := vm.Continue()
+	if got := describeStop(t, vm, stop, err); got != "breakpoint <main> 2" {
+		t.Fatalf("wrong stop: %s", got)
+	}
+
+	// Only the call of the function on line 2 stops, with its own local.
+	stop, err = vm.Continue()
+	if got := describeStop(t, vm, stop, err); got != "breakpoint <anonymous> 2" {
+		t.Fatalf("wrong stop: %s", got)
+	}
+	if got := describeVariables(vm.Locals()); got != "b=2" {
+		t.Errorf("wrong locals: %s", got)
+	}
+
+	stop, err = vm.Continue()
+	if got := describeStop(t, vm, stop, err); got != "exited" {
+		t.Errorf("wrong stop: %s", got)
+	}
+}
+
+func TestDebugRuntimeError(t *testing.T) {
+	vm := newDebugVM(t, "let f = fn() { 1 + true };\nf();")
+	vm.SetBreakpoint("", 2)
+
+	stop, err := vm.Continue()
+	if got := describeStop(t, vm, stop, err); got != "breakpoint <main> 2" {
+		t.Fatalf("wrong stop: %q", got)
+	}
+
+	for i := 0; i < 2; i++ {
+		_, err = vm.StepOver()
+
+		var rerr *RuntimeError
+		if !errors.As(err, &rerr) {
+			t.Fatalf("expected a *RuntimeError, got %T (%v)", err, err)
+		}
+		if len(rerr.Trace) != 2 || rerr.Trace[0].Function != "f" {
+			t.Errorf("wrong trace: %+v", rerr.Trace)
+		}
+	}
+}
+
+func TestDebugLimitsSpanTheRun(t *testing.T) {
+	input := `let i = 0;
+while (i < 100) {
+  i = i + 1;
+}`
+
+	comp := compiler.New()
+	err := comp.Compile(parseFile("debug.mk", input))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	// Every resume runs a single iteration, well within the budget; the
+	// whole loop does not.
+	vm := New(comp.Bytecode(), InstructionBudget(200))
+	vm.DebugContext(context.Background())
+	vm.SetBreakpoint("", 3)
+
+	for i := 0; i < 100; i++ {
+		_, err = vm.Continue()
+		if err != nil {
+			break
+		}
+	}
+	var budgetErr *object.BudgetExceededError
+	if !errors.As(err, &budgetErr) {
+		t.Errorf("expected a *object.BudgetExceededError, got %T (%v)", err, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	vm = New(comp.Bytecode())
+	vm.DebugContext(ctx)
+
+	_, err = vm.Continue()
+	var canceledErr *object.CanceledError
+	if !errors.As(err, &canceledErr) {
+		t.Errorf("expected a *object.CanceledError, got %T (%v)", err, err)
+	}
+}
@@ -0,0 +1,136 @@
+package vm
+
+import (
+	"karaoke/compiler"
+	"karaoke/evaluator"
+	"karaoke/object"
+	"testing"
+)
+
+// TestEnginesAgree runs programs in the evaluator and on every backend,
+// compiled with and without the compiler's optimisations, and checks that
+// they all end with the same value.
+func TestEnginesAgree(t *testing.T) {
+	tests := []string{
+		// A closure assigns to a variable it captured.
+		`let mk = fn() { let n = 0; fn() { n = n + 1; n } };
+let c = mk(); c(); c(); c()`,
+		`let adder = fn(total) { fn(x) { total += x } };
+let add = adder(10); add(1); add(2)`,
+		`let mk = fn() { let n = 0; [fn() { n += 1 }, fn() { n }] };
+let a = mk(); let b = mk(); a[0](); a[0](); b[0](); [a[1](), b[1]()]`,
+		`let f = fn() { let x = 0; let g = fn() { let h = fn() { x += 1 }; h(); h() }; g(); x };
+f()`,
+		// A closure sees assignments made after it captured a variable.
+		`let f = fn() { let x = 1; let g = fn() { x }; x = 2; g() }; f()`,
+		`let f = fn() { let x = 1; let g = fn() { x }; let x = 5; g() }; f()`,
+		// Every call has its own variables, also after a tail call.
+		`let f = fn(n) { let g = fn() { n }; if (n > 0) { f(n - 1) + g() } else { g() } };
+f(3)`,
+		`let f = fn(n, acc) { let g = fn() { n }; if (n == 0) { acc } else { f(n - 1, acc + g()) } };
+f(4, 0)`,
+		`let wrapper = fn() {
+  let countDown = fn(x) { if (x == 0) { 0 } else { countDown(x - 1) } };
+  countDown(3)
+};
+wrapper()`,
+		// A function calls itself through the variable it is bound to.
+		`let f = fn(n) { if (n == 0) { "old" } else { f(n - 1) } };
+let g = f; f = fn(n) { "new" }; g(1)`,
+		`let f = fn() { f = 1 }; f()`,
+		`let h = fn() {
+  let f = fn(n) { if (n == 0) { "old" } else { f(n - 1) } };
+  let g = f; f = fn(n) { "new" }; g(1)
+};
+h()`,
+		`let h = fn() { let f = fn() { f = 1 }; [f(), f] }; h()`,
+		// A break or continue in the value of a let, a return statement,
+		// a prefix expression or && and || leaves the loop.
+		`let s = 0; while (s < 3) { s += 1; let y = if (true) { break } }; s`,
+		`let s = 0; while (s < 3) { s += 1; s = if (s == 1) { continue } else { s } }; s`,
+		`let s = 0; while (s < 3) { s += 1; -if (true) { break } }; s`,
+		`let s = 0; while (s < 3) { s += 1; false || if (true) { break } }; s`,
+		`let s = 0; for (x in [1]) { while (if (s == 2) { break } else { true }) { s += 1 } }; s`,
+		`let f = fn() { while (true) { return if (true) { break } }; 4 }; f()`,
+		// A loop leaves null, also when it breaks.
+		`while (false) { 1 }`,
+		`let i = 0; while (true) { i += 1; if (i == 3) { break } }`,
+		`for (x in [1, 2]) { break }`,
+		// x++ and x-- are x += 1 and x -= 1.
+		`let i = 0; let a = [0, 0]; while (i < 2) { a[i]++; i++ }; [a, i--, i]`,
+		`let f = fn() { let n = 0; [fn() { n++ }, fn() { n-- }] }; let g = f(); g[0](); g[0](); g[1]()`,
+		// All iterations of a loop share its variables.
+		`let fs = []; for (x in [1, 2, 3]) { fs = push(fs, fn() { x }) }; fs[0]()`,
+		`let f = fn() {
+  let fs = [];
+  for (x in [1, 2, 3]) { fs = push(fs, fn() { x }) };
+  [fs[0](), fs[2]()]
+};
+f()`,
+		`let f = fn() {
+  let fs = [];
+  let i = 0;
+  while (i < 3) { let v = i; fs = push(fs, fn() { v }); i += 1 };
+  fs[0]()
+};
+f()`,
+		`let f = fn(h) {
+  let fs = [];
+  for (k, v in h) { fs = push(fs, fn() { k + v }) };
+  fs[0]()
+};
+f({"a": "b"})`,
+	}
+
+	unoptimised := []compiler.Option{
+		compiler.FoldConstants(false),
+		compiler.DeduplicateConstants(false),
+		compiler.Peephole(false),
+	}
+
+	for _, input := range tests {
+		program := parse(input)
+
+		want := evaluator.Eval(program, object.NewEnvironment())
+		if _, ok := want.(*object.Error); ok {
+			t.Fatalf("evaluator error for %q: %s", input, want.Inspect())
+		}
+
+		for name := range Backends {
+			for _, opts := range [][]compiler.Option{nil, unoptimised} {
+				got := runCompiled(t, program, name, opts...)
+				if got.Inspect() != want.Inspect() {
+					t.Errorf("%s: %q: engines disagree. evaluator=%s, vm=%s",
+						name, input, want.Inspect(), got.Inspect())
+				}
+			}
+		}
+	}
+}
+
+// TestEnginesRejectAlike checks that a break or continue the compiler
+// rejects fails the same way in the evaluator once it runs.
+func TestEnginesRejectAlike(t *testing.T) {
+	tests := []string{
+		`while (true) { [if (true) { break }] }`,
+		`while (true) { puts(if (true) { break }) }`,
+		`while (true) { 1 + if (true) { continue } }`,
+		`while (true) { {1: if (true) { break }} }`,
+		`let a = 1; while (true) { a += if (true) { break } }`,
+		`let a = [0]; while (true) { a[0] = if (true) { break } }`,
+	}
+
+	for _, input := range tests {
+		program := parse(input)
+
+		err := compiler.New().Compile(program)
+		if err == nil {
+			t.Fatalf("expected compiler error for %q", input)
+		}
+
+		got := evaluator.Eval(program, object.NewEnvironment())
+		if want := "ERROR: " + err.Error(); got.Inspect() != want {
+			t.Errorf("%q: engines disagree. evaluator=%s, compiler=%s", input, got.Inspect(), want)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package vm
+
+import (
+	"fmt"
+	"karaoke/code"
+	"karaoke/object"
+	"strings"
+)
+
+// mainName is the name the main program has in stack traces.
+const mainName = "<main>"
+
+// A RuntimeError is an error raised while running bytecode. Its message
+// is that of Err; Trace holds the calls that were running, innermost
+// first. Calls replaced by tail calls are not in it.
+type RuntimeError struct {
+	Err   error
+	Trace []TraceFrame
+}
+
+// A TraceFrame is one call in a stack trace: the function and the source
+// of the instruction it was running.
+type TraceFrame struct {
+	Function string
+	Span     code.Span
+}
+
+func (e *RuntimeError) Error() string { return e.Err.Error() }
+func (e *RuntimeError) Unwrap() error { return e.Err }
+
+// StackTrace formats the trace with one call per line.
+func (e *RuntimeError) StackTrace() string {
+	var out strings.Builder
+	for _, f := range e.Trace {
+		fmt.Fprintf(&out, "\tat %s (%s)\n", f.Function, f.Span.Start)
+	}
+	return out.String()
+}
+
+func newTraceFrame(fn *object.CompiledFunction, positions code.PositionTable, offset int) TraceFrame {
+	span, _ := positions.Lookup(offset)
+	return TraceFrame{Function: functionName(fn), Span: span}
+}
+
+// globalName is the name of the global at idx, or its index if the
+// bytecode does not name it.
+func globalName(names []string, idx int) string {
+	if idx < len(names) && names[idx] != "" {
+		return names[idx]
+	}
+	return fmt.Sprintf("#%d", idx)
+}
+
+// functionName is the name fn is shown with in traces and the debugger.
+func functionName(fn *object.CompiledFunction) string {
+	if fn.Name == "" {
+		return "<anonymous>"
+	}
+	return fn.Name
+}
@@ -6,15 +6,15 @@ import (
 )
 
 type Frame struct {
-	fn      *object.CompiledFunction
+	cl      *object.Closure
 	ip      int
 	basePtr int
 }
 
-func NewFrame(fun *object.CompiledFunction, baseptr int) *Frame {
-	return &Frame{fn: fun, ip: -1, basePtr: baseptr}
+func NewFrame(cl *object.Closure, baseptr int) *Frame {
+	return &Frame{cl: cl, ip: -1, basePtr: baseptr}
 }
 
 func (f *Frame) Instructions() code.Instructions {
-	return f.fn.Instructions
+	return f.cl.Fn.Instructions
 }
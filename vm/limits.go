@@ -0,0 +1,91 @@
+package vm
+
+import (
+	"context"
+	"karaoke/object"
+)
+
+// checkInterval is how many instructions run between two looks at the
+// context.
+const checkInterval = 1024
+
+// An Option configures a VM or a RegisterVM.
+type Option func(*limits)
+
+// InstructionBudget limits every run to n instructions. The register VM
+// counts its own instructions, of which a program needs fewer.
+func InstructionBudget(n int64) Option {
+	return func(l *limits) {
+		l.budget = n
+	}
+}
+
+// MemoryLimit limits the bytes every run may allocate for strings, arrays
+// and hashes, as estimated by object.SizeOf. Memory is never given back:
+// the limit is on what a run allocates, not on what it holds at a time.
+func MemoryLimit(n int64) Option {
+	return func(l *limits) {
+		l.memory = n
+	}
+}
+
+// limits stop a run whose context is done, whose budget is spent or that
+// allocated too much. The run loops count ticks down by one per
+// instruction and call check when they reach zero, so the common case
+// costs one decrement.
+type limits struct {
+	budget int64 // the instructions a run may execute, 0 for no limit
+	memory int64 // the bytes a run may allocate, 0 for no limit
+
+	ctx    context.Context
+	used   int64 // instructions run before the current countdown
+	period int64 // the instructions the current countdown started with
+	ticks  int64
+
+	allocated int64
+}
+
+func newLimits(opts []Option) limits {
+	var l limits
+	for _, opt := range opts {
+		opt(&l)
+	}
+	return l
+}
+
+// start begins a run under ctx.
+func (l *limits) start(ctx context.Context) {
+	l.ctx, l.used, l.period, l.ticks = ctx, 0, 0, 0
+	l.allocated = 0
+}
+
+// check is called before an instruction when ticks is zero. It starts the
+// next countdown, which ends at the next look at the context or where the
+// budget runs out.
+func (l *limits) check() error {
+	l.used += l.period
+	if l.budget > 0 && l.used >= l.budget {
+		return &object.BudgetExceededError{Budget: l.budget}
+	}
+	if l.ctx != nil {
+		if err := l.ctx.Err(); err != nil {
+			return &object.CanceledError{Err: err}
+		}
+	}
+
+	l.period = checkInterval
+	if l.budget > 0 && l.budget-l.used < l.period {
+		l.period = l.budget - l.used
+	}
+	l.ticks = l.period
+	return nil
+}
+
+// alloc counts size bytes against the memory limit.
+func (l *limits) alloc(size int64) error {
+	l.allocated += size
+	if l.memory > 0 && l.allocated > l.memory {
+		return &object.MemoryLimitError{Limit: l.memory}
+	}
+	return nil
+}
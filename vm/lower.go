@@ -0,0 +1,487 @@
+package vm
+
+import (
+	"fmt"
+	"karaoke/code"
+	"karaoke/regcode"
+)
+
+// A loweredFn is a compiled function translated to register code. It
+// needs numRegs registers: its locals followed by one temporary for every
+// stack slot the stack code uses.
+type loweredFn struct {
+	ins       regcode.Instructions
+	numRegs   int
+	positions code.PositionTable
+
+	// closures maps the offset of every OpClosure in ins to the offset of
+	// the stack code OpClosure it comes from, which variants are keyed by.
+	closures map[int]int
+}
+
+// maxRegisters is the number of registers a register operand can name.
+const maxRegisters = 1 << 16
+
+type stackInst struct {
+	offset   int
+	op       code.Opcode
+	operands []int
+	span     code.Span
+}
+
+// lower translates stack code to register code. Stack slot d of the frame
+// becomes register numLocals+d. A value is only moved into its slot's
+// register when an instruction needs it there: reading a local leaves a
+// reference to the local's register on the simulated stack, so
+// `a + b` becomes a single OpAdd of the two locals.
+//
+// keepLastPopped makes every value popped off the bottom slot end up in
+// register 0, where RegisterVM.LastPoppedStackElem finds it.
+//
+// The register code of a stack instruction keeps the instruction's
+// position from positions.
+func lower(ins code.Instructions, positions code.PositionTable, numLocals int, keepLastPopped bool) (*loweredFn, error) {
+	insts := []stackInst{}
+	index := map[int]int{}
+	for offset := 0; offset < len(ins); {
+		_, operands, width, err := ins.ReadInstruction(offset)
+		if err != nil {
+			return nil, err
+		}
+		span, _ := positions.Lookup(offset)
+		index[offset] = len(insts)
+		insts = append(insts, stackInst{offset, ins.OpcodeAt(offset), operands, span})
+		offset += width
+	}
+
+	depths, maxDepth, err := stackDepths(insts, index, len(ins))
+	if err != nil {
+		return nil, err
+	}
+	if numLocals+maxDepth > maxRegisters {
+		return nil, fmt.Errorf("function needs %d registers, more than %d",
+			numLocals+maxDepth, maxRegisters)
+	}
+
+	l := &lowering{
+		numLocals:      numLocals,
+		keepLastPopped: keepLastPopped,
+		offsets:        map[int]int{},
+		closures:       map[int]int{},
+		lastWrite:      -1,
+	}
+
+	targets := map[int]bool{}
+	for _, in := range insts {
+		if code.IsJump(in.op) {
+			targets[in.operands[0]] = true
+		}
+	}
+
+	reachable := true
+	for _, in := range insts {
+		depth, ok := depths[in.offset]
+		if !ok {
+			reachable = false
+			continue
+		}
+
+		if targets[in.offset] || !reachable {
+			if reachable {
+				l.flush()
+			}
+			l.reset(depth)
+			reachable = true
+		}
+		l.offsets[in.offset] = len(l.out)
+		l.positions = l.positions.Add(len(l.out), in.span)
+
+		reachable = l.translate(in)
+	}
+	if reachable {
+		l.flush()
+	}
+	l.offsets[len(ins)] = len(l.out)
+
+	for _, f := range l.fixups {
+		regcode.PutUint32(l.out[f.pos:], uint32(l.offsets[f.target]))
+	}
+
+	return &loweredFn{
+		ins:       l.out,
+		numRegs:   numLocals + maxDepth,
+		positions: l.positions,
+		closures:  l.closures,
+	}, nil
+}
+
+// stackDepths computes the stack depth before every reachable instruction
+// and the maximum depth of the function.
+func stackDepths(insts []stackInst, index map[int]int, end int) (map[int]int, int, error) {
+	depths := map[int]int{}
+	maxDepth := 0
+
+	type item struct{ offset, depth int }
+	work := []item{{0, 0}}
+
+	for len(work) > 0 {
+		it := work[len(work)-1]
+		work = work[:len(work)-1]
+
+		if it.offset == end {
+			continue
+		}
+		if d, ok := depths[it.offset]; ok {
+			if d != it.depth {
+				return nil, 0, fmt.Errorf("inconsistent stack depth at %d: %d and %d",
+					it.offset, d, it.depth)
+			}
+			continue
+		}
+		depths[it.offset] = it.depth
+
+		i, ok := index[it.offset]
+		if !ok {
+			return nil, 0, fmt.Errorf("jump to %d is not an instruction boundary", it.offset)
+		}
+		in := insts[i]
+
+		pops, pushes := stackEffect(in)
+		if pops > it.depth {
+			return nil, 0, fmt.Errorf("%s at %d pops %d values off a stack of %d",
+				opName(in.op), in.offset, pops, it.depth)
+		}
+		depth := it.depth - pops + pushes
+		if depth > maxDepth {
+			maxDepth = depth
+		}
+
+		next := end
+		if i+1 < len(insts) {
+			next = insts[i+1].offset
+		}
+
+		switch in.op {
+		case code.OpJump:
+			work = append(work, item{in.operands[0], depth})
+		case code.OpIterNext:
+			// An exhausted iterator is popped instead.
+			work = append(work, item{in.operands[0], it.depth - 1}, item{next, depth})
+		case code.OpJumpNotTruthy:
+			work = append(work, item{in.operands[0], depth}, item{next, depth})
+		case code.OpReturnValue, code.OpReturn:
+		default:
+			work = append(work, item{next, depth})
+		}
+	}
+
+	return depths, maxDepth, nil
+}
+
+func stackEffect(in stackInst) (pops, pushes int) {
+	switch in.op {
+	case code.OpConstant, code.OpTrue, code.OpFalse, code.OpNull,
+		code.OpGetGlobal, code.OpGetLocal, code.OpGetBuiltin, code.OpGetFree,
+		code.OpCurrentClosure, code.OpDup, code.OpGetCell, code.OpGetFreeCell:
+		return 0, 1
+	case code.OpPop, code.OpSetGlobal, code.OpSetLocal, code.OpJumpNotTruthy,
+		code.OpReturnValue, code.OpSetCell, code.OpSetFreeCell:
+		return 1, 0
+	case code.OpAdd, code.OpSub, code.OpMul, code.OpDiv, code.OpMod,
+		code.OpEqual, code.OpNotEqual, code.OpGreaterThan, code.OpIndex:
+		return 2, 1
+	case code.OpDup2:
+		return 0, 2
+	case code.OpMinus, code.OpBang, code.OpIter:
+		return 1, 1
+	case code.OpSetIndex:
+		return 3, 1
+	case code.OpIterNext:
+		return 0, in.operands[1]
+	case code.OpArray:
+		return in.operands[0], 1
+	case code.OpHash:
+		return 2 * in.operands[0], 1
+	case code.OpCall, code.OpTailCall:
+		return in.operands[0] + 1, 1
+	case code.OpClosure:
+		return in.operands[1], 1
+	}
+	return 0, 0
+}
+
+type fixup struct {
+	pos    int // position of the jump operand in the output
+	target int // stack code offset of the target
+}
+
+type lowering struct {
+	numLocals      int
+	keepLastPopped bool
+
+	// stack holds, for every slot of the simulated stack, the register
+	// the slot's value is currently in.
+	stack []int
+
+	out       regcode.Instructions
+	offsets   map[int]int
+	fixups    []fixup
+	positions code.PositionTable
+	closures  map[int]int
+
+	// lastWrite is the position of the last emitted instruction if it
+	// only wrote the register on top of the stack, else -1.
+	lastWrite int
+}
+
+func (l *lowering) slot(depth int) int {
+	return l.numLocals + depth
+}
+
+func (l *lowering) emit(op regcode.Opcode, operands ...int) int {
+	pos := len(l.out)
+	l.out = append(l.out, regcode.Make(op, operands...)...)
+	l.lastWrite = -1
+	return pos
+}
+
+// emitWrite emits an instruction whose first operand is the register it
+// writes and pushes that register.
+func (l *lowering) emitWrite(op regcode.Opcode, operands ...int) {
+	pos := l.emit(op, operands...)
+	l.lastWrite = pos
+	l.stack = append(l.stack, operands[0])
+}
+
+func (l *lowering) emitJump(op regcode.Opcode, target int, operands ...int) {
+	l.emit(op, append(operands, 0)...)
+	l.fixups = append(l.fixups, fixup{len(l.out) - 4, target})
+}
+
+func (l *lowering) pop() int {
+	r := l.stack[len(l.stack)-1]
+	l.stack = l.stack[:len(l.stack)-1]
+	return r
+}
+
+// materialise moves the value of stack slot d into the slot's register.
+func (l *lowering) materialise(d int) {
+	if l.stack[d] != l.slot(d) {
+		l.emit(regcode.OpMove, l.slot(d), l.stack[d])
+		l.stack[d] = l.slot(d)
+	}
+}
+
+// materialiseTop moves the top n stack slots into their registers and
+// returns the register of the lowest of them.
+func (l *lowering) materialiseTop(n int) int {
+	first := len(l.stack) - n
+	for d := first; d < len(l.stack); d++ {
+		l.materialise(d)
+	}
+	return l.slot(first)
+}
+
+// flush brings the stack into the state every jump expects: each slot's
+// value in the slot's register.
+func (l *lowering) flush() {
+	l.materialiseTop(len(l.stack))
+}
+
+func (l *lowering) reset(depth int) {
+	l.stack = l.stack[:0]
+	for d := 0; d < depth; d++ {
+		l.stack = append(l.stack, l.slot(d))
+	}
+	l.lastWrite = -1
+}
+
+// popKept pops the top of the stack. In main code a value popped off the
+// bottom slot is first moved to its register, register 0.
+func (l *lowering) popKept() int {
+	if l.keepLastPopped && len(l.stack) == 1 {
+		l.materialise(0)
+	}
+	return l.pop()
+}
+
+// translate emits the register code for in and reports whether the
+// instruction after it is reachable from it.
+func (l *lowering) translate(in stackInst) bool {
+	top := l.slot(len(l.stack))
+
+	switch in.op {
+	case code.OpConstant:
+		l.emitWrite(regcode.OpLoadConst, top, in.operands[0])
+	case code.OpTrue:
+		l.emitWrite(regcode.OpLoadTrue, top)
+	case code.OpFalse:
+		l.emitWrite(regcode.OpLoadFalse, top)
+	case code.OpNull:
+		l.emitWrite(regcode.OpLoadNull, top)
+	case code.OpGetGlobal:
+		l.emitWrite(regcode.OpGetGlobal, top, in.operands[0])
+	case code.OpGetBuiltin:
+		l.emitWrite(regcode.OpGetBuiltin, top, in.operands[0])
+	case code.OpGetFree:
+		l.emitWrite(regcode.OpGetFree, top, in.operands[0])
+	case code.OpCurrentClosure:
+		l.emitWrite(regcode.OpCurrentClosure, top)
+	case code.OpGetCell:
+		l.emitWrite(regcode.OpGetCell, top, in.operands[0])
+	case code.OpGetFreeCell:
+		l.emitWrite(regcode.OpGetFreeCell, top, in.operands[0])
+
+	case code.OpGetLocal:
+		l.stack = append(l.stack, in.operands[0])
+	case code.OpDup:
+		l.stack = append(l.stack, l.stack[len(l.stack)-1])
+	case code.OpDup2:
+		l.stack = append(l.stack, l.stack[len(l.stack)-2:]...)
+
+	case code.OpSetLocal:
+		l.setLocal(in.operands[0])
+	case code.OpSetGlobal:
+		l.emit(regcode.OpSetGlobal, in.operands[0], l.popKept())
+	case code.OpSetCell:
+		l.emit(regcode.OpSetCell, in.operands[0], l.popKept())
+	case code.OpSetFreeCell:
+		l.emit(regcode.OpSetFreeCell, in.operands[0], l.popKept())
+	case code.OpPop:
+		l.popKept()
+		l.lastWrite = -1
+
+	case code.OpAdd, code.OpSub, code.OpMul, code.OpDiv, code.OpMod,
+		code.OpEqual, code.OpNotEqual, code.OpGreaterThan, code.OpIndex:
+		right := l.pop()
+		left := l.pop()
+		dst := l.slot(len(l.stack))
+		l.emitWrite(binaryOps[in.op], dst, left, right)
+	case code.OpMinus, code.OpBang:
+		operand := l.pop()
+		dst := l.slot(len(l.stack))
+		op := regcode.OpMinus
+		if in.op == code.OpBang {
+			op = regcode.OpBang
+		}
+		l.emitWrite(op, dst, operand)
+
+	case code.OpArray:
+		l.collection(regcode.OpArray, in.operands[0], in.operands[0])
+	case code.OpHash:
+		l.collection(regcode.OpHash, 2*in.operands[0], in.operands[0])
+	case code.OpClosure:
+		numFree := in.operands[1]
+		first := l.materialiseTop(numFree)
+		l.stack = l.stack[:len(l.stack)-numFree]
+		l.closures[len(l.out)] = in.offset
+		l.emitWrite(regcode.OpClosure, first, in.operands[0], first, numFree)
+
+	case code.OpCall, code.OpTailCall:
+		numArgs := in.operands[0]
+		callee := l.materialiseTop(numArgs + 1)
+		l.stack = l.stack[:len(l.stack)-numArgs-1]
+		op := regcode.OpCall
+		if in.op == code.OpTailCall {
+			op = regcode.OpTailCall
+		}
+		l.emit(op, callee, numArgs)
+		l.stack = append(l.stack, callee)
+
+	case code.OpJumpNotTruthy:
+		cond := l.popKept()
+		l.flush()
+		l.emitJump(regcode.OpJumpNotTruthy, in.operands[0], cond)
+	case code.OpJump:
+		l.flush()
+		l.emitJump(regcode.OpJump, in.operands[0])
+		return false
+
+	case code.OpSetIndex:
+		value := l.pop()
+		index := l.pop()
+		collection := l.pop()
+		l.emit(regcode.OpSetIndex, collection, index, value)
+		// A value in a local's register can stay there; a temporary one
+		// moves down to the slot it takes on the stack.
+		if value < l.numLocals {
+			l.stack = append(l.stack, value)
+		} else {
+			l.emitWrite(regcode.OpMove, l.slot(len(l.stack)), value)
+		}
+
+	case code.OpIter:
+		collection := l.pop()
+		dst := l.slot(len(l.stack))
+		l.emitWrite(regcode.OpIter, dst, collection)
+	case code.OpIterNext:
+		numVars := in.operands[1]
+		l.flush()
+		iter := l.slot(len(l.stack) - 1)
+		dst := l.slot(len(l.stack))
+		l.emitJump(regcode.OpIterNext, in.operands[0], iter, dst, numVars)
+		for i := 0; i < numVars; i++ {
+			l.stack = append(l.stack, dst+i)
+		}
+
+	case code.OpReturnValue:
+		l.emit(regcode.OpReturnValue, l.pop())
+		return false
+	case code.OpReturn:
+		l.emit(regcode.OpReturn)
+		return false
+	}
+
+	return true
+}
+
+var binaryOps = map[code.Opcode]regcode.Opcode{
+	code.OpAdd:         regcode.OpAdd,
+	code.OpSub:         regcode.OpSub,
+	code.OpMul:         regcode.OpMul,
+	code.OpDiv:         regcode.OpDiv,
+	code.OpMod:         regcode.OpMod,
+	code.OpEqual:       regcode.OpEqual,
+	code.OpNotEqual:    regcode.OpNotEqual,
+	code.OpGreaterThan: regcode.OpGreaterThan,
+	code.OpIndex:       regcode.OpIndex,
+}
+
+func (l *lowering) collection(op regcode.Opcode, numSlots, length int) {
+	first := l.materialiseTop(numSlots)
+	l.stack = l.stack[:len(l.stack)-numSlots]
+	l.emitWrite(op, first, first, length)
+}
+
+// setLocal stores the top of the stack in local idx. Slots still reading
+// the local's old value get their own copy first. When the value was just
+// computed into the top register, the instruction computing it writes the
+// local directly instead.
+func (l *lowering) setLocal(idx int) {
+	top := len(l.stack) - 1
+	for d := 0; d < top; d++ {
+		if l.stack[d] == idx {
+			l.materialise(d)
+		}
+	}
+
+	lastWrite := l.lastWrite
+	r := l.pop()
+
+	switch {
+	case r == idx:
+	case lastWrite >= 0 && r == l.slot(top):
+		regcode.PutUint16(l.out[lastWrite+1:], uint16(idx))
+	default:
+		l.emit(regcode.OpMove, idx, r)
+	}
+	l.lastWrite = -1
+}
+
+func opName(op code.Opcode) string {
+	def, err := code.Lookup(byte(op))
+	if err != nil {
+		return fmt.Sprintf("opcode %d", op)
+	}
+	return def.Name
+}
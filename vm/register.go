@@ -0,0 +1,691 @@
+package vm
+
+import (
+	"context"
+	"fmt"
+	"karaoke/compiler"
+	"karaoke/object"
+	"karaoke/regcode"
+)
+
+// Machine is what the REPL and the command line need from a VM backend.
+type Machine interface {
+	Run() error
+	RunContext(ctx context.Context) error
+	LastPoppedStackElem() object.Object
+}
+
+// Backends are the VM implementations selectable by name.
+var Backends = map[string]func(bc *compiler.Bytecode, opts ...Option) Machine{
+	"stack":    func(bc *compiler.Bytecode, opts ...Option) Machine { return New(bc, opts...) },
+	"register": func(bc *compiler.Bytecode, opts ...Option) Machine { return NewRegister(bc, opts...) },
+}
+
+type regFrame struct {
+	cl      *object.Closure
+	fn      *loweredFn
+	ip      int
+	basePtr int
+}
+
+// RegisterVM runs the same bytecode as VM, lowered to register code
+// before it starts. Calls follow the layout of the stack VM: the callee
+// sits in the register right below the new frame and the arguments are
+// the callee's first registers, which is also where its locals live.
+type RegisterVM struct {
+	constants []object.Object
+	globals   []object.Object
+	regs      []object.Object
+
+	globalNames []string
+
+	frames    []regFrame
+	framesPtr int
+
+	main    *object.CompiledFunction
+	lowered map[*object.CompiledFunction]*loweredFn
+
+	limits limits
+}
+
+func NewRegister(bc *compiler.Bytecode, opts ...Option) *RegisterVM {
+	return &RegisterVM{
+		constants: bc.Constants,
+		globals:   newGlobals(bc),
+		regs:      make([]object.Object, StackSize),
+		frames:    make([]regFrame, MaxFrames),
+		main: &object.CompiledFunction{
+			Instructions: bc.Instructions,
+			Name:         mainName,
+			Positions:    bc.Positions,
+			Variants:     bc.Variants,
+		},
+		globalNames: bc.GlobalNames,
+		limits:      newLimits(opts),
+	}
+}
+
+// lowerAll translates the main program and every compiled function in the
+// constant pool, variants included.
+func (vm *RegisterVM) lowerAll() error {
+	vm.lowered = map[*object.CompiledFunction]*loweredFn{}
+
+	main, err := lower(vm.main.Instructions, vm.main.Positions, 0, true)
+	if err != nil {
+		return fmt.Errorf("main: %w", err)
+	}
+	vm.lowered[vm.main] = main
+
+	for _, fn := range appendVariants(nil, vm.main) {
+		err := vm.lowerFunction(fn)
+		if err != nil {
+			return fmt.Errorf("function %s: %w", functionName(fn), err)
+		}
+	}
+
+	for i, con := range vm.constants {
+		fn, ok := con.(*object.CompiledFunction)
+		if !ok {
+			continue
+		}
+
+		for _, fn := range appendVariants([]*object.CompiledFunction{fn}, fn) {
+			err := vm.lowerFunction(fn)
+			if err != nil {
+				return fmt.Errorf("function %d: %w", i, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// lowerFunction translates fn, a function in the constant pool or one of
+// its variants.
+func (vm *RegisterVM) lowerFunction(fn *object.CompiledFunction) error {
+	lowered, err := lower(fn.Instructions, fn.Positions, fn.NumLocals, false)
+	if err != nil {
+		return err
+	}
+	vm.lowered[fn] = lowered
+	return nil
+}
+
+// Run runs the program. An error raised by the running program is a
+// *RuntimeError.
+func (vm *RegisterVM) Run() error {
+	return vm.RunContext(context.Background())
+}
+
+// RunContext runs the program until it ends, ctx is done or it spent its
+// instruction budget. An error raised by the running program is a
+// *RuntimeError; when the run was stopped it wraps an
+// *object.CanceledError or an *object.BudgetExceededError.
+func (vm *RegisterVM) RunContext(ctx context.Context) error {
+	err := vm.lowerAll()
+	if err != nil {
+		return err
+	}
+
+	vm.limits.start(ctx)
+	err = vm.run()
+	if err != nil {
+		return vm.runtimeError(err)
+	}
+	return nil
+}
+
+// runtimeError adds the stack trace to err. The running frame's ip is the
+// start of the failing instruction, a caller's ip the instruction after
+// its call.
+func (vm *RegisterVM) runtimeError(err error) *RuntimeError {
+	trace := make([]TraceFrame, 0, vm.framesPtr)
+	for i := vm.framesPtr - 1; i >= 0; i-- {
+		f := vm.frames[i]
+		ip := f.ip
+		if i < vm.framesPtr-1 {
+			ip--
+		}
+		trace = append(trace, newTraceFrame(f.cl.Fn, f.fn.positions, ip))
+	}
+	return &RuntimeError{Err: err, Trace: trace}
+}
+
+func (vm *RegisterVM) run() error {
+	vm.frames[0] = regFrame{
+		cl: &object.Closure{Fn: vm.main},
+		fn: vm.lowered[vm.main],
+	}
+	vm.framesPtr = 1
+
+	frame := &vm.frames[0]
+	if frame.fn.numRegs > len(vm.regs) {
+		return fmt.Errorf("stack overflow")
+	}
+
+	regs := vm.regs
+	ins := frame.fn.ins
+	base := 0
+	ip := 0
+
+	for ip < len(ins) {
+		frame.ip = ip
+		if vm.limits.ticks == 0 {
+			if err := vm.limits.check(); err != nil {
+				return err
+			}
+		}
+		vm.limits.ticks--
+		op := regcode.Opcode(ins[ip])
+
+		switch op {
+		case regcode.OpLoadConst:
+			a := int(regcode.ReadUint16(ins[ip+1:]))
+			constIdx := regcode.ReadUint32(ins[ip+3:])
+			ip += 7
+
+			regs[base+a] = vm.constants[constIdx]
+
+		case regcode.OpLoadTrue:
+			regs[base+int(regcode.ReadUint16(ins[ip+1:]))] = trueObj
+			ip += 3
+
+		case regcode.OpLoadFalse:
+			regs[base+int(regcode.ReadUint16(ins[ip+1:]))] = falseObj
+			ip += 3
+
+		case regcode.OpLoadNull:
+			regs[base+int(regcode.ReadUint16(ins[ip+1:]))] = Null
+			ip += 3
+
+		case regcode.OpMove:
+			a := int(regcode.ReadUint16(ins[ip+1:]))
+			b := int(regcode.ReadUint16(ins[ip+3:]))
+			ip += 5
+
+			regs[base+a] = regs[base+b]
+
+		case regcode.OpGetGlobal:
+			a := int(regcode.ReadUint16(ins[ip+1:]))
+			globalIdx := int(regcode.ReadUint32(ins[ip+3:]))
+			ip += 7
+
+			if globalIdx >= len(vm.globals) || vm.globals[globalIdx] == nil {
+				return fmt.Errorf("variable %s used before assignment", globalName(vm.globalNames, globalIdx))
+			}
+			regs[base+a] = vm.globals[globalIdx]
+
+		case regcode.OpSetGlobal:
+			globalIdx := int(regcode.ReadUint32(ins[ip+1:]))
+			b := int(regcode.ReadUint16(ins[ip+5:]))
+			ip += 7
+
+			if globalIdx >= len(vm.globals) {
+				return fmt.Errorf("global %d does not fit in a store of %d globals", globalIdx, len(vm.globals))
+			}
+			vm.globals[globalIdx] = regs[base+b]
+
+		case regcode.OpGetBuiltin:
+			a := int(regcode.ReadUint16(ins[ip+1:]))
+			builtinIdx := ins[ip+3]
+			ip += 4
+
+			regs[base+a] = object.Builtins[builtinIdx].Builtin
+
+		case regcode.OpGetFree:
+			a := int(regcode.ReadUint16(ins[ip+1:]))
+			freeIdx := regcode.ReadUint16(ins[ip+3:])
+			ip += 5
+
+			regs[base+a] = frame.cl.Free[freeIdx]
+
+		case regcode.OpCurrentClosure:
+			regs[base+int(regcode.ReadUint16(ins[ip+1:]))] = frame.cl
+			ip += 3
+
+		case regcode.OpGetCell:
+			a := int(regcode.ReadUint16(ins[ip+1:]))
+			b := int(regcode.ReadUint16(ins[ip+3:]))
+			ip += 5
+
+			regs[base+a] = regs[base+b].(*object.Cell).Value
+
+		case regcode.OpSetCell:
+			a := int(regcode.ReadUint16(ins[ip+1:]))
+			b := int(regcode.ReadUint16(ins[ip+3:]))
+			ip += 5
+
+			regs[base+a].(*object.Cell).Value = regs[base+b]
+
+		case regcode.OpGetFreeCell:
+			a := int(regcode.ReadUint16(ins[ip+1:]))
+			freeIdx := regcode.ReadUint16(ins[ip+3:])
+			ip += 5
+
+			regs[base+a] = frame.cl.Free[freeIdx].(*object.Cell).Value
+
+		case regcode.OpSetFreeCell:
+			freeIdx := regcode.ReadUint16(ins[ip+1:])
+			b := int(regcode.ReadUint16(ins[ip+3:]))
+			ip += 5
+
+			frame.cl.Free[freeIdx].(*object.Cell).Value = regs[base+b]
+
+		case regcode.OpAdd, regcode.OpSub, regcode.OpMul, regcode.OpDiv, regcode.OpMod,
+			regcode.OpEqual, regcode.OpNotEqual, regcode.OpGreaterThan, regcode.OpIndex:
+			a := int(regcode.ReadUint16(ins[ip+1:]))
+			b := int(regcode.ReadUint16(ins[ip+3:]))
+			c := int(regcode.ReadUint16(ins[ip+5:]))
+			ip += 7
+
+			result, err := regBinaryOp(op, regs[base+b], regs[base+c])
+			if err != nil {
+				return err
+			}
+			if op == regcode.OpAdd {
+				err = vm.limits.alloc(object.SizeOf(result))
+				if err != nil {
+					return err
+				}
+			}
+			regs[base+a] = result
+
+		case regcode.OpMinus:
+			a := int(regcode.ReadUint16(ins[ip+1:]))
+			b := int(regcode.ReadUint16(ins[ip+3:]))
+			ip += 5
+
+			operand, ok := regs[base+b].(*object.Integer)
+			if !ok {
+				return fmt.Errorf("unsupported type for negation: %s", regs[base+b].Type())
+			}
+			regs[base+a] = &object.Integer{Value: -operand.Value}
+
+		case regcode.OpBang:
+			a := int(regcode.ReadUint16(ins[ip+1:]))
+			b := int(regcode.ReadUint16(ins[ip+3:]))
+			ip += 5
+
+			regs[base+a] = nativeBoolToBoolObj(!isTruthy(regs[base+b]))
+
+		case regcode.OpJump:
+			ip = int(regcode.ReadUint32(ins[ip+1:]))
+
+		case regcode.OpJumpNotTruthy:
+			a := int(regcode.ReadUint16(ins[ip+1:]))
+
+			if !isTruthy(regs[base+a]) {
+				ip = int(regcode.ReadUint32(ins[ip+3:]))
+			} else {
+				ip += 7
+			}
+
+		case regcode.OpSetIndex:
+			a := int(regcode.ReadUint16(ins[ip+1:]))
+			b := int(regcode.ReadUint16(ins[ip+3:]))
+			c := int(regcode.ReadUint16(ins[ip+5:]))
+			ip += 7
+
+			grown, err := setIndexOp(regs[base+a], regs[base+b], regs[base+c])
+			if err != nil {
+				return err
+			}
+			err = vm.limits.alloc(grown)
+			if err != nil {
+				return err
+			}
+
+		case regcode.OpIter:
+			a := int(regcode.ReadUint16(ins[ip+1:]))
+			b := int(regcode.ReadUint16(ins[ip+3:]))
+			ip += 5
+
+			it, ok := object.NewIterator(regs[base+b])
+			if !ok {
+				return fmt.Errorf("cannot iterate over %s", regs[base+b].Type())
+			}
+			regs[base+a] = it
+
+		case regcode.OpIterNext:
+			a := int(regcode.ReadUint16(ins[ip+1:]))
+			b := base + int(regcode.ReadUint16(ins[ip+3:]))
+			numVars := int(ins[ip+5])
+
+			key, value, ok := regs[base+a].(*object.Iterator).Next(numVars == 2)
+			if !ok {
+				regs[base+a] = Null
+				ip = int(regcode.ReadUint32(ins[ip+6:]))
+				break
+			}
+			ip += 10
+
+			if numVars == 2 {
+				regs[b], regs[b+1] = key, value
+			} else {
+				regs[b] = value
+			}
+
+		case regcode.OpArray:
+			a := int(regcode.ReadUint16(ins[ip+1:]))
+			b := base + int(regcode.ReadUint16(ins[ip+3:]))
+			n := int(regcode.ReadUint16(ins[ip+5:]))
+			ip += 7
+
+			elements := make([]object.Object, n)
+			copy(elements, regs[b:b+n])
+			arr := &object.Array{Elements: elements}
+			err := vm.limits.alloc(object.SizeOf(arr))
+			if err != nil {
+				return err
+			}
+			regs[base+a] = arr
+
+		case regcode.OpHash:
+			a := int(regcode.ReadUint16(ins[ip+1:]))
+			b := base + int(regcode.ReadUint16(ins[ip+3:]))
+			n := int(regcode.ReadUint16(ins[ip+5:]))
+			ip += 7
+
+			hash, err := buildHash(regs[b : b+2*n])
+			if err != nil {
+				return err
+			}
+			err = vm.limits.alloc(object.SizeOf(hash))
+			if err != nil {
+				return err
+			}
+			regs[base+a] = hash
+
+		case regcode.OpClosure:
+			a := int(regcode.ReadUint16(ins[ip+1:]))
+			constIdx := regcode.ReadUint32(ins[ip+3:])
+			c := base + int(regcode.ReadUint16(ins[ip+7:]))
+			numFree := int(regcode.ReadUint16(ins[ip+9:]))
+			site := frame.fn.closures[ip]
+			ip += 11
+
+			fn, ok := vm.constants[constIdx].(*object.CompiledFunction)
+			if !ok {
+				return fmt.Errorf("not a function: %+v", vm.constants[constIdx])
+			}
+			if variant, ok := frame.cl.Fn.Variants[site]; ok {
+				fn = variant
+			}
+
+			free := make([]object.Object, numFree)
+			copy(free, regs[c:c+numFree])
+			regs[base+a] = &object.Closure{Fn: fn, Free: free}
+
+		case regcode.OpCall, regcode.OpTailCall:
+			callee := base + int(regcode.ReadUint16(ins[ip+1:]))
+			numArgs := int(regcode.ReadUint16(ins[ip+3:]))
+			ip += 5
+
+			var err error
+			if op == regcode.OpTailCall {
+				err = vm.tailCall(callee, numArgs, ip)
+			} else {
+				err = vm.call(callee, numArgs, ip)
+			}
+			if err != nil {
+				return err
+			}
+
+			frame = &vm.frames[vm.framesPtr-1]
+			ins, base, ip = frame.fn.ins, frame.basePtr, frame.ip
+
+		case regcode.OpReturnValue, regcode.OpReturn:
+			var result object.Object = Null
+			if op == regcode.OpReturnValue {
+				result = regs[base+int(regcode.ReadUint16(ins[ip+1:]))]
+			}
+
+			if vm.framesPtr == 1 {
+				regs[0] = result
+				return nil
+			}
+
+			vm.framesPtr--
+			regs[base-1] = result
+
+			frame = &vm.frames[vm.framesPtr-1]
+			ins, base, ip = frame.fn.ins, frame.basePtr, frame.ip
+
+		default:
+			return fmt.Errorf("opcode %d undefined", op)
+		}
+	}
+
+	return nil
+}
+
+// call calls the closure or builtin in register callee, after which the
+// calling frame continues at resume. A closure gets a new frame starting
+// right above the callee; a builtin's result replaces the callee.
+func (vm *RegisterVM) call(callee, numArgs, resume int) error {
+	switch fn := vm.regs[callee].(type) {
+	case *object.Closure:
+		if numArgs != fn.Fn.NumParameters {
+			return fmt.Errorf("wrong number of arguments: want=%d, got=%d",
+				fn.Fn.NumParameters, numArgs)
+		}
+
+		if vm.framesPtr >= MaxFrames {
+			return fmt.Errorf("stack overflow: more than %d nested calls", MaxFrames)
+		}
+
+		lowered := vm.lowered[fn.Fn]
+		if callee+1+lowered.numRegs > len(vm.regs) {
+			return fmt.Errorf("stack overflow")
+		}
+
+		vm.frames[vm.framesPtr-1].ip = resume
+		vm.frames[vm.framesPtr] = regFrame{cl: fn, fn: lowered, basePtr: callee + 1}
+		vm.framesPtr++
+		newCells(vm.regs[callee+1:callee+1+fn.Fn.NumLocals], fn.Fn)
+		return nil
+
+	case *object.Builtin:
+		args := vm.regs[callee+1 : callee+1+numArgs]
+		result := fn.Fn(args...)
+		err := vm.limits.alloc(object.BuiltinResultSize(result, args))
+		if err != nil {
+			return err
+		}
+		if result == nil {
+			result = Null
+		}
+		vm.regs[callee] = result
+		vm.frames[vm.framesPtr-1].ip = resume
+		return nil
+
+	default:
+		return fmt.Errorf("calling non-function and non-built-in: %s", fn.Type())
+	}
+}
+
+// tailCall replaces the current frame with a call of the closure in
+// register callee, so a chain of tail calls runs in constant space.
+// Builtins are called like with call.
+func (vm *RegisterVM) tailCall(callee, numArgs, resume int) error {
+	cl, ok := vm.regs[callee].(*object.Closure)
+	if !ok {
+		return vm.call(callee, numArgs, resume)
+	}
+
+	if numArgs != cl.Fn.NumParameters {
+		return fmt.Errorf("wrong number of arguments: want=%d, got=%d",
+			cl.Fn.NumParameters, numArgs)
+	}
+
+	frame := &vm.frames[vm.framesPtr-1]
+	lowered := vm.lowered[cl.Fn]
+	if frame.basePtr+lowered.numRegs > len(vm.regs) {
+		return fmt.Errorf("stack overflow")
+	}
+
+	copy(vm.regs[frame.basePtr-1:], vm.regs[callee:callee+1+numArgs])
+	frame.cl = cl
+	frame.fn = lowered
+	frame.ip = 0
+	newCells(vm.regs[frame.basePtr:frame.basePtr+cl.Fn.NumLocals], cl.Fn)
+
+	return nil
+}
+
+func regBinaryOp(op regcode.Opcode, left, right object.Object) (object.Object, error) {
+	if op == regcode.OpIndex {
+		return indexOp(left, right)
+	}
+
+	if l, ok := left.(*object.Integer); ok {
+		if r, ok := right.(*object.Integer); ok {
+			return integerOp(op, l.Value, r.Value)
+		}
+	}
+
+	switch op {
+	case regcode.OpEqual:
+		return nativeBoolToBoolObj(left == right), nil
+	case regcode.OpNotEqual:
+		return nativeBoolToBoolObj(left != right), nil
+	case regcode.OpGreaterThan:
+		return nil, fmt.Errorf("unknown operator: %d (%s %s)", op, left.Type(), right.Type())
+	}
+
+	l, lok := left.(*object.String)
+	r, rok := right.(*object.String)
+	if !lok || !rok {
+		return nil, fmt.Errorf("unsupported types for binary operation: %s %s",
+			left.Type(), right.Type())
+	}
+	if op != regcode.OpAdd {
+		return nil, fmt.Errorf("unknown string operator: %d", op)
+	}
+	return &object.String{Value: l.Value + r.Value}, nil
+}
+
+func integerOp(op regcode.Opcode, left, right int64) (object.Object, error) {
+	switch op {
+	case regcode.OpAdd:
+		return &object.Integer{Value: left + right}, nil
+	case regcode.OpSub:
+		return &object.Integer{Value: left - right}, nil
+	case regcode.OpMul:
+		return &object.Integer{Value: left * right}, nil
+	case regcode.OpDiv:
+		if right == 0 {
+			return nil, fmt.Errorf("division by zero")
+		}
+		return &object.Integer{Value: left / right}, nil
+	case regcode.OpMod:
+		if right == 0 {
+			return nil, fmt.Errorf("division by zero")
+		}
+		return &object.Integer{Value: left % right}, nil
+	case regcode.OpEqual:
+		return nativeBoolToBoolObj(left == right), nil
+	case regcode.OpNotEqual:
+		return nativeBoolToBoolObj(left != right), nil
+	case regcode.OpGreaterThan:
+		return nativeBoolToBoolObj(left > right), nil
+	default:
+		return nil, fmt.Errorf("unknown Integer operation: %d", op)
+	}
+}
+
+func indexOp(left, index object.Object) (object.Object, error) {
+	switch left := left.(type) {
+	case *object.Hash:
+		key, ok := index.(object.Hashable)
+		if !ok {
+			return nil, fmt.Errorf("unknown index type for hash: %s", index.Type())
+		}
+
+		pair, ok := left.Pairs[key.HashKey()]
+		if !ok {
+			return Null, nil
+		}
+		return pair.Value, nil
+
+	case *object.Array:
+		idx, ok := index.(*object.Integer)
+		if !ok {
+			return nil, fmt.Errorf("unknown index type for array: %s", index.Type())
+		}
+
+		if idx.Value < 0 || idx.Value > int64(len(left.Elements)-1) {
+			return Null, nil
+		}
+		return left.Elements[idx.Value], nil
+
+	default:
+		return nil, fmt.Errorf("index operator not supported: %s", left.Type())
+	}
+}
+
+// setIndexOp stores value at index of left, which must be an array with
+// that index or a hash. It returns the bytes the hash grew by.
+func setIndexOp(left, index, value object.Object) (int64, error) {
+	switch left := left.(type) {
+	case *object.Hash:
+		key, ok := index.(object.Hashable)
+		if !ok {
+			return 0, fmt.Errorf("unusable as hash key: %s", index.Type())
+		}
+
+		size := object.SizeOf(left)
+		left.Pairs[key.HashKey()] = object.HashPair{Key: index, Value: value}
+		return object.SizeOf(left) - size, nil
+
+	case *object.Array:
+		idx, ok := index.(*object.Integer)
+		if !ok {
+			return 0, fmt.Errorf("unknown index type for array: %s", index.Type())
+		}
+
+		if idx.Value < 0 || idx.Value >= int64(len(left.Elements)) {
+			return 0, fmt.Errorf("index out of bounds (idx: %d, length: %d)",
+				idx.Value, len(left.Elements))
+		}
+		left.Elements[idx.Value] = value
+		return 0, nil
+
+	default:
+		return 0, fmt.Errorf("index assignment not supported: %s", left.Type())
+	}
+}
+
+// buildHash builds a hash from alternating keys and values. Like OpHash in
+// the stack VM, an earlier pair wins over a later one with the same key.
+func buildHash(kvs []object.Object) (object.Object, error) {
+	pairs := make(map[object.HashKey]object.HashPair, len(kvs)/2)
+	for i := len(kvs) - 2; i >= 0; i -= 2 {
+		key, val := kvs[i], kvs[i+1]
+
+		hashKey, ok := key.(object.Hashable)
+		if !ok {
+			return nil, fmt.Errorf("unusable as hash key: %s", key.Type())
+		}
+
+		pairs[hashKey.HashKey()] = object.HashPair{Key: key, Value: val}
+	}
+
+	return &object.Hash{Pairs: pairs}, nil
+}
+
+func (vm *RegisterVM) LastPoppedStackElem() object.Object {
+	return vm.regs[0]
+}
+
+// newCells puts the locals of a call to fn that are held in cells into new
+// ones. A parameter's cell holds its argument and the others hold null.
+func newCells(locals []object.Object, fn *object.CompiledFunction) {
+	for _, idx := range fn.Cells {
+		value := object.Object(Null)
+		if idx < fn.NumParameters {
+			value = locals[idx]
+		}
+		locals[idx] = &object.Cell{Value: value}
+	}
+}
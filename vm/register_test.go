@@ -0,0 +1,279 @@
+package vm
+
+import (
+	"karaoke/code"
+	"karaoke/compiler"
+	"karaoke/regcode"
+	"sort"
+	"testing"
+)
+
+func TestLower(t *testing.T) {
+	tests := []struct {
+		input     []code.Instructions
+		numLocals int
+		expected  []regcode.Instructions
+		numRegs   int
+	}{
+		{
+			// a + b reads both locals in place.
+			input: []code.Instructions{
+				code.Make(code.OpGetLocal, 0),
+				code.Make(code.OpGetLocal, 1),
+				code.Make(code.OpAdd),
+				code.Make(code.OpReturnValue),
+			},
+			numLocals: 2,
+			expected: []regcode.Instructions{
+				regcode.Make(regcode.OpAdd, 2, 0, 1),
+				regcode.Make(regcode.OpReturnValue, 2),
+			},
+			numRegs: 4,
+		},
+		{
+			// let c = 1 + a writes c directly.
+			input: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpGetLocal, 0),
+				code.Make(code.OpAdd),
+				code.Make(code.OpSetLocal, 1),
+				code.Make(code.OpReturn),
+			},
+			numLocals: 2,
+			expected: []regcode.Instructions{
+				regcode.Make(regcode.OpLoadConst, 2, 0),
+				regcode.Make(regcode.OpAdd, 1, 2, 0),
+				regcode.Make(regcode.OpReturn),
+			},
+			numRegs: 4,
+		},
+		{
+			// Arguments are moved next to the callee.
+			input: []code.Instructions{
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpGetLocal, 0),
+				code.Make(code.OpCall, 1),
+				code.Make(code.OpReturnValue),
+			},
+			numLocals: 1,
+			expected: []regcode.Instructions{
+				regcode.Make(regcode.OpGetGlobal, 1, 0),
+				regcode.Make(regcode.OpMove, 2, 0),
+				regcode.Make(regcode.OpCall, 1, 1),
+				regcode.Make(regcode.OpReturnValue, 1),
+			},
+			numRegs: 3,
+		},
+		{
+			// if (a) { a } else { 2 }: both branches leave the value in the
+			// same register, and jumps are re-targeted.
+			input: []code.Instructions{
+				code.Make(code.OpGetLocal, 0),
+				code.Make(code.OpJumpNotTruthy, 10),
+				code.Make(code.OpGetLocal, 0),
+				code.Make(code.OpJump, 13),
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpReturnValue),
+			},
+			numLocals: 1,
+			expected: []regcode.Instructions{
+				regcode.Make(regcode.OpJumpNotTruthy, 0, 17),
+				regcode.Make(regcode.OpMove, 1, 0),
+				regcode.Make(regcode.OpJump, 24),
+				regcode.Make(regcode.OpLoadConst, 1, 0),
+				regcode.Make(regcode.OpReturnValue, 1),
+			},
+			numRegs: 2,
+		},
+		{
+			// Overwriting a local still on the stack copies it first.
+			input: []code.Instructions{
+				code.Make(code.OpGetLocal, 0),
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpSetLocal, 0),
+				code.Make(code.OpReturnValue),
+			},
+			numLocals: 1,
+			expected: []regcode.Instructions{
+				regcode.Make(regcode.OpLoadConst, 2, 0),
+				regcode.Make(regcode.OpMove, 1, 0),
+				regcode.Make(regcode.OpMove, 0, 2),
+				regcode.Make(regcode.OpReturnValue, 1),
+			},
+			numRegs: 3,
+		},
+		{
+			// a[0] = b leaves the local b as the value of the assignment.
+			input: []code.Instructions{
+				code.Make(code.OpGetLocal, 0),
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpGetLocal, 1),
+				code.Make(code.OpSetIndex),
+				code.Make(code.OpReturnValue),
+			},
+			numLocals: 2,
+			expected: []regcode.Instructions{
+				regcode.Make(regcode.OpLoadConst, 3, 0),
+				regcode.Make(regcode.OpSetIndex, 0, 3, 1),
+				regcode.Make(regcode.OpReturnValue, 1),
+			},
+			numRegs: 5,
+		},
+		{
+			// a[0] = 1 moves the value down to the assignment's slot.
+			input: []code.Instructions{
+				code.Make(code.OpGetLocal, 0),
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpSetIndex),
+				code.Make(code.OpReturnValue),
+			},
+			numLocals: 1,
+			expected: []regcode.Instructions{
+				regcode.Make(regcode.OpLoadConst, 2, 0),
+				regcode.Make(regcode.OpLoadConst, 3, 1),
+				regcode.Make(regcode.OpSetIndex, 0, 2, 3),
+				regcode.Make(regcode.OpMove, 1, 3),
+				regcode.Make(regcode.OpReturnValue, 1),
+			},
+			numRegs: 4,
+		},
+		{
+			// a[0] += b reads through the duplicated collection and index.
+			input: []code.Instructions{
+				code.Make(code.OpGetLocal, 0),
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpDup2),
+				code.Make(code.OpIndex),
+				code.Make(code.OpGetLocal, 1),
+				code.Make(code.OpAdd),
+				code.Make(code.OpSetIndex),
+				code.Make(code.OpReturnValue),
+			},
+			numLocals: 2,
+			expected: []regcode.Instructions{
+				regcode.Make(regcode.OpLoadConst, 3, 0),
+				regcode.Make(regcode.OpIndex, 4, 0, 3),
+				regcode.Make(regcode.OpAdd, 4, 4, 1),
+				regcode.Make(regcode.OpSetIndex, 0, 3, 4),
+				regcode.Make(regcode.OpMove, 2, 4),
+				regcode.Make(regcode.OpReturnValue, 2),
+			},
+			numRegs: 6,
+		},
+	}
+
+	for i, tt := range tests {
+		lowered, err := lower(concatInstructions(tt.input), nil, tt.numLocals, false)
+		if err != nil {
+			t.Fatalf("test[%d]: lower failed: %s", i, err)
+		}
+
+		expected := regcode.Instructions{}
+		for _, ins := range tt.expected {
+			expected = append(expected, ins...)
+		}
+
+		if lowered.ins.String() != expected.String() {
+			t.Errorf("test[%d]: wrong register code.\nwant=%q\ngot =%q",
+				i, expected.String(), lowered.ins.String())
+		}
+		if lowered.numRegs != tt.numRegs {
+			t.Errorf("test[%d]: wrong numRegs. want=%d, got=%d", i, tt.numRegs, lowered.numRegs)
+		}
+	}
+}
+
+func TestLowerMalformed(t *testing.T) {
+	tests := []struct {
+		input    []code.Instructions
+		expected string
+	}{
+		{
+			[]code.Instructions{code.Make(code.OpPop)},
+			"OpPop at 0 pops 1 values off a stack of 0",
+		},
+		{
+			[]code.Instructions{
+				code.Make(code.OpTrue),
+				code.Make(code.OpJump, 2),
+			},
+			"jump to 2 is not an instruction boundary",
+		},
+		{
+			[]code.Instructions{
+				code.Make(code.OpTrue),
+				code.Make(code.OpJump, 0),
+			},
+			"inconsistent stack depth at 0: 0 and 1",
+		},
+	}
+
+	for _, tt := range tests {
+		_, err := lower(concatInstructions(tt.input), nil, 0, false)
+		if err == nil {
+			t.Fatalf("expected an error for %q", concatInstructions(tt.input))
+		}
+		if err.Error() != tt.expected {
+			t.Errorf("wrong error: want=%q, got=%q", tt.expected, err)
+		}
+	}
+}
+
+func concatInstructions(insts []code.Instructions) code.Instructions {
+	out := code.Instructions{}
+	for _, ins := range insts {
+		out = append(out, ins...)
+	}
+	return out
+}
+
+func BenchmarkFibonacci(b *testing.B) {
+	benchmarkBackends(b, `
+	let fib = fn(n) { if (n < 2) { n } else { fib(n - 1) + fib(n - 2) } };
+	fib(20);
+	`)
+}
+
+func BenchmarkTailCalls(b *testing.B) {
+	benchmarkBackends(b, `
+	let count = fn(n, acc) { if (n == 0) { acc } else { count(n - 1, acc + 1) } };
+	count(100000, 0);
+	`)
+}
+
+func BenchmarkArrays(b *testing.B) {
+	benchmarkBackends(b, `
+	let build = fn(n, acc) { if (n == 0) { acc } else { build(n - 1, push(acc, [n, n * 2])) } };
+	let sum = fn(arr, acc) {
+		if (len(arr) == 0) { acc } else { sum(rest(arr), acc + first(arr)[1]) }
+	};
+	sum(build(500, []), 0);
+	`)
+}
+
+func benchmarkBackends(b *testing.B, input string) {
+	comp := compiler.New()
+	err := comp.Compile(parse(input))
+	if err != nil {
+		b.Fatalf("compiler error: %s", err)
+	}
+	bc := comp.Bytecode()
+
+	names := []string{}
+	for name := range Backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		b.Run(name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				err := Backends[name](bc).Run()
+				if err != nil {
+					b.Fatalf("vm error: %s", err)
+				}
+			}
+		})
+	}
+}
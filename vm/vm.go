@@ -1,10 +1,13 @@
 package vm
 
 import (
+	"context"
 	"fmt"
 	"karaoke/code"
 	"karaoke/compiler"
 	"karaoke/object"
+	"maps"
+	"slices"
 )
 
 const (
@@ -24,15 +27,23 @@ type VM struct {
 	stack     []object.Object
 	globals   []object.Object
 	sp        int
+
+	globalNames []string
+	debugger    *debugState
+	limits      limits
 }
 
 func (vm *VM) currenFrame() *Frame {
 	return vm.frames[vm.framesPtr-1]
 }
 
-func (vm *VM) pushFrame(f *Frame) {
+func (vm *VM) pushFrame(f *Frame) error {
+	if vm.framesPtr >= MaxFrames {
+		return fmt.Errorf("stack overflow: more than %d nested calls", MaxFrames)
+	}
 	vm.frames[vm.framesPtr] = f
 	vm.framesPtr++
+	return nil
 }
 
 func (vm *VM) popFrame() *Frame {
@@ -40,36 +51,92 @@ func (vm *VM) popFrame() *Frame {
 	return vm.frames[vm.framesPtr]
 }
 
-func NewWithGlobalsStore(bc *compiler.Bytecode, s []object.Object) *VM {
-	vm := New(bc)
+func NewWithGlobalsStore(bc *compiler.Bytecode, s []object.Object, opts ...Option) *VM {
+	vm := New(bc, opts...)
 	vm.globals = s
 	return vm
 }
 
-func New(bc *compiler.Bytecode) *VM {
-	mainFrame := NewFrame(&object.CompiledFunction{Instructions: bc.Instructions}, 0)
+// newGlobals makes a store for the globals of bc: GlobalsSize of them, or
+// as many as bc defines if those are more.
+func newGlobals(bc *compiler.Bytecode) []object.Object {
+	return make([]object.Object, max(GlobalsSize, len(bc.GlobalNames)))
+}
+
+func New(bc *compiler.Bytecode, opts ...Option) *VM {
+	mainFn := &object.CompiledFunction{
+		Instructions: bc.Instructions,
+		Name:         mainName,
+		Positions:    bc.Positions,
+		Variants:     bc.Variants,
+	}
+	mainClosure := &object.Closure{Fn: mainFn}
+	mainFrame := NewFrame(mainClosure, 0)
 
 	frames := make([]*Frame, MaxFrames)
 	frames[0] = mainFrame
 
 	return &VM{
 		constants: bc.Constants,
-		globals:   make([]object.Object, GlobalsSize),
+		globals:   newGlobals(bc),
 		stack:     make([]object.Object, StackSize),
 		sp:        0,
 		framesPtr: 1,
 		frames:    frames,
+
+		globalNames: bc.GlobalNames,
+		limits:      newLimits(opts),
 	}
 }
 
+// Run runs the program. An error it returns is a *RuntimeError.
 func (vm *VM) Run() error {
+	return vm.RunContext(context.Background())
+}
+
+// RunContext runs the program until it ends, ctx is done or it spent its
+// instruction budget. An error it returns is a *RuntimeError; when the run
+// was stopped it wraps an *object.CanceledError or an
+// *object.BudgetExceededError.
+func (vm *VM) RunContext(ctx context.Context) error {
+	vm.limits.start(ctx)
+	err := vm.run()
+	if err != nil {
+		return vm.runtimeError(err)
+	}
+	return nil
+}
+
+// runtimeError adds the stack trace to err. The ip of every frame points
+// into the instruction the frame is running.
+func (vm *VM) runtimeError(err error) *RuntimeError {
+	trace := make([]TraceFrame, 0, vm.framesPtr)
+	for i := vm.framesPtr - 1; i >= 0; i-- {
+		fn := vm.frames[i].cl.Fn
+		trace = append(trace, newTraceFrame(fn, fn.Positions, vm.frames[i].ip))
+	}
+	return &RuntimeError{Err: err, Trace: trace}
+}
+
+func (vm *VM) run() error {
 	var ip int
 	var ins code.Instructions
 	var op code.Opcode
 
 	for vm.currenFrame().ip < len(vm.currenFrame().Instructions())-1 {
+		if vm.debugger != nil && vm.debugger.active && vm.debugger.pause(vm) {
+			return errPaused
+		}
+
 		vm.currenFrame().ip++
 
+		if vm.limits.ticks == 0 {
+			if err := vm.limits.check(); err != nil {
+				return err
+			}
+		}
+		vm.limits.ticks--
+
 		ip = vm.currenFrame().ip
 		ins = vm.currenFrame().Instructions()
 		op = code.Opcode(ins[ip])
@@ -97,15 +164,22 @@ func (vm *VM) Run() error {
 			}
 
 		case code.OpCall:
+			numArgs := int(ins[ip+1])
+			vm.currenFrame().ip += 1
 
-			fnObj, ok := vm.stack[vm.sp-1].(*object.CompiledFunction)
-			if !ok {
-				return fmt.Errorf("wrong type for compiled function: %s", fnObj.Type())
+			err := vm.executeCall(numArgs)
+			if err != nil {
+				return err
 			}
 
-			funcFrame := NewFrame(fnObj, vm.sp)
-			vm.pushFrame(funcFrame)
-			vm.sp = funcFrame.basePtr + fnObj.NumLocals
+		case code.OpTailCall:
+			numArgs := int(ins[ip+1])
+			vm.currenFrame().ip += 1
+
+			err := vm.executeTailCall(numArgs)
+			if err != nil {
+				return err
+			}
 
 		case code.OpIndex:
 			idxObj := vm.stackPop()
@@ -145,24 +219,30 @@ func (vm *VM) Run() error {
 				}
 			}
 
-		case code.OpHash:
-			lenHash := int(code.ReadUint16(ins[ip+1:]))
-			vm.currenFrame().ip += 2
-
-			pairs := make(map[object.HashKey]object.HashPair, lenHash)
-			for i := 0; i < lenHash; i++ {
-				val := vm.stackPop()
-				key := vm.stackPop()
+		case code.OpSetIndex:
+			value := vm.stackPop()
+			idxObj := vm.stackPop()
+			collection := vm.stackPop()
 
-				hashKey, ok := key.(object.Hashable)
-				if !ok {
-					return fmt.Errorf("unusable as hash key: %s", key.Type())
-				}
+			grown, err := setIndexOp(collection, idxObj, value)
+			if err != nil {
+				return err
+			}
+			err = vm.limits.alloc(grown)
+			if err != nil {
+				return err
+			}
 
-				pairs[hashKey.HashKey()] = object.HashPair{Key: key, Value: val}
+			err = vm.stackPush(value)
+			if err != nil {
+				return err
 			}
 
-			err := vm.stackPush(&object.Hash{Pairs: pairs})
+		case code.OpHash:
+			lenHash := int(code.ReadUint16(ins[ip+1:]))
+			vm.currenFrame().ip += 2
+
+			err := vm.pushHash(lenHash)
 			if err != nil {
 				return err
 			}
@@ -171,12 +251,7 @@ func (vm *VM) Run() error {
 			lenArr := int(code.ReadUint16(ins[ip+1:]))
 			vm.currenFrame().ip += 2
 
-			array := make([]object.Object, lenArr)
-			for i := lenArr - 1; i >= 0; i-- {
-				array[i] = vm.stackPop()
-			}
-
-			err := vm.stackPush(&object.Array{Elements: array})
+			err := vm.pushArray(lenArr)
 			if err != nil {
 				return err
 			}
@@ -185,13 +260,16 @@ func (vm *VM) Run() error {
 			objIdx := code.ReadUint16(ins[ip+1:])
 			vm.currenFrame().ip += 2
 
-			vm.globals[objIdx] = vm.stackPop()
+			err := vm.setGlobal(int(objIdx), vm.stackPop())
+			if err != nil {
+				return err
+			}
 
 		case code.OpGetGlobal:
 			objIdx := code.ReadUint16(ins[ip+1:])
 			vm.currenFrame().ip += 2
 
-			err := vm.stackPush(vm.globals[objIdx])
+			err := vm.pushGlobal(int(objIdx))
 			if err != nil {
 				return err
 			}
@@ -211,6 +289,72 @@ func (vm *VM) Run() error {
 				return err
 			}
 
+		case code.OpSetCell:
+			objIdx := uint8(ins[ip+1])
+			vm.currenFrame().ip += 1
+
+			vm.localCell(int(objIdx)).Value = vm.stackPop()
+
+		case code.OpGetCell:
+			objIdx := uint8(ins[ip+1])
+			vm.currenFrame().ip += 1
+
+			err := vm.stackPush(vm.localCell(int(objIdx)).Value)
+			if err != nil {
+				return err
+			}
+
+		case code.OpGetBuiltin:
+			builtinIdx := uint8(ins[ip+1])
+			vm.currenFrame().ip += 1
+
+			def := object.Builtins[builtinIdx]
+
+			err := vm.stackPush(def.Builtin)
+			if err != nil {
+				return err
+			}
+
+		case code.OpClosure:
+			constIdx := int(code.ReadUint16(ins[ip+1:]))
+			numFree := int(ins[ip+3])
+			vm.currenFrame().ip += 3
+
+			err := vm.pushClosure(ip, constIdx, numFree)
+			if err != nil {
+				return err
+			}
+
+		case code.OpGetFree:
+			freeIdx := uint8(ins[ip+1])
+			vm.currenFrame().ip += 1
+
+			err := vm.stackPush(vm.currenFrame().cl.Free[freeIdx])
+			if err != nil {
+				return err
+			}
+
+		case code.OpSetFreeCell:
+			freeIdx := uint8(ins[ip+1])
+			vm.currenFrame().ip += 1
+
+			vm.freeCell(int(freeIdx)).Value = vm.stackPop()
+
+		case code.OpGetFreeCell:
+			freeIdx := uint8(ins[ip+1])
+			vm.currenFrame().ip += 1
+
+			err := vm.stackPush(vm.freeCell(int(freeIdx)).Value)
+			if err != nil {
+				return err
+			}
+
+		case code.OpCurrentClosure:
+			err := vm.stackPush(vm.currenFrame().cl)
+			if err != nil {
+				return err
+			}
+
 		case code.OpNull:
 			vm.stackPush(Null)
 
@@ -236,7 +380,7 @@ func (vm *VM) Run() error {
 				return err
 			}
 
-		case code.OpAdd, code.OpSub, code.OpMul, code.OpDiv:
+		case code.OpAdd, code.OpSub, code.OpMul, code.OpDiv, code.OpMod:
 			err := vm.execBinaryOp(op)
 			if err != nil {
 				return err
@@ -245,6 +389,22 @@ func (vm *VM) Run() error {
 		case code.OpPop:
 			vm.stackPop()
 
+		case code.OpDup:
+			err := vm.stackPush(vm.StackTop())
+			if err != nil {
+				return err
+			}
+
+		case code.OpDup2:
+			err := vm.stackPush(vm.stack[vm.sp-2])
+			if err != nil {
+				return err
+			}
+			err = vm.stackPush(vm.stack[vm.sp-2])
+			if err != nil {
+				return err
+			}
+
 		case code.OpTrue:
 			err := vm.stackPush(trueObj)
 			if err != nil {
@@ -278,11 +438,337 @@ func (vm *VM) Run() error {
 
 			value := argObj.(*object.Integer).Value
 			vm.stackPush(&object.Integer{Value: -value})
+
+		case code.OpIter:
+			err := vm.pushIterator()
+			if err != nil {
+				return err
+			}
+
+		case code.OpIterNext:
+			target := int(code.ReadUint16(ins[ip+1:]))
+			numVars := int(ins[ip+3])
+			vm.currenFrame().ip += 3
+
+			err := vm.iterNext(target, numVars)
+			if err != nil {
+				return err
+			}
+
+		case code.OpWide:
+			err := vm.executeWide(ins, ip)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// executeWide runs an instruction prefixed with OpWide. It is the slow
+// path of the instructions in the loop above, decoding the wide operands
+// with code.ReadOperands.
+func (vm *VM) executeWide(ins code.Instructions, ip int) error {
+	def, operands, width, err := ins.ReadInstruction(ip)
+	if err != nil {
+		return err
+	}
+	vm.currenFrame().ip += width - 1
+
+	switch ins.OpcodeAt(ip) {
+	case code.OpConstant:
+		return vm.stackPush(vm.constants[operands[0]])
+
+	case code.OpJump:
+		vm.currenFrame().ip = operands[0] - 1
+
+	case code.OpJumpNotTruthy:
+		if !isTruthy(vm.stackPop()) {
+			vm.currenFrame().ip = operands[0] - 1
+		}
+
+	case code.OpGetGlobal:
+		return vm.pushGlobal(operands[0])
+
+	case code.OpSetGlobal:
+		return vm.setGlobal(operands[0], vm.stackPop())
+
+	case code.OpGetLocal:
+		return vm.stackPush(vm.stack[vm.currenFrame().basePtr+operands[0]])
+
+	case code.OpSetLocal:
+		vm.stack[vm.currenFrame().basePtr+operands[0]] = vm.stackPop()
+
+	case code.OpGetCell:
+		return vm.stackPush(vm.localCell(operands[0]).Value)
+
+	case code.OpSetCell:
+		vm.localCell(operands[0]).Value = vm.stackPop()
+
+	case code.OpArray:
+		return vm.pushArray(operands[0])
+
+	case code.OpHash:
+		return vm.pushHash(operands[0])
+
+	case code.OpCall:
+		return vm.executeCall(operands[0])
+
+	case code.OpTailCall:
+		return vm.executeTailCall(operands[0])
+
+	case code.OpClosure:
+		return vm.pushClosure(ip, operands[0], operands[1])
+
+	case code.OpGetFree:
+		return vm.stackPush(vm.currenFrame().cl.Free[operands[0]])
+
+	case code.OpGetFreeCell:
+		return vm.stackPush(vm.freeCell(operands[0]).Value)
+
+	case code.OpSetFreeCell:
+		vm.freeCell(operands[0]).Value = vm.stackPop()
+
+	case code.OpGetBuiltin:
+		return vm.stackPush(object.Builtins[operands[0]].Builtin)
+
+	case code.OpIterNext:
+		return vm.iterNext(operands[0], operands[1])
+
+	default:
+		return fmt.Errorf("no wide form of %s", def.Name)
+	}
+
+	return nil
+}
+
+// localCell returns the cell in local idx of the current frame.
+func (vm *VM) localCell(idx int) *object.Cell {
+	return vm.stack[vm.currenFrame().basePtr+idx].(*object.Cell)
+}
+
+// freeCell returns the cell the current closure captured as free variable
+// idx.
+func (vm *VM) freeCell(idx int) *object.Cell {
+	return vm.currenFrame().cl.Free[idx].(*object.Cell)
+}
+
+func (vm *VM) pushIterator() error {
+	obj := vm.stackPop()
+
+	it, ok := object.NewIterator(obj)
+	if !ok {
+		return fmt.Errorf("cannot iterate over %s", obj.Type())
+	}
+	return vm.stackPush(it)
+}
+
+// iterNext advances the iterator on top of the stack and pushes the values
+// of numVars loop variables, the last on top. An exhausted iterator is
+// popped and the frame jumps to target instead; it leaves null as the last
+// popped value, the value of the loop.
+func (vm *VM) iterNext(target, numVars int) error {
+	it := vm.stack[vm.sp-1].(*object.Iterator)
+
+	key, value, ok := it.Next(numVars == 2)
+	if !ok {
+		vm.sp--
+		vm.stack[vm.sp] = Null
+		vm.currenFrame().ip = target - 1
+		return nil
+	}
+
+	if numVars == 2 {
+		err := vm.stackPush(key)
+		if err != nil {
+			return err
+		}
+	}
+	return vm.stackPush(value)
+}
+
+// setGlobal stores obj in the global at idx. The store is never grown,
+// since a VM made by NewWithGlobalsStore shares it with its caller.
+func (vm *VM) setGlobal(idx int, obj object.Object) error {
+	if idx >= len(vm.globals) {
+		return fmt.Errorf("global %d does not fit in a store of %d globals", idx, len(vm.globals))
+	}
+
+	vm.globals[idx] = obj
+	return nil
+}
+
+func (vm *VM) pushGlobal(idx int) error {
+	if idx >= len(vm.globals) || vm.globals[idx] == nil {
+		return fmt.Errorf("variable %s used before assignment", globalName(vm.globalNames, idx))
+	}
+
+	return vm.stackPush(vm.globals[idx])
+}
+
+func (vm *VM) pushArray(length int) error {
+	array := make([]object.Object, length)
+	for i := length - 1; i >= 0; i-- {
+		array[i] = vm.stackPop()
+	}
+
+	arr := &object.Array{Elements: array}
+	err := vm.limits.alloc(object.SizeOf(arr))
+	if err != nil {
+		return err
+	}
+
+	return vm.stackPush(arr)
+}
+
+func (vm *VM) pushHash(numPairs int) error {
+	pairs := make(map[object.HashKey]object.HashPair, numPairs)
+	for i := 0; i < numPairs; i++ {
+		val := vm.stackPop()
+		key := vm.stackPop()
+
+		hashKey, ok := key.(object.Hashable)
+		if !ok {
+			return fmt.Errorf("unusable as hash key: %s", key.Type())
 		}
+
+		pairs[hashKey.HashKey()] = object.HashPair{Key: key, Value: val}
+	}
+
+	hash := &object.Hash{Pairs: pairs}
+	err := vm.limits.alloc(object.SizeOf(hash))
+	if err != nil {
+		return err
+	}
+
+	return vm.stackPush(hash)
+}
+
+func (vm *VM) executeCall(numArgs int) error {
+	callee := vm.stack[vm.sp-1-numArgs]
+	switch callee := callee.(type) {
+	case *object.Closure:
+		return vm.callClosure(callee, numArgs)
+	case *object.Builtin:
+		return vm.callBuiltin(callee, numArgs)
+	default:
+		return fmt.Errorf("calling non-function and non-built-in: %s", callee.Type())
 	}
+}
+
+func (vm *VM) callBuiltin(builtin *object.Builtin, numArgs int) error {
+	args := vm.stack[vm.sp-numArgs : vm.sp]
+
+	result := builtin.Fn(args...)
+	err := vm.limits.alloc(object.BuiltinResultSize(result, args))
+	if err != nil {
+		return err
+	}
+	vm.sp = vm.sp - numArgs - 1
+
+	if result != nil {
+		return vm.stackPush(result)
+	}
+	return vm.stackPush(Null)
+}
+
+func (vm *VM) callClosure(cl *object.Closure, numArgs int) error {
+	if numArgs != cl.Fn.NumParameters {
+		return fmt.Errorf("wrong number of arguments: want=%d, got=%d",
+			cl.Fn.NumParameters, numArgs)
+	}
+
+	funcFrame := NewFrame(cl, vm.sp-numArgs)
+	err := vm.pushFrame(funcFrame)
+	if err != nil {
+		return err
+	}
+
+	err = vm.setStackPointer(funcFrame.basePtr + cl.Fn.NumLocals)
+	if err != nil {
+		return err
+	}
+	vm.clearLocals(funcFrame, numArgs)
+	newCells(vm.stack[funcFrame.basePtr:vm.sp], cl.Fn)
 	return nil
 }
 
+// executeTailCall calls a closure by reusing the current frame: the callee
+// and its arguments replace the caller's slots, so a chain of tail calls
+// runs in constant stack. Builtins are called like with OpCall.
+func (vm *VM) executeTailCall(numArgs int) error {
+	cl, ok := vm.stack[vm.sp-1-numArgs].(*object.Closure)
+	if !ok {
+		return vm.executeCall(numArgs)
+	}
+
+	if numArgs != cl.Fn.NumParameters {
+		return fmt.Errorf("wrong number of arguments: want=%d, got=%d",
+			cl.Fn.NumParameters, numArgs)
+	}
+
+	frame := vm.currenFrame()
+	copy(vm.stack[frame.basePtr-1:], vm.stack[vm.sp-1-numArgs:vm.sp])
+	frame.cl = cl
+	frame.ip = -1
+
+	err := vm.setStackPointer(frame.basePtr + cl.Fn.NumLocals)
+	if err != nil {
+		return err
+	}
+	vm.clearLocals(frame, numArgs)
+	newCells(vm.stack[frame.basePtr:vm.sp], cl.Fn)
+	return nil
+}
+
+// clearLocals empties the slots of the locals a call has not assigned
+// yet when a debugger is attached, so it does not show what an earlier
+// call left in them.
+func (vm *VM) clearLocals(frame *Frame, numArgs int) {
+	if vm.debugger != nil {
+		clear(vm.stack[frame.basePtr+numArgs : frame.basePtr+frame.cl.Fn.NumLocals])
+	}
+}
+
+func (vm *VM) setStackPointer(sp int) error {
+	if sp > StackSize {
+		return fmt.Errorf("stack overflow")
+	}
+	vm.sp = sp
+	return nil
+}
+
+// pushClosure makes a closure of the constant at constIdx, or of its
+// variant for the OpClosure at offset in the current function.
+func (vm *VM) pushClosure(offset, constIdx, numFree int) error {
+	constant := vm.constants[constIdx]
+	fn, ok := constant.(*object.CompiledFunction)
+	if !ok {
+		return fmt.Errorf("not a function: %+v", constant)
+	}
+	if variant, ok := vm.currenFrame().cl.Fn.Variants[offset]; ok {
+		fn = variant
+	}
+
+	free := make([]object.Object, numFree)
+	for i := 0; i < numFree; i++ {
+		free[i] = vm.stack[vm.sp-numFree+i]
+	}
+	vm.sp = vm.sp - numFree
+
+	return vm.stackPush(&object.Closure{Fn: fn, Free: free})
+}
+
+// appendVariants appends to fns the variants of the closures fn makes,
+// each followed by its own, in the order of the offsets they are made at.
+func appendVariants(fns []*object.CompiledFunction, fn *object.CompiledFunction) []*object.CompiledFunction {
+	for _, offset := range slices.Sorted(maps.Keys(fn.Variants)) {
+		variant := fn.Variants[offset]
+		fns = appendVariants(append(fns, variant), variant)
+	}
+	return fns
+}
+
 func (vm *VM) execBinaryIntOp(operand code.Opcode, left object.Object, right object.Object) error {
 	leftVal := left.(*object.Integer).Value
 	rightVal := right.(*object.Integer).Value
@@ -294,8 +780,15 @@ func (vm *VM) execBinaryIntOp(operand code.Opcode, left object.Object, right obj
 		result = leftVal - rightVal
 	case code.OpMul:
 		result = leftVal * rightVal
-	case code.OpDiv:
-		result = leftVal / rightVal
+	case code.OpDiv, code.OpMod:
+		if rightVal == 0 {
+			return fmt.Errorf("division by zero")
+		}
+		if operand == code.OpDiv {
+			result = leftVal / rightVal
+		} else {
+			result = leftVal % rightVal
+		}
 	default:
 		return fmt.Errorf("unknown Integer operation: %d", operand)
 	}
@@ -311,7 +804,13 @@ func (vm *VM) execBinaryStrOp(op code.Opcode, left, right object.Object) error {
 
 	leftVal := left.(*object.String).Value
 	rightVal := right.(*object.String).Value
-	return vm.stackPush(&object.String{Value: leftVal + rightVal})
+	str := &object.String{Value: leftVal + rightVal}
+	err := vm.limits.alloc(object.SizeOf(str))
+	if err != nil {
+		return err
+	}
+
+	return vm.stackPush(str)
 }
 
 func (vm *VM) execBinaryOp(operand code.Opcode) error {
@@ -1,13 +1,19 @@
 package vm
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"karaoke/ast"
+	"karaoke/code"
 	"karaoke/compiler"
 	"karaoke/lexer"
 	"karaoke/object"
 	"karaoke/parser"
+	"karaoke/token"
+	"strings"
 	"testing"
+	"time"
 )
 
 type vmTestCase struct {
@@ -66,6 +72,779 @@ func TestCallingFunctionsWithBindings(t *testing.T) {
 	runVmTests(t, tests)
 }
 
+func TestCallingFunctionsWithArgumentsAndBindings(t *testing.T) {
+	tests := []vmTestCase{
+		{
+			input: `
+			let identity = fn(a) { a; };
+			identity(4);
+			`,
+			expected: 4,
+		},
+		{
+			input: `
+			let sum = fn(a, b) { a + b; };
+			sum(1, 2);
+			`,
+			expected: 3,
+		},
+		{
+			input: `
+			let sum = fn(a, b) {
+				let c = a + b;
+				c;
+			};
+			sum(1, 2) + sum(3, 4);
+			`,
+			expected: 10,
+		},
+		{
+			input: `
+			let globalNum = 10;
+			let sum = fn(a, b) {
+				let c = a + b;
+				c + globalNum;
+			};
+			let outer = fn() {
+				sum(1, 2) + sum(3, 4) + globalNum;
+			};
+			outer() + globalNum;
+			`,
+			expected: 50,
+		},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestCallingFunctionsWithWrongArguments(t *testing.T) {
+	tests := []vmTestCase{
+		{
+			input:    `fn() { 1; }(1);`,
+			expected: `wrong number of arguments: want=0, got=1`,
+		},
+		{
+			input:    `fn(a) { a; }();`,
+			expected: `wrong number of arguments: want=1, got=0`,
+		},
+		{
+			input:    `fn(a, b) { a + b; }(1);`,
+			expected: `wrong number of arguments: want=2, got=1`,
+		},
+	}
+
+	for _, tt := range tests {
+		program := parse(tt.input)
+
+		comp := compiler.New()
+		err := comp.Compile(program)
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		for name, newVM := range Backends {
+			vm := newVM(comp.Bytecode())
+			err = vm.Run()
+			if err == nil {
+				t.Fatalf("%s: expected VM error but resulted in none.", name)
+			}
+
+			if err.Error() != tt.expected {
+				t.Fatalf("%s: wrong VM error: want=%q, got=%q", name, tt.expected, err)
+			}
+		}
+	}
+}
+
+func TestBuiltinFunctions(t *testing.T) {
+	tests := []vmTestCase{
+		{`len("")`, 0},
+		{`len("four")`, 4},
+		{`len("hello world")`, 11},
+		{
+			`len(1)`,
+			&object.Error{
+				Message: "argument to `len` not supported, got INTEGER",
+			},
+		},
+		{`len("one", "two")`,
+			&object.Error{
+				Message: "wrong number of arguments. got=2, want=1",
+			},
+		},
+		{`len([1, 2, 3])`, 3},
+		{`len([])`, 0},
+		{`puts("hello", "world!")`, Null},
+		{`first([1, 2, 3])`, 1},
+		{`first([])`, Null},
+		{`first(1)`,
+			&object.Error{
+				Message: "argument to `first` must be ARRAY, got INTEGER",
+			},
+		},
+		{`last([1, 2, 3])`, 3},
+		{`last([])`, Null},
+		{`last(1)`,
+			&object.Error{
+				Message: "argument to `last` must be ARRAY, got INTEGER",
+			},
+		},
+		{`rest([1, 2, 3])`, []int{2, 3}},
+		{`rest([])`, Null},
+		{`push([], 1)`, []int{1}},
+		{`push(1, 1)`,
+			&object.Error{
+				Message: "argument to `push` must be ARRAY, got INTEGER",
+			},
+		},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestClosures(t *testing.T) {
+	tests := []vmTestCase{
+		{
+			input: `
+			let newClosure = fn(a) {
+				fn() { a; };
+			};
+			let closure = newClosure(99);
+			closure();
+			`,
+			expected: 99,
+		},
+		{
+			input: `
+			let newAdder = fn(a, b) {
+				fn(c) { a + b + c };
+			};
+			let adder = newAdder(1, 2);
+			adder(8);
+			`,
+			expected: 11,
+		},
+		{
+			input: `
+			let newAdder = fn(a, b) {
+				let c = a + b;
+				fn(d) { c + d };
+			};
+			let adder = newAdder(1, 2);
+			adder(8);
+			`,
+			expected: 11,
+		},
+		{
+			input: `
+			let newAdderOuter = fn(a, b) {
+				let c = a + b;
+				fn(d) {
+					let e = d + c;
+					fn(f) { e + f; };
+				};
+			};
+			let newAdderInner = newAdderOuter(1, 2)
+			let adder = newAdderInner(3);
+			adder(8);
+			`,
+			expected: 14,
+		},
+		{
+			input: `
+			let a = 1;
+			let newAdderOuter = fn(b) {
+				fn(c) {
+					fn(d) { a + b + c + d };
+				};
+			};
+			let newAdderInner = newAdderOuter(2)
+			let adder = newAdderInner(3);
+			adder(8);
+			`,
+			expected: 14,
+		},
+		{
+			input: `
+			let newClosure = fn(a, b) {
+				let one = fn() { a; };
+				let two = fn() { b; };
+				fn() { one() + two(); };
+			};
+			let closure = newClosure(9, 90);
+			closure();
+			`,
+			expected: 99,
+		},
+		{
+			input: `
+			let counter = fn(start) {
+				let inc = fn(n) { n + 1 };
+				fn() { inc(start) };
+			};
+			let next = counter(41);
+			next() + next();
+			`,
+			expected: 84,
+		},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestRecursiveFunctions(t *testing.T) {
+	tests := []vmTestCase{
+		{
+			input: `
+			let countDown = fn(x) {
+				if (x == 0) {
+					return 0;
+				} else {
+					countDown(x - 1);
+				}
+			};
+			countDown(1);
+			`,
+			expected: 0,
+		},
+		{
+			input: `
+			let wrapper = fn() {
+				let countDown = fn(x) {
+					if (x == 0) {
+						return 0;
+					} else {
+						countDown(x - 1);
+					}
+				};
+				countDown(1);
+			};
+			wrapper();
+			`,
+			expected: 0,
+		},
+		{
+			input: `
+			let wrapper = fn() {
+				let inner = fn(x) {
+					let step = fn() { inner(x - 1) };
+					if (x == 0) { 42 } else { step() }
+				};
+				inner(3);
+			};
+			wrapper();
+			`,
+			expected: 42,
+		},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestForwardReferences(t *testing.T) {
+	tests := []vmTestCase{
+		{
+			input: `
+			let isEven = fn(n) { if (n == 0) { true } else { isOdd(n - 1) } };
+			let isOdd = fn(n) { if (n == 0) { false } else { isEven(n - 1) } };
+			isEven(10);
+			`,
+			expected: true,
+		},
+		{
+			input: `
+			let main = fn() { helper(20) + offset };
+			let helper = fn(x) { x * 2 };
+			let offset = 2;
+			main();
+			`,
+			expected: 42,
+		},
+		{
+			input: `
+			let a = 1;
+			let getA = fn() { a };
+			let a = 2;
+			getA();
+			`,
+			expected: 2,
+		},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestUseBeforeAssignment(t *testing.T) {
+	tests := []vmTestCase{
+		{
+			input:    `let f = fn() { g() }; f(); let g = fn() { 1 };`,
+			expected: "variable g used before assignment",
+		},
+		{
+			input:    `x; let x = 1;`,
+			expected: "variable x used before assignment",
+		},
+	}
+
+	for _, tt := range tests {
+		program := parse(tt.input)
+
+		comp := compiler.New()
+		err := comp.Compile(program)
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		for name, newVM := range Backends {
+			vm := newVM(comp.Bytecode())
+			err = vm.Run()
+			if err == nil {
+				t.Fatalf("%s: expected VM error but resulted in none.", name)
+			}
+
+			if err.Error() != tt.expected {
+				t.Fatalf("%s: wrong VM error: want=%q, got=%q", name, tt.expected, err)
+			}
+		}
+	}
+}
+
+func TestTailCalls(t *testing.T) {
+	tests := []vmTestCase{
+		{
+			input: `
+			let count = fn(n, acc) {
+				if (n == 0) { acc } else { count(n - 1, acc + 1) }
+			};
+			count(100000, 0);
+			`,
+			expected: 100000,
+		},
+		{
+			input: `
+			let count = fn(n) {
+				if (n == 0) { return "done"; }
+				return count(n - 1);
+			};
+			count(5000);
+			`,
+			expected: "done",
+		},
+		{
+			input: `
+			let isEven = fn(n) { if (n == 0) { true } else { isOdd(n - 1) } };
+			let isOdd = fn(n) { if (n == 0) { false } else { isEven(n - 1) } };
+			isOdd(9999);
+			`,
+			expected: true,
+		},
+		{
+			input: `
+			let build = fn(n, acc) {
+				if (n == 0) { acc } else { build(n - 1, push(acc, n)) }
+			};
+			let sum = fn(arr, acc) {
+				if (len(arr) == 0) { acc } else { sum(rest(arr), acc + first(arr)) }
+			};
+			sum(build(2000, []), 0);
+			`,
+			expected: 2001000,
+		},
+		{
+			input: `
+			let outer = fn(n) { inner(n) + 1 };
+			let inner = fn(n) { if (n == 0) { 0 } else { inner(n - 1) } };
+			outer(3000);
+			`,
+			expected: 1,
+		},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestPeepholePatterns(t *testing.T) {
+	tests := []vmTestCase{
+		{"let x = 5; x;", 5},
+		{"let x = 5; let y = x; y;", 5},
+		{"fn() { let a = 7; a }()", 7},
+		{"fn() { let a = 1; let b = a + 1; b }()", 2},
+		{"if (true) { 10 }", 10},
+		{"if (false) { 10 }", Null},
+		{"if (false) { 10 } else { 20 }", 20},
+		{"if (true) { if (false) { 1 } else { 2 } } else { 3 }", 2},
+		{"let f = fn(x) { if (x) { let y = x; y } }; f(4);", 4},
+		{"let f = fn(x) { if (x) { let y = x; y } }; f(false);", Null},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestWideOperands(t *testing.T) {
+	var manyConstants, manyGlobals, manyLocals strings.Builder
+	for i := 0; i < 70000; i++ {
+		fmt.Fprintf(&manyConstants, "%d; ", i)
+	}
+	for i := 0; i < 66000; i++ {
+		fmt.Fprintf(&manyGlobals, "let g%s = %d; ", letterName(i), i)
+	}
+	for i := 0; i < 300; i++ {
+		fmt.Fprintf(&manyLocals, "let a%s = %d; ", letterName(i), i)
+	}
+
+	longBranch := strings.Repeat("1; ", 20000)
+
+	tests := []vmTestCase{
+		{manyConstants.String() + "70000", 70000},
+		{manyGlobals.String() + "g" + letterName(65999) + " + g" + letterName(1), 66000},
+		{"let f = fn() { " + manyLocals.String() + "a" + letterName(299) + " + a" + letterName(1) + " }; f();", 300},
+		{"let f = fn(x) { if (x) { " + longBranch + "5 } else { 6 } }; f(true);", 5},
+		{"let f = fn(x) { if (x) { " + longBranch + "5 } else { 6 } }; f(false);", 6},
+		{"let i = 0; while (i < 3) { " + longBranch + "let i = i + 1 }; i", 3},
+		{longBranch + "let i = 0; while (i < 3) { let i = i + 1 }; i", 3},
+		{"let s = 0; for (x in [1, 2]) { " + longBranch + "let s = s + x }; s", 3},
+		{"let s = 0; for (x in [1, 2, 3]) { if (x == 2) { break } " + longBranch + "let s = s + x }; s", 1},
+		{longBranch + "let i = 0; while (i < 3) { let i = i + 1; continue; }; i", 3},
+		{"let f = fn() { let s = 0; for (i, x in [1, 2]) { " + longBranch + "let s = s + i * x }; s }; f()", 2},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestGlobalsStore(t *testing.T) {
+	var manyGlobals strings.Builder
+	for i := 0; i < 66000; i++ {
+		fmt.Fprintf(&manyGlobals, "let g%s = %d; ", letterName(i), i)
+	}
+
+	tests := []struct {
+		input    string
+		size     int
+		expected string
+	}{
+		{"let a = 0; let b = 1; let c = 2;", 2, "global 2 does not fit in a store of 2 globals"},
+		{manyGlobals.String(), GlobalsSize, "global 65536 does not fit in a store of 65536 globals"},
+	}
+
+	for _, tt := range tests {
+		comp := compiler.New()
+		err := comp.Compile(parse(tt.input))
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		// The store is shared with the caller, so the VM fails rather than
+		// grow it.
+		store := make([]object.Object, tt.size)
+		err = NewWithGlobalsStore(comp.Bytecode(), store).Run()
+		if err == nil || err.Error() != tt.expected {
+			t.Errorf("wrong error. want=%q, got=%v", tt.expected, err)
+		}
+		for i, obj := range store {
+			if err := testIntegerObject(int64(i), obj); err != nil {
+				t.Fatalf("global %d: %s", i, err)
+			}
+		}
+	}
+}
+
+// letterName spells i in base 26 with the letters a to z, since
+// identifiers cannot contain digits.
+func letterName(i int) string {
+	name := ""
+	for {
+		name = string(rune('a'+i%26)) + name
+		i /= 26
+		if i == 0 {
+			return name
+		}
+	}
+}
+
+func TestStackOverflow(t *testing.T) {
+	input := `
+	let deep = fn() { deep() + 1 };
+	deep();
+	`
+	program := parse(input)
+
+	comp := compiler.New()
+	err := comp.Compile(program)
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	expected := fmt.Sprintf("stack overflow: more than %d nested calls", MaxFrames)
+
+	for name, newVM := range Backends {
+		vm := newVM(comp.Bytecode())
+		err = vm.Run()
+		if err == nil {
+			t.Fatalf("%s: expected VM error but resulted in none.", name)
+		}
+
+		if err.Error() != expected {
+			t.Fatalf("%s: wrong VM error: want=%q, got=%q", name, expected, err)
+		}
+	}
+}
+
+func TestInstructionBudget(t *testing.T) {
+	comp := compiler.New()
+	err := comp.Compile(parse("let loop = fn() { loop() }; loop();"))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	for name, newVM := range Backends {
+		vm := newVM(comp.Bytecode(), InstructionBudget(5000))
+		err = vm.Run()
+
+		var budgetErr *object.BudgetExceededError
+		if !errors.As(err, &budgetErr) {
+			t.Fatalf("%s: expected a budget error, got %v", name, err)
+		}
+		if budgetErr.Budget != 5000 {
+			t.Errorf("%s: wrong budget. want=5000, got=%d", name, budgetErr.Budget)
+		}
+		if _, ok := err.(*RuntimeError); !ok {
+			t.Errorf("%s: error is a %T, not a *RuntimeError", name, err)
+		}
+	}
+
+	// "1" is an OpConstant and an OpPop.
+	comp = compiler.New()
+	comp.Compile(parse("1"))
+	for budget, fails := range map[int64]bool{1: true, 2: false} {
+		err := New(comp.Bytecode(), InstructionBudget(budget)).Run()
+		if (err != nil) != fails {
+			t.Errorf("budget %d: wrong error %v", budget, err)
+		}
+	}
+}
+
+func TestMemoryLimit(t *testing.T) {
+	tests := []struct {
+		input string
+		limit int64
+		fails bool
+	}{
+		{`let grow = fn(s, n) { if (n == 0) { s } else { grow(s + s, n - 1) } };
+grow("ab", 40)`, 1 << 20, true},
+		{`let fill = fn(arr, n) { if (n == 0) { arr } else { fill(push(arr, n), n - 1) } };
+len(fill([], 100000))`, 1 << 20, true},
+		{`let fill = fn(arr, n) { if (n == 0) { arr } else { fill(push(arr, n), n - 1) } };
+len(fill([], 10))`, 1 << 20, false},
+		{`let pairs = fn(n) { if (n == 0) { {} } else { let h = {1: n, 2: n}; pairs(n - 1) } };
+pairs(100000)`, 1 << 20, true},
+		// Only the concatenation allocates; first returns an element.
+		{`let a = "ab"; let b = ["xxxx"]; first(b) + first(b) + a + "cd"`, 16 + 8 + 10 + 12, false},
+		{`let a = "ab"; let b = ["xxxx"]; first(b) + first(b) + a + "cd"`, 16 + 8 + 10 + 11, true},
+		// A new key grows a hash; setting an existing one does not.
+		{`let h = {}; h["a"] = 1; h["a"] = 2; h`, 56, false},
+		{`let h = {}; h["a"] = 1; h["a"] = 2; h`, 55, true},
+	}
+
+	for _, tt := range tests {
+		comp := compiler.New(compiler.FoldConstants(false))
+		err := comp.Compile(parse(tt.input))
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		for name, newVM := range Backends {
+			err := newVM(comp.Bytecode(), MemoryLimit(tt.limit)).Run()
+
+			var memErr *object.MemoryLimitError
+			if errors.As(err, &memErr) != tt.fails {
+				t.Errorf("%s: %q with limit %d: wrong error %v", name, tt.input, tt.limit, err)
+				continue
+			}
+			if tt.fails && memErr.Limit != tt.limit {
+				t.Errorf("%s: wrong limit. want=%d, got=%d", name, tt.limit, memErr.Limit)
+			}
+		}
+	}
+}
+
+func TestRunContext(t *testing.T) {
+	comp := compiler.New()
+	err := comp.Compile(parse("let loop = fn() { loop() }; loop();"))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	tests := []struct {
+		ctx  func() (context.Context, context.CancelFunc)
+		want error
+	}{
+		{func() (context.Context, context.CancelFunc) {
+			return context.WithTimeout(context.Background(), 10*time.Millisecond)
+		}, context.DeadlineExceeded},
+		{func() (context.Context, context.CancelFunc) {
+			return canceled, func() {}
+		}, context.Canceled},
+	}
+
+	for _, tt := range tests {
+		for name, newVM := range Backends {
+			ctx, cancel := tt.ctx()
+			err := newVM(comp.Bytecode()).RunContext(ctx)
+			cancel()
+
+			var cancelErr *object.CanceledError
+			if !errors.As(err, &cancelErr) || !errors.Is(err, tt.want) {
+				t.Errorf("%s: expected to be stopped by %v, got %v", name, tt.want, err)
+			}
+		}
+	}
+}
+
+func TestRuntimeErrorTrace(t *testing.T) {
+	tests := []struct {
+		input   string
+		message string
+		trace   []string
+	}{
+		{
+			input: `let add = fn(a, b) {
+  a + b
+};
+let twice = fn(x) { add(x, "s") + add(x, x) };
+twice(1);`,
+			message: "unsupported types for binary operation: INTEGER STRING",
+			trace: []string{
+				"add 2:3-2:8",
+				"twice 4:21-4:32",
+				"<main> 5:1-5:9",
+			},
+		},
+		{
+			// The tail call to check replaced the frame of loop.
+			input: `let check = fn(n) { if (n > 0) { -true } else { 0 } };
+let loop = fn(n) { check(n) };
+[loop(0), fn() { loop(1) + 0 }()];`,
+			message: "unsupported type for negation: BOOLEAN",
+			trace: []string{
+				"check 1:34-1:39",
+				"<anonymous> 3:18-3:25",
+				"<main> 3:11-3:33",
+			},
+		},
+		{
+			input: `let f = fn(a) { a };
+f(1, 2);`,
+			message: "wrong number of arguments: want=1, got=2",
+			trace: []string{
+				"<main> 2:1-2:8",
+			},
+		},
+		{
+			input: `let xs = 5;
+for (x in xs) { x }`,
+			message: "cannot iterate over INTEGER",
+			trace: []string{
+				"<main> 2:1-2:20",
+			},
+		},
+		{
+			// Equal functions on different lines keep their own positions.
+			input: `let fs = [fn(x) { x + 1 },
+ fn(x) { x + 1 }]; fs[1]("s")`,
+			message: "unsupported types for binary operation: STRING INTEGER",
+			trace: []string{
+				"<anonymous> 2:10-2:15",
+				"<main> 2:20-2:30",
+			},
+		},
+		{
+			// So do the closures those functions make.
+			input: `let fs = [fn() { fn(x) { x + 1 } },
+ fn() { fn(y) { y + 1 } }]; fs[1]()("s")`,
+			message: "unsupported types for binary operation: STRING INTEGER",
+			trace: []string{
+				"<anonymous> 2:17-2:22",
+				"<main> 2:29-2:41",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		program := parseFile("trace.mk", tt.input)
+
+		for name, newVM := range Backends {
+			comp := compiler.New()
+			err := comp.Compile(program)
+			if err != nil {
+				t.Fatalf("compiler error: %s", err)
+			}
+
+			err = newVM(comp.Bytecode()).Run()
+			rerr, ok := err.(*RuntimeError)
+			if !ok {
+				t.Fatalf("%s: expected a *RuntimeError, got %T (%v)", name, err, err)
+			}
+			if rerr.Error() != tt.message {
+				t.Errorf("%s: wrong message. want=%q, got=%q", name, tt.message, rerr.Error())
+			}
+
+			trace := []string{}
+			for _, f := range rerr.Trace {
+				if f.Span.Start.File != "trace.mk" {
+					t.Errorf("%s: wrong file in %v", name, f)
+				}
+				trace = append(trace, fmt.Sprintf("%s %d:%d-%d:%d", f.Function,
+					f.Span.Start.Line, f.Span.Start.Column, f.Span.End.Line, f.Span.End.Column))
+			}
+			if strings.Join(trace, "\n") != strings.Join(tt.trace, "\n") {
+				t.Errorf("%s: wrong trace.\nwant=%q\ngot =%q", name, tt.trace, trace)
+			}
+		}
+	}
+}
+
+func TestStackTraceFormat(t *testing.T) {
+	err := &RuntimeError{
+		Err: fmt.Errorf("boom"),
+		Trace: []TraceFrame{
+			{Function: "f", Span: code.Span{Start: token.Position{File: "a.mk", Line: 2, Column: 3}}},
+			{Function: "<main>", Span: code.Span{Start: token.Position{File: "a.mk", Line: 5, Column: 1}}},
+		},
+	}
+
+	expected := "\tat f (a.mk:2:3)\n\tat <main> (a.mk:5:1)\n"
+	if err.StackTrace() != expected {
+		t.Errorf("wrong stack trace. want=%q, got=%q", expected, err.StackTrace())
+	}
+}
+
+func TestRecursiveFibonacci(t *testing.T) {
+	tests := []vmTestCase{
+		{
+			input: `
+			let fibonacci = fn(x) {
+				if (x == 0) {
+					return 0;
+				} else {
+					if (x == 1) {
+						return 1;
+					} else {
+						fibonacci(x - 1) + fibonacci(x - 2);
+					}
+				}
+			};
+			fibonacci(15);
+			`,
+			expected: 610,
+		},
+	}
+
+	runVmTests(t, tests)
+}
+
 func TestFunctionCallsWithoutArguments(t *testing.T) {
 	tests := []vmTestCase{
 		{"fn() { return 5 + 10 }()", 15},
@@ -214,6 +993,9 @@ func TestIntegerArithmetic(t *testing.T) {
 		{"-10", -10},
 		{"-50 + 100 + -50", 0},
 		{"(5 + 10 * 2 + 15 / 3) * 2 + -10", 50},
+		{"17 % 5", 2},
+		{"-7 % 3", -1},
+		{"2 + 10 % 4 * 3", 8},
 	}
 
 	runVmTests(t, tests)
@@ -271,30 +1053,294 @@ func TestConditionals(t *testing.T) {
 	runVmTests(t, tests)
 }
 
-func runVmTests(t *testing.T, tests []vmTestCase) {
-	t.Helper()
+func TestLogicalExpressions(t *testing.T) {
+	tests := []vmTestCase{
+		{"true && true", true},
+		{"true && false", false},
+		{"false || true", true},
+		{"false || false", false},
+		{"1 && 2", 2},
+		{"false && 2", false},
+		{"1 || 2", 1},
+		{`"" || 2`, ""},
+		{"if (false) { 1 } || 3", 3},
+		{"if (false) { 1 } && 3", Null},
+		{"1 < 2 && 3 > 4 || 5", 5},
+		{"true || false && false", true},
+		{"false && 1 / 0", false},
+		{"let n = 0; let f = fn() { n += 1; true }; f() || f(); true && f(); n", 2},
+		{"let i = 0; while (i < 10 && i * i < 20) { i += 1 }; i", 5},
+		{"let f = fn(a, b) { a && b || 0 }; [f(1, 2), f(1, false), f(false, 3)]", []int{2, 0, 0}},
+		{"let f = fn(a) { let b = a || 7; b * 2 }; [f(1), f(false)]", []int{2, 14}},
+		{"let s = 0; for (x in [1, 2, 3, 4]) { x % 2 == 0 && if (true) { continue }; s += x }; s", 4},
+	}
 
-	for _, tt := range tests {
-		program := parse(tt.input)
+	runVmTests(t, tests)
+}
+
+func TestWhileLoops(t *testing.T) {
+	tests := []vmTestCase{
+		{"let i = 0; let s = 0; while (i < 5) { let s = s + i; let i = i + 1; }; s", 10},
+		{"let i = 0; while (i < 5000) { let i = i + 1 }; i", 5000},
+		{"let f = fn(x) { x }; let i = 0; while (f(i) < 5000) { let i = f(i) + 1 }; i", 5000},
+		{"let i = 0; while (false) { let i = 1 }; i", 0},
+		{"let f = fn() { while (false) { 10 } }; f()", Null},
+		{"if (true) { while (false) { 10 } }", Null},
+		// A loop leaves null as its value, however it exits.
+		{"while (false) { 10 }", Null},
+		{"let i = 0; while (i < 3) { i += 1 }", Null},
+		{"while (true) { break }", Null},
+		{"let i = 0; while (true) { i += 1; if (i == 3) { break } }", Null},
+		{"let f = fn() { while (true) { break } }; f()", Null},
+		{"if (true) { while (true) { 10; break } } else { 1 }", Null},
+		{"if (true) { let a = 1; }", Null},
+		{`
+let f = fn(n) {
+  let i = 0;
+  while (true) {
+    if (i == n) { return i * 2; }
+    let i = i + 1;
+  }
+};
+f(5)`, 10},
+		{`
+let table = fn(n) {
+  let cells = [];
+  let i = 1;
+  while (i < n + 1) {
+    let j = 1;
+    while (j < n + 1) {
+      let cells = push(cells, i * j);
+      let j = j + 1;
+    }
+    let i = i + 1;
+  }
+  cells
+};
+table(3)`, []int{1, 2, 3, 2, 4, 6, 3, 6, 9}},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestForLoops(t *testing.T) {
+	tests := []vmTestCase{
+		{"let s = 0; for (x in [1, 2, 3]) { let s = s + x }; s", 6},
+		{"let s = 0; for (i, x in [5, 6, 7]) { let s = s + i * x }; s", 20},
+		{`let ks = ""; for (k in {"b": 1, "a": 2, "c": 3}) { let ks = ks + k }; ks`, "abc"},
+		{`let vs = []; for (k, v in {"b": 1, 2: 10, true: 100}) { let vs = push(vs, v) }; vs`, []int{100, 10, 1}},
+		{`let vs = []; for (k, v in {"b": 1, "a": 2}) { let vs = push(vs, v) }; vs`, []int{2, 1}},
+		{`let cs = ""; for (c in "héllo") { let cs = c + cs }; cs`, "olléh"},
+		{"let xs = [1, 2]; for (x in xs) { let xs = push(xs, x) }; len(xs)", 4},
+		{"for (x in []) { 10 }", Null},
+		{"for (x in [1]) { 10 }", Null},
+		{"for (x in [1, 2]) { break }", Null},
+		{"let f = fn() { for (x in [1, 2]) { break } }; f()", Null},
+		{"let f = fn() { for (x in [1]) { 10 } }; f()", Null},
+		{`
+let find = fn(xs, y) {
+  for (i, x in xs) {
+    if (x == y) { return i; }
+  }
+  -1
+};
+[find([4, 5, 6], 6), find([4, 5, 6], 7)]`, []int{2, -1}},
+		{`
+let pairs = fn(xs, ys) {
+  let out = [];
+  for (x in xs) {
+    for (y in ys) { let out = push(out, x * y) }
+  }
+  out
+};
+pairs([1, 2], [10, 20])`, []int{10, 20, 20, 40}},
+		{`
+let adders = [];
+for (x in [1, 2]) { let adders = push(adders, fn(y) { x + y }) };
+adders[0](10)`, 12},
+	}
 
+	runVmTests(t, tests)
+}
+
+func TestBreakAndContinue(t *testing.T) {
+	tests := []vmTestCase{
+		{"let i = 0; while (true) { let i = i + 1; if (i == 3) { break; } }; i", 3},
+		{"let i = 0; let s = 0; while (i < 5) { let i = i + 1; if (i == 2) { continue } let s = s + i }; s", 13},
+		{"let s = 0; for (x in [1, 2, 3, 4]) { if (x == 3) { break } let s = s + x }; s", 3},
+		{"let s = 0; for (x in [1, 2, 3, 4]) { if (x == 3) { continue } let s = s + x }; s", 7},
+		{"let f = fn() { for (x in [1, 2]) { break } }; f()", Null},
+		{"let n = 0; while (n < 5000) { for (x in [1]) { break } let n = n + 1 }; n", 5000},
+		{"let a = 0; for (x in [1, 2]) { let a = if (x == 2) { break } else { x } }; a", 1},
+		{`
+let pairs = fn(xs) {
+  let n = 0;
+  for (x in xs) {
+    for (y in xs) {
+      if (y > x) { break }
+      let n = n + 1;
+    }
+  }
+  n
+};
+pairs([1, 2, 3])`, 6},
+		{`
+let first = fn(xs, p) {
+  let i = 0;
+  while (i < len(xs)) {
+    let x = xs[i];
+    let i = i + 1;
+    if (!p(x)) { continue }
+    return x;
+  }
+  -1
+};
+[first([1, 4, 6], fn(x) { x > 3 }), first([1], fn(x) { false })]`, []int{4, -1}},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestAssignments(t *testing.T) {
+	tests := []vmTestCase{
+		{"let a = 5; a = a + 1; a;", 6},
+		{"let a = 5; a = 7", 7},
+		{"let a = 1; let b = 2; a = b = 3; a + b", 6},
+		{"let a = 0; let i = 0; while (i < 4) { i = i + 1; a = a + i; }; a", 10},
+		{"let c = 0; let inc = fn() { c = c + 1 }; inc(); inc(); c", 2},
+		{"let f = fn(n) { let s = 0; for (x in [1, 2, 3]) { s = s + x * n }; s }; f(2)", 12},
+		{"let f = fn(a) { a = a * 2; a }; f(4)", 8},
+		{"let f = fn(a) { let b = a; a = 1; [a, b] }; f(4)", []int{1, 4}},
+		{"let a = [1, 2, 3]; a[1] = 5; a", []int{1, 5, 3}},
+		{"let a = [1, 2]; let b = a; b[0] = 10; a[0]", 10},
+		{`let h = {"a": 1}; h["a"] = h["a"] + 1; h["b"] = 5; h["a"] + h["b"]`, 7},
+		{"let a = [[0]]; a[0][0] = 4; a[0][0]", 4},
+		{"let a = [0]; (a[0] = 3) + 1", 4},
+		{"let f = fn() { let a = [0, 0]; let v = a[0] = 3; [(a[1] = 4) + (a[0] = 5), v] }; f()", []int{9, 3}},
+		{"let f = fn(a, x) { a[0] = x }; f([0], 7)", 7},
+		{"let f = fn(h) { h[1] = 2; h }; f({})[1]", 2},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestCompoundAssignments(t *testing.T) {
+	tests := []vmTestCase{
+		{"let a = 5; a += 2; a -= 1; a *= 10; a /= 4; a %= 4; a", 3},
+		{"let a = 1; let b = 2; a += b += 3; a * 10 + b", 65},
+		{`let s = "a"; s += "b"; s`, "ab"},
+		{"let c = 0; let inc = fn() { c += 1 }; inc(); inc(); c", 2},
+		{"let f = fn(a) { let s = 0; for (x in a) { s += x }; s }; f([1, 2, 3])", 6},
+		{"let f = fn(n) { n -= 1; n * 2 }; f(4)", 6},
+		{"let a = [1, 2]; a[1] *= 5; a", []int{1, 10}},
+		{`let h = {"n": 1}; h["n"] += 4; h["n"]`, 5},
+		{"let f = fn(a) { (a[0] += 1) + (a[0] += 1) }; f([0])", 3},
+		{"let n = 0; let a = [10, 20]; let k = fn() { n += 1; 1 }; a[k()] += 5; [a[1], n]", []int{25, 1}},
+		{"let a = 5; a++; a++; a--; a", 6},
+		{"let a = 1; a++ * 10", 20},
+		{"let f = fn() { let i = 0; while (i < 3) { i++ }; i }; f()", 3},
+		{"let c = 0; let inc = fn() { c++ }; inc(); inc()", 2},
+		{"let a = [1, 2]; a[1]++; a[0]--; a", []int{0, 3}},
+		{"let n = 0; let a = [10, 20]; let k = fn() { n++; 1 }; a[k()]++; [a[1], n]", []int{21, 1}},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestDivisionByZero(t *testing.T) {
+	tests := []string{
+		"let a = 0; 1 / a",
+		"let a = 0; 1 % a",
+		"let a = 1; a /= 0",
+	}
+
+	for _, input := range tests {
 		comp := compiler.New()
-		err := comp.Compile(program)
+		err := comp.Compile(parse(input))
 		if err != nil {
 			t.Fatalf("compiler error: %s", err)
 		}
 
-		vm := New(comp.Bytecode())
-		err = vm.Run()
+		for name, newVM := range Backends {
+			err := newVM(comp.Bytecode()).Run()
+			if err == nil || err.Error() != "division by zero" {
+				t.Errorf("%s: wrong VM error for %q: want=%q, got=%v", name, input, "division by zero", err)
+			}
+		}
+	}
+}
+
+func TestSetIndexErrors(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"let a = [1]; a[1] = 2", "index out of bounds (idx: 1, length: 1)"},
+		{"let a = [1]; a[-1] = 2", "index out of bounds (idx: -1, length: 1)"},
+		{`let a = [1]; a["x"] = 2`, "unknown index type for array: STRING"},
+		{"let h = {}; h[[]] = 2", "unusable as hash key: ARRAY"},
+		{`let s = "ab"; s[0] = 2`, "index assignment not supported: STRING"},
+	}
+
+	for _, tt := range tests {
+		comp := compiler.New()
+		err := comp.Compile(parse(tt.input))
 		if err != nil {
-			t.Fatalf("vm error: %s", err)
+			t.Fatalf("compiler error: %s", err)
 		}
 
-		stackElem := vm.LastPoppedStackElem()
+		for name, newVM := range Backends {
+			err := newVM(comp.Bytecode()).Run()
+			if err == nil {
+				t.Fatalf("%s: expected VM error but resulted in none.", name)
+			}
 
-		testExpectedObject(t, tt.expected, stackElem)
+			if err.Error() != tt.expected {
+				t.Errorf("%s: wrong VM error: want=%q, got=%q", name, tt.expected, err)
+			}
+		}
 	}
 }
 
+// runVmTests runs every test on every backend, compiled with and without
+// the compiler's optimisations, and checks all runs leave the same value.
+func runVmTests(t *testing.T, tests []vmTestCase) {
+	t.Helper()
+
+	for _, tt := range tests {
+		program := parse(tt.input)
+
+		for name := range Backends {
+			optimised := runCompiled(t, program, name)
+			unoptimised := runCompiled(t, program, name,
+				compiler.FoldConstants(false),
+				compiler.DeduplicateConstants(false),
+				compiler.Peephole(false))
+
+			testExpectedObject(t, tt.expected, optimised)
+			testExpectedObject(t, tt.expected, unoptimised)
+		}
+	}
+}
+
+func runCompiled(t *testing.T, program *ast.Program, backend string, opts ...compiler.Option) object.Object {
+	t.Helper()
+
+	comp := compiler.New(opts...)
+	err := comp.Compile(program)
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	vm := Backends[backend](comp.Bytecode())
+	err = vm.Run()
+	if err != nil {
+		t.Fatalf("%s vm error: %s", backend, err)
+	}
+
+	return vm.LastPoppedStackElem()
+}
+
 func testExpectedObject(t *testing.T, expected interface{}, actual object.Object) {
 	t.Helper()
 
@@ -305,6 +1351,23 @@ func testExpectedObject(t *testing.T, expected interface{}, actual object.Object
 			t.Fatalf("testIntegerObject failed: %s", err)
 		}
 
+	case string:
+		err := testStringObject(expected, actual)
+		if err != nil {
+			t.Fatalf("testStringObject failed: %s", err)
+		}
+
+	case *object.Error:
+		errObj, ok := actual.(*object.Error)
+		if !ok {
+			t.Errorf("object is not Error: %T (%+v)", actual, actual)
+			return
+		}
+		if errObj.Message != expected.Message {
+			t.Errorf("wrong error message. expected=%q, got=%q",
+				expected.Message, errObj.Message)
+		}
+
 	case *object.Null:
 		if actual != Null {
 			t.Errorf("object is not Null: %T (%+v)", actual, actual)
@@ -358,6 +1421,12 @@ func testExpectedObject(t *testing.T, expected interface{}, actual object.Object
 	}
 }
 
+func parseFile(file, input string) *ast.Program {
+	l := lexer.NewWithFile(file, input)
+	p := parser.New(l)
+	return p.ParseProgram()
+}
+
 func parse(input string) *ast.Program {
 	l := lexer.New(input)
 	p := parser.New(l)
@@ -379,6 +1448,21 @@ func testBoolObject(expected bool, actual object.Object) error {
 	return nil
 }
 
+func testStringObject(expected string, actual object.Object) error {
+	result, ok := actual.(*object.String)
+	if !ok {
+		return fmt.Errorf("object is not String. got=%T (%+v)",
+			actual, actual)
+	}
+
+	if result.Value != expected {
+		return fmt.Errorf("object has wrong value. got=%q, want=%q",
+			result.Value, expected)
+	}
+
+	return nil
+}
+
 func testIntegerObject(expected int64, actual object.Object) error {
 	result, ok := actual.(*object.Integer)
 	if !ok {